@@ -0,0 +1,84 @@
+// Copyright © 2017 The virtual-kubelet authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/spf13/cobra"
+	azproviderv2 "github.com/virtual-kubelet/azure-aci/pkg/provider"
+	"github.com/virtual-kubelet/virtual-kubelet/node/nodeutil"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	doctorOutputText = "text"
+	doctorOutputJSON = "json"
+)
+
+// newDoctorCommand returns the command checking the Azure and cluster prerequisites of the
+// virtual node, it fails when one of them is not met so it can gate deployments.
+func newDoctorCommand() *cobra.Command {
+	output := doctorOutputText
+
+	cmd := &cobra.Command{
+		Use:   "doctor",
+		Short: "Check the Azure and cluster prerequisites of the virtual node",
+		Long: "Check the Azure and cluster prerequisites of the virtual node end to end, without changing anything.\n" +
+			"The checks use the same environment variables as the virtual kubelet, and the command fails when one of them fails.",
+		Args:          cobra.NoArgs,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if output != doctorOutputText && output != doctorOutputJSON {
+				return fmt.Errorf("output %q is not supported, supported values are %s and %s", output, doctorOutputText, doctorOutputJSON)
+			}
+
+			report := azproviderv2.RunDoctor(cmd.Context(), func() (kubernetes.Interface, error) {
+				return nodeutil.ClientsetFromEnv(kubeConfigPath)
+			})
+
+			if output == doctorOutputJSON {
+				b, err := json.MarshalIndent(report, "", "  ")
+				if err != nil {
+					return err
+				}
+				fmt.Fprintln(cmd.OutOrStdout(), string(b))
+			} else {
+				writeDoctorReport(cmd.OutOrStdout(), report)
+			}
+
+			if !report.Passed {
+				return fmt.Errorf("the virtual node prerequisites are not met")
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVarP(&output, "output", "o", output, "output format (text/json)")
+
+	return cmd
+}
+
+func writeDoctorReport(w io.Writer, report *azproviderv2.DoctorReport) {
+	for _, check := range report.Checks {
+		fmt.Fprintf(w, "[%s] %s: %s\n", strings.ToUpper(string(check.Status)), check.Name, check.Message)
+		if check.Remediation != "" {
+			fmt.Fprintf(w, "       remediation: %s\n", check.Remediation)
+		}
+	}
+}
@@ -72,6 +72,9 @@ var (
 	clientCACert   string
 	clientNoVerify bool
 
+	admissionWebhookAddr      string
+	admissionWebhookAuditOnly bool
+
 	webhookAuth                  bool
 	webhookAuthnCacheTTL         time.Duration
 	webhookAuthzUnauthedCacheTTL time.Duration
@@ -92,20 +95,7 @@ func main() {
 	binaryName := filepath.Base(os.Args[0])
 	desc := binaryName + " implements a node on a Kubernetes cluster using Azure Container Instances to run pods."
 
-	var azACIAPIs *client.AzClientsAPIs
-	azConfig := auth.Config{}
-
 	var provider string
-	//Setup config
-	err := azConfig.SetAuthConfig(ctx)
-	if err != nil {
-		log.G(ctx).Fatal(err)
-	}
-
-	azACIAPIs, err = client.NewAzClientsAPIs(ctx, azConfig)
-	if err != nil {
-		log.G(ctx).Fatal(err)
-	}
 
 	if kubeConfigPath == "" {
 		home, _ := homedir.Dir()
@@ -140,8 +130,8 @@ func main() {
 		cfg.NodeSpec.Status.NodeInfo.KubeletVersion = strings.Join([]string{k8sVersion, "vk-azure-aci", buildVersion}, "-")
 		return nil
 	}
+	mux := http.NewServeMux()
 	configureRoutes := func(cfg *nodeutil.NodeConfig) error {
-		mux := http.NewServeMux()
 		cfg.Handler = mux
 		return nodeutil.AttachProviderRoutes(mux)(cfg)
 	}
@@ -197,19 +187,33 @@ func main() {
 		}
 		return nil
 	}
-	k8sClient, err := nodeutil.ClientsetFromEnv(kubeConfigPath)
-	if err != nil {
-		log.G(ctx).Fatal(err)
-	}
-	withClient := func(cfg *nodeutil.NodeConfig) error {
-		return nodeutil.WithClient(k8sClient)(cfg)
-	}
 
 	run := func(ctx context.Context) error {
+		// The Azure and Kubernetes clients are only needed to run the node, the other commands
+		// work offline.
+		azConfig := auth.Config{}
+		if err := azConfig.SetAuthConfig(ctx); err != nil {
+			return err
+		}
+
+		azACIAPIs, err := client.NewAzClientsAPIs(ctx, azConfig)
+		if err != nil {
+			return err
+		}
+
+		k8sClient, err := nodeutil.ClientsetFromEnv(kubeConfigPath)
+		if err != nil {
+			return err
+		}
+		withClient := func(cfg *nodeutil.NodeConfig) error {
+			return nodeutil.WithClient(k8sClient)(cfg)
+		}
+
 		if err := configureTracing(nodeName, traceSampleRate); err != nil {
 			return err
 		}
 
+		var aciProvider *azproviderv2.ACIProvider
 		node, err := nodeutil.NewNode(nodeName,
 			func(cfg nodeutil.ProviderConfig) (nodeutil.Provider, node.NodeProvider, error) {
 				if port := os.Getenv("KUBELET_PORT"); port != "" {
@@ -226,7 +230,9 @@ func main() {
 					return nil, nil, err
 				}
 				p.ConfigureNode(ctx, cfg.Node)
-				return p, nil, err
+				aciProvider = p
+				// The provider refreshes the node status when the ACI quota changes.
+				return p, p, err
 			},
 			withClient,
 			withTaint,
@@ -245,6 +251,17 @@ func main() {
 			return err
 		}
 
+		// The provider metrics are served next to the kubelet endpoints.
+		mux.Handle("/metrics", aciProvider.MetricsHandler())
+
+		if admissionWebhookAddr != "" {
+			go func() {
+				if err := serveAdmissionWebhook(ctx, aciProvider); err != nil {
+					log.G(ctx).WithError(err).Error("admission webhook stopped")
+				}
+			}()
+		}
+
 		go func() error {
 			err = node.Run(ctx)
 			if err != nil {
@@ -283,6 +300,8 @@ func main() {
 			}
 		},
 	}
+	cmd.AddCommand(newTranslateCommand(), newDoctorCommand())
+
 	flags := cmd.Flags()
 
 	klogFlags := flag.NewFlagSet("klog", flag.ContinueOnError)
@@ -313,6 +332,11 @@ func main() {
 	flags.DurationVar(&webhookAuthzUnauthedCacheTTL, "authorization-webhook-cache-unauthorized-ttl", webhookAuthzUnauthedCacheTTL,
 		"The duration to cache 'unauthorized' responses from the webhook authorizer.")
 
+	flags.StringVar(&admissionWebhookAddr, "admission-webhook-addr", os.Getenv("ADMISSION_WEBHOOK_ADDR"),
+		"address serving the admission webhook validating the pods tolerating the node taint, disabled when empty")
+	flags.BoolVar(&admissionWebhookAuditOnly, "admission-webhook-audit-only", os.Getenv("ADMISSION_WEBHOOK_AUDIT_ONLY") == "true",
+		"admit the pods ACI can't run with their problems as warnings instead of rejecting them")
+
 	flags.StringVar(&traceSampleRate, "trace-sample-rate", traceSampleRate, "set probability of tracing samples")
 
 	// deprecated flags
@@ -338,6 +362,36 @@ func main() {
 	}
 }
 
+// serveAdmissionWebhook serves the admission webhook over TLS with the certificate of the kubelet
+// API, until the context is done.
+func serveAdmissionWebhook(ctx context.Context, p *azproviderv2.ACIProvider) error {
+	mux := http.NewServeMux()
+	mux.Handle("/validate-pods", azproviderv2.NewAdmissionWebhook(p, azproviderv2.AdmissionOptions{
+		Taint: v1.Taint{
+			Key:    taintKey,
+			Value:  taintValue,
+			Effect: v1.TaintEffect(taintEffect),
+		},
+		AuditOnly: admissionWebhookAuditOnly,
+	}))
+
+	srv := &http.Server{
+		Addr:              admissionWebhookAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	log.G(ctx).Infof("serving the admission webhook on %s", admissionWebhookAddr)
+	if err := srv.ListenAndServeTLS(certPath, keyPath); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
 func envOrDefault(key string, defaultValue string) string {
 	v, set := os.LookupEnv(key)
 	if set {
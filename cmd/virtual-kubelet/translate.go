@@ -0,0 +1,172 @@
+// Copyright © 2017 The virtual-kubelet authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	azproviderv2 "github.com/virtual-kubelet/azure-aci/pkg/provider"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+const (
+	translateOutputJSON        = "json"
+	translateOutputARMTemplate = "arm-template"
+)
+
+// newTranslateCommand returns the command rendering the container group of a pod manifest, the
+// same way the provider does when the pod is scheduled to the virtual node.
+func newTranslateCommand() *cobra.Command {
+	var (
+		filename    string
+		objectFiles []string
+		output      = translateOutputJSON
+		opts        = azproviderv2.TranslateOptions{
+			Region:          os.Getenv("ACI_REGION"),
+			OperatingSystem: operatingSystem,
+			NodeName:        nodeName,
+			ClusterDomain:   clusterDomain,
+			ClusterID:       os.Getenv("ACI_CLUSTER_ID"),
+		}
+	)
+	opts.Network.VnetSubscriptionID = os.Getenv("ACI_VNET_SUBSCRIPTION_ID")
+	opts.Network.VnetResourceGroup = envOrDefault("ACI_VNET_RESOURCE_GROUP", os.Getenv("ACI_RESOURCE_GROUP"))
+	opts.Network.VnetName = os.Getenv("ACI_VNET_NAME")
+	opts.Network.SubnetName = os.Getenv("ACI_SUBNET_NAME")
+	opts.Network.KubeDNSIP = os.Getenv("KUBE_DNS_IP")
+
+	cmd := &cobra.Command{
+		Use:   "translate -f pod.yaml",
+		Short: "Render the ACI container group of a pod manifest",
+		Long: "Render the ACI container group of a pod manifest, without Azure nor cluster access.\n" +
+			"The secrets and config maps the pod references are read from the manifests given, and the secret values are redacted.",
+		Args:          cobra.NoArgs,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if output != translateOutputJSON && output != translateOutputARMTemplate {
+				return fmt.Errorf("output %q is not supported, supported values are %s and %s", output, translateOutputJSON, translateOutputARMTemplate)
+			}
+
+			var pod *v1.Pod
+			for _, file := range append([]string{filename}, objectFiles...) {
+				objects, err := readManifests(file)
+				if err != nil {
+					return err
+				}
+				for _, obj := range objects {
+					switch obj := obj.(type) {
+					case *v1.Pod:
+						if pod != nil {
+							return fmt.Errorf("%s: only one pod can be translated at once", file)
+						}
+						pod = obj
+					case *v1.Secret:
+						opts.Secrets = append(opts.Secrets, obj)
+					case *v1.ConfigMap:
+						opts.ConfigMaps = append(opts.ConfigMaps, obj)
+					default:
+						return fmt.Errorf("%s: %s is not supported, only a pod and its secrets and config maps can be given", file, obj.GetObjectKind().GroupVersionKind().Kind)
+					}
+				}
+			}
+			if pod == nil {
+				return fmt.Errorf("%s: no pod to translate", filename)
+			}
+
+			cg, err := azproviderv2.TranslatePod(cmd.Context(), pod, opts)
+			if err != nil {
+				var agg utilerrors.Aggregate
+				if !errors.As(err, &agg) {
+					agg = utilerrors.NewAggregate([]error{err})
+				}
+				for _, err := range agg.Errors() {
+					fmt.Fprintf(cmd.ErrOrStderr(), "error: %v\n", err)
+				}
+				return fmt.Errorf("pod %s can not be translated to a container group", pod.Name)
+			}
+
+			var rendered interface{} = cg
+			if output == translateOutputARMTemplate {
+				rendered = azproviderv2.NewContainerGroupTemplate(cg)
+			}
+			b, err := json.MarshalIndent(rendered, "", "  ")
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintln(cmd.OutOrStdout(), string(b))
+			return err
+		},
+	}
+
+	flags := cmd.Flags()
+	flags.StringVarP(&filename, "filename", "f", filename, "pod manifest to translate, it may also contain the secrets and config maps of the pod")
+	flags.StringSliceVar(&objectFiles, "objects", objectFiles, "manifests of the secrets and config maps the pod references")
+	flags.StringVarP(&output, "output", "o", output, "output format (json/arm-template)")
+	flags.StringVar(&opts.Region, "region", opts.Region, "ACI region of the container group, defaults to ACI_REGION")
+	flags.StringVar(&opts.OperatingSystem, "os", opts.OperatingSystem, "Operating System (Linux/Windows)")
+	flags.StringVar(&opts.NodeName, "nodename", opts.NodeName, "kubernetes node name")
+	flags.StringVar(&opts.ClusterDomain, "cluster-domain", opts.ClusterDomain, "kubernetes cluster-domain")
+	flags.StringVar(&opts.ClusterID, "cluster-id", opts.ClusterID, "identity of the cluster the container group is tagged with, defaults to ACI_CLUSTER_ID")
+	flags.StringVar(&opts.Network.SubnetName, "subnet-name", opts.Network.SubnetName, "ACI subnet of the container group, defaults to ACI_SUBNET_NAME")
+	flags.StringVar(&opts.Network.VnetName, "vnet-name", opts.Network.VnetName, "virtual network of the ACI subnet, defaults to ACI_VNET_NAME")
+	flags.StringVar(&opts.Network.VnetResourceGroup, "vnet-resource-group", opts.Network.VnetResourceGroup, "resource group of the virtual network, defaults to ACI_VNET_RESOURCE_GROUP")
+	flags.StringVar(&opts.Network.VnetSubscriptionID, "vnet-subscription-id", opts.Network.VnetSubscriptionID, "subscription of the virtual network, defaults to ACI_VNET_SUBSCRIPTION_ID")
+	flags.StringVar(&opts.Network.KubeDNSIP, "kube-dns-ip", opts.Network.KubeDNSIP, "IP of the cluster DNS the container group resolves names with, defaults to KUBE_DNS_IP")
+	cmd.MarkFlagRequired("filename")
+
+	return cmd
+}
+
+// readManifests decodes the YAML or JSON documents of the file.
+func readManifests(file string) ([]runtime.Object, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var objects []runtime.Object
+	reader := yaml.NewYAMLReader(bufio.NewReader(f))
+	for {
+		doc, err := reader.Read()
+		if err == io.EOF {
+			return objects, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		if len(bytes.TrimSpace(doc)) == 0 {
+			continue
+		}
+
+		obj, _, err := scheme.Codecs.UniversalDeserializer().Decode(doc, nil, nil)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		objects = append(objects, obj)
+	}
+}
@@ -74,6 +74,15 @@ func (c *Config) GetSPCredential(ctx context.Context) (*azidentity.ClientSecretC
 	return spCredential, nil
 }
 
+// GetCredential returns the credential of the user identity when no service principal is configured,
+// or the credential of the service principal.
+func (c *Config) GetCredential(ctx context.Context) (azcore.TokenCredential, error) {
+	if len(c.AuthConfig.ClientID) == 0 {
+		return c.GetMSICredential(ctx)
+	}
+	return c.GetSPCredential(ctx)
+}
+
 // GetAuthorizer return autorest authorizer.
 func (c *Config) GetAuthorizer(ctx context.Context, resource string) (autorest.Authorizer, error) {
 	var auth autorest.Authorizer
@@ -6,7 +6,6 @@ package client
 
 import (
 	"context"
-	"fmt"
 	"net/http"
 	"os"
 
@@ -17,6 +16,7 @@ import (
 	azaciv2 "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerinstance/armcontainerinstance/v2"
 	"github.com/pkg/errors"
 	"github.com/virtual-kubelet/azure-aci/pkg/auth"
+	"github.com/virtual-kubelet/azure-aci/pkg/util"
 	"github.com/virtual-kubelet/azure-aci/pkg/validation"
 	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
 	"github.com/virtual-kubelet/virtual-kubelet/log"
@@ -26,19 +26,26 @@ import (
 
 type AzClientsInterface interface {
 	ContainerGroupGetter
-	CreateContainerGroup(ctx context.Context, resourceGroup, podNS, podName string, cg *azaciv2.ContainerGroup) error
+	CreateContainerGroup(ctx context.Context, resourceGroup, podNS, podName string, cg *azaciv2.ContainerGroup) (ContainerGroupPoller, error)
 	GetContainerGroupInfo(ctx context.Context, resourceGroup, namespace, name, nodeName string) (*azaciv2.ContainerGroup, error)
 	GetContainerGroupListResult(ctx context.Context, resourceGroup string) ([]*azaciv2.ContainerGroup, error)
 	ListCapabilities(ctx context.Context, region string) ([]*azaciv2.Capabilities, error)
-	DeleteContainerGroup(ctx context.Context, resourceGroup, cgName string) error
+	ListUsage(ctx context.Context, region string) ([]*azaciv2.Usage, error)
+	DeleteContainerGroup(ctx context.Context, resourceGroup, cgName string) (ContainerGroupPoller, error)
+	UpdateContainerGroupTags(ctx context.Context, resourceGroup, cgName string, tags map[string]*string) error
+	RestartContainerGroup(ctx context.Context, resourceGroup, cgName string) (ContainerGroupPoller, error)
 	ListLogs(ctx context.Context, resourceGroup, cgName, containerName string, opts api.ContainerLogOpts) (*string, error)
 	ExecuteContainerCommand(ctx context.Context, resourceGroup, cgName, containerName string, containerReq azaciv2.ContainerExecRequest) (*azaciv2.ContainerExecResponse, error)
+	Attach(ctx context.Context, resourceGroup, cgName, containerName string) (*azaciv2.ContainerAttachResponse, error)
+	ThrottlingState() ThrottlingState
 }
 
 type AzClientsAPIs struct {
 	ContainersClient     *azaciv2.ContainersClient
 	ContainerGroupClient *azaciv2.ContainerGroupsClient
 	LocationClient       *azaciv2.LocationClient
+
+	throttling *throttlingPolicy
 }
 
 func NewAzClientsAPIs(ctx context.Context, azConfig auth.Config) (*AzClientsAPIs, error) {
@@ -50,19 +57,16 @@ func NewAzClientsAPIs(ctx context.Context, azConfig auth.Config) (*AzClientsAPIs
 
 	logger.Debug("getting azure credential")
 
-	var err error
-	var credential azcore.TokenCredential
-	isUserIdentity := len(azConfig.AuthConfig.ClientID) == 0
-
-	if isUserIdentity {
-		credential, err = azConfig.GetMSICredential(ctx)
-	} else {
-		credential, err = azConfig.GetSPCredential(ctx)
-	}
+	credential, err := azConfig.GetCredential(ctx)
 	if err != nil {
 		return nil, errors.Wrap(err, "an error has occurred while creating getting credential ")
 	}
 
+	throttling, err := newThrottlingPolicyFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
 	logger.Debug("setting aci user agent")
 	userAgent := os.Getenv("ACI_EXTRA_USER_AGENT")
 	options := arm.ClientOptions{
@@ -71,6 +75,18 @@ func NewAzClientsAPIs(ctx context.Context, azConfig auth.Config) (*AzClientsAPIs
 			Telemetry: policy.TelemetryOptions{
 				ApplicationID: userAgent,
 			},
+			// The throttled requests are retried by the throttling policy, which also holds the
+			// other requests until ARM accepts them again.
+			Retry: policy.RetryOptions{
+				StatusCodes: []int{
+					http.StatusRequestTimeout,
+					http.StatusInternalServerError,
+					http.StatusBadGateway,
+					http.StatusServiceUnavailable,
+					http.StatusGatewayTimeout,
+				},
+			},
+			PerCallPolicies: []policy.Policy{throttling},
 		},
 	}
 
@@ -93,6 +109,7 @@ func NewAzClientsAPIs(ctx context.Context, azConfig auth.Config) (*AzClientsAPIs
 	obj.ContainersClient = cClient
 	obj.ContainerGroupClient = cgClient
 	obj.LocationClient = lClient
+	obj.throttling = throttling
 
 	logger.Debug("aci clients have been initialized successfully")
 	return &obj, nil
@@ -108,22 +125,24 @@ func (a *AzClientsAPIs) GetContainerGroup(ctx context.Context, resourceGroup, co
 
 	result, err := a.ContainerGroupClient.Get(ctxWithResp, resourceGroup, containerGroupName, nil)
 	if err != nil {
-		if rawResponse.StatusCode == http.StatusNotFound {
+		if rawResponse != nil && rawResponse.StatusCode == http.StatusNotFound {
 			logger.Errorf("failed to query Container Group %s, not found", containerGroupName)
 			return nil, errdefs.NotFound("cg is not found")
 		}
-		logger.Errorf("an error has occurred while getting container group info %s, status code %d", containerGroupName, rawResponse.StatusCode)
-		return nil, err
+		logger.Errorf("an error has occurred while getting container group info %s, status code %d", containerGroupName, getStatusCode(rawResponse))
+		return nil, AsARMError(err)
 	}
 
 	return &result.ContainerGroup, nil
 }
 
-func (a *AzClientsAPIs) CreateContainerGroup(ctx context.Context, resourceGroup, podNS, podName string, cg *azaciv2.ContainerGroup) error {
+// CreateContainerGroup starts the creation of a container group. The returned poller tracks the
+// long-running operation until the container group is provisioned.
+func (a *AzClientsAPIs) CreateContainerGroup(ctx context.Context, resourceGroup, podNS, podName string, cg *azaciv2.ContainerGroup) (ContainerGroupPoller, error) {
 	logger := log.G(ctx).WithField("method", "CreateContainerGroup")
 	ctx, span := trace.StartSpan(ctx, "client.CreateContainerGroup")
 	defer span.End()
-	cgName := containerGroupName(podNS, podName)
+	cgName := util.ContainerGroupName(podNS, podName)
 
 	containerGroup := azaciv2.ContainerGroup{
 		Properties: cg.Properties,
@@ -139,43 +158,67 @@ func (a *AzClientsAPIs) CreateContainerGroup(ctx context.Context, resourceGroup,
 	ctxWithResp := runtime.WithCaptureResponse(ctx, &rawResponse)
 
 	logger.Infof("creating container group with name: %s", cgName)
-	_, err := a.ContainerGroupClient.BeginCreateOrUpdate(ctxWithResp, resourceGroup, cgName, containerGroup, nil)
+	poller, err := a.ContainerGroupClient.BeginCreateOrUpdate(ctxWithResp, resourceGroup, cgName, containerGroup, nil)
 	if err != nil {
-		logger.Errorf("an error has occurred while creating container group %s, status code %d", cgName, rawResponse.StatusCode)
-		return err
+		if rawResponse != nil {
+			logger.Errorf("an error has occurred while creating container group %s, status code %d", cgName, rawResponse.StatusCode)
+		}
+		return nil, AsARMError(err)
 	}
 
-	return nil
+	return &containerGroupPoller[azaciv2.ContainerGroupsClientCreateOrUpdateResponse]{
+		poller: poller,
+		result: func(resp azaciv2.ContainerGroupsClientCreateOrUpdateResponse) *azaciv2.ContainerGroup {
+			return &resp.ContainerGroup
+		},
+	}, nil
 }
 
-// GetContainerGroupInfo returns a container group from ACI.
+// GetContainerGroupInfo returns the container group of a pod from ACI. The container group is
+// looked up by name, and is only returned when it is tagged with the namespace and name of the pod.
 func (a *AzClientsAPIs) GetContainerGroupInfo(ctx context.Context, resourceGroup, namespace, name, nodeName string) (*azaciv2.ContainerGroup, error) {
-	logger := log.G(ctx).WithField("method", "GetContainerGroupInfo")
 	ctx, span := trace.StartSpan(ctx, "client.GetContainerGroupInfo")
 	defer span.End()
-	var rawResponse *http.Response
-	ctxWithResp := runtime.WithCaptureResponse(ctx, &rawResponse)
-
-	cgName := containerGroupName(namespace, name)
 
-	response, err := a.ContainerGroupClient.Get(ctxWithResp, resourceGroup, cgName, nil)
+	cg, err := a.getPodContainerGroup(ctx, resourceGroup, util.ContainerGroupName(namespace, name), namespace, name)
+	if errdefs.IsNotFound(err) {
+		// The container groups created before the names were hashed are named after the pod.
+		cg, err = a.getPodContainerGroup(ctx, resourceGroup, util.LegacyContainerGroupName(namespace, name), namespace, name)
+	}
 	if err != nil {
-		if rawResponse != nil && rawResponse.StatusCode == http.StatusNotFound {
-			return nil, errdefs.NotFound("cg is not found")
-		}
-		logger.Errorf("an error has occurred while getting container group info %s, status code %d", cgName, rawResponse.StatusCode)
 		return nil, err
 	}
 
-	err = validation.ValidateContainerGroup(ctx, &response.ContainerGroup)
+	err = validation.ValidateContainerGroup(ctx, cg)
 	if err != nil {
 		return nil, err
 	}
 
-	if nodeName != "" && *response.Tags["NodeName"] != nodeName {
-		return nil, errors.Wrapf(err, "container group %s found with mismatching node", cgName)
+	if nodeName != "" && (cg.Tags["NodeName"] == nil || *cg.Tags["NodeName"] != nodeName) {
+		return nil, errors.Errorf("container group %s found with mismatching node", *cg.Name)
 	}
 
+	return cg, nil
+}
+
+func (a *AzClientsAPIs) getPodContainerGroup(ctx context.Context, resourceGroup, cgName, namespace, name string) (*azaciv2.ContainerGroup, error) {
+	logger := log.G(ctx).WithField("method", "GetContainerGroupInfo")
+
+	var rawResponse *http.Response
+	ctxWithResp := runtime.WithCaptureResponse(ctx, &rawResponse)
+
+	response, err := a.ContainerGroupClient.Get(ctxWithResp, resourceGroup, cgName, nil)
+	if err != nil {
+		if rawResponse != nil && rawResponse.StatusCode == http.StatusNotFound {
+			return nil, errdefs.NotFound("cg is not found")
+		}
+		logger.Errorf("an error has occurred while getting container group info %s, status code %d", cgName, getStatusCode(rawResponse))
+		return nil, AsARMError(err)
+	}
+
+	if !util.IsContainerGroupOfPod(&response.ContainerGroup, namespace, name) {
+		return nil, errdefs.NotFoundf("container group %s does not belong to pod %s/%s", cgName, namespace, name)
+	}
 	return &response.ContainerGroup, nil
 }
 
@@ -193,8 +236,8 @@ func (a *AzClientsAPIs) GetContainerGroupListResult(ctx context.Context, resourc
 	for pager.More() {
 		page, err := pager.NextPage(ctxWithResp)
 		if err != nil {
-			logger.Errorf("an error has occurred while getting list of container groups, status code %d", rawResponse.StatusCode)
-			return nil, err
+			logger.Errorf("an error has occurred while getting list of container groups, status code %d", getStatusCode(rawResponse))
+			return nil, AsARMError(err)
 		}
 		cgList = append(cgList, page.Value...)
 	}
@@ -227,7 +270,75 @@ func (a *AzClientsAPIs) ListCapabilities(ctx context.Context, region string) ([]
 	return capList, nil
 }
 
-func (a *AzClientsAPIs) DeleteContainerGroup(ctx context.Context, resourceGroup, cgName string) error {
+// ListUsage returns the ACI usage and quota limits of the subscription in the region.
+func (a *AzClientsAPIs) ListUsage(ctx context.Context, region string) ([]*azaciv2.Usage, error) {
+	logger := log.G(ctx).WithField("method", "ListUsage")
+	ctx, span := trace.StartSpan(ctx, "client.ListUsage")
+	defer span.End()
+
+	var rawResponse *http.Response
+	ctxWithResp := runtime.WithCaptureResponse(ctx, &rawResponse)
+
+	pager := a.LocationClient.NewListUsagePager(region, nil)
+
+	var usageList []*azaciv2.Usage
+	for pager.More() {
+		page, err := pager.NextPage(ctxWithResp)
+		if err != nil {
+			logger.Errorf("an error has occurred while getting the usage of the location %s, status code %d", region, getStatusCode(rawResponse))
+			return nil, AsARMError(err)
+		}
+		usageList = append(usageList, page.Value...)
+	}
+	return usageList, nil
+}
+
+// UpdateContainerGroupTags replaces the tags of a container group, the container group is not
+// redeployed.
+func (a *AzClientsAPIs) UpdateContainerGroupTags(ctx context.Context, resourceGroup, cgName string, tags map[string]*string) error {
+	logger := log.G(ctx).WithField("method", "UpdateContainerGroupTags")
+	ctx, span := trace.StartSpan(ctx, "client.UpdateContainerGroupTags")
+	defer span.End()
+
+	var rawResponse *http.Response
+	ctxWithResp := runtime.WithCaptureResponse(ctx, &rawResponse)
+
+	_, err := a.ContainerGroupClient.Update(ctxWithResp, resourceGroup, cgName, azaciv2.Resource{Tags: tags}, nil)
+	if err != nil {
+		logger.Errorf("an error has occurred while updating the tags of container group %s, status code %d", cgName, getStatusCode(rawResponse))
+		return AsARMError(err)
+	}
+	return nil
+}
+
+// RestartContainerGroup starts the restart of the containers of a container group in place, the
+// container group is not redeployed. The returned poller doesn't return the container group.
+func (a *AzClientsAPIs) RestartContainerGroup(ctx context.Context, resourceGroup, cgName string) (ContainerGroupPoller, error) {
+	logger := log.G(ctx).WithField("method", "RestartContainerGroup")
+	ctx, span := trace.StartSpan(ctx, "client.RestartContainerGroup")
+	defer span.End()
+
+	var rawResponse *http.Response
+	ctxWithResp := runtime.WithCaptureResponse(ctx, &rawResponse)
+
+	poller, err := a.ContainerGroupClient.BeginRestart(ctxWithResp, resourceGroup, cgName, nil)
+	if err != nil {
+		logger.Errorf("failed to restart container group %s, status code %d", cgName, getStatusCode(rawResponse))
+		return nil, AsARMError(err)
+	}
+
+	logger.Infof("restart of container group %s has been accepted", cgName)
+	return &containerGroupPoller[azaciv2.ContainerGroupsClientRestartResponse]{
+		poller: poller,
+		result: func(resp azaciv2.ContainerGroupsClientRestartResponse) *azaciv2.ContainerGroup {
+			return nil
+		},
+	}, nil
+}
+
+// DeleteContainerGroup starts the deletion of a container group. The returned poller tracks the
+// long-running operation until the container group is gone.
+func (a *AzClientsAPIs) DeleteContainerGroup(ctx context.Context, resourceGroup, cgName string) (ContainerGroupPoller, error) {
 	logger := log.G(ctx).WithField("method", "DeleteContainerGroup")
 	ctx, span := trace.StartSpan(ctx, "client.DeleteContainerGroup")
 	defer span.End()
@@ -235,16 +346,24 @@ func (a *AzClientsAPIs) DeleteContainerGroup(ctx context.Context, resourceGroup,
 	var rawResponse *http.Response
 	ctxWithResp := runtime.WithCaptureResponse(ctx, &rawResponse)
 
-	_, err := a.ContainerGroupClient.BeginDelete(ctxWithResp, resourceGroup, cgName, nil)
+	poller, err := a.ContainerGroupClient.BeginDelete(ctxWithResp, resourceGroup, cgName, nil)
 	if err != nil {
-		logger.Errorf("failed to delete container group %s, status code %d", cgName, rawResponse.StatusCode)
-		return err
+		if rawResponse != nil {
+			logger.Errorf("failed to delete container group %s, status code %d", cgName, rawResponse.StatusCode)
+		}
+		return nil, AsARMError(err)
 	}
 
-	logger.Infof("container group %s has deleted successfully", cgName)
-	return nil
+	logger.Infof("deletion of container group %s has been accepted", cgName)
+	return &containerGroupPoller[azaciv2.ContainerGroupsClientDeleteResponse]{
+		poller: poller,
+		result: func(resp azaciv2.ContainerGroupsClientDeleteResponse) *azaciv2.ContainerGroup {
+			return &resp.ContainerGroup
+		},
+	}, nil
 }
 
+// ListLogs returns the logs of a container. Only the Tail and Timestamps options are supported by ACI.
 func (a *AzClientsAPIs) ListLogs(ctx context.Context, resourceGroup, cgName, containerName string, opts api.ContainerLogOpts) (*string, error) {
 	logger := log.G(ctx).WithField("method", "ListLogs")
 	ctx, span := trace.StartSpan(ctx, "client.ListLogs")
@@ -253,8 +372,6 @@ func (a *AzClientsAPIs) ListLogs(ctx context.Context, resourceGroup, cgName, con
 	var rawResponse *http.Response
 	ctxWithResp := runtime.WithCaptureResponse(ctx, &rawResponse)
 
-	enableTimestamp := true
-
 	// tail should be > 0, otherwise, set to nil
 	var logTail *int32
 	tail := int32(opts.Tail)
@@ -266,13 +383,15 @@ func (a *AzClientsAPIs) ListLogs(ctx context.Context, resourceGroup, cgName, con
 
 	options := azaciv2.ContainersClientListLogsOptions{
 		Tail:       logTail,
-		Timestamps: &enableTimestamp,
+		Timestamps: &opts.Timestamps,
 	}
 
 	response, err := a.ContainersClient.ListLogs(ctxWithResp, resourceGroup, cgName, containerName, &options)
 	if err != nil {
-		logger.Errorf("error getting container logs, name: %s , container group:  %s, status code %d", containerName, cgName, rawResponse.StatusCode)
-		return nil, err
+		if rawResponse != nil {
+			logger.Errorf("error getting container logs, name: %s , container group:  %s, status code %d", containerName, cgName, rawResponse.StatusCode)
+		}
+		return nil, AsARMError(err)
 	}
 
 	return response.Content, nil
@@ -288,14 +407,48 @@ func (a *AzClientsAPIs) ExecuteContainerCommand(ctx context.Context, resourceGro
 
 	result, err := a.ContainersClient.ExecuteCommand(ctxWithResp, resourceGroup, cgName, containerName, containerReq, nil)
 	if err != nil {
-		logger.Errorf("an error has occurred while executing command for container group %s, status code %d", cgName, rawResponse.StatusCode)
-		return nil, err
+		logger.Errorf("an error has occurred while executing command for container group %s, status code %d", cgName, getStatusCode(rawResponse))
+		return nil, AsARMError(err)
 	}
 
 	logger.Debug("ExecuteContainerCommand is successful")
 	return &result.ContainerExecResponse, nil
 }
 
-func containerGroupName(podNS, podName string) string {
-	return fmt.Sprintf("%s-%s", podNS, podName)
+// Attach returns the websocket uri and password to attach to the output stream of a container.
+func (a *AzClientsAPIs) Attach(ctx context.Context, resourceGroup, cgName, containerName string) (*azaciv2.ContainerAttachResponse, error) {
+	logger := log.G(ctx).WithField("method", "Attach")
+	ctx, span := trace.StartSpan(ctx, "client.Attach")
+	defer span.End()
+
+	var rawResponse *http.Response
+	ctxWithResp := runtime.WithCaptureResponse(ctx, &rawResponse)
+
+	result, err := a.ContainersClient.Attach(ctxWithResp, resourceGroup, cgName, containerName, nil)
+	if err != nil {
+		if rawResponse != nil {
+			logger.Errorf("an error has occurred while attaching to container %s of container group %s, status code %d", containerName, cgName, rawResponse.StatusCode)
+		}
+		return nil, AsARMError(err)
+	}
+
+	logger.Debug("Attach is successful")
+	return &result.ContainerAttachResponse, nil
+}
+
+// ThrottlingState returns the ARM throttling observed by the clients.
+func (a *AzClientsAPIs) ThrottlingState() ThrottlingState {
+	if a.throttling == nil {
+		return ThrottlingState{Reads: OperationThrottling{Remaining: -1}, Writes: OperationThrottling{Remaining: -1}}
+	}
+	return a.throttling.State()
+}
+
+// getStatusCode returns the status code of the response, or 0 when the request failed before a
+// response was received.
+func getStatusCode(rawResponse *http.Response) int {
+	if rawResponse == nil {
+		return 0
+	}
+	return rawResponse.StatusCode
 }
@@ -0,0 +1,212 @@
+/*
+Copyright (c) Microsoft Corporation.
+Licensed under the Apache 2.0 license.
+*/
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+)
+
+// ARMErrorKind classifies the ARM errors by how they should be handled.
+type ARMErrorKind string
+
+const (
+	// ARMErrorUnknown is an ARM error that is not classified.
+	ARMErrorUnknown ARMErrorKind = "Unknown"
+	// ARMErrorNotFound is a missing resource, it is reported as errdefs.NotFound.
+	ARMErrorNotFound ARMErrorKind = "NotFound"
+	// ARMErrorQuotaExceeded is a subscription quota reached, the request can be retried once
+	// resources are freed.
+	ARMErrorQuotaExceeded ARMErrorKind = "QuotaExceeded"
+	// ARMErrorCapacity is a region lacking the capacity for the requested resources, the request can
+	// be retried later.
+	ARMErrorCapacity ARMErrorKind = "RegionCapacity"
+	// ARMErrorInvalidSpec is a container group rejected by ACI, it is reported as
+	// errdefs.InvalidInput and retrying it does not help.
+	ARMErrorInvalidSpec ARMErrorKind = "InvalidSpec"
+	// ARMErrorThrottled is a request throttled by ARM, it can be retried later.
+	ARMErrorThrottled ARMErrorKind = "Throttled"
+	// ARMErrorUnauthorized is a request the identity of the virtual kubelet is not allowed to make.
+	ARMErrorUnauthorized ARMErrorKind = "Unauthorized"
+	// ARMErrorTransient is a server side failure, the request can be retried.
+	ARMErrorTransient ARMErrorKind = "Transient"
+)
+
+// armErrorKinds classifies the ARM and ACI error codes.
+var armErrorKinds = map[string]ARMErrorKind{
+	"ResourceNotFound":      ARMErrorNotFound,
+	"ResourceGroupNotFound": ARMErrorNotFound,
+	"NotFound":              ARMErrorNotFound,
+
+	"ContainerGroupQuotaReached": ARMErrorQuotaExceeded,
+	"QuotaExceeded":              ARMErrorQuotaExceeded,
+
+	// ACI reports ServiceUnavailable when the region can not allocate the requested resources.
+	"ServiceUnavailable": ARMErrorCapacity,
+	"SkuNotAvailable":    ARMErrorCapacity,
+
+	"InvalidImage":              ARMErrorInvalidSpec,
+	"InaccessibleImage":         ARMErrorInvalidSpec,
+	"InvalidContainerGroupName": ARMErrorInvalidSpec,
+	"InvalidContainerName":      ARMErrorInvalidSpec,
+	"InvalidRequestContent":     ARMErrorInvalidSpec,
+	"InvalidParameter":          ARMErrorInvalidSpec,
+	"InvalidResourceName":       ARMErrorInvalidSpec,
+	"UnsupportedFeature":        ARMErrorInvalidSpec,
+
+	"TooManyRequests":               ARMErrorThrottled,
+	"SubscriptionRequestsThrottled": ARMErrorThrottled,
+	"ResourceRequestsThrottled":     ARMErrorThrottled,
+
+	"AuthorizationFailed":         ARMErrorUnauthorized,
+	"LinkedAuthorizationFailed":   ARMErrorUnauthorized,
+	"AuthenticationFailed":        ARMErrorUnauthorized,
+	"InvalidAuthenticationToken":  ARMErrorUnauthorized,
+	"RegistryCredentialsRequired": ARMErrorUnauthorized,
+}
+
+// ARMError is an error returned by ARM, classified by kind.
+type ARMError struct {
+	Kind ARMErrorKind
+	// StatusCode is the status code of the response, or of the final polling response of a
+	// long-running operation.
+	StatusCode int
+	Code       string
+	Message    string
+
+	err error
+}
+
+func (e *ARMError) Error() string {
+	return e.err.Error()
+}
+
+// Cause returns the error returned by the Azure SDK.
+func (e *ARMError) Cause() error {
+	return e.err
+}
+
+func (e *ARMError) Unwrap() error {
+	return e.err
+}
+
+// NotFound implements errdefs.ErrNotFound.
+func (e *ARMError) NotFound() bool {
+	return e.Kind == ARMErrorNotFound
+}
+
+// InvalidInput implements errdefs.ErrInvalidInput.
+func (e *ARMError) InvalidInput() bool {
+	return e.Kind == ARMErrorInvalidSpec
+}
+
+// Retryable is true when the same request can succeed later.
+func (e *ARMError) Retryable() bool {
+	switch e.Kind {
+	case ARMErrorQuotaExceeded, ARMErrorCapacity, ARMErrorThrottled, ARMErrorTransient:
+		return true
+	}
+	return false
+}
+
+// Summary returns the ARM error code and message.
+func (e *ARMError) Summary() string {
+	if e.Message == "" {
+		return e.Code
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// ClassifyARMError returns the ARM error of err, or nil when err does not come from an ARM response.
+func ClassifyARMError(err error) *ARMError {
+	var armErr *ARMError
+	if errors.As(err, &armErr) {
+		return armErr
+	}
+
+	var respErr *azcore.ResponseError
+	if !errors.As(err, &respErr) {
+		return nil
+	}
+	code, message, _ := GetARMErrorCodeAndMessage(err)
+	return &ARMError{
+		Kind:       getARMErrorKind(code, respErr.StatusCode),
+		StatusCode: respErr.StatusCode,
+		Code:       code,
+		Message:    message,
+		err:        err,
+	}
+}
+
+// AsARMError returns err as an *ARMError when it comes from an ARM response, so it can be checked
+// with errdefs, and err unchanged otherwise.
+func AsARMError(err error) error {
+	if armErr := ClassifyARMError(err); armErr != nil {
+		return armErr
+	}
+	return err
+}
+
+func getARMErrorKind(code string, statusCode int) ARMErrorKind {
+	if kind, ok := armErrorKinds[code]; ok {
+		return kind
+	}
+
+	switch {
+	case statusCode == http.StatusNotFound:
+		return ARMErrorNotFound
+	case statusCode == http.StatusTooManyRequests:
+		return ARMErrorThrottled
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		return ARMErrorUnauthorized
+	case statusCode == http.StatusBadRequest:
+		return ARMErrorInvalidSpec
+	case statusCode >= http.StatusInternalServerError:
+		return ARMErrorTransient
+	}
+	return ARMErrorUnknown
+}
+
+// armErrorBody is the error payload returned by ARM, for both requests and long-running operations.
+type armErrorBody struct {
+	Error *struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// GetARMErrorCodeAndMessage extracts the ARM error code and message from an error returned by the Azure SDK.
+// ok is false when err does not come from an ARM response.
+func GetARMErrorCodeAndMessage(err error) (code, message string, ok bool) {
+	var armErr *ARMError
+	if errors.As(err, &armErr) {
+		return armErr.Code, armErr.Message, true
+	}
+
+	var respErr *azcore.ResponseError
+	if !errors.As(err, &respErr) {
+		return "", "", false
+	}
+
+	code = respErr.ErrorCode
+	if respErr.RawResponse != nil {
+		// the SDK buffers the body of error responses, so it can be read again here.
+		if payload, pErr := runtime.Payload(respErr.RawResponse); pErr == nil {
+			var body armErrorBody
+			if json.Unmarshal(payload, &body) == nil && body.Error != nil {
+				if code == "" {
+					code = body.Error.Code
+				}
+				message = body.Error.Message
+			}
+		}
+	}
+	return code, message, true
+}
@@ -0,0 +1,73 @@
+/*
+Copyright (c) Microsoft Corporation.
+Licensed under the Apache 2.0 license.
+*/
+package client
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	pkgerrors "github.com/pkg/errors"
+	testsutil "github.com/virtual-kubelet/azure-aci/pkg/tests"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestClassifyARMError(t *testing.T) {
+	cases := []struct {
+		statusCode        int
+		code              string
+		expectedKind      ARMErrorKind
+		expectedRetryable bool
+	}{
+		{http.StatusConflict, "ContainerGroupQuotaReached", ARMErrorQuotaExceeded, true},
+		{http.StatusConflict, "ServiceUnavailable", ARMErrorCapacity, true},
+		{http.StatusBadRequest, "InvalidImage", ARMErrorInvalidSpec, false},
+		{http.StatusBadRequest, "InaccessibleImage", ARMErrorInvalidSpec, false},
+		{http.StatusBadRequest, "InvalidContainerGroupName", ARMErrorInvalidSpec, false},
+		{http.StatusBadRequest, "SomethingElse", ARMErrorInvalidSpec, false},
+		{http.StatusTooManyRequests, "SubscriptionRequestsThrottled", ARMErrorThrottled, true},
+		{http.StatusForbidden, "AuthorizationFailed", ARMErrorUnauthorized, false},
+		{http.StatusNotFound, "ResourceNotFound", ARMErrorNotFound, false},
+		{http.StatusInternalServerError, "InternalServerError", ARMErrorTransient, true},
+		// The failed long-running operations are reported with the status of the last poll.
+		{http.StatusOK, "ContainerGroupQuotaReached", ARMErrorQuotaExceeded, true},
+		{http.StatusConflict, "Conflict", ARMErrorUnknown, false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.code, func(t *testing.T) {
+			err := testsutil.NewARMResponseError(tc.statusCode, `{"error":{"code":"`+tc.code+`","message":"a message"}}`)
+			armErr := ClassifyARMError(pkgerrors.Wrap(err, "wrapped"))
+			assert.Assert(t, armErr != nil)
+			assert.Check(t, is.Equal(armErr.Kind, tc.expectedKind))
+			assert.Check(t, is.Equal(armErr.Retryable(), tc.expectedRetryable))
+			assert.Check(t, is.Equal(armErr.Code, tc.code))
+			assert.Check(t, is.Equal(armErr.Summary(), tc.code+": a message"))
+			assert.Check(t, is.Equal(armErr.StatusCode, tc.statusCode))
+		})
+	}
+
+	assert.Check(t, ClassifyARMError(errors.New("not an ARM error")) == nil)
+}
+
+func TestAsARMErrorMapsToErrdefs(t *testing.T) {
+	notFound := AsARMError(testsutil.NewARMResponseError(http.StatusNotFound, `{"error":{"code":"ResourceNotFound","message":"not found"}}`))
+	assert.Check(t, errdefs.IsNotFound(notFound))
+	assert.Check(t, !errdefs.IsInvalidInput(notFound))
+
+	invalid := AsARMError(testsutil.NewARMResponseError(http.StatusBadRequest, `{"error":{"code":"InvalidImage","message":"invalid"}}`))
+	assert.Check(t, errdefs.IsInvalidInput(invalid))
+	assert.Check(t, !errdefs.IsNotFound(invalid))
+
+	code, message, ok := GetARMErrorCodeAndMessage(invalid)
+	assert.Check(t, ok)
+	assert.Check(t, is.Equal(code, "InvalidImage"))
+	assert.Check(t, is.Equal(message, "invalid"))
+
+	plain := errors.New("not an ARM error")
+	assert.Check(t, is.Equal(AsARMError(plain), plain))
+}
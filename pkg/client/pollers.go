@@ -0,0 +1,37 @@
+/*
+Copyright (c) Microsoft Corporation.
+Licensed under the Apache 2.0 license.
+*/
+package client
+
+import (
+	"context"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	azaciv2 "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerinstance/armcontainerinstance/v2"
+)
+
+// lroPollingFrequency is how often the state of a container group long-running operation is checked.
+const lroPollingFrequency = 10 * time.Second
+
+// ContainerGroupPoller tracks a container group long-running operation.
+type ContainerGroupPoller interface {
+	// PollUntilDone blocks until the operation reaches a terminal state. It returns the container group
+	// as reported by ARM on success, or the ARM error when the operation fails.
+	PollUntilDone(ctx context.Context) (*azaciv2.ContainerGroup, error)
+}
+
+// containerGroupPoller adapts the SDK poller of a container group operation to ContainerGroupPoller.
+type containerGroupPoller[T any] struct {
+	poller *runtime.Poller[T]
+	result func(T) *azaciv2.ContainerGroup
+}
+
+func (c *containerGroupPoller[T]) PollUntilDone(ctx context.Context) (*azaciv2.ContainerGroup, error) {
+	resp, err := c.poller.PollUntilDone(ctx, &runtime.PollUntilDoneOptions{Frequency: lroPollingFrequency})
+	if err != nil {
+		return nil, AsARMError(err)
+	}
+	return c.result(resp), nil
+}
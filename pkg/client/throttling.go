@@ -0,0 +1,297 @@
+/*
+Copyright (c) Microsoft Corporation.
+Licensed under the Apache 2.0 license.
+*/
+package client
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	"golang.org/x/time/rate"
+)
+
+const (
+	headerRetryAfter                   = "Retry-After"
+	headerRemainingSubscriptionReads   = "x-ms-ratelimit-remaining-subscription-reads"
+	headerRemainingSubscriptionWrites  = "x-ms-ratelimit-remaining-subscription-writes"
+	headerRemainingSubscriptionDeletes = "x-ms-ratelimit-remaining-subscription-deletes"
+	// headerRemainingResource holds the remaining requests of the resource provider policies, e.g.
+	// Microsoft.ContainerInstance/ContainerGroupPutDelete3Min;299, comma separated.
+	headerRemainingResource = "x-ms-ratelimit-remaining-resource"
+
+	// lowRemainingRequests is the number of remaining requests under which the operations are
+	// reported as throttled, so the callers slow down before ARM rejects the requests.
+	lowRemainingRequests = 10
+
+	// The budgets allow bursts of budgetBurstDuration worth of requests.
+	budgetBurstDuration = 10 * time.Second
+
+	defaultReadBudget  = 20.0
+	defaultWriteBudget = 5.0
+)
+
+type operationType int
+
+const (
+	readOperation operationType = iota
+	writeOperation
+)
+
+func (o operationType) String() string {
+	if o == readOperation {
+		return "read"
+	}
+	return "write"
+}
+
+func getOperationType(method string) operationType {
+	if method == http.MethodGet || method == http.MethodHead {
+		return readOperation
+	}
+	return writeOperation
+}
+
+// throttlingRetryOptions is how the requests throttled by ARM are retried. The reads are retried
+// less, the pods tracker reads the container groups again on its next update anyway.
+type throttlingRetryOptions struct {
+	maxRetries int
+	baseDelay  time.Duration
+	maxDelay   time.Duration
+}
+
+var throttlingRetries = map[operationType]throttlingRetryOptions{
+	readOperation:  {maxRetries: 2, baseDelay: time.Second, maxDelay: 30 * time.Second},
+	writeOperation: {maxRetries: 5, baseDelay: 5 * time.Second, maxDelay: 2 * time.Minute},
+}
+
+// ThrottlingState is the ARM throttling observed by the client.
+type ThrottlingState struct {
+	Reads  OperationThrottling
+	Writes OperationThrottling
+}
+
+// OperationThrottling is the ARM throttling of the read or write requests.
+type OperationThrottling struct {
+	// Throttled is set while ARM asks to retry later, or when the remaining requests run low.
+	Throttled bool
+	// RetryAfter is when ARM accepts the requests again, it is zero when ARM did not throttle.
+	RetryAfter time.Time
+	// Remaining is the number of requests ARM reported as remaining, or -1 when unknown.
+	Remaining int
+}
+
+type operationThrottling struct {
+	retryAfter time.Time
+	remaining  int
+	budget     *rate.Limiter
+}
+
+// throttlingPolicy is a pipeline policy sharing the ARM request quota between the callers of the
+// client. Every request waits for the read or write budget, the throttled requests are retried
+// after the delay asked by ARM, or after a jittered backoff, and the requests of the same type are
+// held until then.
+type throttlingPolicy struct {
+	lock       sync.Mutex
+	operations map[operationType]*operationThrottling
+}
+
+// newThrottlingPolicy creates a throttling policy with budgets of requests per second, a budget of
+// zero does not limit the requests.
+func newThrottlingPolicy(readBudget, writeBudget float64) *throttlingPolicy {
+	return &throttlingPolicy{
+		operations: map[operationType]*operationThrottling{
+			readOperation:  {remaining: -1, budget: newBudget(readBudget)},
+			writeOperation: {remaining: -1, budget: newBudget(writeBudget)},
+		},
+	}
+}
+
+func newBudget(requestsPerSecond float64) *rate.Limiter {
+	if requestsPerSecond <= 0 {
+		return nil
+	}
+	burst := int(math.Ceil(requestsPerSecond * budgetBurstDuration.Seconds()))
+	return rate.NewLimiter(rate.Limit(requestsPerSecond), burst)
+}
+
+// newThrottlingPolicyFromEnv creates the throttling policy with the budgets, in requests per second,
+// of ACI_ARM_READ_BUDGET and ACI_ARM_WRITE_BUDGET.
+func newThrottlingPolicyFromEnv() (*throttlingPolicy, error) {
+	readBudget, err := getBudgetFromEnv("ACI_ARM_READ_BUDGET", defaultReadBudget)
+	if err != nil {
+		return nil, err
+	}
+	writeBudget, err := getBudgetFromEnv("ACI_ARM_WRITE_BUDGET", defaultWriteBudget)
+	if err != nil {
+		return nil, err
+	}
+	return newThrottlingPolicy(readBudget, writeBudget), nil
+}
+
+func getBudgetFromEnv(key string, defaultBudget float64) (float64, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultBudget, nil
+	}
+	budget, err := strconv.ParseFloat(value, 64)
+	if err != nil || budget < 0 {
+		return 0, fmt.Errorf("invalid %s %q, expected a number of requests per second", key, value)
+	}
+	return budget, nil
+}
+
+// Do implements policy.Policy.
+func (t *throttlingPolicy) Do(req *policy.Request) (*http.Response, error) {
+	ctx := req.Raw().Context()
+	op := getOperationType(req.Raw().Method)
+	retries := throttlingRetries[op]
+
+	for attempt := 0; ; attempt++ {
+		if err := t.wait(ctx, op); err != nil {
+			return nil, err
+		}
+		if attempt > 0 {
+			if err := req.RewindBody(); err != nil {
+				return nil, err
+			}
+		}
+
+		resp, err := req.Clone(ctx).Next()
+		if err != nil {
+			return resp, err
+		}
+		t.observe(op, resp.Header)
+		if resp.StatusCode != http.StatusTooManyRequests || attempt >= retries.maxRetries {
+			return resp, nil
+		}
+
+		delay := getRetryAfter(resp.Header, time.Now())
+		if delay <= 0 {
+			delay = getThrottlingBackoff(retries, attempt)
+		}
+		t.throttle(op, time.Now().Add(delay))
+		log.G(ctx).Warnf("ARM throttled the %s request %s %s, retrying in %s", op, req.Raw().Method, req.Raw().URL.Path, delay)
+		runtime.Drain(resp)
+	}
+}
+
+// wait blocks until ARM accepts the requests of the operation type again, and the budget allows
+// one more request.
+func (t *throttlingPolicy) wait(ctx context.Context, op operationType) error {
+	t.lock.Lock()
+	retryAfter := t.operations[op].retryAfter
+	budget := t.operations[op].budget
+	t.lock.Unlock()
+
+	if delay := time.Until(retryAfter); delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+
+	if budget == nil {
+		return nil
+	}
+	return budget.Wait(ctx)
+}
+
+func (t *throttlingPolicy) throttle(op operationType, retryAfter time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if retryAfter.After(t.operations[op].retryAfter) {
+		t.operations[op].retryAfter = retryAfter
+	}
+}
+
+// observe records the remaining requests reported by ARM, the lowest of the subscription and
+// resource provider limits.
+func (t *throttlingPolicy) observe(op operationType, header http.Header) {
+	remaining := -1
+	lower := func(value string) {
+		if count, err := strconv.Atoi(strings.TrimSpace(value)); err == nil && (remaining < 0 || count < remaining) {
+			remaining = count
+		}
+	}
+
+	switch op {
+	case readOperation:
+		lower(header.Get(headerRemainingSubscriptionReads))
+	case writeOperation:
+		lower(header.Get(headerRemainingSubscriptionWrites))
+		lower(header.Get(headerRemainingSubscriptionDeletes))
+	}
+	for _, policyRemaining := range strings.Split(header.Get(headerRemainingResource), ",") {
+		if i := strings.LastIndexByte(policyRemaining, ';'); i >= 0 {
+			lower(policyRemaining[i+1:])
+		}
+	}
+
+	if remaining < 0 {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.operations[op].remaining = remaining
+}
+
+// State returns the current throttling of the read and write requests.
+func (t *throttlingPolicy) State() ThrottlingState {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := time.Now()
+	state := func(op operationType) OperationThrottling {
+		o := t.operations[op]
+		s := OperationThrottling{Remaining: o.remaining}
+		if o.retryAfter.After(now) {
+			s.RetryAfter = o.retryAfter
+			s.Throttled = true
+		}
+		if o.remaining >= 0 && o.remaining < lowRemainingRequests {
+			s.Throttled = true
+		}
+		return s
+	}
+	return ThrottlingState{Reads: state(readOperation), Writes: state(writeOperation)}
+}
+
+// getRetryAfter returns the delay of the Retry-After header, in seconds or as an HTTP date.
+func getRetryAfter(header http.Header, now time.Time) time.Duration {
+	value := header.Get(headerRetryAfter)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+// getThrottlingBackoff returns an exponential backoff, jittered over its upper half.
+func getThrottlingBackoff(retries throttlingRetryOptions, attempt int) time.Duration {
+	backoff := retries.baseDelay << attempt
+	if backoff <= 0 || backoff > retries.maxDelay {
+		backoff = retries.maxDelay
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
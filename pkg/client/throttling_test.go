@@ -0,0 +1,164 @@
+/*
+Copyright (c) Microsoft Corporation.
+Licensed under the Apache 2.0 license.
+*/
+package client
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+// fakeTransport returns the responses in order, and records the requests sent.
+type fakeTransport struct {
+	responses []*http.Response
+	requests  []*http.Request
+}
+
+func (f *fakeTransport) Do(req *http.Request) (*http.Response, error) {
+	resp := f.responses[len(f.requests)]
+	f.requests = append(f.requests, req)
+	resp.Request = req
+	return resp, nil
+}
+
+func newFakeResponse(statusCode int, header map[string]string) *http.Response {
+	resp := &http.Response{
+		StatusCode: statusCode,
+		Header:     http.Header{},
+		Body:       http.NoBody,
+	}
+	for key, value := range header {
+		resp.Header.Set(key, value)
+	}
+	return resp
+}
+
+func sendThroughPolicy(t *testing.T, throttling *throttlingPolicy, transport *fakeTransport, method string) *http.Response {
+	pipeline := runtime.NewPipeline("test", "v0.0.0", runtime.PipelineOptions{PerCall: []policy.Policy{throttling}},
+		&policy.ClientOptions{Transport: transport, Retry: policy.RetryOptions{MaxRetries: -1}})
+	req, err := runtime.NewRequest(context.Background(), method, "https://management.azure.com/test")
+	assert.NilError(t, err)
+	resp, err := pipeline.Do(req)
+	assert.NilError(t, err)
+	return resp
+}
+
+func TestThrottlingPolicyRetriesThrottledRequests(t *testing.T) {
+	defaultRetries := throttlingRetries
+	throttlingRetries = map[operationType]throttlingRetryOptions{
+		readOperation:  {maxRetries: 2, baseDelay: time.Millisecond, maxDelay: 10 * time.Millisecond},
+		writeOperation: {maxRetries: 1, baseDelay: time.Millisecond, maxDelay: 10 * time.Millisecond},
+	}
+	defer func() { throttlingRetries = defaultRetries }()
+
+	transport := &fakeTransport{responses: []*http.Response{
+		newFakeResponse(http.StatusTooManyRequests, nil),
+		newFakeResponse(http.StatusTooManyRequests, nil),
+		newFakeResponse(http.StatusOK, nil),
+	}}
+	resp := sendThroughPolicy(t, newThrottlingPolicy(0, 0), transport, http.MethodGet)
+	assert.Check(t, is.Equal(resp.StatusCode, http.StatusOK))
+	assert.Check(t, is.Len(transport.requests, 3))
+
+	transport = &fakeTransport{responses: []*http.Response{
+		newFakeResponse(http.StatusTooManyRequests, nil),
+		newFakeResponse(http.StatusTooManyRequests, nil),
+	}}
+	resp = sendThroughPolicy(t, newThrottlingPolicy(0, 0), transport, http.MethodPut)
+	assert.Check(t, is.Equal(resp.StatusCode, http.StatusTooManyRequests), "the throttled response should be returned once the retries are exhausted")
+	assert.Check(t, is.Len(transport.requests, 2))
+}
+
+func TestThrottlingPolicyHoldsRequestsUntilRetryAfter(t *testing.T) {
+	throttling := newThrottlingPolicy(0, 0)
+	transport := &fakeTransport{responses: []*http.Response{
+		newFakeResponse(http.StatusTooManyRequests, map[string]string{headerRetryAfter: "1"}),
+		newFakeResponse(http.StatusOK, nil),
+	}}
+
+	start := time.Now()
+	resp := sendThroughPolicy(t, throttling, transport, http.MethodGet)
+	assert.Check(t, is.Equal(resp.StatusCode, http.StatusOK))
+	assert.Check(t, time.Since(start) >= time.Second, "the request should be retried after the delay asked by ARM")
+
+	throttling.throttle(readOperation, time.Now().Add(time.Hour))
+	state := throttling.State()
+	assert.Check(t, state.Reads.Throttled)
+	assert.Check(t, !state.Writes.Throttled, "the writes should not be throttled by the reads")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Check(t, throttling.wait(ctx, readOperation) != nil, "the reads should be held until ARM accepts them")
+	assert.NilError(t, throttling.wait(ctx, writeOperation))
+}
+
+func TestThrottlingPolicyObservesRemainingRequests(t *testing.T) {
+	throttling := newThrottlingPolicy(0, 0)
+	state := throttling.State()
+	assert.Check(t, is.Equal(state.Reads.Remaining, -1))
+	assert.Check(t, is.Equal(state.Writes.Remaining, -1))
+
+	transport := &fakeTransport{responses: []*http.Response{
+		newFakeResponse(http.StatusOK, map[string]string{headerRemainingSubscriptionReads: "5"}),
+		newFakeResponse(http.StatusOK, map[string]string{
+			headerRemainingSubscriptionWrites: "1199",
+			headerRemainingResource:           "Microsoft.ContainerInstance/ContainerGroupPutDelete3Min;299,Microsoft.ContainerInstance/ContainerGroupPutDelete1Hour;42",
+		}),
+	}}
+	sendThroughPolicy(t, throttling, transport, http.MethodGet)
+	sendThroughPolicy(t, throttling, transport, http.MethodPut)
+
+	state = throttling.State()
+	assert.Check(t, is.Equal(state.Reads.Remaining, 5))
+	assert.Check(t, state.Reads.Throttled, "the reads should be throttled when few requests remain")
+	assert.Check(t, is.Equal(state.Writes.Remaining, 42), "the lowest remaining requests should be kept")
+	assert.Check(t, !state.Writes.Throttled)
+}
+
+func TestGetRetryAfter(t *testing.T) {
+	now := time.Date(2023, 1, 2, 10, 0, 0, 0, time.UTC)
+
+	assert.Check(t, is.Equal(getRetryAfter(http.Header{}, now), time.Duration(0)))
+	assert.Check(t, is.Equal(getRetryAfter(http.Header{headerRetryAfter: {"17"}}, now), 17*time.Second))
+	assert.Check(t, is.Equal(getRetryAfter(http.Header{headerRetryAfter: {now.Add(time.Minute).Format(http.TimeFormat)}}, now), time.Minute))
+	assert.Check(t, is.Equal(getRetryAfter(http.Header{headerRetryAfter: {"soon"}}, now), time.Duration(0)))
+}
+
+func TestGetThrottlingBackoff(t *testing.T) {
+	retries := throttlingRetryOptions{maxRetries: 10, baseDelay: time.Second, maxDelay: 30 * time.Second}
+	for attempt := 0; attempt < 10; attempt++ {
+		backoff := getThrottlingBackoff(retries, attempt)
+		expected := retries.baseDelay << attempt
+		if expected > retries.maxDelay {
+			expected = retries.maxDelay
+		}
+		assert.Check(t, backoff >= expected/2 && backoff <= expected, "attempt %d: backoff %s", attempt, backoff)
+	}
+}
+
+func TestGetBudgetFromEnv(t *testing.T) {
+	t.Setenv("ACI_ARM_READ_BUDGET", "")
+	budget, err := getBudgetFromEnv("ACI_ARM_READ_BUDGET", defaultReadBudget)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(budget, defaultReadBudget))
+
+	t.Setenv("ACI_ARM_READ_BUDGET", "2.5")
+	budget, err = getBudgetFromEnv("ACI_ARM_READ_BUDGET", defaultReadBudget)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(budget, 2.5))
+	assert.Check(t, is.Equal(newBudget(budget).Burst(), 25))
+	assert.Check(t, newBudget(0) == nil, "a budget of zero should not limit the requests")
+
+	t.Setenv("ACI_ARM_READ_BUDGET", "-1")
+	_, err = getBudgetFromEnv("ACI_ARM_READ_BUDGET", defaultReadBudget)
+	assert.Check(t, err != nil && strings.Contains(err.Error(), "ACI_ARM_READ_BUDGET"))
+}
@@ -0,0 +1,93 @@
+/*
+Copyright (c) Microsoft Corporation.
+Licensed under the Apache 2.0 license.
+*/
+package logarchive
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/pkg/errors"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+)
+
+// BlobSink stores the log archives as block blobs in an Azure Storage container.
+type BlobSink struct {
+	client *container.Client
+}
+
+// NewBlobSink creates a sink storing the log archives in the container at containerURL, e.g.
+// https://<account>.blob.core.windows.net/<container>. The identity needs the Storage Blob Data
+// Contributor role on the container.
+func NewBlobSink(containerURL string, credential azcore.TokenCredential, options azcore.ClientOptions) (*BlobSink, error) {
+	client, err := container.NewClient(containerURL, credential, &container.ClientOptions{ClientOptions: options})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create the log archive blob client")
+	}
+	return &BlobSink{client: client}, nil
+}
+
+// Put implements Sink.
+func (s *BlobSink) Put(ctx context.Context, key string, content []byte) error {
+	_, err := s.client.NewBlockBlobClient(key).UploadBuffer(ctx, content, nil)
+	return err
+}
+
+// Get implements Sink.
+func (s *BlobSink) Get(ctx context.Context, key string) ([]byte, error) {
+	resp, err := s.client.NewBlobClient(key).DownloadStream(ctx, nil)
+	if err != nil {
+		if bloberror.HasCode(err, bloberror.BlobNotFound, bloberror.ContainerNotFound) {
+			return nil, errdefs.NotFoundf("log archive %s not found", key)
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// List implements Sink.
+func (s *BlobSink) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	pager := s.client.NewListBlobsFlatPager(&container.ListBlobsFlatOptions{Prefix: &prefix})
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range page.Segment.BlobItems {
+			if item.Name != nil {
+				keys = append(keys, *item.Name)
+			}
+		}
+	}
+	return keys, nil
+}
+
+// Prune implements Sink.
+func (s *BlobSink) Prune(ctx context.Context, before time.Time) ([]string, error) {
+	var pruned []string
+	pager := s.client.NewListBlobsFlatPager(nil)
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return pruned, err
+		}
+		for _, item := range page.Segment.BlobItems {
+			if item.Name == nil || item.Properties == nil || item.Properties.LastModified == nil ||
+				!item.Properties.LastModified.Before(before) {
+				continue
+			}
+			if _, err := s.client.NewBlobClient(*item.Name).Delete(ctx, nil); err != nil && !bloberror.HasCode(err, bloberror.BlobNotFound) {
+				return pruned, err
+			}
+			pruned = append(pruned, *item.Name)
+		}
+	}
+	return pruned, nil
+}
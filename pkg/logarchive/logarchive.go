@@ -0,0 +1,172 @@
+/*
+Copyright (c) Microsoft Corporation.
+Licensed under the Apache 2.0 license.
+*/
+package logarchive
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+)
+
+// Sink stores the archived logs of the containers. Keys are slash separated paths.
+type Sink interface {
+	// Put stores the content under key, replacing any previous content.
+	Put(ctx context.Context, key string, content []byte) error
+	// Get returns the content stored under key, or a NotFound error.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// List returns the keys starting with prefix.
+	List(ctx context.Context, prefix string) ([]string, error)
+	// Prune deletes the content stored before the time, and returns the keys deleted.
+	Prune(ctx context.Context, before time.Time) ([]string, error)
+}
+
+// FileSink stores the log archives in a directory of the local filesystem.
+type FileSink struct {
+	dir string
+}
+
+// NewFileSink creates a sink storing the log archives under dir.
+func NewFileSink(dir string) (*FileSink, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("the log archive directory can not be empty")
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create the log archive directory: %w", err)
+	}
+	return &FileSink{dir: dir}, nil
+}
+
+func (s *FileSink) path(key string) (string, error) {
+	p := filepath.Join(s.dir, filepath.FromSlash(key))
+	if !strings.HasPrefix(p, filepath.Clean(s.dir)+string(filepath.Separator)) {
+		return "", errdefs.InvalidInputf("invalid log archive key %q", key)
+	}
+	return p, nil
+}
+
+// Put implements Sink. The content is written to a temporary file first, so a partial archive is
+// never served.
+func (s *FileSink) Put(ctx context.Context, key string, content []byte) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(p), ".archive-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), p)
+}
+
+// Get implements Sink.
+func (s *FileSink) Get(ctx context.Context, key string) ([]byte, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	content, err := os.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil, errdefs.NotFoundf("log archive %s not found", key)
+	}
+	return content, err
+}
+
+// List implements Sink. Only the directory of the prefix is walked, a missing directory has no
+// keys.
+func (s *FileSink) List(ctx context.Context, prefix string) ([]string, error) {
+	root := s.dir
+	if i := strings.LastIndex(prefix, "/"); i > 0 {
+		p, err := s.path(prefix[:i])
+		if err != nil {
+			return nil, err
+		}
+		root = p
+	}
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	var keys []string
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".archive-") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.dir, p)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// Prune implements Sink. The directories left empty are removed.
+func (s *FileSink) Prune(ctx context.Context, before time.Time) ([]string, error) {
+	var pruned []string
+	var dirs []string
+	err := filepath.WalkDir(s.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if p != s.dir {
+				dirs = append(dirs, p)
+			}
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".archive-") {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if !info.ModTime().Before(before) {
+			return nil
+		}
+		rel, err := filepath.Rel(s.dir, p)
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(p); err != nil {
+			return err
+		}
+		pruned = append(pruned, filepath.ToSlash(rel))
+		return nil
+	})
+
+	// The directories are walked parents first, the deepest are removed first.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		_ = os.Remove(dirs[i])
+	}
+	return pruned, err
+}
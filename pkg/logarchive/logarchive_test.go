@@ -0,0 +1,82 @@
+/*
+Copyright (c) Microsoft Corporation.
+Licensed under the Apache 2.0 license.
+*/
+package logarchive
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestFileSink(t *testing.T) {
+	ctx := context.Background()
+	sink, err := NewFileSink(t.TempDir())
+	assert.NilError(t, err)
+
+	assert.NilError(t, sink.Put(ctx, "ns/pod/container/0.log", []byte("first")))
+	assert.NilError(t, sink.Put(ctx, "ns/pod/container/1.log", []byte("second")))
+	assert.NilError(t, sink.Put(ctx, "ns/pod/container/1.log", []byte("replaced")))
+	assert.NilError(t, sink.Put(ctx, "ns/other/container/0.log", []byte("other")))
+
+	content, err := sink.Get(ctx, "ns/pod/container/1.log")
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(string(content), "replaced"))
+
+	_, err = sink.Get(ctx, "ns/pod/container/2.log")
+	assert.Check(t, errdefs.IsNotFound(err), "expected a NotFound error, got %v", err)
+
+	keys, err := sink.List(ctx, "ns/pod/")
+	assert.NilError(t, err)
+	sort.Strings(keys)
+	assert.Check(t, is.DeepEqual(keys, []string{"ns/pod/container/0.log", "ns/pod/container/1.log"}))
+
+	// The prefixes don't have to end with a directory.
+	keys, err = sink.List(ctx, "ns/pod/container/1")
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual(keys, []string{"ns/pod/container/1.log"}))
+
+	keys, err = sink.List(ctx, "missing/pod/")
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(keys, 0), "a missing directory should have no keys")
+
+	_, err = sink.List(ctx, "../")
+	assert.Check(t, errdefs.IsInvalidInput(err), "expected an InvalidInput error, got %v", err)
+
+	err = sink.Put(ctx, "../outside.log", []byte("content"))
+	assert.Check(t, errdefs.IsInvalidInput(err), "expected an InvalidInput error, got %v", err)
+}
+
+func TestFileSinkPrune(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	sink, err := NewFileSink(dir)
+	assert.NilError(t, err)
+
+	assert.NilError(t, sink.Put(ctx, "ns/old/uid/container/0.log", []byte("old")))
+	assert.NilError(t, sink.Put(ctx, "ns/pod/uid/container/0.log", []byte("old")))
+	assert.NilError(t, sink.Put(ctx, "ns/pod/uid/container/1.log", []byte("recent")))
+	old := time.Now().Add(-2 * time.Hour)
+	for _, key := range []string{"ns/old/uid/container/0.log", "ns/pod/uid/container/0.log"} {
+		assert.NilError(t, os.Chtimes(filepath.Join(dir, filepath.FromSlash(key)), old, old))
+	}
+
+	pruned, err := sink.Prune(ctx, time.Now().Add(-time.Hour))
+	assert.NilError(t, err)
+	sort.Strings(pruned)
+	assert.Check(t, is.DeepEqual(pruned, []string{"ns/old/uid/container/0.log", "ns/pod/uid/container/0.log"}))
+
+	keys, err := sink.List(ctx, "ns/")
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual(keys, []string{"ns/pod/uid/container/1.log"}))
+	_, err = os.Stat(filepath.Join(dir, "ns", "old"))
+	assert.Check(t, os.IsNotExist(err), "the empty directories should be removed")
+}
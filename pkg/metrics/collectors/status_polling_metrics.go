@@ -0,0 +1,79 @@
+/*
+Copyright (c) Microsoft Corporation.
+Licensed under the Apache 2.0 license.
+*/
+
+package collectors
+
+import (
+	"time"
+
+	compbasemetrics "k8s.io/component-base/metrics"
+)
+
+var (
+	statusPollingARMCallsDesc = compbasemetrics.NewDesc("aci_status_polling_arm_calls",
+		"Number of ARM calls spent by the last pod status polling cycle",
+		[]string{"call"},
+		nil,
+		compbasemetrics.ALPHA,
+		"")
+
+	statusPollingARMCallsTotalDesc = compbasemetrics.NewDesc("aci_status_polling_arm_calls_total",
+		"Cumulative number of ARM calls spent polling the pod statuses",
+		nil,
+		nil,
+		compbasemetrics.ALPHA,
+		"")
+
+	statusPollingIntervalDesc = compbasemetrics.NewDesc("aci_status_polling_interval_seconds",
+		"Current interval between two pod status polling cycles in seconds",
+		nil,
+		nil,
+		compbasemetrics.ALPHA,
+		"")
+)
+
+// StatusPollingStats are the ARM calls spent polling the status of the pods.
+type StatusPollingStats struct {
+	// ListCalls and GetCalls are the calls of the last polling cycle.
+	ListCalls int
+	GetCalls  int
+	// TotalCalls are the calls of all the polling cycles.
+	TotalCalls int64
+	// Interval is the delay until the next polling cycle.
+	Interval time.Duration
+}
+
+// NewStatusPollingMetricsCollector returns a metrics.StableCollector which exports the pod status polling metrics,
+// the stats are read when the metrics are collected
+func NewStatusPollingMetricsCollector(pollingStats func() StatusPollingStats) compbasemetrics.StableCollector {
+	return &statusPollingMetricsCollector{
+		pollingStats: pollingStats,
+	}
+}
+
+type statusPollingMetricsCollector struct {
+	compbasemetrics.BaseStableCollector
+
+	pollingStats func() StatusPollingStats
+}
+
+// Check if statusPollingMetricsCollector implements necessary interface
+var _ compbasemetrics.StableCollector = &statusPollingMetricsCollector{}
+
+// DescribeWithStability implements compbasemetrics.StableCollector
+func (sc *statusPollingMetricsCollector) DescribeWithStability(ch chan<- *compbasemetrics.Desc) {
+	ch <- statusPollingARMCallsDesc
+	ch <- statusPollingARMCallsTotalDesc
+	ch <- statusPollingIntervalDesc
+}
+
+// CollectWithStability implements compbasemetrics.StableCollector
+func (sc *statusPollingMetricsCollector) CollectWithStability(ch chan<- compbasemetrics.Metric) {
+	pollingStats := sc.pollingStats()
+	ch <- compbasemetrics.NewLazyConstMetric(statusPollingARMCallsDesc, compbasemetrics.GaugeValue, float64(pollingStats.ListCalls), "list")
+	ch <- compbasemetrics.NewLazyConstMetric(statusPollingARMCallsDesc, compbasemetrics.GaugeValue, float64(pollingStats.GetCalls), "get")
+	ch <- compbasemetrics.NewLazyConstMetric(statusPollingARMCallsTotalDesc, compbasemetrics.CounterValue, float64(pollingStats.TotalCalls))
+	ch <- compbasemetrics.NewLazyConstMetric(statusPollingIntervalDesc, compbasemetrics.GaugeValue, pollingStats.Interval.Seconds())
+}
@@ -7,6 +7,7 @@ package metrics
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"sync"
 	"time"
 
@@ -16,6 +17,8 @@ import (
 	dto "github.com/prometheus/client_model/go"
 	"github.com/virtual-kubelet/azure-aci/pkg/client"
 	"github.com/virtual-kubelet/azure-aci/pkg/metrics/collectors"
+	"github.com/virtual-kubelet/azure-aci/pkg/util"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
 	"github.com/virtual-kubelet/virtual-kubelet/log"
 	stats "github.com/virtual-kubelet/virtual-kubelet/node/api/statsv1alpha1"
 	"github.com/virtual-kubelet/virtual-kubelet/trace"
@@ -36,6 +39,9 @@ type ACIPodMetricsProvider struct {
 	podGetter      corev1listers.PodLister
 	aciCGGetter    client.ContainerGroupGetter
 	podStatsGetter client.PodStatsGetter
+
+	// registry holds the metrics of the provider itself, they don't depend on the pods stats.
+	registry compbasemetrics.KubeRegistry
 }
 
 func NewACIPodMetricsProvider(nodeName, aciResourcegroup string, podLister corev1listers.PodLister, aciCGGetter client.ContainerGroupGetter) *ACIPodMetricsProvider {
@@ -43,6 +49,7 @@ func NewACIPodMetricsProvider(nodeName, aciResourcegroup string, podLister corev
 		nodeName:    nodeName,
 		podGetter:   podLister,
 		aciCGGetter: aciCGGetter,
+		registry:    compbasemetrics.NewKubeRegistry(),
 	}
 
 	realTimeGetter := WrapCachedPodStatsGetter(
@@ -52,6 +59,17 @@ func NewACIPodMetricsProvider(nodeName, aciResourcegroup string, podLister corev
 	return &provider
 }
 
+// SetStatusPollingStatsGetter exports the ARM calls spent polling the pod statuses with the
+// provider metrics. It is called once, when the provider starts tracking the pods.
+func (p *ACIPodMetricsProvider) SetStatusPollingStatsGetter(getter func() collectors.StatusPollingStats) {
+	p.registry.CustomMustRegister(collectors.NewStatusPollingMetricsCollector(getter))
+}
+
+// MetricsHandler returns the handler serving the provider metrics.
+func (p *ACIPodMetricsProvider) MetricsHandler() http.Handler {
+	return compbasemetrics.HandlerFor(p.registry, compbasemetrics.HandlerOpts{})
+}
+
 // GetStatsSummary returns the stats summary for pods running on ACI
 func (p *ACIPodMetricsProvider) GetStatsSummary(ctx context.Context) (summary *stats.Summary, err error) {
 	ctx, span := trace.StartSpan(ctx, "GetSummaryStats")
@@ -208,24 +226,26 @@ func (decider *podStatsGetterDecider) GetPodStats(ctx context.Context, pod *v1.P
 }
 
 func (decider *podStatsGetterDecider) getContainerGroupFromPod(ctx context.Context, pod *v1.Pod) (*azaciv2.ContainerGroup, error) {
-	cgName := containerGroupName(pod.Namespace, pod.Name)
 	cacheKey := string(pod.UID)
 	aciContainerGroup, found := decider.cache.Get(cacheKey)
 	if found {
 		return aciContainerGroup.(*azaciv2.ContainerGroup), nil
 	}
-	aciCG, err := decider.aciCGGetter.GetContainerGroup(ctx, decider.rgName, cgName)
+	aciCG, err := decider.aciCGGetter.GetContainerGroup(ctx, decider.rgName, util.ContainerGroupName(pod.Namespace, pod.Name))
+	if errdefs.IsNotFound(err) {
+		// The container groups created before the names were hashed are named after the pod.
+		aciCG, err = decider.aciCGGetter.GetContainerGroup(ctx, decider.rgName, util.LegacyContainerGroupName(pod.Namespace, pod.Name))
+	}
 	if err != nil {
 		return nil, err
 	}
+	if uid := util.GetContainerGroupPodUID(aciCG); uid != "" && uid != string(pod.UID) {
+		return nil, errdefs.NotFoundf("the container group of pod %s/%s belongs to pod %s", pod.Namespace, pod.Name, uid)
+	}
 	decider.cache.Set(cacheKey, aciCG, cache.DefaultExpiration)
 	return aciCG, nil
 }
 
-func containerGroupName(podNS, podName string) string {
-	return fmt.Sprintf("%s-%s", podNS, podName)
-}
-
 func newUInt64Pointer(value int) *uint64 {
 	var u = uint64(value)
 	return &u
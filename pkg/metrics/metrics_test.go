@@ -7,6 +7,9 @@ package metrics
 import (
 	"context"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -14,6 +17,7 @@ import (
 	"github.com/golang/mock/gomock"
 	"github.com/google/uuid"
 	"github.com/virtual-kubelet/azure-aci/pkg/client"
+	"github.com/virtual-kubelet/azure-aci/pkg/metrics/collectors"
 	stats "github.com/virtual-kubelet/virtual-kubelet/node/api/statsv1alpha1"
 	"gotest.tools/assert"
 	v1 "k8s.io/api/core/v1"
@@ -137,6 +141,33 @@ func TestGetMetricsResource(t *testing.T) {
 		})
 	}
 }
+func TestMetricsHandlerExportsStatusPollingStats(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	podMetricsProvider := NewACIPodMetricsProvider("node-1", "rg", NewMockPodGetter(ctrl), nil)
+	pollingStats := collectors.StatusPollingStats{ListCalls: 1, GetCalls: 2, TotalCalls: 3}
+	podMetricsProvider.SetStatusPollingStatsGetter(func() collectors.StatusPollingStats {
+		return pollingStats
+	})
+
+	scrape := func() string {
+		recorder := httptest.NewRecorder()
+		podMetricsProvider.MetricsHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		assert.Equal(t, recorder.Code, http.StatusOK)
+		return recorder.Body.String()
+	}
+
+	// The pod stats are not collected, the stats of the polling are exported regardless.
+	body := scrape()
+	assert.Check(t, strings.Contains(body, "aci_status_polling_arm_calls_total 3"), body)
+	assert.Check(t, strings.Contains(body, `aci_status_polling_arm_calls{call="get"} 2`), body)
+
+	pollingStats.TotalCalls = 5
+	body = scrape()
+	assert.Check(t, strings.Contains(body, "aci_status_polling_arm_calls_total 5"), "the stats should be read on each scrape: %s", body)
+}
+
 func TestPodStatsGetterDecider(t *testing.T) {
 	t.Run("useRealtimeMetricsAndContainerGroupCacheTakeEffective", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
@@ -205,11 +205,80 @@ func (pn *ProviderNetwork) shouldCreateOrUpdateSubnet(currentSubnet aznetworkv2.
 	return createSubnet, nil
 }
 
+// ValidateConfig loads and validates the network configuration the same way SetVNETConfig does,
+// without setting up the subnet.
+func (pn *ProviderNetwork) ValidateConfig(ctx context.Context, azConfig *auth.Config) error {
+	return pn.validateNetworkConfig(ctx, azConfig)
+}
+
+// CheckSubnetSetup reads the ACI subnet and returns whether SetVNETConfig would create or delegate
+// it, or an error when it can't be used by ACI. Nothing is changed.
+func (pn *ProviderNetwork) CheckSubnetSetup(ctx context.Context, azConfig *auth.Config) (bool, error) {
+	ctx, span := trace.StartSpan(ctx, "network.CheckSubnetSetup")
+	defer span.End()
+
+	subnetsClient, err := pn.GetSubnetClient(ctx, azConfig)
+	if err != nil {
+		return false, err
+	}
+	currentSubnet, err := pn.GetACISubnet(ctx, subnetsClient)
+	if err != nil {
+		return false, err
+	}
+	if currentSubnet.Properties == nil {
+		// the subnet doesn't exist, it is created with the configured CIDR
+		return true, nil
+	}
+	return pn.shouldCreateOrUpdateSubnet(currentSubnet)
+}
+
+// CheckSubnet returns an error when the ACI subnet can't be read, or is not delegated to Azure
+// Container Instance anymore. It always succeeds when no subnet is configured.
+func (pn *ProviderNetwork) CheckSubnet(ctx context.Context, azConfig *auth.Config) error {
+	ctx, span := trace.StartSpan(ctx, "network.CheckSubnet")
+	defer span.End()
+
+	if pn.SubnetName == "" {
+		return nil
+	}
+
+	subnetsClient, err := pn.GetSubnetClient(ctx, azConfig)
+	if err != nil {
+		return err
+	}
+	response, err := subnetsClient.Get(ctx, pn.VnetResourceGroup, pn.VnetName, pn.SubnetName, nil)
+	if err != nil {
+		return fmt.Errorf("error while looking up subnet '%s': %v", pn.SubnetName, err)
+	}
+	return checkSubnetDelegation(pn.SubnetName, response.Subnet)
+}
+
+// checkSubnetDelegation returns an error when the subnet can't host container groups.
+func checkSubnetDelegation(subnetName string, subnet aznetworkv2.Subnet) error {
+	if subnet.Properties == nil {
+		return fmt.Errorf("subnet '%s' has no properties", subnetName)
+	}
+	if subnet.Properties.RouteTable != nil && subnet.Properties.RouteTable.ID != nil {
+		return fmt.Errorf("subnet '%s' references the route table '%s'", subnetName, *subnet.Properties.RouteTable.ID)
+	}
+	for _, l := range subnet.Properties.ServiceAssociationLinks {
+		if l.Properties != nil && l.Properties.LinkedResourceType != nil && *l.Properties.LinkedResourceType == subnetDelegationService {
+			return nil
+		}
+	}
+	for _, d := range subnet.Properties.Delegations {
+		if d.Properties != nil && d.Properties.ServiceName != nil && *d.Properties.ServiceName == subnetDelegationService {
+			return nil
+		}
+	}
+	return fmt.Errorf("subnet '%s' is not delegated to Azure Container Instance", subnetName)
+}
+
 func (pn *ProviderNetwork) GetACISubnet(ctx context.Context, subnetsClient *aznetworkv2.SubnetsClient) (aznetworkv2.Subnet, error) {
 	response, err := subnetsClient.Get(ctx, pn.VnetResourceGroup, pn.VnetName, pn.SubnetName, nil)
 	var respErr *azcore.ResponseError
 	if err != nil {
-		if errors.As(err, &respErr) && !(respErr.RawResponse.StatusCode == http.StatusNotFound) {
+		if !errors.As(err, &respErr) || respErr.RawResponse.StatusCode != http.StatusNotFound {
 			return aznetworkv2.Subnet{}, fmt.Errorf("error while looking up subnet: %v", err)
 		}
 
@@ -274,6 +274,65 @@ func TestShouldCreateOrUpdateSubnet(t *testing.T) {
 
 }
 
+func TestCheckSubnetDelegation(t *testing.T) {
+	subnetName := "fakeSubnet"
+	routeTableID := "fakeRouteTable"
+	otherService := "Microsoft.Web/serverFarms"
+
+	cases := []struct {
+		description      string
+		subnetProperties *aznetworkv2.SubnetPropertiesFormat
+		expectedError    string
+	}{
+		{
+			description: "subnet linked to container groups is healthy",
+			subnetProperties: &aznetworkv2.SubnetPropertiesFormat{
+				ServiceAssociationLinks: []*aznetworkv2.ServiceAssociationLink{{
+					Properties: &aznetworkv2.ServiceAssociationLinkPropertiesFormat{LinkedResourceType: &serviceName},
+				}},
+			},
+		},
+		{
+			description: "subnet delegated to container groups is healthy",
+			subnetProperties: &aznetworkv2.SubnetPropertiesFormat{
+				Delegations: []*aznetworkv2.Delegation{{
+					Properties: &aznetworkv2.ServiceDelegationPropertiesFormat{ServiceName: &serviceName},
+				}},
+			},
+		},
+		{
+			description: "subnet delegated to another service is unhealthy",
+			subnetProperties: &aznetworkv2.SubnetPropertiesFormat{
+				Delegations: []*aznetworkv2.Delegation{{
+					Properties: &aznetworkv2.ServiceDelegationPropertiesFormat{ServiceName: &otherService},
+				}},
+			},
+			expectedError: "subnet 'fakeSubnet' is not delegated to Azure Container Instance",
+		},
+		{
+			description: "subnet referencing a route table is unhealthy",
+			subnetProperties: &aznetworkv2.SubnetPropertiesFormat{
+				RouteTable: &aznetworkv2.RouteTable{ID: &routeTableID},
+			},
+			expectedError: "subnet 'fakeSubnet' references the route table 'fakeRouteTable'",
+		},
+		{
+			description:   "subnet without properties is unhealthy",
+			expectedError: "subnet 'fakeSubnet' has no properties",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.description, func(t *testing.T) {
+			err := checkSubnetDelegation(subnetName, aznetworkv2.Subnet{Name: &subnetName, Properties: tc.subnetProperties})
+			if tc.expectedError == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.expectedError)
+			}
+		})
+	}
+}
+
 func TestValidateNetworkConfig(t *testing.T) {
 	azConfig := auth.Config{}
 
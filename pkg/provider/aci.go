@@ -6,18 +6,19 @@ package provider
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"io"
 	"os"
 	"path"
 	"reflect"
 	"strings"
+	"sync"
 	"time"
 
 	azaciv2 "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerinstance/armcontainerinstance/v2"
-	"github.com/gorilla/websocket"
 	"github.com/pkg/errors"
 	"github.com/virtual-kubelet/azure-aci/pkg/analytics"
 	"github.com/virtual-kubelet/azure-aci/pkg/auth"
@@ -34,7 +35,8 @@ import (
 	"github.com/virtual-kubelet/virtual-kubelet/trace"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	corev1listers "k8s.io/client-go/listers/core/v1"
 
@@ -43,7 +45,6 @@ import (
 	"k8s.io/client-go/kubernetes/scheme"
 	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/tools/record"
-	"k8s.io/client-go/tools/reference"
 )
 
 const (
@@ -88,22 +89,63 @@ type ACIProvider struct {
 	enabledFeatures          *featureflag.FlagIdentifier
 	providerNetwork          network.ProviderNetwork
 	eventRecorder            record.EventRecorder
+	kubeClient               kubernetes.Interface
+	tokenSource              serviceAccountTokenSource
 
 	resourceGroup      string
 	region             string
 	nodeName           string
+	clusterID          string
 	operatingSystem    string
 	cpu                string
 	memory             string
 	pods               string
 	gpu                string
 	gpuSKUs            []azaciv2.GpuSKU
+	capacityLimits     v1.ResourceList
+	nodeCapacity       *nodeCapacity
+	node               *v1.Node
+	capacityLock       sync.RWMutex
+	nodeHealth         nodeHealth
 	internalIP         string
 	daemonEndpointPort int32
 	diagnostics        *azaciv2.ContainerGroupDiagnostics
 	clusterDomain      string
 	tracker            *PodsTracker
 
+	// checkSubnet checks the ACI subnet is still usable, it is nil without subnet.
+	checkSubnet func(ctx context.Context) error
+
+	// previousNodeNames are the names the node had before, the container groups of the pods of the
+	// node tagged with them are adopted on startup.
+	previousNodeNames []string
+	reconcileDryRun   bool
+	// migratedPods are the UIDs of the pods bound to a previous node name whose container group
+	// was adopted.
+	migratedPods sync.Map
+
+	createOperations     *containerGroupOperations
+	deleteOperations     *containerGroupOperations
+	backgroundOperations *containerGroupOperations
+	pendingPods          *pendingPods
+	pendingPodsMaxWait   time.Duration
+	pendingDeletions     sync.Map
+	// specDrifts are the hashes of the drifted container groups already handled, by pod UID.
+	specDrifts            sync.Map
+	execExitCodeDetection bool
+	execTerminalResize    bool
+	logArchiver           *containerLogsArchiver
+
+	serviceAccountTokens             serviceAccountTokens
+	serviceAccountTokenRefreshPolicy ServiceAccountTokenRefreshPolicy
+
+	podUpdatePolicy PodUpdatePolicy
+	// podUpdates are the updates already applied to the container groups, by pod UID.
+	podUpdates sync.Map
+	// configUpdates are the changes of the secrets and config maps already applied to the
+	// container groups, by pod UID.
+	configUpdates sync.Map
+
 	*metrics.ACIPodMetricsProvider
 }
 
@@ -218,6 +260,49 @@ func NewACIProvider(ctx context.Context, config string, azConfig auth.Config, az
 	p.nodeName = nodeName
 	p.internalIP = internalIP
 	p.daemonEndpointPort = daemonEndpointPort
+	p.kubeClient = kubeClient
+	if kubeClient != nil {
+		p.tokenSource = &kubeServiceAccountTokenSource{kubeClient: kubeClient}
+	}
+	p.execExitCodeDetection = os.Getenv("ACI_EXEC_EXIT_CODE_DETECTION") != "false"
+	p.execTerminalResize = os.Getenv("ACI_EXEC_TERMINAL_RESIZE") != "false"
+	p.pendingPods = newPendingPods()
+
+	p.pendingPodsMaxWait, err = getPendingPodsMaxWait()
+	if err != nil {
+		return nil, err
+	}
+
+	p.serviceAccountTokenRefreshPolicy, err = getServiceAccountTokenRefreshPolicy()
+	if err != nil {
+		return nil, err
+	}
+
+	p.podUpdatePolicy, err = getPodUpdatePolicy()
+	if err != nil {
+		return nil, err
+	}
+
+	p.clusterID, err = getClusterID(ctx, kubeClient)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.setReconcileConfig(); err != nil {
+		return nil, err
+	}
+
+	logArchiveSink, err := newLogArchiveSink(ctx, azConfig)
+	if err != nil {
+		return nil, err
+	}
+	if logArchiveSink != nil {
+		retention, err := getLogArchiveRetention()
+		if err != nil {
+			return nil, err
+		}
+		p.logArchiver = newContainerLogsArchiver(logArchiveSink, retention)
+	}
 
 	if azConfig.AKSCredential != nil {
 		p.resourceGroup = azConfig.AKSCredential.ResourceGroup
@@ -291,6 +376,10 @@ func NewACIProvider(ctx context.Context, config string, azConfig auth.Config, az
 	}
 
 	if p.providerNetwork.SubnetName != "" {
+		p.checkSubnet = func(ctx context.Context) error {
+			return p.providerNetwork.CheckSubnet(ctx, &azConfig)
+		}
+
 		// windows containers don't support kube-proxy nor realtime metrics
 		if p.operatingSystem != string(azaciv2.OperatingSystemTypesWindows) {
 			err = p.setACIExtensions(ctx)
@@ -301,6 +390,10 @@ func NewACIProvider(ctx context.Context, config string, azConfig auth.Config, az
 	}
 
 	p.ACIPodMetricsProvider = metrics.NewACIPodMetricsProvider(p.nodeName, p.resourceGroup, p.podsL, p.azClientsAPIs)
+	// The workers are started once the provider is configured, they run until ctx is done.
+	p.createOperations = newContainerGroupOperations(ctx, createOperationWorkers)
+	p.deleteOperations = newContainerGroupOperations(ctx, deleteOperationWorkers)
+	p.backgroundOperations = newContainerGroupOperations(ctx, backgroundOperationWorkers)
 	return &p, err
 }
 
@@ -314,11 +407,69 @@ func addAzureAttributes(ctx context.Context, span trace.Span, p *ACIProvider) co
 // CreatePod accepts a Pod definition and creates
 // an ACI deployment
 func (p *ACIProvider) CreatePod(ctx context.Context, pod *v1.Pod) error {
-	var err error
 	ctx, span := trace.StartSpan(ctx, "aci.CreatePod")
 	defer span.End()
 	ctx = addAzureAttributes(ctx, span, p)
 
+	cg, err := p.getContainerGroup(ctx, pod)
+	if err != nil {
+		return err
+	}
+
+	log.G(ctx).Debugf("start creating pod %v", pod.Name)
+	poller, err := p.azClientsAPIs.CreateContainerGroup(ctx, p.resourceGroup, pod.Namespace, pod.Name, cg)
+	if err != nil {
+		// virtual-kubelet retries the pods returning an error, the pods ACI rejected are reported
+		// as failed instead.
+		if isPendingCreateFailure(err) && p.tracker != nil {
+			p.keepPodPending(ctx, pod, err)
+			return nil
+		}
+		if _, _, retryable := getCreateFailureReason(err); !retryable && p.tracker != nil {
+			p.pendingPods.remove(pod.UID)
+			log.G(ctx).WithError(err).Errorf("container group of pod %s was rejected", pod.Name)
+			p.updatePodStatusWithCreateFailure(ctx, pod, err)
+			return nil
+		}
+		return err
+	}
+
+	// ARM accepted the container group, the provisioning outcome is reported through the tracker.
+	podCopy := pod.DeepCopy()
+	return p.createOperations.submit(ctx, func(ctx context.Context) {
+		p.trackCreateContainerGroup(ctx, podCopy, poller)
+	})
+}
+
+// setACIExtensions
+func (p *ACIProvider) setACIExtensions(ctx context.Context) error {
+	masterURI := os.Getenv("MASTER_URI")
+	if masterURI == "" {
+		masterURI = "10.0.0.1"
+	}
+	clusterCIDR := os.Getenv("CLUSTER_CIDR")
+	if clusterCIDR == "" {
+		clusterCIDR = "10.240.0.0/16"
+	}
+
+	kubeExtensions, err := client.GetKubeProxyExtension(serviceAccountSecretMountPath, masterURI, clusterCIDR)
+	if err != nil {
+		return fmt.Errorf("error creating kube proxy extension: %v", err)
+	}
+
+	p.containerGroupExtensions = append(p.containerGroupExtensions, kubeExtensions)
+
+	enableRealTimeMetricsExtension := os.Getenv("ENABLE_REAL_TIME_METRICS")
+	if enableRealTimeMetricsExtension == "true" {
+		realtimeExtension := client.GetRealtimeMetricsExtension()
+		p.containerGroupExtensions = append(p.containerGroupExtensions, realtimeExtension)
+	}
+	return nil
+}
+
+// getContainerGroup converts the pod to the container group CreatePod deploys. The conversion
+// only reads the secrets and config maps of the pod, it doesn't call ARM.
+func (p *ACIProvider) getContainerGroup(ctx context.Context, pod *v1.Pod) (*azaciv2.ContainerGroup, error) {
 	cg := &azaciv2.ContainerGroup{
 		Properties: &azaciv2.ContainerGroupPropertiesProperties{},
 	}
@@ -330,32 +481,42 @@ func (p *ACIProvider) CreatePod(ctx context.Context, pod *v1.Pod) error {
 	cg.Properties.RestartPolicy = &policy
 	cg.Properties.OSType = &os
 
+	// the conversion errors are all collected, so they can be fixed at once
+	var errs []error
+
 	// get containers
-	containers, err := p.getContainers(pod)
+	containers, err := p.getContainers(ctx, pod)
 	if err != nil {
-		return err
+		errs = append(errs, err)
 	}
 	// get registry creds
 	creds, err := p.getImagePullSecrets(pod)
 	if err != nil {
-		return err
+		errs = append(errs, err)
 	}
 	// get volumes
 	volumes, err := p.getVolumes(ctx, pod)
 	if err != nil {
-		return err
-
+		errs = append(errs, err)
 	}
 
 	if p.enabledFeatures.IsEnabled(ctx, featureflag.InitContainerFeature) {
 		// get initContainers
 		initContainers, err := p.getInitContainers(ctx, pod)
 		if err != nil {
-			return err
+			errs = append(errs, err)
 		}
 		cg.Properties.InitContainers = initContainers
 	}
 
+	switch len(errs) {
+	case 0:
+	case 1:
+		return nil, errs[0]
+	default:
+		return nil, utilerrors.NewAggregate(errs)
+	}
+
 	// confidential compute proeprties
 	if p.enabledFeatures.IsEnabled(ctx, featureflag.ConfidentialComputeFeature) {
 		// set confidentialComputeProperties
@@ -405,6 +566,10 @@ func (p *ACIProvider) CreatePod(ctx context.Context, pod *v1.Pod) error {
 		"UID":               &podUID,
 		"CreationTimestamp": &podCreationTimestamp,
 	}
+	if p.clusterID != "" {
+		clusterID := p.clusterID
+		cg.Tags[clusterIDTag] = &clusterID
+	}
 
 	p.providerNetwork.AmendVnetResources(ctx, *cg, pod, p.clusterDomain)
 
@@ -414,35 +579,12 @@ func (p *ACIProvider) CreatePod(ctx context.Context, pod *v1.Pod) error {
 		cg.Properties.Extensions = p.containerGroupExtensions
 	}
 
-	log.G(ctx).Debugf("start creating pod %v", pod.Name)
-	// TODO: Run in a go routine to not block workers, and use tracker.UpdatePodStatus() based on result.
-	return p.azClientsAPIs.CreateContainerGroup(ctx, p.resourceGroup, pod.Namespace, pod.Name, cg)
-}
-
-// setACIExtensions
-func (p *ACIProvider) setACIExtensions(ctx context.Context) error {
-	masterURI := os.Getenv("MASTER_URI")
-	if masterURI == "" {
-		masterURI = "10.0.0.1"
-	}
-	clusterCIDR := os.Getenv("CLUSTER_CIDR")
-	if clusterCIDR == "" {
-		clusterCIDR = "10.240.0.0/16"
-	}
-
-	kubeExtensions, err := client.GetKubeProxyExtension(serviceAccountSecretMountPath, masterURI, clusterCIDR)
-	if err != nil {
-		return fmt.Errorf("error creating kube proxy extension: %v", err)
-	}
+	p.setPodUpdateTags(ctx, pod, cg)
 
-	p.containerGroupExtensions = append(p.containerGroupExtensions, kubeExtensions)
+	specHash := containerGroupSpecHash(cg)
+	cg.Tags[specHashTag] = &specHash
 
-	enableRealTimeMetricsExtension := os.Getenv("ENABLE_REAL_TIME_METRICS")
-	if enableRealTimeMetricsExtension == "true" {
-		realtimeExtension := client.GetRealtimeMetricsExtension()
-		p.containerGroupExtensions = append(p.containerGroupExtensions, realtimeExtension)
-	}
-	return nil
+	return cg, nil
 }
 
 func (p *ACIProvider) getDiagnostics(pod *v1.Pod) *azaciv2.ContainerGroupDiagnostics {
@@ -457,15 +599,6 @@ func (p *ACIProvider) getDiagnostics(pod *v1.Pod) *azaciv2.ContainerGroupDiagnos
 	return p.diagnostics
 }
 
-func containerGroupName(podNS, podName string) string {
-	return fmt.Sprintf("%s-%s", podNS, podName)
-}
-
-// UpdatePod is a noop, ACI currently does not support live updates of a pod.
-func (p *ACIProvider) UpdatePod(ctx context.Context, pod *v1.Pod) error {
-	return nil
-}
-
 // DeletePod deletes the specified pod out of ACI.
 func (p *ACIProvider) DeletePod(ctx context.Context, pod *v1.Pod) error {
 	ctx, span := trace.StartSpan(ctx, "aci.DeletePod")
@@ -473,25 +606,78 @@ func (p *ACIProvider) DeletePod(ctx context.Context, pod *v1.Pod) error {
 	ctx = addAzureAttributes(ctx, span, p)
 
 	log.G(ctx).Debugf("start deleting pod %v", pod.Name)
-	// TODO: Run in a go routine to not block workers.
-	return p.deleteContainerGroup(ctx, pod.Namespace, pod.Name)
+	p.serviceAccountTokens.forget(pod.UID)
+	p.pendingPods.remove(pod.UID)
+	p.specDrifts.Delete(pod.UID)
+	p.podUpdates.Delete(pod.UID)
+	p.configUpdates.Delete(pod.UID)
+
+	cgName := util.ContainerGroupName(pod.Namespace, pod.Name)
+	if _, inProgress := p.pendingDeletions.LoadOrStore(cgName, struct{}{}); inProgress {
+		log.G(ctx).Debugf("deletion of container group %v is already in progress", cgName)
+		return nil
+	}
+
+	// The pod stays Terminating until the container group is actually deleted, the container
+	// statuses are only updated once the delete operation completes.
+	podCopy := pod.DeepCopy()
+	err := p.deleteOperations.submit(ctx, func(ctx context.Context) {
+		defer p.pendingDeletions.Delete(cgName)
+		p.terminatePod(ctx, podCopy)
+	})
+	if err != nil {
+		p.pendingDeletions.Delete(cgName)
+	}
+	return err
+}
+
+// deleteContainerGroup deletes the container group of the pod, when it was created for the pod
+// with the given UID. The container group of a pod recreated with the same name is not deleted.
+func (p *ACIProvider) deleteContainerGroup(ctx context.Context, podNS, podName string, podUID types.UID) error {
+	_, err := p.deletePodContainerGroup(ctx, podNS, podName, podUID)
+	return err
 }
 
-func (p *ACIProvider) deleteContainerGroup(ctx context.Context, podNS, podName string) error {
+// deletePodContainerGroup is deleteContainerGroup, it also returns the name of the container group
+// once it is found, the container groups created before the names were hashed are named after the
+// pod.
+func (p *ACIProvider) deletePodContainerGroup(ctx context.Context, podNS, podName string, podUID types.UID) (string, error) {
 	ctx, span := trace.StartSpan(ctx, "aci.deleteContainerGroup")
 	defer span.End()
 	ctx = addAzureAttributes(ctx, span, p)
 
-	cgName := containerGroupName(podNS, podName)
+	cg, err := p.getContainerGroupInfo(ctx, podNS, podName, "")
+	if err != nil {
+		return "", err
+	}
+	if err := checkContainerGroupOwner(cg, podUID); err != nil {
+		log.G(ctx).WithError(err).Infof("not deleting the container group of pod %s/%s", podNS, podName)
+		return "", err
+	}
+	cgName := *cg.Name
+
+	// ACI discards the logs with the container group.
+	p.archiveContainerGroupLogs(ctx, podNS, podName, cg)
 
-	err := p.azClientsAPIs.DeleteContainerGroup(ctx, p.resourceGroup, cgName)
+	poller, err := p.azClientsAPIs.DeleteContainerGroup(ctx, p.resourceGroup, cgName)
 	if err != nil {
 		log.G(ctx).WithError(err).Errorf("failed to delete container group %v", cgName)
-		return err
+		return cgName, err
+	}
+
+	if _, err := poller.PollUntilDone(ctx); err != nil {
+		log.G(ctx).WithError(err).Errorf("failed to complete the deletion of container group %v", cgName)
+		return cgName, err
+	}
+
+	if p.logArchiver != nil {
+		p.logArchiver.forget(podNS, podName)
 	}
+	// The deletion frees ACI quota, the pending pods are retried now.
+	p.pendingPods.wake(time.Now())
 
 	if p.tracker != nil {
-		// Delete is not a sync API on ACI yet, but will assume with current implementation that termination is completed. Also, till gracePeriod is supported.
+		// The container group is gone, report the containers as terminated.
 		updateErr := p.tracker.UpdatePodStatus(ctx,
 			podNS,
 			podName,
@@ -521,7 +707,7 @@ func (p *ACIProvider) deleteContainerGroup(ctx context.Context, podNS, podName s
 		}
 	}
 
-	return nil
+	return cgName, nil
 }
 
 // GetPod returns a pod by name that is running inside ACI
@@ -531,7 +717,7 @@ func (p *ACIProvider) GetPod(ctx context.Context, namespace, name string) (*v1.P
 	defer span.End()
 	ctx = addAzureAttributes(ctx, span, p)
 
-	cg, err := p.azClientsAPIs.GetContainerGroupInfo(ctx, p.resourceGroup, namespace, name, p.nodeName)
+	cg, err := p.getContainerGroupInfo(ctx, namespace, name, p.nodeName)
 	if err != nil {
 		return nil, err
 	}
@@ -544,157 +730,63 @@ func (p *ACIProvider) GetPod(ctx context.Context, namespace, name string) (*v1.P
 	return p.containerGroupToPod(ctx, cg)
 }
 
-// GetContainerLogs returns the logs of a pod by name that is running inside ACI.
-func (p *ACIProvider) GetContainerLogs(ctx context.Context, namespace, podName, containerName string, opts api.ContainerLogOpts) (io.ReadCloser, error) {
-	ctx, span := trace.StartSpan(ctx, "aci.GetContainerLogs")
-	defer span.End()
-	ctx = addAzureAttributes(ctx, span, p)
-
-	cg, err := p.azClientsAPIs.GetContainerGroupInfo(ctx, p.resourceGroup, namespace, podName, p.nodeName)
-	if err != nil {
-		return nil, err
-	}
-
-	// get logs from cg
-	logContent, err := p.azClientsAPIs.ListLogs(ctx, p.resourceGroup, *cg.Name, containerName, opts)
-	if err != nil {
-		return nil, err
-	}
-	if logContent != nil {
-		logStr := *logContent
-		return io.NopCloser(strings.NewReader(logStr)), nil
-	}
-	return nil, nil
-}
-
 // GetPodFullName as defined in the provider context
 func (p *ACIProvider) GetPodFullName(namespace string, pod string) string {
 	return fmt.Sprintf("%s-%s", namespace, pod)
 }
 
-// RunInContainer executes a command in a container in the pod, copying data
-// between in/out/err and the container's stdin/stdout/stderr.
-func (p *ACIProvider) RunInContainer(ctx context.Context, namespace, name, container string, cmd []string, attach api.AttachIO) error {
-	logger := log.G(ctx).WithField("method", "RunInContainer")
-	ctx, span := trace.StartSpan(ctx, "aci.RunInContainer")
+// AttachToContainer attaches to the output of a running container, and to its input when the
+// container was started with stdin enabled.
+func (p *ACIProvider) AttachToContainer(ctx context.Context, namespace, podName, containerName string, attach api.AttachIO) error {
+	ctx, span := trace.StartSpan(ctx, "aci.AttachToContainer")
 	defer span.End()
 	ctx = addAzureAttributes(ctx, span, p)
 
-	out := attach.Stdout()
+	out := containerOutput(attach)
 	if out != nil {
 		defer out.Close()
 	}
 
-	cg, err := p.azClientsAPIs.GetContainerGroupInfo(ctx, p.resourceGroup, namespace, name, p.nodeName)
+	pod, err := p.podsL.Pods(namespace).Get(podName)
 	if err != nil {
 		return err
 	}
-
-	termSize := api.TermSize{
-		Width:  60,
-		Height: 120,
-	}
-	if attach.TTY() {
-		resize := attach.Resize()
-		select {
-		case termSize = <-resize:
-			break
-		case <-time.After(5 * time.Second):
+	var podContainer *v1.Container
+	for i := range pod.Spec.Containers {
+		if pod.Spec.Containers[i].Name == containerName {
+			podContainer = &pod.Spec.Containers[i]
 			break
 		}
 	}
-	// Set default terminal size
-	cols := int32(termSize.Width)
-	rows := int32(termSize.Height)
-	cmdParam := strings.Join(cmd, " ")
-	req := azaciv2.ContainerExecRequest{
-		Command: &cmdParam,
-		TerminalSize: &azaciv2.ContainerExecRequestTerminalSize{
-			Cols: &cols,
-			Rows: &rows,
-		},
+	if podContainer == nil {
+		return errdefs.NotFoundf("container %s not found in pod %s", containerName, podName)
 	}
 
-	xcrsp, err := p.azClientsAPIs.ExecuteContainerCommand(ctx, p.resourceGroup, *cg.Name, container, req)
+	cg, err := p.getContainerGroupInfo(ctx, namespace, podName, p.nodeName)
 	if err != nil {
 		return err
 	}
 
-	wsURI := *xcrsp.WebSocketURI
-	password := *xcrsp.Password
-
-	c, _, err := websocket.DefaultDialer.Dial(wsURI, nil)
+	attachResp, err := p.azClientsAPIs.Attach(ctx, p.resourceGroup, *cg.Name, containerName)
 	if err != nil {
 		return err
 	}
-	if err := c.WriteMessage(websocket.TextMessage, []byte(password)); err != nil { // Websocket password needs to be sent before WS terminal is active
-		return err
-	}
 
-	// Cleanup on exit
-	defer c.Close()
-
-	in := attach.Stdin()
-	if in != nil {
-		go func() {
-			for {
-				select {
-				case <-ctx.Done():
-					return
-				default:
-				}
-
-				var msg = make([]byte, 512)
-				n, err := in.Read(msg)
-				if err != nil {
-					// Handle errors
-					return
-				}
-				if n > 0 { // Only call WriteMessage if there is data to send
-					if err = c.WriteMessage(websocket.BinaryMessage, msg[:n]); err != nil {
-						logger.Errorf("an error has occurred while trying to write message")
-						return
-					}
-				}
-			}
-		}()
-	}
+	c, err := dialContainerStream(ctx, *attachResp.WebSocketURI, *attachResp.Password, passwordAsAuthorizationHeader)
 	if err != nil {
 		return err
 	}
 
-	if out != nil {
-		for {
-			select {
-			case <-ctx.Done():
-				break
-			default:
-			}
-
-			_, cr, err := c.NextReader()
-			if err != nil {
-				// Handle errors
-				break
-			}
-			if _, err := io.Copy(out, cr); err != nil {
-				logger.Errorf("an error has occurred while trying to copy message")
-				break
-			}
-		}
+	stdin := attach.Stdin()
+	if !podContainer.Stdin {
+		stdin = nil
 	}
-	if err != nil {
+	if err := streamContainer(ctx, c, stdin, out); err != nil {
 		return err
 	}
-
 	return ctx.Err()
 }
 
-// AttachToContainer Implementation placeholder
-// TODO: complete the implementation for Attach functionality
-func (p *ACIProvider) AttachToContainer(ctx context.Context, namespace string, podName string, containerName string, attach api.AttachIO) error {
-	return nil
-}
-
 // GetPodStatus returns the status of a pod by name that is running inside ACI
 // returns nil if a pod by that name is not found.
 func (p *ACIProvider) GetPodStatus(ctx context.Context, namespace, name string) (*v1.PodStatus, error) {
@@ -702,16 +794,22 @@ func (p *ACIProvider) GetPodStatus(ctx context.Context, namespace, name string)
 	defer span.End()
 	ctx = addAzureAttributes(ctx, span, p)
 
-	cg, err := p.azClientsAPIs.GetContainerGroupInfo(ctx, p.resourceGroup, namespace, name, p.nodeName)
+	cg, err := p.getContainerGroupInfo(ctx, namespace, name, p.nodeName)
 	if err != nil {
 		return nil, err
 	}
 
-	err = validation.ValidateContainerGroup(ctx, cg)
+	return p.getContainerGroupPodStatus(ctx, namespace, name, cg)
+}
+
+func (p *ACIProvider) getContainerGroupPodStatus(ctx context.Context, namespace, name string, cg *azaciv2.ContainerGroup) (*v1.PodStatus, error) {
+	err := validation.ValidateContainerGroup(ctx, cg)
 	if err != nil {
 		return nil, err
 	}
 
+	p.observeContainerGroupLogs(ctx, namespace, name, cg)
+
 	return p.getPodStatusFromContainerGroup(ctx, cg)
 }
 
@@ -761,6 +859,14 @@ func (p *ACIProvider) GetPods(ctx context.Context) ([]*v1.Pod, error) {
 			continue
 		}
 
+		if !p.ownsContainerGroup(cg) {
+			log.G(ctx).WithFields(log.Fields{
+				"name": *cgName,
+				"id":   *cg.ID,
+			}).Debugf("container group %s does not belong to cluster %s", *cgName, p.clusterID)
+			continue
+		}
+
 		if cg.Tags != nil && cg.Tags["NodeName"] != nil {
 			if *cg.Tags["NodeName"] != p.nodeName {
 				log.G(ctx).WithFields(log.Fields{
@@ -804,14 +910,22 @@ func (p *ACIProvider) NotifyPods(ctx context.Context, notifierCb func(*v1.Pod))
 
 	// Capture the notifier to be used for communicating updates to VK
 	p.tracker = &PodsTracker{
-		pods:           p.podsL,
-		updateCb:       notifierCb,
-		handler:        p,
-		lastEventCheck: time.UnixMicro(0),
-		eventRecorder:  p.eventRecorder,
+		pods:          p.podsL,
+		updateCb:      notifierCb,
+		handler:       p,
+		eventRecorder: p.eventRecorder,
+	}
+	if p.ACIPodMetricsProvider != nil {
+		p.ACIPodMetricsProvider.SetStatusPollingStatsGetter(p.tracker.PollingStats)
 	}
 
+	go p.runReconcile(ctx)
 	go p.tracker.StartTracking(ctx)
+	go p.runServiceAccountTokenRefresh(ctx)
+	go p.runPendingPodsRetry(ctx)
+	if p.logArchiver != nil && p.logArchiver.retention > 0 {
+		go p.runLogArchivePrune(ctx)
+	}
 }
 
 // ListActivePods interface impl.
@@ -831,72 +945,130 @@ func (p *ACIProvider) ListActivePods(ctx context.Context) ([]PodIdentifier, erro
 			PodIdentifier{
 				namespace: pod.Namespace,
 				name:      pod.Name,
+				uid:       pod.UID,
 			})
 	}
 
 	return podsIdentifiers, nil
 }
 
-// FetchPodStatus interface impl
-func (p *ACIProvider) FetchPodStatus(ctx context.Context, ns, name string) (*v1.PodStatus, error) {
-	ctx, span := trace.StartSpan(ctx, "ACIProvider.FetchPodStatus")
+// ListPodFingerprints interface impl
+func (p *ACIProvider) ListPodFingerprints(ctx context.Context) (map[PodIdentifier]string, error) {
+	ctx, span := trace.StartSpan(ctx, "ACIProvider.ListPodFingerprints")
 	defer span.End()
+	ctx = addAzureAttributes(ctx, span, p)
 
-	return p.GetPodStatus(ctx, ns, name)
-}
+	cgs, err := p.listPodContainerGroups(ctx)
+	if err != nil {
+		return nil, err
+	}
 
-func (p *ACIProvider) FetchPodEvents(ctx context.Context, pod *v1.Pod, evtSink func(timestamp *time.Time, object runtime.Object, eventtype, reason, messageFmt string, args ...interface{})) error {
-	ctx, span := trace.StartSpan(ctx, "ACIProvider.FetchPodEvents")
-	defer span.End()
-	if !p.enabledFeatures.IsEnabled(ctx, featureflag.Events) {
-		return nil
+	fingerprints := make(map[PodIdentifier]string, len(cgs))
+	for id, cg := range cgs {
+		// The list entries do not have the instance view, their content changes with the state of
+		// the container group.
+		content, err := json.Marshal(cg)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(content)
+		fingerprints[id] = hex.EncodeToString(sum[:])
 	}
+	return fingerprints, nil
+}
 
+// CheckPodSpecs interface impl
+func (p *ACIProvider) CheckPodSpecs(ctx context.Context, pods []*v1.Pod) {
+	ctx, span := trace.StartSpan(ctx, "ACIProvider.CheckPodSpecs")
+	defer span.End()
 	ctx = addAzureAttributes(ctx, span, p)
-	cgName := containerGroupName(pod.Namespace, pod.Name)
-	cg, err := p.azClientsAPIs.GetContainerGroup(ctx, p.resourceGroup, cgName)
+
+	cgs, err := p.listPodContainerGroups(ctx)
 	if err != nil {
-		return err
-	}
-	if *cg.Tags["NodeName"] != p.nodeName {
-		return errors.Wrapf(err, "container group %s found with mismatching node", cgName)
+		log.G(ctx).WithError(err).Warn("failed to list the container groups, skipping the spec checks")
+		return
 	}
 
-	if cg.Properties != nil && cg.Properties.InstanceView != nil && cg.Properties.InstanceView.Events != nil {
-		for _, evt := range cg.Properties.InstanceView.Events {
-			evtSink(evt.LastTimestamp, pod, *evt.Type, *evt.Name, *evt.Message)
+	for _, pod := range pods {
+		cg, ok := cgs[PodIdentifier{namespace: pod.Namespace, name: pod.Name}]
+		if !ok || checkContainerGroupOwner(cg, pod.UID) != nil {
+			continue
 		}
+		p.checkSpecDrift(ctx, pod, cg)
+		p.checkConfigUpdate(ctx, pod, cg)
 	}
+}
 
-	if cg.Properties != nil && cg.Properties.Containers != nil {
-		for _, container := range cg.Properties.Containers {
-			if container.Properties != nil && container.Properties.InstanceView != nil && container.Properties.InstanceView.Events != nil {
-				for _, evt := range container.Properties.InstanceView.Events {
-					podReference, err := reference.GetReference(scheme.Scheme, pod)
-					if err != nil {
-						log.G(ctx).WithError(err).Warnf("cannot get k8s object reference from pod %s in namespace %s", pod.Name, pod.Namespace)
-					}
-					podReference.FieldPath = fmt.Sprintf("spec.containers{%s}", *container.Name)
-					evtSink(evt.LastTimestamp, podReference, *evt.Type, *evt.Name, *evt.Message)
-				}
-			}
+// listPodContainerGroups returns the container groups of the pods of the node, using a single
+// call to ACI. The list entries do not have the instance view of the container groups.
+func (p *ACIProvider) listPodContainerGroups(ctx context.Context) (map[PodIdentifier]*azaciv2.ContainerGroup, error) {
+	cgs, err := p.azClientsAPIs.GetContainerGroupListResult(ctx, p.resourceGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[PodIdentifier]*azaciv2.ContainerGroup, len(cgs))
+	for _, cg := range cgs {
+		if cg == nil || cg.Tags == nil || cg.Tags["NodeName"] == nil || *cg.Tags["NodeName"] != p.nodeName ||
+			cg.Tags["Namespace"] == nil || cg.Tags["PodName"] == nil || !p.ownsContainerGroup(cg) {
+			continue
 		}
+		result[PodIdentifier{namespace: *cg.Tags["Namespace"], name: *cg.Tags["PodName"]}] = cg
 	}
-	return nil
+	return result, nil
+}
+
+// FetchPodStatus interface impl
+func (p *ACIProvider) FetchPodStatus(ctx context.Context, pod *v1.Pod, evtSink func(evt *PodEvent)) (*v1.PodStatus, error) {
+	ctx, span := trace.StartSpan(ctx, "ACIProvider.FetchPodStatus")
+	defer span.End()
+	ctx = addAzureAttributes(ctx, span, p)
+
+	cg, err := p.getContainerGroupInfo(ctx, pod.Namespace, pod.Name, p.nodeName)
+	if err != nil {
+		return nil, err
+	}
+	// The status of a pod recreated with the same name is not the one of the previous pod.
+	if err := checkContainerGroupOwner(cg, pod.UID); err != nil {
+		return nil, err
+	}
+
+	if p.enabledFeatures.IsEnabled(ctx, featureflag.Events) {
+		sendContainerGroupEvents(ctx, pod, cg, evtSink)
+	}
+	return p.getContainerGroupPodStatus(ctx, pod.Namespace, pod.Name, cg)
+}
+
+// IsThrottled interface impl
+func (p *ACIProvider) IsThrottled(ctx context.Context) bool {
+	return p.azClientsAPIs.ThrottlingState().Reads.Throttled
 }
 
 // CleanupPod interface impl
-func (p *ACIProvider) CleanupPod(ctx context.Context, ns, name string) error {
+func (p *ACIProvider) CleanupPod(ctx context.Context, ns, name string, uid types.UID) error {
 	ctx, span := trace.StartSpan(ctx, "ACIProvider.CleanupPod")
 	defer span.End()
 
-	return p.deleteContainerGroup(ctx, ns, name)
+	alive, err := p.isMigratedPodAlive(ctx, ns, name, uid)
+	if err != nil {
+		return err
+	}
+	if alive {
+		log.G(ctx).Infof("not cleaning up the container group of pod %s/%s bound to a previous node name", ns, name)
+		return nil
+	}
+	return p.deleteContainerGroup(ctx, ns, name, uid)
 }
 
-// PortForward
-func (p *ACIProvider) PortForward(ctx context.Context, namespace, pod string, port int32, stream io.ReadWriteCloser) error {
-	log.G(ctx).Info("Port Forward is not supported in AZure ACI")
-	return nil
+// checkContainerGroupOwner returns a not found error when the container group was created for
+// another pod with the same namespace and name. It is not checked for the pods without UID, nor
+// for the container groups without UID tag.
+func checkContainerGroupOwner(cg *azaciv2.ContainerGroup, podUID types.UID) error {
+	uid := util.GetContainerGroupPodUID(cg)
+	if podUID == "" || uid == "" || uid == string(podUID) {
+		return nil
+	}
+	return errdefs.NotFoundf("container group %s belongs to pod %s, not to pod %s", *cg.Name, uid, podUID)
 }
 
 func (p *ACIProvider) getImagePullSecrets(pod *v1.Pod) ([]*azaciv2.ImageRegistryCredential, error) {
@@ -1041,14 +1213,6 @@ func readDockerConfigJSONSecret(secret *v1.Secret, ips []*azaciv2.ImageRegistryC
 	return ips, err
 }
 
-// verify if Container is properly declared for the use on ACI
-func (p *ACIProvider) verifyContainer(container *v1.Container) error {
-	if len(container.Command) == 0 && len(container.Args) > 0 {
-		return errdefs.InvalidInput("ACI does not support providing args without specifying the command. Please supply both command and args to the pod spec.")
-	}
-	return nil
-}
-
 // this method is used for both initConainers and containers
 func (p *ACIProvider) getCommand(container v1.Container) []*string {
 	command := make([]*string, 0)
@@ -1077,55 +1241,18 @@ func (p *ACIProvider) getVolumeMounts(container v1.Container) []*azaciv2.VolumeM
 	return volumeMounts
 }
 
-// get EnvironmentVariables declared on Container as []aci.EnvironmentVariable
-func (p *ACIProvider) getEnvironmentVariables(container v1.Container) []*azaciv2.EnvironmentVariable {
-	environmentVariable := make([]*azaciv2.EnvironmentVariable, 0, len(container.Env))
-	for i := range container.Env {
-		if container.Env[i].Value != "" {
-			envVar := getACIEnvVar(container.Env[i])
-			environmentVariable = append(environmentVariable, envVar)
-		}
-	}
-	return environmentVariable
-}
-
 // get InitContainers defined in Pod as []aci.InitContainerDefinition
 func (p *ACIProvider) getInitContainers(ctx context.Context, pod *v1.Pod) ([]*azaciv2.InitContainerDefinition, error) {
 	initContainers := make([]*azaciv2.InitContainerDefinition, 0, len(pod.Spec.InitContainers))
 	for i, initContainer := range pod.Spec.InitContainers {
-		err := p.verifyContainer(&initContainer)
-		if err != nil {
-			log.G(ctx).Errorf("couldn't verify container %v", err)
-			return nil, err
+		if problems := getInitContainerProblems(initContainer); len(problems) > 0 {
+			log.G(ctx).Errorf("couldn't verify init container %s: %v", initContainer.Name, problems[0])
+			return nil, problems[0]
 		}
 
-		if initContainer.Ports != nil {
-			log.G(ctx).Errorf("azure container instances initcontainers do not support ports")
-			return nil, errdefs.InvalidInput("azure container instances initContainers do not support ports")
-		}
-		if initContainer.Resources.Requests != nil {
-			log.G(ctx).Errorf("azure container instances initcontainers do not support resources requests")
-			return nil, errdefs.InvalidInput("azure container instances initContainers do not support resources requests")
-		}
-		if initContainer.Resources.Limits != nil {
-			log.G(ctx).Errorf("azure container instances initcontainers do not support resources limits")
-			return nil, errdefs.InvalidInput("azure container instances initContainers do not support resources limits")
-		}
-		if initContainer.LivenessProbe != nil {
-			log.G(ctx).Errorf("azure container instances initcontainers do not support livenessProbe")
-			return nil, errdefs.InvalidInput("azure container instances initContainers do not support livenessProbe")
-		}
-		if initContainer.ReadinessProbe != nil {
-			log.G(ctx).Errorf("azure container instances initcontainers do not support readinessProbe")
-			return nil, errdefs.InvalidInput("azure container instances initContainers do not support readinessProbe")
-		}
-		if hasLifecycleHook(initContainer) {
-			log.G(ctx).Errorf("azure container instances initcontainers do not support lifecycle hooks")
-			return nil, errdefs.InvalidInput("azure container instances initContainers do not support lifecycle hooks")
-		}
-		if initContainer.StartupProbe != nil {
-			log.G(ctx).Errorf("azure container instances initcontainers do not support startupProbe")
-			return nil, errdefs.InvalidInput("azure container instances initContainers do not support startupProbe")
+		envVars, err := p.getEnvironmentVariables(ctx, pod, pod.Spec.InitContainers[i])
+		if err != nil {
+			return nil, err
 		}
 
 		newInitContainer := azaciv2.InitContainerDefinition{
@@ -1134,7 +1261,7 @@ func (p *ACIProvider) getInitContainers(ctx context.Context, pod *v1.Pod) ([]*az
 				Image:                &pod.Spec.InitContainers[i].Image,
 				Command:              p.getCommand(pod.Spec.InitContainers[i]),
 				VolumeMounts:         p.getVolumeMounts(pod.Spec.InitContainers[i]),
-				EnvironmentVariables: p.getEnvironmentVariables(pod.Spec.InitContainers[i]),
+				EnvironmentVariables: envVars,
 			},
 		}
 
@@ -1143,20 +1270,14 @@ func (p *ACIProvider) getInitContainers(ctx context.Context, pod *v1.Pod) ([]*az
 	return initContainers, nil
 }
 
-func (p *ACIProvider) getContainers(pod *v1.Pod) ([]*azaciv2.Container, error) {
+func (p *ACIProvider) getContainers(ctx context.Context, pod *v1.Pod) ([]*azaciv2.Container, error) {
 	containers := make([]*azaciv2.Container, 0, len(pod.Spec.Containers))
 
 	podContainers := pod.Spec.Containers
 	for c := range podContainers {
 
-		if len(podContainers[c].Command) == 0 && len(podContainers[c].Args) > 0 {
-			return nil, errdefs.InvalidInput("ACI does not support providing args without specifying the command. Please supply both command and args to the pod spec.")
-		}
-		if hasLifecycleHook(podContainers[c]) {
-			return nil, errdefs.InvalidInput("ACI does not support lifecycle hooks")
-		}
-		if podContainers[c].StartupProbe != nil {
-			return nil, errdefs.InvalidInput("ACI does not support startupProbe")
+		if problems := getContainerProblems(podContainers[c]); len(problems) > 0 {
+			return nil, problems[0]
 		}
 		cmd := p.getCommand(podContainers[c])
 		ports := make([]*azaciv2.ContainerPort, 0, len(podContainers[c].Ports))
@@ -1186,15 +1307,11 @@ func (p *ACIProvider) getContainers(pod *v1.Pod) ([]*azaciv2.Container, error) {
 			})
 		}
 
-		initEnv := make([]*azaciv2.EnvironmentVariable, 0, len(podContainers[c].Env))
-		aciContainer.Properties.EnvironmentVariables = initEnv
-		for _, e := range podContainers[c].Env {
-			if e.Value != "" {
-				envVar := getACIEnvVar(e)
-				envList := append(aciContainer.Properties.EnvironmentVariables, envVar)
-				aciContainer.Properties.EnvironmentVariables = envList
-			}
+		envVars, err := p.getEnvironmentVariables(ctx, pod, podContainers[c])
+		if err != nil {
+			return nil, err
 		}
+		aciContainer.Properties.EnvironmentVariables = envVars
 
 		// NOTE(robbiezhang): ACI CPU request must be times of 10m
 		cpuRequest := 1.00
@@ -1304,21 +1421,22 @@ func (p *ACIProvider) setConfidentialComputeProperties(ctx context.Context, pod
 }
 
 func (p *ACIProvider) getGPUSKU(pod *v1.Pod) (azaciv2.GpuSKU, error) {
-	if len(p.gpuSKUs) == 0 {
+	gpuSKUs := p.getGPUSKUs()
+	if len(gpuSKUs) == 0 {
 		return "", fmt.Errorf("the pod requires GPU resource, but ACI doesn't provide GPU enabled container group in region %s", p.region)
 	}
 
 	if desiredSKU, ok := pod.Annotations[gpuTypeAnnotation]; ok {
-		for _, supportedSKU := range p.gpuSKUs {
+		for _, supportedSKU := range gpuSKUs {
 			if strings.EqualFold(desiredSKU, string(supportedSKU)) {
 				return supportedSKU, nil
 			}
 		}
 
-		return "", fmt.Errorf("the pod requires GPU SKU %s, but ACI only supports SKUs %v in region %s", desiredSKU, p.gpuSKUs, p.region)
+		return "", fmt.Errorf("the pod requires GPU SKU %s, but ACI only supports SKUs %v in region %s", desiredSKU, gpuSKUs, p.region)
 	}
 
-	return p.gpuSKUs[0], nil
+	return gpuSKUs[0], nil
 }
 
 func getProbe(probe *v1.Probe, ports []v1.ContainerPort) (*azaciv2.ContainerProbe, error) {
@@ -1438,8 +1556,9 @@ func getACIEnvVar(e v1.EnvVar) *azaciv2.EnvironmentVariable {
 }
 
 func hasLifecycleHook(c v1.Container) bool {
-	hasHandler := func(l *v1.LifecycleHandler) bool {
-		return l != nil && (l.HTTPGet != nil || l.Exec != nil || l.TCPSocket != nil)
-	}
-	return c.Lifecycle != nil && (hasHandler(c.Lifecycle.PreStop) || hasHandler(c.Lifecycle.PostStart))
+	return c.Lifecycle != nil && (hasLifecycleHandler(c.Lifecycle.PreStop) || hasLifecycleHandler(c.Lifecycle.PostStart))
+}
+
+func hasLifecycleHandler(l *v1.LifecycleHandler) bool {
+	return l != nil && (l.HTTPGet != nil || l.Exec != nil || l.TCPSocket != nil)
 }
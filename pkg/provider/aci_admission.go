@@ -0,0 +1,223 @@
+/*
+Copyright (c) Microsoft Corporation.
+Licensed under the Apache 2.0 license.
+*/
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	admissionv1 "k8s.io/api/admission/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+)
+
+// maxAdmissionReviewSize bounds the admission reviews read by the webhook.
+const maxAdmissionReviewSize = 3 * 1024 * 1024
+
+// AdmissionOptions configures the admission webhook validating the pods scheduled to ACI.
+type AdmissionOptions struct {
+	// Taint is the taint of the virtual node, only the pods tolerating it explicitly and targeting
+	// the virtual node are validated.
+	Taint v1.Taint
+	// AuditOnly admits the pods ACI can't run, with the problems returned as warnings.
+	AuditOnly bool
+}
+
+// NewAdmissionWebhook returns a validating admission webhook rejecting the pods ACI can't run
+// before they are scheduled to the virtual node, with all their problems at once.
+func NewAdmissionWebhook(p *ACIProvider, opts AdmissionOptions) http.Handler {
+	return &admissionWebhook{provider: p, opts: opts}
+}
+
+type admissionWebhook struct {
+	provider *ACIProvider
+	opts     AdmissionOptions
+}
+
+func (h *admissionWebhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxAdmissionReviewSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	review := admissionv1.AdmissionReview{}
+	if err := json.Unmarshal(body, &review); err != nil || review.Request == nil {
+		http.Error(w, "the body is not an admission review", http.StatusBadRequest)
+		return
+	}
+
+	review.Response = h.review(ctx, review.Request)
+	review.Request = nil
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(review); err != nil {
+		log.G(ctx).WithError(err).Error("failed to write the admission review response")
+	}
+}
+
+func (h *admissionWebhook) review(ctx context.Context, req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	response := &admissionv1.AdmissionResponse{UID: req.UID, Allowed: true}
+	if req.Kind.Kind != "Pod" || req.Operation != admissionv1.Create {
+		return response
+	}
+
+	pod := &v1.Pod{}
+	if err := json.Unmarshal(req.Object.Raw, pod); err != nil {
+		response.Allowed = false
+		response.Result = &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    http.StatusBadRequest,
+			Reason:  metav1.StatusReasonBadRequest,
+			Message: fmt.Sprintf("the pod can not be decoded: %v", err),
+		}
+		return response
+	}
+	if pod.Namespace == "" {
+		pod.Namespace = req.Namespace
+	}
+	if pod.Name == "" {
+		pod.Name = pod.GenerateName
+	}
+	if !h.targetsVirtualNode(pod) {
+		return response
+	}
+
+	problems := h.provider.validatePod(ctx, pod)
+	if len(problems) == 0 {
+		return response
+	}
+
+	messages := make([]string, 0, len(problems))
+	for _, problem := range problems {
+		messages = append(messages, problem.Error())
+	}
+	log.G(ctx).Infof("pod %s/%s has problems preventing ACI from running it (audit only: %t): %s",
+		pod.Namespace, pod.Name, h.opts.AuditOnly, strings.Join(messages, "; "))
+	if h.opts.AuditOnly {
+		response.Warnings = messages
+		return response
+	}
+
+	response.Allowed = false
+	response.Result = &metav1.Status{
+		Status:  metav1.StatusFailure,
+		Code:    http.StatusForbidden,
+		Reason:  metav1.StatusReasonForbidden,
+		Message: getAdmissionDenial(pod, messages),
+	}
+	return response
+}
+
+// getAdmissionDenial returns the message listing the problems of the pod.
+func getAdmissionDenial(pod *v1.Pod, messages []string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "pod %s can not run on Azure Container Instances, it has %d problem(s):", pod.Name, len(messages))
+	for i, message := range messages {
+		fmt.Fprintf(&b, " (%d) %s;", i+1, message)
+	}
+	return strings.TrimSuffix(b.String(), ";")
+}
+
+// targetsVirtualNode returns whether the pod is meant to run on the virtual node: it is bound to
+// the node, or tolerates its taint and selects it by its labels. The DaemonSet pods run on every
+// node tolerating their taint, they are never validated.
+func (h *admissionWebhook) targetsVirtualNode(pod *v1.Pod) bool {
+	for _, owner := range pod.OwnerReferences {
+		if owner.Kind == "DaemonSet" {
+			return false
+		}
+	}
+	if pod.Spec.NodeName != "" {
+		return pod.Spec.NodeName == h.provider.nodeName
+	}
+	if !toleratesTaint(pod, &h.opts.Taint) {
+		return false
+	}
+
+	h.provider.capacityLock.RLock()
+	defer h.provider.capacityLock.RUnlock()
+	if h.provider.node == nil {
+		return false
+	}
+	return selectsNode(pod, h.provider.node)
+}
+
+// toleratesTaint returns whether the pod tolerates the taint explicitly, the tolerations of all
+// the taints are used by the pods meant to run everywhere.
+func toleratesTaint(pod *v1.Pod, taint *v1.Taint) bool {
+	for i := range pod.Spec.Tolerations {
+		if pod.Spec.Tolerations[i].Key != "" && pod.Spec.Tolerations[i].ToleratesTaint(taint) {
+			return true
+		}
+	}
+	return false
+}
+
+// selectsNode returns whether the node selector or the required node affinity of the pod selects
+// the node. The pods without any are not considered to select it.
+func selectsNode(pod *v1.Pod, node *v1.Node) bool {
+	selected := false
+	if len(pod.Spec.NodeSelector) > 0 {
+		if !labels.SelectorFromSet(pod.Spec.NodeSelector).Matches(labels.Set(node.Labels)) {
+			return false
+		}
+		selected = true
+	}
+	if affinity := pod.Spec.Affinity; affinity != nil && affinity.NodeAffinity != nil &&
+		affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution != nil {
+		terms := affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+		if !matchesNodeSelectorTerms(terms, node) {
+			return false
+		}
+		selected = true
+	}
+	return selected
+}
+
+// matchesNodeSelectorTerms returns whether one of the terms matches the node, the requirements of
+// a term must all be met.
+func matchesNodeSelectorTerms(terms []v1.NodeSelectorTerm, node *v1.Node) bool {
+	operators := map[v1.NodeSelectorOperator]selection.Operator{
+		v1.NodeSelectorOpIn:           selection.In,
+		v1.NodeSelectorOpNotIn:        selection.NotIn,
+		v1.NodeSelectorOpExists:       selection.Exists,
+		v1.NodeSelectorOpDoesNotExist: selection.DoesNotExist,
+		v1.NodeSelectorOpGt:           selection.GreaterThan,
+		v1.NodeSelectorOpLt:           selection.LessThan,
+	}
+	matches := func(requirements []v1.NodeSelectorRequirement, fields labels.Set) bool {
+		for _, r := range requirements {
+			requirement, err := labels.NewRequirement(r.Key, operators[r.Operator], r.Values)
+			if err != nil || !requirement.Matches(fields) {
+				return false
+			}
+		}
+		return true
+	}
+
+	for _, term := range terms {
+		if len(term.MatchExpressions) == 0 && len(term.MatchFields) == 0 {
+			continue
+		}
+		if matches(term.MatchExpressions, labels.Set(node.Labels)) &&
+			matches(term.MatchFields, labels.Set{"metadata.name": node.Name}) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,201 @@
+/*
+Copyright (c) Microsoft Corporation.
+Licensed under the Apache 2.0 license.
+*/
+package provider
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	azaciv2 "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerinstance/armcontainerinstance/v2"
+	"github.com/golang/mock/gomock"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	admissionv1 "k8s.io/api/admission/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+var admissionTestTaint = v1.Taint{Key: "virtual-kubelet.io/provider", Value: "azure", Effect: v1.TaintEffectNoSchedule}
+
+func newAdmissionTestPod() *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "web",
+			Annotations: map[string]string{gpuTypeAnnotation: "H100"},
+		},
+		Spec: v1.PodSpec{
+			NodeSelector: map[string]string{"type": "virtual-kubelet"},
+			Tolerations:  []v1.Toleration{{Key: admissionTestTaint.Key, Operator: v1.TolerationOpExists}},
+			InitContainers: []v1.Container{{
+				Name:      "init",
+				Image:     "busybox",
+				Resources: v1.ResourceRequirements{Requests: v1.ResourceList{v1.ResourceCPU: resource.MustParse("1")}},
+			}},
+			Containers: []v1.Container{{
+				Name:         "web",
+				Image:        "nginx",
+				Args:         []string{"--verbose"},
+				StartupProbe: &v1.Probe{},
+				Lifecycle: &v1.Lifecycle{
+					PostStart: &v1.LifecycleHandler{Exec: &v1.ExecAction{Command: []string{"touch", "/ready"}}},
+					PreStop:   &v1.LifecycleHandler{Exec: &v1.ExecAction{Command: []string{"sleep", "5"}}},
+				},
+				Resources: v1.ResourceRequirements{Limits: v1.ResourceList{gpuResourceName: resource.MustParse("1")}},
+			}},
+			Volumes: []v1.Volume{{
+				Name:         "host",
+				VolumeSource: v1.VolumeSource{HostPath: &v1.HostPathVolumeSource{Path: "/var/log"}},
+			}},
+		},
+	}
+}
+
+func postAdmissionReview(t *testing.T, handler http.Handler, pod *v1.Pod) *admissionv1.AdmissionResponse {
+	t.Helper()
+
+	raw, err := json.Marshal(pod)
+	assert.NilError(t, err)
+	review := admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request: &admissionv1.AdmissionRequest{
+			UID:       "review-uid",
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Namespace: podNamespace,
+			Operation: admissionv1.Create,
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	}
+	body, err := json.Marshal(review)
+	assert.NilError(t, err)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/validate-pods", bytes.NewReader(body)))
+	assert.Assert(t, is.Equal(rec.Code, http.StatusOK), rec.Body.String())
+
+	response := admissionv1.AdmissionReview{}
+	assert.NilError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+	assert.Assert(t, response.Response != nil)
+	assert.Check(t, is.Equal(string(response.Response.UID), "review-uid"))
+	return response.Response
+}
+
+func TestAdmissionWebhook(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	provider, err := createTestProvider(createNewACIMock(), NewMockConfigMapLister(mockCtrl),
+		NewMockSecretLister(mockCtrl), NewMockPodLister(mockCtrl), nil)
+	if err != nil {
+		t.Fatal("failed to create the test provider", err)
+	}
+	provider.gpuSKUs = []azaciv2.GpuSKU{azaciv2.GpuSKUK80}
+	provider.node = &v1.Node{ObjectMeta: metav1.ObjectMeta{
+		Name:   fakeNodeName,
+		Labels: map[string]string{"type": "virtual-kubelet", "kubernetes.io/os": "linux"},
+	}}
+
+	handler := NewAdmissionWebhook(provider, AdmissionOptions{Taint: admissionTestTaint})
+	response := postAdmissionReview(t, handler, newAdmissionTestPod())
+	assert.Check(t, !response.Allowed)
+	assert.Assert(t, response.Result != nil)
+	assert.Check(t, is.Equal(response.Result.Code, int32(http.StatusForbidden)))
+	message := response.Result.Message
+	assert.Check(t, strings.HasPrefix(message, "pod web can not run on Azure Container Instances, it has 6 problem(s):"), message)
+	for _, problem := range []string{
+		"(1) container web: ACI does not support providing args without specifying the command",
+		"container web: ACI does not support postStart lifecycle hooks",
+		"container web: ACI does not support startupProbe",
+		"the pod requires GPU SKU H100, but ACI only supports SKUs [K80]",
+		"init container init: azure container instances initContainers do not support resources requests",
+		"pod web requires volume host which is of an unsupported type",
+	} {
+		assert.Check(t, strings.Contains(message, problem), "%q is missing from %q", problem, message)
+	}
+
+	audit := NewAdmissionWebhook(provider, AdmissionOptions{Taint: admissionTestTaint, AuditOnly: true})
+	response = postAdmissionReview(t, audit, newAdmissionTestPod())
+	assert.Check(t, response.Allowed, "the pods should only be audited")
+	assert.Check(t, is.Len(response.Warnings, 6))
+
+	for _, tc := range []struct {
+		description string
+		update      func(pod *v1.Pod)
+		validated   bool
+	}{
+		{
+			description: "pods not tolerating the virtual node taint are not validated",
+			update:      func(pod *v1.Pod) { pod.Spec.Tolerations = nil },
+		},
+		{
+			description: "pods tolerating all the taints are not validated",
+			update: func(pod *v1.Pod) {
+				pod.Spec.Tolerations = []v1.Toleration{{Operator: v1.TolerationOpExists}}
+			},
+		},
+		{
+			description: "pods not selecting the virtual node are not validated",
+			update:      func(pod *v1.Pod) { pod.Spec.NodeSelector = nil },
+		},
+		{
+			description: "pods selecting other nodes are not validated",
+			update:      func(pod *v1.Pod) { pod.Spec.NodeSelector = map[string]string{"type": "agent"} },
+		},
+		{
+			description: "DaemonSet pods are not validated",
+			update: func(pod *v1.Pod) {
+				pod.OwnerReferences = []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "DaemonSet", Name: "agent"}}
+			},
+		},
+		{
+			description: "pods bound to another node are not validated",
+			update:      func(pod *v1.Pod) { pod.Spec.NodeName = "aks-nodepool1-0" },
+		},
+		{
+			description: "pods bound to the virtual node are validated",
+			update: func(pod *v1.Pod) {
+				pod.Spec.NodeSelector = nil
+				pod.Spec.Tolerations = nil
+				pod.Spec.NodeName = fakeNodeName
+			},
+			validated: true,
+		},
+		{
+			description: "pods selecting the virtual node by affinity are validated",
+			update: func(pod *v1.Pod) {
+				pod.Spec.NodeSelector = nil
+				pod.Spec.Affinity = &v1.Affinity{NodeAffinity: &v1.NodeAffinity{
+					RequiredDuringSchedulingIgnoredDuringExecution: &v1.NodeSelector{
+						NodeSelectorTerms: []v1.NodeSelectorTerm{
+							{MatchExpressions: []v1.NodeSelectorRequirement{{Key: "type", Operator: v1.NodeSelectorOpIn, Values: []string{"agent"}}}},
+							{MatchExpressions: []v1.NodeSelectorRequirement{{Key: "type", Operator: v1.NodeSelectorOpIn, Values: []string{"virtual-kubelet"}}}},
+						},
+					},
+				}}
+			},
+			validated: true,
+		},
+	} {
+		pod := newAdmissionTestPod()
+		tc.update(pod)
+		response = postAdmissionReview(t, handler, pod)
+		assert.Check(t, is.Equal(response.Allowed, !tc.validated), tc.description)
+	}
+
+	pod := newAdmissionTestPod()
+
+	pod.Annotations = nil
+	pod.Spec.InitContainers = nil
+	pod.Spec.Volumes = nil
+	pod.Spec.Containers[0] = v1.Container{Name: "web", Image: "nginx"}
+	response = postAdmissionReview(t, handler, pod)
+	assert.Check(t, response.Allowed)
+	assert.Check(t, is.Len(response.Warnings, 0))
+}
@@ -0,0 +1,89 @@
+/*
+Copyright (c) Microsoft Corporation.
+Licensed under the Apache 2.0 license.
+*/
+package provider
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	azaciv2 "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerinstance/armcontainerinstance/v2"
+	"github.com/virtual-kubelet/azure-aci/pkg/util"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/utils/ptr"
+)
+
+const (
+	clusterIDEnv = "ACI_CLUSTER_ID"
+	// clusterIDTag is the tag of the container groups with the identity of the cluster of their
+	// pod. Several clusters, and several virtual nodes, can share a resource group, the container
+	// groups of the other clusters are never listed, adopted nor deleted.
+	clusterIDTag = "ClusterID"
+)
+
+// getClusterID returns the identity of the cluster, ACI_CLUSTER_ID when it is set, or else the UID
+// of the kube-system namespace which is stable for the lifetime of the cluster.
+func getClusterID(ctx context.Context, kubeClient kubernetes.Interface) (string, error) {
+	if clusterID := os.Getenv(clusterIDEnv); clusterID != "" {
+		return clusterID, nil
+	}
+
+	ns, err := kubeClient.CoreV1().Namespaces().Get(ctx, metav1.NamespaceSystem, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to get the %s namespace identifying the cluster, set %s to identify it: %w",
+			metav1.NamespaceSystem, clusterIDEnv, err)
+	}
+	return string(ns.UID), nil
+}
+
+// isContainerGroupOfCluster is true when the container group is tagged with the identity of the
+// cluster.
+func (p *ACIProvider) isContainerGroupOfCluster(cg *azaciv2.ContainerGroup) bool {
+	return cg != nil && cg.Tags != nil && cg.Tags[clusterIDTag] != nil && *cg.Tags[clusterIDTag] == p.clusterID
+}
+
+// ownsContainerGroup is true when the container group is tagged with the identity of the cluster.
+// The container groups created before the tag belong to the cluster when they are tagged with the
+// node name and the UID of a pod of the node. They are only tagged by the reconciliation, the
+// lookups don't change the container groups.
+func (p *ACIProvider) ownsContainerGroup(cg *azaciv2.ContainerGroup) bool {
+	if cg == nil || cg.Tags == nil {
+		return false
+	}
+	if cg.Tags[clusterIDTag] != nil {
+		return p.isContainerGroupOfCluster(cg)
+	}
+	return p.isUntaggedContainerGroupOfNode(cg)
+}
+
+// isUntaggedContainerGroupOfNode is true when the container group, without cluster identity, is
+// tagged with the node name and the UID of a pod of the node.
+func (p *ACIProvider) isUntaggedContainerGroupOfNode(cg *azaciv2.ContainerGroup) bool {
+	if cg.Name == nil || ptr.Deref(cg.Tags["NodeName"], "") != p.nodeName ||
+		cg.Tags["Namespace"] == nil || cg.Tags["PodName"] == nil {
+		return false
+	}
+	uid := util.GetContainerGroupPodUID(cg)
+	if uid == "" {
+		return false
+	}
+	pod, err := p.podsL.Pods(*cg.Tags["Namespace"]).Get(*cg.Tags["PodName"])
+	return err == nil && pod != nil && string(pod.UID) == uid
+}
+
+// getContainerGroupInfo returns the container group of the pod, it is not found when it belongs
+// to another cluster.
+func (p *ACIProvider) getContainerGroupInfo(ctx context.Context, namespace, name, nodeName string) (*azaciv2.ContainerGroup, error) {
+	cg, err := p.azClientsAPIs.GetContainerGroupInfo(ctx, p.resourceGroup, namespace, name, nodeName)
+	if err != nil {
+		return nil, err
+	}
+	if !p.ownsContainerGroup(cg) {
+		return nil, errdefs.NotFoundf("container group %s does not belong to cluster %s", *cg.Name, p.clusterID)
+	}
+	return cg, nil
+}
@@ -0,0 +1,119 @@
+/*
+Copyright (c) Microsoft Corporation.
+Licensed under the Apache 2.0 license.
+*/
+package provider
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	azaciv2 "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerinstance/armcontainerinstance/v2"
+	"github.com/golang/mock/gomock"
+	testsutil "github.com/virtual-kubelet/azure-aci/pkg/tests"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newClusterTestContainerGroup(podName, clusterID string) *azaciv2.ContainerGroup {
+	cg := testsutil.CreateTestContainerGroupObj(podName, podNamespace, "Succeeded", runningState,
+		testsutil.CgCreationTime.Add(time.Second*2))
+	if clusterID == "" {
+		delete(cg.Tags, clusterIDTag)
+	} else {
+		cg.Tags[clusterIDTag] = &clusterID
+	}
+	return cg
+}
+
+func TestGetClusterID(t *testing.T) {
+	t.Setenv(clusterIDEnv, "")
+
+	kubeClient := fake.NewSimpleClientset(&v1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: metav1.NamespaceSystem, UID: "kube-system-uid"},
+	})
+	clusterID, err := getClusterID(context.Background(), kubeClient)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(clusterID, "kube-system-uid"))
+
+	_, err = getClusterID(context.Background(), fake.NewSimpleClientset())
+	assert.Check(t, err != nil && strings.Contains(err.Error(), clusterIDEnv), "%v", err)
+
+	t.Setenv(clusterIDEnv, "my-cluster")
+	clusterID, err = getClusterID(context.Background(), fake.NewSimpleClientset())
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(clusterID, "my-cluster"))
+}
+
+func TestContainerGroupsOfOtherClustersAreIgnored(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	cgs := map[string]*azaciv2.ContainerGroup{
+		"owned":         newClusterTestContainerGroup("owned", testsutil.FakeClusterID),
+		"other-cluster": newClusterTestContainerGroup("other-cluster", "other-cluster"),
+		"untagged":      newClusterTestContainerGroup("untagged", ""),
+		"legacy":        newClusterTestContainerGroup("legacy", ""),
+	}
+	// The container group created before the cluster tag for a pod of the node is still owned.
+	legacyPod := testsutil.CreatePodObj("legacy", podNamespace)
+	legacyPod.UID = "legacy-uid"
+	legacyUID := string(legacyPod.UID)
+	cgs["legacy"].Tags["UID"] = &legacyUID
+
+	aciMocks := createNewACIMock()
+	aciMocks.MockGetContainerGroupList = func(ctx context.Context, resourceGroup string) ([]*azaciv2.ContainerGroup, error) {
+		return []*azaciv2.ContainerGroup{cgs["owned"], cgs["other-cluster"], cgs["untagged"], cgs["legacy"]}, nil
+	}
+	aciMocks.MockGetContainerGroupInfo = func(ctx context.Context, resourceGroup, namespace, name, nodeName string) (*azaciv2.ContainerGroup, error) {
+		return cgs[name], nil
+	}
+	deleted := []string{}
+	aciMocks.MockDeleteContainerGroup = func(ctx context.Context, resourceGroup, cgName string) error {
+		deleted = append(deleted, cgName)
+		return nil
+	}
+	aciMocks.MockUpdateContainerGroupTags = func(ctx context.Context, resourceGroup, cgName string, tags map[string]*string) error {
+		t.Errorf("container group %s should not be tagged outside of the reconciliation", cgName)
+		return nil
+	}
+
+	podLister := NewMockPodLister(mockCtrl)
+	podNamespaceLister := NewMockPodNamespaceLister(mockCtrl)
+	podLister.EXPECT().Pods(podNamespace).Return(podNamespaceLister).AnyTimes()
+	podNamespaceLister.EXPECT().Get("legacy").Return(legacyPod, nil).AnyTimes()
+	podNamespaceLister.EXPECT().Get("untagged").Return(nil, errors.NewNotFound(v1.Resource("pods"), "untagged")).AnyTimes()
+
+	provider, err := createTestProvider(aciMocks, NewMockConfigMapLister(mockCtrl),
+		NewMockSecretLister(mockCtrl), podLister, nil)
+	if err != nil {
+		t.Fatal("failed to create the test provider", err)
+	}
+
+	fingerprints, err := provider.ListPodFingerprints(context.Background())
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(fingerprints, 2))
+	_, ok := fingerprints[PodIdentifier{namespace: podNamespace, name: "owned"}]
+	assert.Check(t, ok, "the container group of the cluster should be listed")
+	_, ok = fingerprints[PodIdentifier{namespace: podNamespace, name: "legacy"}]
+	assert.Check(t, ok, "the container group of a pod of the node created before the cluster tag should be listed")
+	assert.Check(t, is.Nil(cgs["legacy"].Tags[clusterIDTag]), "the lookups should not tag the container groups")
+
+	for name := range cgs {
+		_, err := provider.getContainerGroupInfo(context.Background(), podNamespace, name, provider.nodeName)
+		if name == "owned" || name == "legacy" {
+			assert.Check(t, is.Nil(err))
+			continue
+		}
+		assert.Check(t, errdefs.IsNotFound(err), "the container group %s should not be found: %v", name, err)
+		assert.Check(t, errdefs.IsNotFound(provider.CleanupPod(context.Background(), podNamespace, name, "")))
+	}
+	assert.Check(t, is.Len(deleted, 0), "the container groups of the other clusters should not be deleted")
+}
@@ -0,0 +1,388 @@
+/*
+Copyright (c) Microsoft Corporation.
+Licensed under the Apache 2.0 license.
+*/
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resources/armresources"
+	"github.com/virtual-kubelet/azure-aci/pkg/auth"
+	"github.com/virtual-kubelet/azure-aci/pkg/client"
+	"github.com/virtual-kubelet/azure-aci/pkg/network"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// DoctorCheckStatus is the outcome of a check of the doctor.
+type DoctorCheckStatus string
+
+const (
+	DoctorCheckPassed  DoctorCheckStatus = "pass"
+	DoctorCheckWarning DoctorCheckStatus = "warn"
+	DoctorCheckFailed  DoctorCheckStatus = "fail"
+	// DoctorCheckSkipped is the status of the checks depending on a failed check.
+	DoctorCheckSkipped DoctorCheckStatus = "skip"
+)
+
+const containerInstanceProviderNamespace = "Microsoft.ContainerInstance"
+
+// DoctorCheck is the result of a check of the virtual node prerequisites.
+type DoctorCheck struct {
+	Name        string            `json:"name"`
+	Status      DoctorCheckStatus `json:"status"`
+	Message     string            `json:"message"`
+	Remediation string            `json:"remediation,omitempty"`
+}
+
+// DoctorReport is the result of all the checks of the virtual node prerequisites.
+type DoctorReport struct {
+	Passed bool          `json:"passed"`
+	Checks []DoctorCheck `json:"checks"`
+}
+
+// kubeletPermissions are the permissions the virtual kubelet needs in the cluster.
+var kubeletPermissions = []authorizationv1.ResourceAttributes{
+	{Verb: "create", Resource: "nodes"},
+	{Verb: "patch", Resource: "nodes", Subresource: "status"},
+	{Verb: "update", Group: "coordination.k8s.io", Resource: "leases"},
+	{Verb: "watch", Resource: "pods"},
+	{Verb: "update", Resource: "pods", Subresource: "status"},
+	{Verb: "delete", Resource: "pods"},
+	{Verb: "list", Resource: "secrets"},
+	{Verb: "list", Resource: "configmaps"},
+	{Verb: "create", Resource: "events"},
+	{Verb: "create", Resource: "serviceaccounts", Subresource: "token"},
+}
+
+// doctor checks the prerequisites of the virtual node, its dependencies are replaced in tests.
+type doctor struct {
+	getenv                func(string) string
+	setAuthConfig         func(ctx context.Context, azConfig *auth.Config) error
+	newAzClients          func(ctx context.Context, azConfig auth.Config) (client.AzClientsInterface, error)
+	getRegistrationState  func(ctx context.Context, azConfig auth.Config, namespace string) (string, error)
+	validateNetworkConfig func(ctx context.Context, pn *network.ProviderNetwork, azConfig *auth.Config) error
+	checkSubnetSetup      func(ctx context.Context, pn *network.ProviderNetwork, azConfig *auth.Config) (bool, error)
+	newKubeClient         func() (kubernetes.Interface, error)
+
+	report DoctorReport
+}
+
+// RunDoctor checks end to end, without changing anything, that the virtual node can run with its
+// Azure configuration, and the cluster client newKubeClient returns.
+func RunDoctor(ctx context.Context, newKubeClient func() (kubernetes.Interface, error)) *DoctorReport {
+	d := &doctor{
+		getenv: os.Getenv,
+		setAuthConfig: func(ctx context.Context, azConfig *auth.Config) error {
+			return azConfig.SetAuthConfig(ctx)
+		},
+		newAzClients: func(ctx context.Context, azConfig auth.Config) (client.AzClientsInterface, error) {
+			return client.NewAzClientsAPIs(ctx, azConfig)
+		},
+		getRegistrationState: getProviderRegistrationState,
+		validateNetworkConfig: func(ctx context.Context, pn *network.ProviderNetwork, azConfig *auth.Config) error {
+			return pn.ValidateConfig(ctx, azConfig)
+		},
+		checkSubnetSetup: func(ctx context.Context, pn *network.ProviderNetwork, azConfig *auth.Config) (bool, error) {
+			return pn.CheckSubnetSetup(ctx, azConfig)
+		},
+		newKubeClient: newKubeClient,
+	}
+	return d.run(ctx)
+}
+
+func (d *doctor) run(ctx context.Context) *DoctorReport {
+	d.report = DoctorReport{Passed: true}
+
+	azConfig := auth.Config{}
+	azureReady := d.check("azure-credentials", func() (DoctorCheckStatus, string, string) {
+		if err := d.setAuthConfig(ctx, &azConfig); err != nil {
+			return DoctorCheckFailed, err.Error(),
+				"set AZURE_CLIENT_ID and AZURE_CLIENT_SECRET, or VIRTUALNODE_USER_IDENTITY_CLIENTID for a managed identity, or AKS_CREDENTIAL_LOCATION to the AKS credential file, and AZURE_TENANT_ID and AZURE_SUBSCRIPTION_ID"
+		}
+		identity := "service principal " + azConfig.AuthConfig.ClientID
+		if azConfig.AuthConfig.ClientID == "" {
+			identity = "managed identity " + azConfig.AuthConfig.UserIdentityClientId
+		}
+		return DoctorCheckPassed, fmt.Sprintf("using %s in subscription %s", identity, azConfig.AuthConfig.SubscriptionID), ""
+	})
+
+	var resourceGroup, region string
+	if azureReady {
+		if azConfig.AKSCredential != nil {
+			resourceGroup = azConfig.AKSCredential.ResourceGroup
+			region = azConfig.AKSCredential.Region
+		}
+		if rg := d.getenv("ACI_RESOURCE_GROUP"); rg != "" {
+			resourceGroup = rg
+		}
+		if r := d.getenv("ACI_REGION"); r != "" {
+			region = r
+		}
+	}
+
+	regionReady := azureReady && d.check("region", func() (DoctorCheckStatus, string, string) {
+		return checkRegion(resourceGroup, region)
+	})
+	if !azureReady {
+		d.skip("region", "azure-credentials")
+	}
+
+	if regionReady {
+		d.check("cloud", func() (DoctorCheckStatus, string, string) {
+			return checkCloud(azConfig.Cloud, region)
+		})
+	} else {
+		d.skip("cloud", "region")
+	}
+
+	var azClients client.AzClientsInterface
+	armReady := regionReady && d.check("arm-access", func() (DoctorCheckStatus, string, string) {
+		var err error
+		azClients, err = d.newAzClients(ctx, azConfig)
+		if err != nil {
+			return DoctorCheckFailed, err.Error(), "check the credentials of the virtual kubelet identity"
+		}
+		if _, err := azClients.GetContainerGroupListResult(ctx, resourceGroup); err != nil {
+			return DoctorCheckFailed, fmt.Sprintf("can't list the container groups of resource group %s: %v", resourceGroup, err),
+				getARMAccessRemediation(err, resourceGroup)
+		}
+		return DoctorCheckPassed, fmt.Sprintf("the container groups of resource group %s can be listed", resourceGroup), ""
+	})
+	if !regionReady {
+		d.skip("arm-access", "region")
+	}
+
+	if armReady {
+		d.check("resource-provider", func() (DoctorCheckStatus, string, string) {
+			state, err := d.getRegistrationState(ctx, azConfig, containerInstanceProviderNamespace)
+			if err != nil {
+				return DoctorCheckWarning, fmt.Sprintf("can't read the registration of %s: %v", containerInstanceProviderNamespace, err),
+					"grant the virtual kubelet identity the read permission on the subscription to check the registration"
+			}
+			if !strings.EqualFold(state, "Registered") {
+				return DoctorCheckFailed, fmt.Sprintf("resource provider %s is %s in the subscription", containerInstanceProviderNamespace, state),
+					"run `az provider register --namespace " + containerInstanceProviderNamespace + "`"
+			}
+			return DoctorCheckPassed, fmt.Sprintf("resource provider %s is registered", containerInstanceProviderNamespace), ""
+		})
+	} else {
+		d.skip("resource-provider", "arm-access")
+	}
+
+	pn := network.ProviderNetwork{}
+	if azConfig.AKSCredential != nil {
+		pn.VnetName = azConfig.AKSCredential.VNetName
+		pn.VnetResourceGroup = azConfig.AKSCredential.VNetResourceGroup
+	}
+	if pn.VnetResourceGroup == "" {
+		pn.VnetResourceGroup = resourceGroup
+	}
+	networkReady := regionReady && d.check("network-config", func() (DoctorCheckStatus, string, string) {
+		if err := d.validateNetworkConfig(ctx, &pn, &azConfig); err != nil {
+			return DoctorCheckFailed, err.Error(), "set ACI_VNET_NAME and ACI_VNET_RESOURCE_GROUP, and ACI_SUBNET_NAME to run the pods in a subnet"
+		}
+		if pn.SubnetName == "" {
+			return DoctorCheckPassed, "no ACI subnet is configured, the pods get public IPs", ""
+		}
+		return DoctorCheckPassed, fmt.Sprintf("pods run in subnet %s of virtual network %s", pn.SubnetName, pn.VnetName), ""
+	})
+	if !regionReady {
+		d.skip("network-config", "region")
+	}
+
+	if networkReady && armReady && pn.SubnetName != "" {
+		d.check("subnet", func() (DoctorCheckStatus, string, string) {
+			setup, err := d.checkSubnetSetup(ctx, &pn, &azConfig)
+			if err != nil {
+				return DoctorCheckFailed, err.Error(),
+					"use a subnet dedicated to ACI without route table, delegated to Microsoft.ContainerInstance/containerGroups, and grant the virtual kubelet identity the Network Contributor role on the virtual network"
+			}
+			if setup {
+				return DoctorCheckWarning, fmt.Sprintf("subnet %s is created or delegated to ACI when the virtual kubelet starts", pn.SubnetName),
+					"grant the virtual kubelet identity the Network Contributor role on the virtual network, or delegate the subnet to Microsoft.ContainerInstance/containerGroups"
+			}
+			return DoctorCheckPassed, fmt.Sprintf("subnet %s is delegated to ACI", pn.SubnetName), ""
+		})
+	} else if !networkReady {
+		d.skip("subnet", "network-config")
+	} else if !armReady && pn.SubnetName != "" {
+		d.skip("subnet", "arm-access")
+	}
+
+	var kubeClient kubernetes.Interface
+	kubeReady := d.check("kubernetes", func() (DoctorCheckStatus, string, string) {
+		var err error
+		kubeClient, err = d.newKubeClient()
+		if err == nil {
+			var version fmt.Stringer
+			version, err = kubeClient.Discovery().ServerVersion()
+			if err == nil {
+				return DoctorCheckPassed, "connected to the API server " + version.String(), ""
+			}
+		}
+		return DoctorCheckFailed, fmt.Sprintf("can't connect to the API server: %v", err), "set KUBECONFIG, or run the virtual kubelet in the cluster with its service account"
+	})
+
+	if kubeReady {
+		d.check("kubernetes-rbac", func() (DoctorCheckStatus, string, string) {
+			return checkKubernetesRBAC(ctx, kubeClient)
+		})
+	} else {
+		d.skip("kubernetes-rbac", "kubernetes")
+	}
+
+	return &d.report
+}
+
+// check records the result of the check, and returns whether it didn't fail.
+func (d *doctor) check(name string, check func() (DoctorCheckStatus, string, string)) bool {
+	status, message, remediation := check()
+	d.report.Checks = append(d.report.Checks, DoctorCheck{
+		Name:        name,
+		Status:      status,
+		Message:     message,
+		Remediation: remediation,
+	})
+	if status == DoctorCheckFailed {
+		d.report.Passed = false
+	}
+	return status != DoctorCheckFailed
+}
+
+func (d *doctor) skip(name, dependency string) {
+	d.report.Checks = append(d.report.Checks, DoctorCheck{
+		Name:    name,
+		Status:  DoctorCheckSkipped,
+		Message: fmt.Sprintf("skipped since check %s failed", dependency),
+	})
+}
+
+func checkRegion(resourceGroup, region string) (DoctorCheckStatus, string, string) {
+	if resourceGroup == "" {
+		return DoctorCheckFailed, "the resource group of the container groups is not set", "set ACI_RESOURCE_GROUP"
+	}
+	if region == "" {
+		return DoctorCheckFailed, "the region of the container groups is not set", "set ACI_REGION"
+	}
+	if !isValidACIRegion(region) {
+		return DoctorCheckFailed, fmt.Sprintf("region %s is not supported by ACI", region),
+			"set ACI_REGION to one of " + strings.Join(validAciRegions, ", ")
+	}
+	return DoctorCheckPassed, fmt.Sprintf("container groups are created in resource group %s in region %s", resourceGroup, region), ""
+}
+
+// checkCloud checks the Azure cloud of the credentials hosts the region.
+func checkCloud(cloudConfig cloud.Configuration, region string) (DoctorCheckStatus, string, string) {
+	configured := getCloudName(cloudConfig)
+	expected := getRegionCloud(region)
+	if configured != expected {
+		return DoctorCheckFailed, fmt.Sprintf("region %s is in %s, but the credentials are for %s", region, expected, configured),
+			fmt.Sprintf("set the cloud of the AKS credential file to %s, or use a region of %s", expected, configured)
+	}
+	return DoctorCheckPassed, fmt.Sprintf("region %s is in %s", region, configured), ""
+}
+
+func getCloudName(cloudConfig cloud.Configuration) auth.CloudEnvironmentName {
+	switch cloudConfig.ActiveDirectoryAuthorityHost {
+	case cloud.AzureGovernment.ActiveDirectoryAuthorityHost:
+		return auth.AzureUSGovernmentCloud
+	case cloud.AzureChina.ActiveDirectoryAuthorityHost:
+		return auth.AzureChinaCloud
+	default:
+		return auth.AzurePublicCloud
+	}
+}
+
+func getRegionCloud(region string) auth.CloudEnvironmentName {
+	region = strings.ToLower(strings.ReplaceAll(region, " ", ""))
+	switch {
+	case strings.HasPrefix(region, "usgov"), strings.HasPrefix(region, "usdod"):
+		return auth.AzureUSGovernmentCloud
+	case strings.HasPrefix(region, "china"):
+		return auth.AzureChinaCloud
+	default:
+		return auth.AzurePublicCloud
+	}
+}
+
+func getARMAccessRemediation(err error, resourceGroup string) string {
+	var authErr *azidentity.AuthenticationFailedError
+	if errors.As(err, &authErr) {
+		return "check the credentials of the virtual kubelet identity, and that the virtual kubelet can reach Microsoft Entra ID"
+	}
+	if armErr := client.ClassifyARMError(err); armErr != nil {
+		switch armErr.Kind {
+		case client.ARMErrorUnauthorized:
+			return fmt.Sprintf("grant the virtual kubelet identity the Contributor role on resource group %s", resourceGroup)
+		case client.ARMErrorNotFound:
+			return fmt.Sprintf("create resource group %s, or set ACI_RESOURCE_GROUP to an existing resource group", resourceGroup)
+		}
+	}
+	return "check the virtual kubelet can reach Azure Resource Manager"
+}
+
+// checkKubernetesRBAC checks the virtual kubelet is allowed to manage its node and pods.
+func checkKubernetesRBAC(ctx context.Context, kubeClient kubernetes.Interface) (DoctorCheckStatus, string, string) {
+	var denied []string
+	for i := range kubeletPermissions {
+		review := &authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{ResourceAttributes: &kubeletPermissions[i]},
+		}
+		review, err := kubeClient.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, review, metav1.CreateOptions{})
+		if err != nil {
+			return DoctorCheckFailed, fmt.Sprintf("can't review the permissions of the virtual kubelet: %v", err),
+				"allow the virtual kubelet to create selfsubjectaccessreviews"
+		}
+		if !review.Status.Allowed {
+			denied = append(denied, formatResourceAttributes(kubeletPermissions[i]))
+		}
+	}
+	if len(denied) > 0 {
+		return DoctorCheckFailed, "the virtual kubelet is not allowed to " + strings.Join(denied, ", "),
+			"bind the virtual kubelet service account to a cluster role granting these permissions, as the helm chart does"
+	}
+	return DoctorCheckPassed, "the virtual kubelet is allowed to manage its node and pods", ""
+}
+
+func formatResourceAttributes(attributes authorizationv1.ResourceAttributes) string {
+	resource := attributes.Resource
+	if attributes.Subresource != "" {
+		resource += "/" + attributes.Subresource
+	}
+	if attributes.Group != "" {
+		resource += "." + attributes.Group
+	}
+	return attributes.Verb + " " + resource
+}
+
+func getProviderRegistrationState(ctx context.Context, azConfig auth.Config, namespace string) (string, error) {
+	credential, err := azConfig.GetCredential(ctx)
+	if err != nil {
+		return "", err
+	}
+	providers, err := armresources.NewProvidersClient(azConfig.AuthConfig.SubscriptionID, credential, &arm.ClientOptions{
+		ClientOptions: azcore.ClientOptions{Cloud: azConfig.Cloud},
+	})
+	if err != nil {
+		return "", err
+	}
+	response, err := providers.Get(ctx, namespace, nil)
+	if err != nil {
+		return "", err
+	}
+	if response.RegistrationState == nil {
+		return "", fmt.Errorf("the registration state of %s is unknown", namespace)
+	}
+	return *response.RegistrationState, nil
+}
@@ -0,0 +1,157 @@
+/*
+Copyright (c) Microsoft Corporation.
+Licensed under the Apache 2.0 license.
+*/
+package provider
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+	azaciv2 "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerinstance/armcontainerinstance/v2"
+	"github.com/virtual-kubelet/azure-aci/pkg/auth"
+	"github.com/virtual-kubelet/azure-aci/pkg/client"
+	"github.com/virtual-kubelet/azure-aci/pkg/network"
+	testsutil "github.com/virtual-kubelet/azure-aci/pkg/tests"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+func newTestDoctor(env map[string]string, deniedResources ...string) *doctor {
+	aciMocks := createNewACIMock()
+	aciMocks.MockGetContainerGroupList = func(ctx context.Context, resourceGroup string) ([]*azaciv2.ContainerGroup, error) {
+		return nil, nil
+	}
+
+	return &doctor{
+		getenv: func(key string) string {
+			return env[key]
+		},
+		setAuthConfig: func(ctx context.Context, azConfig *auth.Config) error {
+			azConfig.AuthConfig = auth.NewAuthentication("client", "secret", "subscription", "tenant", "")
+			azConfig.Cloud = cloud.AzurePublic
+			return nil
+		},
+		newAzClients: func(ctx context.Context, azConfig auth.Config) (client.AzClientsInterface, error) {
+			return aciMocks, nil
+		},
+		getRegistrationState: func(ctx context.Context, azConfig auth.Config, namespace string) (string, error) {
+			return "Registered", nil
+		},
+		validateNetworkConfig: func(ctx context.Context, pn *network.ProviderNetwork, azConfig *auth.Config) error {
+			pn.VnetName = env["ACI_VNET_NAME"]
+			pn.SubnetName = env["ACI_SUBNET_NAME"]
+			return nil
+		},
+		checkSubnetSetup: func(ctx context.Context, pn *network.ProviderNetwork, azConfig *auth.Config) (bool, error) {
+			return false, nil
+		},
+		newKubeClient: func() (kubernetes.Interface, error) {
+			kubeClient := fake.NewSimpleClientset()
+			kubeClient.PrependReactor("create", "selfsubjectaccessreviews", func(action clienttesting.Action) (bool, runtime.Object, error) {
+				review := action.(clienttesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+				review.Status.Allowed = true
+				for _, resource := range deniedResources {
+					if review.Spec.ResourceAttributes.Resource == resource {
+						review.Status.Allowed = false
+					}
+				}
+				return true, review, nil
+			})
+			return kubeClient, nil
+		},
+	}
+}
+
+func getDoctorCheck(t *testing.T, report *DoctorReport, name string) DoctorCheck {
+	t.Helper()
+	for _, check := range report.Checks {
+		if check.Name == name {
+			return check
+		}
+	}
+	t.Fatalf("check %s is missing from the report", name)
+	return DoctorCheck{}
+}
+
+func TestDoctor(t *testing.T) {
+	env := map[string]string{
+		"ACI_RESOURCE_GROUP": "rg",
+		"ACI_REGION":         "westus2",
+		"ACI_VNET_NAME":      "vnet",
+		"ACI_SUBNET_NAME":    "aci",
+	}
+
+	report := newTestDoctor(env).run(context.Background())
+	assert.Check(t, report.Passed, "%+v", report.Checks)
+	assert.Check(t, is.Len(report.Checks, 9))
+	for _, check := range report.Checks {
+		assert.Check(t, is.Equal(check.Status, DoctorCheckPassed), "%+v", check)
+	}
+
+	d := newTestDoctor(env, "secrets")
+	d.getRegistrationState = func(ctx context.Context, azConfig auth.Config, namespace string) (string, error) {
+		return "NotRegistered", nil
+	}
+	d.checkSubnetSetup = func(ctx context.Context, pn *network.ProviderNetwork, azConfig *auth.Config) (bool, error) {
+		return false, errors.New("unable to delegate subnet 'aci' to Azure Container Instance since it references the route table 'rt'")
+	}
+	report = d.run(context.Background())
+	assert.Check(t, !report.Passed)
+	check := getDoctorCheck(t, report, "resource-provider")
+	assert.Check(t, is.Equal(check.Status, DoctorCheckFailed))
+	assert.Check(t, is.Equal(check.Remediation, "run `az provider register --namespace Microsoft.ContainerInstance`"))
+	assert.Check(t, is.Equal(getDoctorCheck(t, report, "subnet").Status, DoctorCheckFailed))
+	check = getDoctorCheck(t, report, "kubernetes-rbac")
+	assert.Check(t, is.Equal(check.Status, DoctorCheckFailed))
+	assert.Check(t, is.Equal(check.Message, "the virtual kubelet is not allowed to list secrets"))
+
+	d = newTestDoctor(env)
+	d.newAzClients = func(ctx context.Context, azConfig auth.Config) (client.AzClientsInterface, error) {
+		aciMocks := createNewACIMock()
+		aciMocks.MockGetContainerGroupList = func(ctx context.Context, resourceGroup string) ([]*azaciv2.ContainerGroup, error) {
+			return nil, client.AsARMError(testsutil.NewARMResponseError(http.StatusForbidden,
+				`{"error":{"code":"AuthorizationFailed","message":"The client does not have authorization."}}`))
+		}
+		return aciMocks, nil
+	}
+	report = d.run(context.Background())
+	assert.Check(t, !report.Passed)
+	check = getDoctorCheck(t, report, "arm-access")
+	assert.Check(t, is.Equal(check.Status, DoctorCheckFailed))
+	assert.Check(t, is.Equal(check.Remediation, "grant the virtual kubelet identity the Contributor role on resource group rg"))
+	assert.Check(t, is.Equal(getDoctorCheck(t, report, "resource-provider").Status, DoctorCheckSkipped))
+	assert.Check(t, is.Equal(getDoctorCheck(t, report, "subnet").Status, DoctorCheckSkipped))
+	assert.Check(t, is.Equal(getDoctorCheck(t, report, "network-config").Status, DoctorCheckPassed))
+
+	d = newTestDoctor(map[string]string{"ACI_RESOURCE_GROUP": "rg", "ACI_REGION": "mars"})
+	report = d.run(context.Background())
+	check = getDoctorCheck(t, report, "region")
+	assert.Check(t, is.Equal(check.Status, DoctorCheckFailed))
+	assert.Check(t, strings.HasPrefix(check.Remediation, "set ACI_REGION to one of"), check.Remediation)
+	assert.Check(t, is.Equal(getDoctorCheck(t, report, "arm-access").Status, DoctorCheckSkipped))
+	assert.Check(t, is.Equal(getDoctorCheck(t, report, "kubernetes").Status, DoctorCheckPassed),
+		"the cluster checks should not depend on Azure")
+}
+
+func TestCheckCloud(t *testing.T) {
+	status, _, _ := checkCloud(cloud.AzurePublic, "westus2")
+	assert.Check(t, is.Equal(status, DoctorCheckPassed))
+	status, _, _ = checkCloud(cloud.AzureGovernment, "usgovvirginia")
+	assert.Check(t, is.Equal(status, DoctorCheckPassed))
+
+	status, message, _ := checkCloud(cloud.AzurePublic, "usgovarizona")
+	assert.Check(t, is.Equal(status, DoctorCheckFailed))
+	assert.Check(t, is.Equal(message, "region usgovarizona is in AzureUSGovernmentCloud, but the credentials are for AzurePublicCloud"))
+	status, _, _ = checkCloud(cloud.AzureGovernment, "chinaeast2")
+	assert.Check(t, is.Equal(status, DoctorCheckFailed))
+}
@@ -0,0 +1,226 @@
+/*
+Copyright (c) Microsoft Corporation.
+Licensed under the Apache 2.0 license.
+*/
+package provider
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	azaciv2 "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerinstance/armcontainerinstance/v2"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/utils/ptr"
+)
+
+// SpecDriftPolicy defines what the provider does when the container group of a pod was modified
+// outside of Kubernetes, in the portal or with the CLI.
+type SpecDriftPolicy string
+
+const (
+	// SpecDriftPolicyIgnore doesn't check the container group of the pod.
+	SpecDriftPolicyIgnore SpecDriftPolicy = "ignore"
+	// SpecDriftPolicyReport reports the drift with a warning event, it is the default.
+	SpecDriftPolicyReport SpecDriftPolicy = "report"
+	// SpecDriftPolicyRecreate reports the drift and redeploys the container group of the pod,
+	// which restores its spec and restarts its containers.
+	SpecDriftPolicyRecreate SpecDriftPolicy = "recreate"
+)
+
+const (
+	// specDriftPolicyAnnotation is the pod annotation with the SpecDriftPolicy of the pod.
+	specDriftPolicyAnnotation = "virtual-kubelet.io/spec-drift-policy"
+	// specHashTag is the tag of the container groups with the hash of the spec they were created
+	// with.
+	specHashTag = "SpecHash"
+
+	reasonSpecDrift              = "SpecDrift"
+	reasonSpecDriftRestored      = "SpecDriftRestored"
+	reasonSpecDriftRestoreFailed = "SpecDriftRestoreFailed"
+)
+
+// containerGroupSpec is the part of a container group spec that ARM returns as it was deployed.
+// The secure values, the credentials and the fields ARM fills are left out, so the hash of a
+// container group is the same at creation and once deployed.
+type containerGroupSpec struct {
+	OSType         string
+	RestartPolicy  string
+	Containers     []containerSpec
+	InitContainers []containerSpec
+	Volumes        []string
+	IPAddressType  string
+	Ports          []int32
+	DNSNameLabel   string
+}
+
+type containerSpec struct {
+	Name         string
+	Image        string
+	Command      []string
+	Env          map[string]string
+	Ports        []int32
+	VolumeMounts []string
+	Requests     []float64
+	Limits       []float64
+	GPUSKU       string
+	GPUCount     int32
+}
+
+// containerGroupSpecHash returns the hash of the spec of the container group.
+func containerGroupSpecHash(cg *azaciv2.ContainerGroup) string {
+	spec := containerGroupSpec{}
+	if props := cg.Properties; props != nil {
+		spec.OSType = string(ptr.Deref(props.OSType, ""))
+		spec.RestartPolicy = string(ptr.Deref(props.RestartPolicy, ""))
+		for _, container := range props.Containers {
+			if container == nil || container.Properties == nil {
+				continue
+			}
+			c := newContainerSpec(container.Name, container.Properties.Image, container.Properties.Command,
+				container.Properties.EnvironmentVariables, container.Properties.VolumeMounts)
+			for _, port := range container.Properties.Ports {
+				if port != nil && port.Port != nil {
+					c.Ports = append(c.Ports, *port.Port)
+				}
+			}
+			if resources := container.Properties.Resources; resources != nil {
+				if requests := resources.Requests; requests != nil {
+					c.Requests = []float64{ptr.Deref(requests.CPU, 0), ptr.Deref(requests.MemoryInGB, 0)}
+					if requests.Gpu != nil {
+						c.GPUSKU = string(ptr.Deref(requests.Gpu.SKU, ""))
+						c.GPUCount = ptr.Deref(requests.Gpu.Count, 0)
+					}
+				}
+				if limits := resources.Limits; limits != nil {
+					c.Limits = []float64{ptr.Deref(limits.CPU, 0), ptr.Deref(limits.MemoryInGB, 0)}
+				}
+			}
+			spec.Containers = append(spec.Containers, c)
+		}
+		for _, container := range props.InitContainers {
+			if container == nil || container.Properties == nil {
+				continue
+			}
+			spec.InitContainers = append(spec.InitContainers, newContainerSpec(container.Name, container.Properties.Image,
+				container.Properties.Command, container.Properties.EnvironmentVariables, container.Properties.VolumeMounts))
+		}
+		for _, volume := range props.Volumes {
+			if volume != nil {
+				spec.Volumes = append(spec.Volumes, ptr.Deref(volume.Name, ""))
+			}
+		}
+		if ip := props.IPAddress; ip != nil {
+			spec.IPAddressType = string(ptr.Deref(ip.Type, ""))
+			spec.DNSNameLabel = ptr.Deref(ip.DNSNameLabel, "")
+			for _, port := range ip.Ports {
+				if port != nil && port.Port != nil {
+					spec.Ports = append(spec.Ports, *port.Port)
+				}
+			}
+		}
+	}
+
+	// The fields are all marshalable, the error is never set.
+	data, _ := json.Marshal(spec)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func newContainerSpec(name, image *string, command []*string, envVars []*azaciv2.EnvironmentVariable, mounts []*azaciv2.VolumeMount) containerSpec {
+	c := containerSpec{
+		Name:  ptr.Deref(name, ""),
+		Image: ptr.Deref(image, ""),
+	}
+	for _, arg := range command {
+		c.Command = append(c.Command, ptr.Deref(arg, ""))
+	}
+	for _, env := range envVars {
+		if env == nil || env.Name == nil {
+			continue
+		}
+		if c.Env == nil {
+			c.Env = make(map[string]string, len(envVars))
+		}
+		// ARM never returns the secure values, only their names are compared.
+		c.Env[*env.Name] = ptr.Deref(env.Value, "")
+	}
+	for _, mount := range mounts {
+		if mount != nil {
+			c.VolumeMounts = append(c.VolumeMounts, ptr.Deref(mount.Name, "")+":"+ptr.Deref(mount.MountPath, ""))
+		}
+	}
+	return c
+}
+
+// getSpecDriftPolicy returns the SpecDriftPolicy of the pod, the invalid policies are reported.
+func getSpecDriftPolicy(pod *v1.Pod) (SpecDriftPolicy, bool) {
+	switch policy := SpecDriftPolicy(pod.Annotations[specDriftPolicyAnnotation]); policy {
+	case "":
+		return SpecDriftPolicyReport, true
+	case SpecDriftPolicyIgnore, SpecDriftPolicyReport, SpecDriftPolicyRecreate:
+		return policy, true
+	default:
+		return SpecDriftPolicyReport, false
+	}
+}
+
+// checkSpecDrift compares the spec of the container group of the pod with the hash it was
+// created with, and handles a drift according to the SpecDriftPolicy of the pod. The tracker checks
+// the container groups periodically, independently of their status updates. A drift is only
+// handled once, until the container group changes again. The container groups created before
+// the hash tag are not checked.
+func (p *ACIProvider) checkSpecDrift(ctx context.Context, pod *v1.Pod, cg *azaciv2.ContainerGroup) {
+	expected := ptr.Deref(cg.Tags[specHashTag], "")
+	if expected == "" {
+		return
+	}
+	actual := containerGroupSpecHash(cg)
+	if actual == expected {
+		p.specDrifts.Delete(pod.UID)
+		return
+	}
+
+	policy, valid := getSpecDriftPolicy(pod)
+	if policy == SpecDriftPolicyIgnore {
+		return
+	}
+	if handled, ok := p.specDrifts.Load(pod.UID); ok && handled == actual {
+		return
+	}
+	p.specDrifts.Store(pod.UID, actual)
+
+	logger := log.G(ctx).WithField("policy", policy)
+	logger.Warnf("container group %s of pod %s/%s was modified outside of Kubernetes", *cg.Name, pod.Namespace, pod.Name)
+	if !valid {
+		p.recordPodEvent(pod, v1.EventTypeWarning, reasonSpecDrift,
+			"Container group %s was modified outside of Kubernetes, %s %q is invalid, supported values are %s, %s and %s",
+			*cg.Name, specDriftPolicyAnnotation, pod.Annotations[specDriftPolicyAnnotation],
+			SpecDriftPolicyIgnore, SpecDriftPolicyReport, SpecDriftPolicyRecreate)
+		return
+	}
+	p.recordPodEvent(pod, v1.EventTypeWarning, reasonSpecDrift,
+		"Container group %s was modified outside of Kubernetes, its spec no longer matches the pod", *cg.Name)
+	if policy != SpecDriftPolicyRecreate {
+		return
+	}
+
+	cgName := *cg.Name
+	err := p.redeployContainerGroup(ctx, pod, func(ctx context.Context, pod *v1.Pod, err error) {
+		if err != nil {
+			log.G(ctx).WithError(err).Errorf("failed to redeploy pod %s to restore its container group", pod.Name)
+			p.recordPodEvent(pod, v1.EventTypeWarning, reasonSpecDriftRestoreFailed,
+				"Failed to redeploy the container group to restore its spec: %v", err)
+			return
+		}
+		p.recordPodEvent(pod, v1.EventTypeNormal, reasonSpecDriftRestored,
+			"Container group %s redeployed to restore the spec of the pod", cgName)
+	})
+	if err != nil {
+		// The drift is handled again on the next check.
+		logger.WithError(err).Errorf("failed to redeploy pod %s to restore its container group", pod.Name)
+		p.specDrifts.Delete(pod.UID)
+	}
+}
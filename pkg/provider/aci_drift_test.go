@@ -0,0 +1,253 @@
+/*
+Copyright (c) Microsoft Corporation.
+Licensed under the Apache 2.0 license.
+*/
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	azaciv2 "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerinstance/armcontainerinstance/v2"
+	"github.com/golang/mock/gomock"
+	testsutil "github.com/virtual-kubelet/azure-aci/pkg/tests"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/ptr"
+)
+
+// newDeployedContainerGroup returns the container group as ARM returns it once deployed, without
+// the secure values and with the fields ARM fills.
+func newDeployedContainerGroup(t *testing.T, cg *azaciv2.ContainerGroup) *azaciv2.ContainerGroup {
+	data, err := json.Marshal(cg)
+	assert.NilError(t, err)
+	deployed := &azaciv2.ContainerGroup{}
+	assert.NilError(t, json.Unmarshal(data, deployed))
+
+	name := "deployed"
+	deployed.Name = &name
+	for _, container := range deployed.Properties.Containers {
+		for _, env := range container.Properties.EnvironmentVariables {
+			env.SecureValue = nil
+		}
+	}
+	provisioningState := "Succeeded"
+	deployed.Properties.ProvisioningState = &provisioningState
+	deployed.Properties.InstanceView = &azaciv2.ContainerGroupPropertiesInstanceView{State: &provisioningState}
+	return deployed
+}
+
+func TestContainerGroupSpecHash(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	provider, err := createTestProvider(createNewACIMock(), NewMockConfigMapLister(mockCtrl),
+		NewMockSecretLister(mockCtrl), NewMockPodLister(mockCtrl), nil)
+	if err != nil {
+		t.Fatal("Unable to create test provider", err)
+	}
+
+	pod := testsutil.CreatePodObj(podName, podNamespace)
+	pod.Spec.Containers[0].Env = []v1.EnvVar{{Name: "LEVEL", Value: "warn"}}
+	cg, err := provider.getContainerGroup(context.Background(), pod)
+	assert.NilError(t, err)
+	assert.Assert(t, cg.Tags[specHashTag] != nil)
+	assert.Check(t, is.Equal(*cg.Tags[specHashTag], containerGroupSpecHash(cg)))
+
+	deployed := newDeployedContainerGroup(t, cg)
+	assert.Check(t, is.Equal(containerGroupSpecHash(deployed), *cg.Tags[specHashTag]),
+		"the fields ARM fills should not change the hash")
+
+	image := "nginx:modified"
+	deployed.Properties.Containers[0].Properties.Image = &image
+	assert.Check(t, containerGroupSpecHash(deployed) != *cg.Tags[specHashTag], "the image should change the hash")
+
+	deployed = newDeployedContainerGroup(t, cg)
+	value := "debug"
+	deployed.Properties.Containers[0].Properties.EnvironmentVariables[0].Value = &value
+	assert.Check(t, containerGroupSpecHash(deployed) != *cg.Tags[specHashTag], "the environment should change the hash")
+}
+
+// waitForEvents returns the reasons of the events recorded, waiting for the events recorded by
+// the container group operation workers.
+func waitForEvents(t *testing.T, recorder *record.FakeRecorder, count int) []string {
+	events := make([]string, 0, count)
+	for len(events) < count {
+		select {
+		case event := <-recorder.Events:
+			events = append(events, event)
+		case <-time.After(10 * time.Second):
+			t.Fatalf("only %d of the %d expected events were recorded: %v", len(events), count, events)
+		}
+	}
+	return events
+}
+
+func TestCheckSpecDrift(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	cases := []struct {
+		description       string
+		policy            string
+		createErr         error
+		expectedEvents    []string
+		expectedRecreates int32
+	}{
+		{
+			description:    "the drift is reported by default",
+			expectedEvents: []string{reasonSpecDrift},
+		},
+		{
+			description: "ignore policy doesn't report the drift",
+			policy:      string(SpecDriftPolicyIgnore),
+		},
+		{
+			description:       "recreate policy redeploys the container group",
+			policy:            string(SpecDriftPolicyRecreate),
+			expectedEvents:    []string{reasonSpecDrift, reasonSpecDriftRestored},
+			expectedRecreates: 1,
+		},
+		{
+			description:       "quota failure of the redeployment doesn't keep the running pod pending",
+			policy:            string(SpecDriftPolicyRecreate),
+			createErr:         testsutil.NewARMResponseError(http.StatusConflict, `{"error":{"code":"ContainerGroupQuotaReached","message":"container group quota exceeded."}}`),
+			expectedEvents:    []string{reasonSpecDrift, reasonSpecDriftRestoreFailed},
+			expectedRecreates: 1,
+		},
+		{
+			description:    "invalid policy is reported",
+			policy:         "restore",
+			expectedEvents: []string{specDriftPolicyAnnotation},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.description, func(t *testing.T) {
+			var recreates int32
+			aciMocks := createNewACIMock()
+			aciMocks.MockCreateContainerGroup = func(ctx context.Context, resourceGroup, podNS, podName string, cg *azaciv2.ContainerGroup) error {
+				atomic.AddInt32(&recreates, 1)
+				return tc.createErr
+			}
+
+			provider, err := createTestProvider(aciMocks, NewMockConfigMapLister(mockCtrl),
+				NewMockSecretLister(mockCtrl), NewMockPodLister(mockCtrl), nil)
+			if err != nil {
+				t.Fatal("Unable to create test provider", err)
+			}
+			recorder := record.NewFakeRecorder(5)
+			provider.eventRecorder = recorder
+
+			pod := testsutil.CreatePodObj(podName, podNamespace)
+			if tc.policy != "" {
+				pod.Annotations = map[string]string{specDriftPolicyAnnotation: tc.policy}
+			}
+			cg, err := provider.getContainerGroup(context.Background(), pod)
+			assert.NilError(t, err)
+
+			deployed := newDeployedContainerGroup(t, cg)
+			provider.checkSpecDrift(context.Background(), pod, deployed)
+			assert.Check(t, is.Len(recorder.Events, 0), "the container group should not drift")
+
+			image := "nginx:modified"
+			deployed.Properties.Containers[0].Properties.Image = &image
+			provider.checkSpecDrift(context.Background(), pod, deployed)
+			// The drift is handled once.
+			provider.checkSpecDrift(context.Background(), pod, deployed)
+
+			events := waitForEvents(t, recorder, len(tc.expectedEvents))
+			for i, reason := range tc.expectedEvents {
+				assert.Check(t, strings.Contains(events[i], reason), events[i])
+			}
+			assert.Check(t, is.Len(recorder.Events, 0))
+			assert.Check(t, is.Equal(atomic.LoadInt32(&recreates), tc.expectedRecreates))
+			assert.Check(t, !provider.pendingPods.isPending(pod.UID))
+
+			// The drift is reported again once the container group is modified again.
+			deployed = newDeployedContainerGroup(t, cg)
+			provider.checkSpecDrift(context.Background(), pod, deployed)
+			image = "nginx:modified-again"
+			deployed.Properties.Containers[0].Properties.Image = &image
+			provider.checkSpecDrift(context.Background(), pod, deployed)
+			waitForEvents(t, recorder, len(tc.expectedEvents))
+		})
+	}
+}
+
+func TestCheckPodSpecs(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	var deployed *azaciv2.ContainerGroup
+	aciMocks := createNewACIMock()
+	aciMocks.MockGetContainerGroupList = func(ctx context.Context, resourceGroup string) ([]*azaciv2.ContainerGroup, error) {
+		return []*azaciv2.ContainerGroup{deployed}, nil
+	}
+	aciMocks.MockGetContainerGroupInfo = func(ctx context.Context, resourceGroup, namespace, name, nodeName string) (*azaciv2.ContainerGroup, error) {
+		return deployed, nil
+	}
+
+	provider, err := createTestProvider(aciMocks, NewMockConfigMapLister(mockCtrl),
+		NewMockSecretLister(mockCtrl), NewMockPodLister(mockCtrl), nil)
+	if err != nil {
+		t.Fatal("Unable to create test provider", err)
+	}
+	recorder := record.NewFakeRecorder(5)
+	provider.eventRecorder = recorder
+
+	pod := testsutil.CreatePodObj(podName, podNamespace)
+	pod.UID = "pod"
+	pod.Spec.NodeName = fakeNodeName
+	cg, err := provider.getContainerGroup(context.Background(), pod)
+	assert.NilError(t, err)
+	deployed = newDeployedContainerGroup(t, cg)
+	deployed.ID = ptr.To("deployed")
+	image := "nginx:modified"
+	deployed.Properties.Containers[0].Properties.Image = &image
+	deployed.Properties.Containers[0].Properties.InstanceView = testsutil.CreateACIContainerObj("Running", "Initializing",
+		testsutil.CgCreationTime, testsutil.CgCreationTime, false, false, false).Properties.InstanceView
+
+	// The status updates don't check the spec of the container group.
+	_, err = provider.FetchPodStatus(context.Background(), pod, func(*PodEvent) {})
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(recorder.Events, 0))
+
+	provider.CheckPodSpecs(context.Background(), []*v1.Pod{pod})
+	events := waitForEvents(t, recorder, 1)
+	assert.Check(t, strings.Contains(events[0], reasonSpecDrift), events[0])
+
+	// The container groups of other pods, or of a previous pod with the same name, are not checked.
+	other := testsutil.CreatePodObj(podName, podNamespace)
+	other.UID = "other"
+	provider.specDrifts.Delete(pod.UID)
+	provider.CheckPodSpecs(context.Background(), []*v1.Pod{other, testsutil.CreatePodObj("other", podNamespace)})
+	assert.Check(t, is.Len(recorder.Events, 0))
+}
+
+func TestCheckSpecDriftWithoutEventRecorder(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	provider, err := createTestProvider(createNewACIMock(), NewMockConfigMapLister(mockCtrl),
+		NewMockSecretLister(mockCtrl), NewMockPodLister(mockCtrl), nil)
+	if err != nil {
+		t.Fatal("Unable to create test provider", err)
+	}
+	provider.eventRecorder = nil
+
+	pod := testsutil.CreatePodObj(podName, podNamespace)
+	cg, err := provider.getContainerGroup(context.Background(), pod)
+	assert.NilError(t, err)
+	deployed := newDeployedContainerGroup(t, cg)
+	image := "nginx:modified"
+	deployed.Properties.Containers[0].Properties.Image = &image
+	provider.checkSpecDrift(context.Background(), pod, deployed)
+}
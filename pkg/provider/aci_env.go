@@ -0,0 +1,362 @@
+/*
+Copyright (c) Microsoft Corporation.
+Licensed under the Apache 2.0 license.
+*/
+package provider
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	azaciv2 "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerinstance/armcontainerinstance/v2"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	v1 "k8s.io/api/core/v1"
+	k8serr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// reasonInvalidEnvironmentVariableNames matches the event reason kubelet uses for skipped EnvFrom keys.
+	reasonInvalidEnvironmentVariableNames = "InvalidEnvironmentVariableNames"
+
+	// Defaults used by getContainers when a container does not declare requests,
+	// so that resourceFieldRef reports what ACI actually allocates.
+	defaultContainerCPURequest    = "1"
+	defaultContainerMemoryRequest = "1.5G"
+)
+
+// get EnvironmentVariables declared on Container as []aci.EnvironmentVariable,
+// expanding EnvFrom sources and resolving any value sourced through ValueFrom.
+// As in kubelet, explicit Env entries take precedence over EnvFrom ones.
+func (p *ACIProvider) getEnvironmentVariables(ctx context.Context, pod *v1.Pod, container v1.Container) ([]*azaciv2.EnvironmentVariable, error) {
+	environmentVariable := make([]*azaciv2.EnvironmentVariable, 0, len(container.Env))
+	indexByName := make(map[string]int)
+	setEnvVar := func(envVar *azaciv2.EnvironmentVariable) {
+		if i, ok := indexByName[*envVar.Name]; ok {
+			environmentVariable[i] = envVar
+			return
+		}
+		indexByName[*envVar.Name] = len(environmentVariable)
+		environmentVariable = append(environmentVariable, envVar)
+	}
+
+	for _, envFrom := range container.EnvFrom {
+		envVars, err := p.getEnvFromVariables(pod, envFrom)
+		if err != nil {
+			return nil, err
+		}
+		for _, envVar := range envVars {
+			setEnvVar(envVar)
+		}
+	}
+
+	for i := range container.Env {
+		e := container.Env[i]
+		if e.ValueFrom == nil {
+			// An empty value is set too, it overrides the value of the EnvFrom sources.
+			setEnvVar(getACIEnvVar(e))
+			continue
+		}
+
+		value, ok, err := p.resolveEnvVarSource(ctx, pod, container, e)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		e.Value = value
+		setEnvVar(getACIEnvVar(e))
+	}
+	return environmentVariable, nil
+}
+
+// getEnvFromVariables expands a ConfigMap or Secret EnvFrom source into environment variables.
+// Keys that are not valid environment variable names are skipped and reported with a warning event.
+func (p *ACIProvider) getEnvFromVariables(pod *v1.Pod, envFrom v1.EnvFromSource) ([]*azaciv2.EnvironmentVariable, error) {
+	var sourceKind, sourceName string
+	var secure bool
+	values := make(map[string]string)
+
+	switch {
+	case envFrom.ConfigMapRef != nil:
+		sourceKind, sourceName = "configMap", envFrom.ConfigMapRef.Name
+		optional := envFrom.ConfigMapRef.Optional != nil && *envFrom.ConfigMapRef.Optional
+
+		configMap, err := p.configL.ConfigMaps(pod.Namespace).Get(sourceName)
+		if err != nil && !k8serr.IsNotFound(err) {
+			return nil, err
+		}
+		if configMap == nil || k8serr.IsNotFound(err) {
+			if optional {
+				return nil, nil
+			}
+			return nil, errdefs.InvalidInputf("configMap %s referenced by envFrom is required by pod %s and does not exist", sourceName, pod.Name)
+		}
+		// As in kubelet, the BinaryData of the config map is not exposed as env vars.
+		for k, v := range configMap.Data {
+			values[k] = v
+		}
+
+	case envFrom.SecretRef != nil:
+		sourceKind, sourceName = "secret", envFrom.SecretRef.Name
+		optional := envFrom.SecretRef.Optional != nil && *envFrom.SecretRef.Optional
+		secure = true
+
+		secret, err := p.secretL.Secrets(pod.Namespace).Get(sourceName)
+		if err != nil && !k8serr.IsNotFound(err) {
+			return nil, err
+		}
+		if secret == nil || k8serr.IsNotFound(err) {
+			if optional {
+				return nil, nil
+			}
+			return nil, errdefs.InvalidInputf("secret %s referenced by envFrom is required by pod %s and does not exist", sourceName, pod.Name)
+		}
+		for k, v := range secret.Data {
+			values[k] = string(v)
+		}
+
+	default:
+		return nil, nil
+	}
+
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	envVars := make([]*azaciv2.EnvironmentVariable, 0, len(keys))
+	var invalidKeys []string
+	for _, k := range keys {
+		name := envFrom.Prefix + k
+		if errMsgs := validation.IsEnvVarName(name); len(errMsgs) != 0 {
+			invalidKeys = append(invalidKeys, k)
+			continue
+		}
+
+		value := values[k]
+		envVar := &azaciv2.EnvironmentVariable{Name: &name}
+		if secure {
+			envVar.SecureValue = &value
+		} else {
+			envVar.Value = &value
+		}
+		envVars = append(envVars, envVar)
+	}
+
+	if len(invalidKeys) > 0 && p.eventRecorder != nil {
+		p.eventRecorder.Eventf(pod, v1.EventTypeWarning, reasonInvalidEnvironmentVariableNames,
+			"Keys [%s] from the EnvFrom %s %s/%s were skipped since they are considered invalid environment variable names.",
+			strings.Join(invalidKeys, ", "), sourceKind, pod.Namespace, sourceName)
+	}
+
+	return envVars, nil
+}
+
+// resolveEnvVarSource returns the value of an env var sourced through ValueFrom.
+// The boolean result is false when the variable must be left out of the container,
+// e.g. an optional reference that does not exist.
+func (p *ACIProvider) resolveEnvVarSource(ctx context.Context, pod *v1.Pod, container v1.Container, e v1.EnvVar) (string, bool, error) {
+	source := e.ValueFrom
+	switch {
+	case source.SecretKeyRef != nil:
+		return p.getSecretKeyRefValue(pod, e.Name, source.SecretKeyRef)
+	case source.ConfigMapKeyRef != nil:
+		return p.getConfigMapKeyRefValue(pod, e.Name, source.ConfigMapKeyRef)
+	case source.FieldRef != nil:
+		return p.getFieldRefValue(ctx, pod, e.Name, source.FieldRef)
+	case source.ResourceFieldRef != nil:
+		value, err := getResourceFieldRefValue(container, source.ResourceFieldRef, p.allocatable())
+		if err != nil {
+			return "", false, errdefs.InvalidInputf("env var %s of container %s in pod %s: %v", e.Name, container.Name, pod.Name, err)
+		}
+		return value, true, nil
+	}
+
+	return "", false, errdefs.InvalidInputf("env var %s of container %s in pod %s has an unsupported value source", e.Name, container.Name, pod.Name)
+}
+
+func (p *ACIProvider) getSecretKeyRefValue(pod *v1.Pod, envName string, ref *v1.SecretKeySelector) (string, bool, error) {
+	optional := ref.Optional != nil && *ref.Optional
+
+	secret, err := p.secretL.Secrets(pod.Namespace).Get(ref.Name)
+	if err != nil && !k8serr.IsNotFound(err) {
+		return "", false, err
+	}
+	if secret == nil || k8serr.IsNotFound(err) {
+		if optional {
+			return "", false, nil
+		}
+		return "", false, errdefs.InvalidInputf("secret %s referenced by env var %s is required by pod %s and does not exist", ref.Name, envName, pod.Name)
+	}
+
+	value, ok := secret.Data[ref.Key]
+	if !ok {
+		if optional {
+			return "", false, nil
+		}
+		return "", false, errdefs.InvalidInputf("key %s referenced by env var %s does not exist in secret %s required by pod %s", ref.Key, envName, ref.Name, pod.Name)
+	}
+	return string(value), true, nil
+}
+
+func (p *ACIProvider) getConfigMapKeyRefValue(pod *v1.Pod, envName string, ref *v1.ConfigMapKeySelector) (string, bool, error) {
+	optional := ref.Optional != nil && *ref.Optional
+
+	configMap, err := p.configL.ConfigMaps(pod.Namespace).Get(ref.Name)
+	if err != nil && !k8serr.IsNotFound(err) {
+		return "", false, err
+	}
+	if configMap == nil || k8serr.IsNotFound(err) {
+		if optional {
+			return "", false, nil
+		}
+		return "", false, errdefs.InvalidInputf("configMap %s referenced by env var %s is required by pod %s and does not exist", ref.Name, envName, pod.Name)
+	}
+
+	if value, ok := configMap.Data[ref.Key]; ok {
+		return value, true, nil
+	}
+	if optional {
+		return "", false, nil
+	}
+	return "", false, errdefs.InvalidInputf("key %s referenced by env var %s does not exist in configMap %s required by pod %s", ref.Key, envName, ref.Name, pod.Name)
+}
+
+func (p *ACIProvider) getFieldRefValue(ctx context.Context, pod *v1.Pod, envName string, ref *v1.ObjectFieldSelector) (string, bool, error) {
+	fieldPath := ref.FieldPath
+
+	if path, subscript, ok := splitMaybeSubscriptedPath(fieldPath); ok {
+		switch path {
+		case "metadata.labels":
+			return pod.Labels[subscript], true, nil
+		case "metadata.annotations":
+			return pod.Annotations[subscript], true, nil
+		}
+		return "", false, errdefs.InvalidInputf("unsupported fieldPath %s for env var %s in pod %s", fieldPath, envName, pod.Name)
+	}
+
+	switch fieldPath {
+	case "metadata.name":
+		return pod.Name, true, nil
+	case "metadata.namespace":
+		return pod.Namespace, true, nil
+	case "metadata.uid":
+		return string(pod.UID), true, nil
+	case "metadata.labels":
+		return formatMap(pod.Labels), true, nil
+	case "metadata.annotations":
+		return formatMap(pod.Annotations), true, nil
+	case "spec.nodeName":
+		return pod.Spec.NodeName, true, nil
+	case "spec.serviceAccountName":
+		return pod.Spec.ServiceAccountName, true, nil
+	case "status.hostIP":
+		return p.internalIP, true, nil
+	case "status.podIP":
+		// ACI assigns the IP address only once the container group is created.
+		if pod.Status.PodIP == "" {
+			log.G(ctx).Warnf("pod IP of pod %s is not known before the container group is created, skipping env var %s", pod.Name, envName)
+			return "", false, nil
+		}
+		return pod.Status.PodIP, true, nil
+	}
+
+	return "", false, errdefs.InvalidInputf("unsupported fieldPath %s for env var %s in pod %s", fieldPath, envName, pod.Name)
+}
+
+// getResourceFieldRefValue resolves a resourceFieldRef against the container's
+// requests, defaulted the same way getContainers does, and limits. As in kubelet,
+// the limits the container does not declare fall back to the node allocatable.
+func getResourceFieldRefValue(container v1.Container, ref *v1.ResourceFieldSelector, allocatable v1.ResourceList) (string, error) {
+	divisor := ref.Divisor
+	if divisor.IsZero() {
+		divisor = resource.MustParse("1")
+	}
+
+	requests := container.Resources.Requests
+	limits := container.Resources.Limits
+
+	cpuRequest := resource.MustParse(defaultContainerCPURequest)
+	if q, ok := requests[v1.ResourceCPU]; ok {
+		cpuRequest = q
+	}
+	memoryRequest := resource.MustParse(defaultContainerMemoryRequest)
+	if q, ok := requests[v1.ResourceMemory]; ok {
+		memoryRequest = q
+	}
+	limit := func(name v1.ResourceName) resource.Quantity {
+		if q, ok := limits[name]; ok {
+			return q
+		}
+		return allocatable[name]
+	}
+
+	switch ref.Resource {
+	case "requests.cpu":
+		return convertResourceCPUToString(cpuRequest, divisor), nil
+	case "limits.cpu":
+		return convertResourceCPUToString(limit(v1.ResourceCPU), divisor), nil
+	case "requests.memory":
+		return convertResourceToString(memoryRequest, divisor), nil
+	case "limits.memory":
+		return convertResourceToString(limit(v1.ResourceMemory), divisor), nil
+	case "requests.ephemeral-storage":
+		return convertResourceToString(requests[v1.ResourceEphemeralStorage], divisor), nil
+	case "limits.ephemeral-storage":
+		return convertResourceToString(limit(v1.ResourceEphemeralStorage), divisor), nil
+	}
+
+	return "", fmt.Errorf("unsupported resource %s", ref.Resource)
+}
+
+// convertResourceCPUToString converts cpu value to the format of divisor and returns
+// ceiling of the value.
+func convertResourceCPUToString(cpu resource.Quantity, divisor resource.Quantity) string {
+	c := int64(math.Ceil(float64(cpu.MilliValue()) / float64(divisor.MilliValue())))
+	return strconv.FormatInt(c, 10)
+}
+
+// convertResourceToString converts a memory or storage value to the format of divisor
+// and returns ceiling of the value.
+func convertResourceToString(q resource.Quantity, divisor resource.Quantity) string {
+	m := int64(math.Ceil(float64(q.Value()) / float64(divisor.Value())))
+	return strconv.FormatInt(m, 10)
+}
+
+// splitMaybeSubscriptedPath splits a field path such as metadata.labels['key']
+// into the path and the subscript.
+func splitMaybeSubscriptedPath(fieldPath string) (string, string, bool) {
+	if !strings.HasSuffix(fieldPath, "']") {
+		return fieldPath, "", false
+	}
+	s := strings.TrimSuffix(fieldPath, "']")
+	parts := strings.SplitN(s, "['", 2)
+	if len(parts) < 2 || len(parts[0]) == 0 {
+		return fieldPath, "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// formatMap renders a map the way the downward API does, one key="value" per line.
+func formatMap(m map[string]string) string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	lines := make([]string, 0, len(keys))
+	for _, k := range keys {
+		lines = append(lines, fmt.Sprintf("%s=%q", k, m[k]))
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,346 @@
+/*
+Copyright (c) Microsoft Corporation.
+Licensed under the Apache 2.0 license.
+*/
+package provider
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	azaciv2 "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerinstance/armcontainerinstance/v2"
+	"github.com/golang/mock/gomock"
+	testsutil "github.com/virtual-kubelet/azure-aci/pkg/tests"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func findEnvVar(envVars []*azaciv2.EnvironmentVariable, name string) *azaciv2.EnvironmentVariable {
+	for _, e := range envVars {
+		if *e.Name == name {
+			return e
+		}
+	}
+	return nil
+}
+
+func TestGetEnvironmentVariablesWithValueFrom(t *testing.T) {
+	secretName := "env-secret"
+	configMapName := "env-config"
+	optional := true
+
+	fakeSecret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: secretName, Namespace: podNamespace},
+		Data:       map[string][]byte{"password": []byte("s3cr3t")},
+	}
+	fakeConfigMap := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: configMapName, Namespace: podNamespace},
+		Data:       map[string]string{"mode": "debug"},
+	}
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockSecretLister := NewMockSecretLister(mockCtrl)
+	mockSecretNamespaceLister := NewMockSecretNamespaceLister(mockCtrl)
+	mockSecretLister.EXPECT().Secrets(podNamespace).Return(mockSecretNamespaceLister).AnyTimes()
+	mockSecretNamespaceLister.EXPECT().Get(secretName).Return(fakeSecret, nil).AnyTimes()
+	mockSecretNamespaceLister.EXPECT().Get("missing").Return(nil, errors.NewNotFound(v1.Resource("secret"), "missing")).AnyTimes()
+
+	mockConfigMapLister := NewMockConfigMapLister(mockCtrl)
+	mockConfigMapNamespaceLister := NewMockConfigMapNamespaceLister(mockCtrl)
+	mockConfigMapLister.EXPECT().ConfigMaps(podNamespace).Return(mockConfigMapNamespaceLister).AnyTimes()
+	mockConfigMapNamespaceLister.EXPECT().Get(configMapName).Return(fakeConfigMap, nil).AnyTimes()
+
+	provider, err := createTestProvider(createNewACIMock(), mockConfigMapLister,
+		mockSecretLister, NewMockPodLister(mockCtrl), nil)
+	if err != nil {
+		t.Fatal("Unable to create test provider", err)
+	}
+
+	pod := testsutil.CreatePodObj(podName, podNamespace)
+	pod.Labels = map[string]string{"app": "web"}
+	pod.Spec.NodeName = fakeNodeName
+	pod.Spec.Containers[0].Resources = v1.ResourceRequirements{
+		Requests: v1.ResourceList{v1.ResourceMemory: resource.MustParse("512Mi")},
+		Limits:   v1.ResourceList{v1.ResourceCPU: resource.MustParse("1500m")},
+	}
+	pod.Spec.Containers[0].Env = []v1.EnvVar{
+		{Name: "PLAIN", Value: "value"},
+		{Name: "PASSWORD", ValueFrom: &v1.EnvVarSource{SecretKeyRef: &v1.SecretKeySelector{
+			LocalObjectReference: v1.LocalObjectReference{Name: secretName}, Key: "password"}}},
+		{Name: "OPTIONAL_SECRET", ValueFrom: &v1.EnvVarSource{SecretKeyRef: &v1.SecretKeySelector{
+			LocalObjectReference: v1.LocalObjectReference{Name: "missing"}, Key: "password", Optional: &optional}}},
+		{Name: "MODE", ValueFrom: &v1.EnvVarSource{ConfigMapKeyRef: &v1.ConfigMapKeySelector{
+			LocalObjectReference: v1.LocalObjectReference{Name: configMapName}, Key: "mode"}}},
+		{Name: "POD_NAME", ValueFrom: &v1.EnvVarSource{FieldRef: &v1.ObjectFieldSelector{FieldPath: "metadata.name"}}},
+		{Name: "APP", ValueFrom: &v1.EnvVarSource{FieldRef: &v1.ObjectFieldSelector{FieldPath: "metadata.labels['app']"}}},
+		{Name: "NODE_NAME", ValueFrom: &v1.EnvVarSource{FieldRef: &v1.ObjectFieldSelector{FieldPath: "spec.nodeName"}}},
+		{Name: "POD_IP", ValueFrom: &v1.EnvVarSource{FieldRef: &v1.ObjectFieldSelector{FieldPath: "status.podIP"}}},
+		{Name: "CPU_LIMIT", ValueFrom: &v1.EnvVarSource{ResourceFieldRef: &v1.ResourceFieldSelector{Resource: "limits.cpu", Divisor: resource.MustParse("1m")}}},
+		{Name: "MEMORY_REQUEST", ValueFrom: &v1.EnvVarSource{ResourceFieldRef: &v1.ResourceFieldSelector{Resource: "requests.memory", Divisor: resource.MustParse("1Mi")}}},
+	}
+
+	envVars, err := provider.getEnvironmentVariables(context.Background(), pod, pod.Spec.Containers[0])
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(envVars, 8), "unresolvable optional env vars should be skipped")
+
+	password := findEnvVar(envVars, "PASSWORD")
+	assert.Check(t, password != nil, "secret env var should be present")
+	assert.Check(t, is.Nil(password.Value), "secret env var should not use Value")
+	assert.Check(t, is.Equal("s3cr3t", *password.SecureValue), "secret env var should use SecureValue")
+
+	expected := map[string]string{
+		"PLAIN":          "value",
+		"MODE":           "debug",
+		"POD_NAME":       podName,
+		"APP":            "web",
+		"NODE_NAME":      fakeNodeName,
+		"CPU_LIMIT":      "1500",
+		"MEMORY_REQUEST": "512",
+	}
+	for name, value := range expected {
+		envVar := findEnvVar(envVars, name)
+		assert.Check(t, envVar != nil, "env var %s should be present", name)
+		if envVar != nil {
+			assert.Check(t, is.Equal(value, *envVar.Value), "env var %s doesn't match", name)
+		}
+	}
+	assert.Check(t, findEnvVar(envVars, "OPTIONAL_SECRET") == nil, "missing optional secret should be skipped")
+	assert.Check(t, findEnvVar(envVars, "POD_IP") == nil, "unknown pod IP should be skipped")
+}
+
+func TestGetEnvironmentVariablesWithMissingRequiredRefs(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockSecretLister := NewMockSecretLister(mockCtrl)
+	mockSecretNamespaceLister := NewMockSecretNamespaceLister(mockCtrl)
+	mockSecretLister.EXPECT().Secrets(podNamespace).Return(mockSecretNamespaceLister).AnyTimes()
+	mockSecretNamespaceLister.EXPECT().Get("missing").Return(nil, errors.NewNotFound(v1.Resource("secret"), "missing")).AnyTimes()
+
+	mockConfigMapLister := NewMockConfigMapLister(mockCtrl)
+	mockConfigMapNamespaceLister := NewMockConfigMapNamespaceLister(mockCtrl)
+	mockConfigMapLister.EXPECT().ConfigMaps(podNamespace).Return(mockConfigMapNamespaceLister).AnyTimes()
+	mockConfigMapNamespaceLister.EXPECT().Get("config").Return(&v1.ConfigMap{
+		Data:       map[string]string{},
+		BinaryData: map[string][]byte{"binary": []byte("value")},
+	}, nil).AnyTimes()
+
+	aciMocks := createNewACIMock()
+	aciMocks.MockCreateContainerGroup = func(ctx context.Context, resourceGroup, podNS, podName string, cg *azaciv2.ContainerGroup) error {
+		t.Fatal("container group should not be created")
+		return nil
+	}
+
+	provider, err := createTestProvider(aciMocks, mockConfigMapLister,
+		mockSecretLister, NewMockPodLister(mockCtrl), nil)
+	if err != nil {
+		t.Fatal("Unable to create test provider", err)
+	}
+
+	cases := []struct {
+		description string
+		env         v1.EnvVar
+	}{
+		{
+			description: "missing secret",
+			env: v1.EnvVar{Name: "PASSWORD", ValueFrom: &v1.EnvVarSource{SecretKeyRef: &v1.SecretKeySelector{
+				LocalObjectReference: v1.LocalObjectReference{Name: "missing"}, Key: "password"}}},
+		},
+		{
+			description: "missing configMap key",
+			env: v1.EnvVar{Name: "MODE", ValueFrom: &v1.EnvVarSource{ConfigMapKeyRef: &v1.ConfigMapKeySelector{
+				LocalObjectReference: v1.LocalObjectReference{Name: "config"}, Key: "mode"}}},
+		},
+		{
+			description: "configMap key in binary data",
+			env: v1.EnvVar{Name: "BINARY", ValueFrom: &v1.EnvVarSource{ConfigMapKeyRef: &v1.ConfigMapKeySelector{
+				LocalObjectReference: v1.LocalObjectReference{Name: "config"}, Key: "binary"}}},
+		},
+		{
+			description: "unsupported fieldPath",
+			env:         v1.EnvVar{Name: "FIELD", ValueFrom: &v1.EnvVarSource{FieldRef: &v1.ObjectFieldSelector{FieldPath: "spec.unknown"}}},
+		},
+		{
+			description: "unsupported resource",
+			env:         v1.EnvVar{Name: "RESOURCE", ValueFrom: &v1.EnvVarSource{ResourceFieldRef: &v1.ResourceFieldSelector{Resource: "limits.unknown"}}},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.description, func(t *testing.T) {
+			pod := testsutil.CreatePodObj(podName, podNamespace)
+			pod.Spec.Containers[0].Env = []v1.EnvVar{tc.env}
+
+			err := provider.CreatePod(context.Background(), pod)
+			assert.Check(t, err != nil, "CreatePod should fail")
+			assert.Check(t, errdefs.IsInvalidInput(err), "error should be an invalid input error")
+		})
+	}
+}
+
+func TestGetResourceFieldRefValue(t *testing.T) {
+	container := v1.Container{
+		Resources: v1.ResourceRequirements{
+			Requests: v1.ResourceList{v1.ResourceCPU: resource.MustParse("250m")},
+			Limits:   v1.ResourceList{v1.ResourceEphemeralStorage: resource.MustParse("1Gi")},
+		},
+	}
+	allocatable := v1.ResourceList{
+		v1.ResourceCPU:              resource.MustParse("4"),
+		v1.ResourceMemory:           resource.MustParse("16G"),
+		v1.ResourceEphemeralStorage: resource.MustParse("50Gi"),
+	}
+
+	cases := []struct {
+		resource string
+		divisor  string
+		expected string
+	}{
+		{"requests.cpu", "", "1"},
+		{"requests.cpu", "1m", "250"},
+		{"limits.cpu", "1m", "4000"},
+		{"requests.memory", "1M", "1500"},
+		{"limits.memory", "1G", "16"},
+		{"requests.ephemeral-storage", "", "0"},
+		{"limits.ephemeral-storage", "1Mi", "1024"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.resource+"/"+tc.divisor, func(t *testing.T) {
+			ref := &v1.ResourceFieldSelector{Resource: tc.resource}
+			if tc.divisor != "" {
+				ref.Divisor = resource.MustParse(tc.divisor)
+			}
+			value, err := getResourceFieldRefValue(container, ref, allocatable)
+			assert.NilError(t, err)
+			assert.Check(t, is.Equal(tc.expected, value))
+		})
+	}
+}
+
+func TestGetEnvironmentVariablesWithEnvFrom(t *testing.T) {
+	secretName := "env-secret"
+	configMapName := "env-config"
+	optional := true
+
+	fakeSecret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: secretName, Namespace: podNamespace},
+		Data: map[string][]byte{
+			"PASSWORD": []byte("s3cr3t"),
+			"MODE":     []byte("from-secret"),
+		},
+	}
+	fakeConfigMap := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: configMapName, Namespace: podNamespace},
+		Data: map[string]string{
+			"MODE":      "debug",
+			"LEVEL":     "info",
+			"1-invalid": "skipped",
+		},
+		BinaryData: map[string][]byte{"BINARY": []byte("skipped")},
+	}
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockSecretLister := NewMockSecretLister(mockCtrl)
+	mockSecretNamespaceLister := NewMockSecretNamespaceLister(mockCtrl)
+	mockSecretLister.EXPECT().Secrets(podNamespace).Return(mockSecretNamespaceLister).AnyTimes()
+	mockSecretNamespaceLister.EXPECT().Get(secretName).Return(fakeSecret, nil).AnyTimes()
+	mockSecretNamespaceLister.EXPECT().Get("missing").Return(nil, errors.NewNotFound(v1.Resource("secret"), "missing")).AnyTimes()
+
+	mockConfigMapLister := NewMockConfigMapLister(mockCtrl)
+	mockConfigMapNamespaceLister := NewMockConfigMapNamespaceLister(mockCtrl)
+	mockConfigMapLister.EXPECT().ConfigMaps(podNamespace).Return(mockConfigMapNamespaceLister).AnyTimes()
+	mockConfigMapNamespaceLister.EXPECT().Get(configMapName).Return(fakeConfigMap, nil).AnyTimes()
+
+	provider, err := createTestProvider(createNewACIMock(), mockConfigMapLister,
+		mockSecretLister, NewMockPodLister(mockCtrl), nil)
+	if err != nil {
+		t.Fatal("Unable to create test provider", err)
+	}
+	fakeRecorder := record.NewFakeRecorder(5)
+	provider.eventRecorder = fakeRecorder
+
+	pod := testsutil.CreatePodObj(podName, podNamespace)
+	pod.Spec.Containers[0].EnvFrom = []v1.EnvFromSource{
+		{ConfigMapRef: &v1.ConfigMapEnvSource{LocalObjectReference: v1.LocalObjectReference{Name: configMapName}}},
+		{Prefix: "DB_", SecretRef: &v1.SecretEnvSource{LocalObjectReference: v1.LocalObjectReference{Name: secretName}}},
+		{SecretRef: &v1.SecretEnvSource{LocalObjectReference: v1.LocalObjectReference{Name: "missing"}, Optional: &optional}},
+	}
+	pod.Spec.Containers[0].Env = []v1.EnvVar{
+		{Name: "LEVEL", Value: "warn"},
+		{Name: "MODE", Value: ""},
+	}
+
+	envVars, err := provider.getEnvironmentVariables(context.Background(), pod, pod.Spec.Containers[0])
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(envVars, 4))
+
+	level := findEnvVar(envVars, "LEVEL")
+	assert.Assert(t, level != nil, "LEVEL env var should be present")
+	assert.Check(t, is.Equal("warn", *level.Value), "explicit env should take precedence over envFrom")
+	mode := findEnvVar(envVars, "MODE")
+	assert.Assert(t, mode != nil, "MODE env var should be present")
+	assert.Check(t, is.Equal("", *mode.Value), "explicit empty env should take precedence over envFrom")
+	dbMode := findEnvVar(envVars, "DB_MODE")
+	assert.Assert(t, dbMode != nil, "DB_MODE env var should be present")
+	assert.Check(t, is.Nil(dbMode.Value), "secret env var should not use Value")
+	password := findEnvVar(envVars, "DB_PASSWORD")
+	assert.Assert(t, password != nil, "DB_PASSWORD env var should be present")
+	assert.Check(t, is.Equal("s3cr3t", *password.SecureValue), "secret env var should use SecureValue")
+	assert.Check(t, findEnvVar(envVars, "1-invalid") == nil, "invalid key should be skipped")
+	assert.Check(t, findEnvVar(envVars, "BINARY") == nil, "binary data should be skipped")
+
+	select {
+	case event := <-fakeRecorder.Events:
+		assert.Check(t, strings.Contains(event, reasonInvalidEnvironmentVariableNames), "unexpected event %s", event)
+		assert.Check(t, strings.Contains(event, "1-invalid"), "event should list the skipped key")
+	default:
+		t.Fatal("a warning event is expected for invalid keys")
+	}
+
+	pod.Spec.InitContainers = []v1.Container{{
+		Name:    "init",
+		EnvFrom: []v1.EnvFromSource{{SecretRef: &v1.SecretEnvSource{LocalObjectReference: v1.LocalObjectReference{Name: "missing"}}}},
+	}}
+	_, err = provider.getInitContainers(context.Background(), pod)
+	assert.Check(t, errdefs.IsInvalidInput(err), "missing required envFrom secret should fail")
+}
+
+func TestGetEnvironmentVariablesKeepsEmptyValues(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	provider, err := createTestProvider(createNewACIMock(), NewMockConfigMapLister(mockCtrl),
+		NewMockSecretLister(mockCtrl), NewMockPodLister(mockCtrl), nil)
+	if err != nil {
+		t.Fatal("Unable to create test provider", err)
+	}
+
+	// As in kubelet, a variable declared with an empty value is set in the container, the
+	// applications can tell it from an unset variable.
+	pod := testsutil.CreatePodObj(podName, podNamespace)
+	pod.Spec.Containers[0].Env = []v1.EnvVar{
+		{Name: "EMPTY"},
+		{Name: "PLAIN", Value: "value"},
+	}
+
+	envVars, err := provider.getEnvironmentVariables(context.Background(), pod, pod.Spec.Containers[0])
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(envVars, 2))
+
+	empty := findEnvVar(envVars, "EMPTY")
+	assert.Assert(t, empty != nil, "EMPTY env var should be present")
+	assert.Assert(t, empty.Value != nil, "EMPTY env var should have a value")
+	assert.Check(t, is.Equal("", *empty.Value))
+}
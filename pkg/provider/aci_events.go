@@ -0,0 +1,115 @@
+/*
+Copyright (c) Microsoft Corporation.
+Licensed under the Apache 2.0 license.
+*/
+package provider
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	azaciv2 "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerinstance/armcontainerinstance/v2"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/reference"
+)
+
+// The event reasons used by kubelet, see k8s.io/kubernetes/pkg/kubelet/events.
+const (
+	kubeletEventReasonCreated = "Created"
+	kubeletEventReasonStarted = "Started"
+	kubeletEventReasonFailed  = "Failed"
+	kubeletEventReasonKilling = "Killing"
+	kubeletEventReasonBackOff = "BackOff"
+	kubeletEventReasonPulling = "Pulling"
+	kubeletEventReasonPulled  = "Pulled"
+)
+
+// kubeletEventReasons maps the lower cased names of the ACI events to the reasons and types of
+// the events kubelet records in the same situation.
+var kubeletEventReasons = map[string]struct {
+	reason    string
+	eventType string
+}{
+	"pulling":  {kubeletEventReasonPulling, v1.EventTypeNormal},
+	"pulled":   {kubeletEventReasonPulled, v1.EventTypeNormal},
+	"created":  {kubeletEventReasonCreated, v1.EventTypeNormal},
+	"started":  {kubeletEventReasonStarted, v1.EventTypeNormal},
+	"killing":  {kubeletEventReasonKilling, v1.EventTypeNormal},
+	"backoff":  {kubeletEventReasonBackOff, v1.EventTypeWarning},
+	"back-off": {kubeletEventReasonBackOff, v1.EventTypeWarning},
+	"failed":   {kubeletEventReasonFailed, v1.EventTypeWarning},
+}
+
+// toKubeletEvent returns the reason and type kubelet uses for an ACI event. The names of the
+// events unknown to kubelet are kept as they are.
+func toKubeletEvent(name, eventType string) (string, string) {
+	if kubeletEvent, ok := kubeletEventReasons[strings.ToLower(name)]; ok {
+		return kubeletEvent.reason, kubeletEvent.eventType
+	}
+	return name, eventType
+}
+
+// sendContainerGroupEvents reports the events of the container group, and of its containers, of the pod.
+func sendContainerGroupEvents(ctx context.Context, pod *v1.Pod, cg *azaciv2.ContainerGroup, evtSink func(evt *PodEvent)) {
+	if cg.Properties == nil {
+		return
+	}
+
+	if cg.Properties.InstanceView != nil {
+		for _, evt := range cg.Properties.InstanceView.Events {
+			sendPodEvent(evtSink, pod, "", evt)
+		}
+	}
+
+	for _, container := range cg.Properties.Containers {
+		if container.Name == nil || container.Properties == nil || container.Properties.InstanceView == nil ||
+			len(container.Properties.InstanceView.Events) == 0 {
+			continue
+		}
+
+		podReference, err := reference.GetReference(scheme.Scheme, pod)
+		if err != nil {
+			log.G(ctx).WithError(err).Warnf("cannot get k8s object reference from pod %s in namespace %s", pod.Name, pod.Namespace)
+			continue
+		}
+		podReference.FieldPath = fmt.Sprintf("spec.containers{%s}", *container.Name)
+
+		for _, evt := range container.Properties.InstanceView.Events {
+			sendPodEvent(evtSink, podReference, *container.Name, evt)
+		}
+	}
+}
+
+func sendPodEvent(evtSink func(evt *PodEvent), object runtime.Object, container string, evt *azaciv2.Event) {
+	if evt == nil || evt.Name == nil {
+		return
+	}
+
+	var eventType, message string
+	if evt.Type != nil {
+		eventType = *evt.Type
+	}
+	if evt.Message != nil {
+		message = *evt.Message
+	}
+	var count int32 = 1
+	if evt.Count != nil {
+		count = *evt.Count
+	}
+
+	reason, eventType := toKubeletEvent(*evt.Name, eventType)
+	evtSink(&PodEvent{
+		Object:         object,
+		Container:      container,
+		Type:           eventType,
+		Reason:         reason,
+		Message:        message,
+		Count:          count,
+		FirstTimestamp: evt.FirstTimestamp,
+		LastTimestamp:  evt.LastTimestamp,
+	})
+}
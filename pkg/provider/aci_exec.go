@@ -0,0 +1,395 @@
+/*
+Copyright (c) Microsoft Corporation.
+Licensed under the Apache 2.0 license.
+*/
+package provider
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	azaciv2 "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerinstance/armcontainerinstance/v2"
+	"github.com/google/uuid"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	"github.com/virtual-kubelet/virtual-kubelet/node/api"
+	"github.com/virtual-kubelet/virtual-kubelet/trace"
+	utilexec "k8s.io/utils/exec"
+)
+
+const (
+	// execExitCodeMarker prefixes the exit status printed by the exec wrapper, it is stripped from the output.
+	execExitCodeMarker = "__VK_ACI_EXIT_CODE__="
+	// execTTYFilePrefix prefixes the file the exec wrapper records the terminal of the session in,
+	// so it can be resized from another exec session.
+	execTTYFilePrefix = "/tmp/.vk-aci-exec-tty-"
+	// terminalResizeDelay coalesces the resizes of the client terminal, each one is applied with an
+	// exec request to ARM.
+	terminalResizeDelay = 500 * time.Millisecond
+
+	defaultExecTerminalWidth  = 60
+	defaultExecTerminalHeight = 120
+	initialTerminalSizeWait   = 5 * time.Second
+)
+
+// RunInContainer executes a command in a container in the pod, copying data
+// between in/out/err and the container's stdin/stdout/stderr.
+func (p *ACIProvider) RunInContainer(ctx context.Context, namespace, name, container string, cmd []string, attach api.AttachIO) error {
+	ctx, span := trace.StartSpan(ctx, "aci.RunInContainer")
+	defer span.End()
+	ctx = addAzureAttributes(ctx, span, p)
+
+	out := containerOutput(attach)
+	if out != nil {
+		defer out.Close()
+	}
+
+	cg, err := p.getContainerGroupInfo(ctx, namespace, name, p.nodeName)
+	if err != nil {
+		return err
+	}
+
+	// The resizes of the client terminal are applied until the session ends.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	termSize := api.TermSize{
+		Width:  defaultExecTerminalWidth,
+		Height: defaultExecTerminalHeight,
+	}
+	var resize <-chan api.TermSize
+	if attach.TTY() {
+		resize = attach.Resize()
+		termSize = getInitialTerminalSize(ctx, resize, termSize)
+	}
+
+	// The command is wrapped in a shell on Linux only, when the options needing it are enabled.
+	linux := p.operatingSystem != string(azaciv2.OperatingSystemTypesWindows)
+	detectExitCode := p.execExitCodeDetection && linux
+	ttyFile := ""
+	if resize != nil && p.execTerminalResize && linux {
+		ttyFile = execTTYFilePrefix + uuid.New().String()
+	}
+	if detectExitCode || ttyFile != "" {
+		cmd = wrapExecCommand(cmd, ttyFile, detectExitCode)
+	}
+
+	cols := int32(termSize.Width)
+	rows := int32(termSize.Height)
+	cmdParam := quoteExecCommand(cmd, p.operatingSystem)
+	req := azaciv2.ContainerExecRequest{
+		Command: &cmdParam,
+		TerminalSize: &azaciv2.ContainerExecRequestTerminalSize{
+			Cols: &cols,
+			Rows: &rows,
+		},
+	}
+
+	xcrsp, err := p.azClientsAPIs.ExecuteContainerCommand(ctx, p.resourceGroup, *cg.Name, container, req)
+	if err != nil {
+		return err
+	}
+
+	c, err := dialContainerStream(ctx, *xcrsp.WebSocketURI, *xcrsp.Password, passwordAsFirstMessage)
+	if err != nil {
+		return err
+	}
+	if resize != nil {
+		go p.applyTerminalResizes(ctx, *cg.Name, container, ttyFile, resize)
+	}
+
+	if !detectExitCode {
+		if err := streamContainer(ctx, c, attach.Stdin(), out); err != nil {
+			return err
+		}
+		return ctx.Err()
+	}
+
+	exitCodeOut := &exitCodeWriter{out: out}
+	err = streamContainer(ctx, c, attach.Stdin(), exitCodeOut)
+	if flushErr := exitCodeOut.Flush(); err == nil {
+		err = flushErr
+	}
+	if err != nil {
+		return err
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	if code, ok := exitCodeOut.ExitCode(); ok && code != 0 {
+		return utilexec.CodeExitError{
+			Err:  fmt.Errorf("command terminated with exit code %d", code),
+			Code: code,
+		}
+	}
+	return nil
+}
+
+// getInitialTerminalSize returns the size of the client terminal to start the exec session with,
+// the latest size received by then is used.
+func getInitialTerminalSize(ctx context.Context, resize <-chan api.TermSize, termSize api.TermSize) api.TermSize {
+	if resize == nil {
+		return termSize
+	}
+
+	select {
+	case size, ok := <-resize:
+		if ok {
+			termSize = size
+		}
+	case <-time.After(initialTerminalSizeWait):
+		log.G(ctx).Debugf("no terminal size received, using %dx%d", termSize.Width, termSize.Height)
+	case <-ctx.Done():
+		return termSize
+	}
+
+	// Apply the resize events already queued by the client before the session starts.
+	for {
+		select {
+		case size, ok := <-resize:
+			if !ok {
+				return termSize
+			}
+			termSize = size
+		default:
+			return termSize
+		}
+	}
+}
+
+// applyTerminalResizes applies the resizes of the client terminal to the exec session until it
+// ends. ACI only takes the terminal size when a session is created, so the terminal recorded by
+// the exec wrapper in ttyFile is resized with stty from another exec session, which signals the
+// command with SIGWINCH. The resizes received within terminalResizeDelay are applied at once.
+// Without ttyFile the resizes are only consumed, so the client is never blocked.
+func (p *ACIProvider) applyTerminalResizes(ctx context.Context, cgName, container, ttyFile string, resize <-chan api.TermSize) {
+	var latest api.TermSize
+	var apply <-chan time.Time
+	for {
+		select {
+		case size, ok := <-resize:
+			if !ok {
+				return
+			}
+			if ttyFile == "" {
+				log.G(ctx).Debugf("terminal resized to %dx%d, the exec sessions are not resized when ACI_EXEC_TERMINAL_RESIZE is false", size.Width, size.Height)
+				continue
+			}
+			latest = size
+			if apply == nil {
+				apply = time.After(terminalResizeDelay)
+			}
+		case <-apply:
+			apply = nil
+			if err := p.resizeExecTerminal(ctx, cgName, container, ttyFile, latest); err != nil && ctx.Err() == nil {
+				log.G(ctx).WithError(err).Warnf("failed to resize the terminal of the exec session to %dx%d", latest.Width, latest.Height)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// resizeExecTerminal resizes the terminal recorded in ttyFile from a new exec session.
+func (p *ACIProvider) resizeExecTerminal(ctx context.Context, cgName, container, ttyFile string, size api.TermSize) error {
+	script := fmt.Sprintf(`stty -F "$(cat %s)" cols %d rows %d`, ttyFile, size.Width, size.Height)
+	cmd := quoteExecCommand([]string{"/bin/sh", "-c", script}, p.operatingSystem)
+	cols := int32(size.Width)
+	rows := int32(size.Height)
+	req := azaciv2.ContainerExecRequest{
+		Command: &cmd,
+		TerminalSize: &azaciv2.ContainerExecRequestTerminalSize{
+			Cols: &cols,
+			Rows: &rows,
+		},
+	}
+
+	xcrsp, err := p.azClientsAPIs.ExecuteContainerCommand(ctx, p.resourceGroup, cgName, container, req)
+	if err != nil {
+		return err
+	}
+	c, err := dialContainerStream(ctx, *xcrsp.WebSocketURI, *xcrsp.Password, passwordAsFirstMessage)
+	if err != nil {
+		return err
+	}
+	return streamContainer(ctx, c, nil, nil)
+}
+
+// wrapExecCommand runs the command through a shell, as the ACI exec endpoint can neither resize
+// the terminal of a session nor report the exit status of its command. The shell records the
+// terminal of the session in ttyFile when it is set, and prints the exit status of the command
+// once it completes when exitCode is set.
+func wrapExecCommand(cmd []string, ttyFile string, exitCode bool) []string {
+	var b strings.Builder
+	if ttyFile != "" {
+		fmt.Fprintf(&b, "tty > %s; ", ttyFile)
+	}
+	fmt.Fprintf(&b, "%s; status=$?; ", quoteExecCommand(cmd, ""))
+	if ttyFile != "" {
+		fmt.Fprintf(&b, "rm -f %s; ", ttyFile)
+	}
+	if exitCode {
+		fmt.Fprintf(&b, "printf '%%s%%d\\n' '%s' \"$status\"; ", execExitCodeMarker)
+	}
+	b.WriteString(`exit "$status"`)
+	return []string{"/bin/sh", "-c", b.String()}
+}
+
+// quoteExecCommand flattens argv into the single command line accepted by the ACI exec endpoint,
+// quoting the arguments so they are split back as they were given.
+func quoteExecCommand(cmd []string, operatingSystem string) string {
+	quoted := make([]string, 0, len(cmd))
+	for _, arg := range cmd {
+		if operatingSystem == string(azaciv2.OperatingSystemTypesWindows) {
+			quoted = append(quoted, quoteWindowsArg(arg))
+		} else {
+			quoted = append(quoted, quotePosixArg(arg))
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+func quotePosixArg(arg string) string {
+	if arg == "" {
+		return "''"
+	}
+	safe := true
+	for _, r := range arg {
+		if !isSafeCommandRune(r) {
+			safe = false
+			break
+		}
+	}
+	if safe {
+		return arg
+	}
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
+// quoteWindowsArg follows the CommandLineToArgvW rules.
+func quoteWindowsArg(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\n\v\"") {
+		return arg
+	}
+
+	var b strings.Builder
+	b.WriteByte('"')
+	backslashes := 0
+	for _, r := range arg {
+		switch r {
+		case '\\':
+			backslashes++
+			continue
+		case '"':
+			b.WriteString(strings.Repeat(`\`, backslashes*2+1))
+		default:
+			b.WriteString(strings.Repeat(`\`, backslashes))
+		}
+		backslashes = 0
+		b.WriteRune(r)
+	}
+	b.WriteString(strings.Repeat(`\`, backslashes*2))
+	b.WriteByte('"')
+	return b.String()
+}
+
+func isSafeCommandRune(r rune) bool {
+	return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') ||
+		strings.ContainsRune("-_./:=@%+,", r)
+}
+
+// exitCodeWriter forwards the output of a wrapped exec command, stripping the exit status printed
+// by the wrapper.
+type exitCodeWriter struct {
+	out io.Writer
+
+	lock     sync.Mutex
+	pending  []byte
+	exitCode *int
+}
+
+func (w *exitCodeWriter) Write(data []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.exitCode != nil {
+		// Nothing is expected after the exit status.
+		return len(data), nil
+	}
+
+	w.pending = append(w.pending, data...)
+	marker := []byte(execExitCodeMarker)
+
+	if i := bytes.Index(w.pending, marker); i >= 0 {
+		rest := w.pending[i+len(marker):]
+		end := bytes.IndexAny(rest, "\r\n")
+		if end < 0 {
+			// Wait for the rest of the exit status.
+			return len(data), w.write(w.pending[:i])
+		}
+		if code, err := strconv.Atoi(string(rest[:end])); err == nil {
+			w.exitCode = &code
+		}
+		head := w.pending[:i]
+		w.pending = nil
+		return len(data), w.writeAll(head)
+	}
+
+	// Keep the end of the output that could be the beginning of the marker.
+	keep := 0
+	for n := len(marker) - 1; n > 0; n-- {
+		if len(w.pending) >= n && bytes.Equal(w.pending[len(w.pending)-n:], marker[:n]) {
+			keep = n
+			break
+		}
+	}
+	flush := w.pending[:len(w.pending)-keep]
+	w.pending = append([]byte(nil), w.pending[len(w.pending)-keep:]...)
+	return len(data), w.writeAll(flush)
+}
+
+// write forwards the output before the marker, and keeps only the marker pending.
+func (w *exitCodeWriter) write(head []byte) error {
+	tail := append([]byte(nil), w.pending[len(head):]...)
+	err := w.writeAll(head)
+	w.pending = tail
+	return err
+}
+
+func (w *exitCodeWriter) writeAll(data []byte) error {
+	if w.out == nil || len(data) == 0 {
+		return nil
+	}
+	_, err := w.out.Write(data)
+	return err
+}
+
+// Flush forwards the output kept back when the stream ends without an exit status.
+func (w *exitCodeWriter) Flush() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.exitCode != nil {
+		return nil
+	}
+	pending := w.pending
+	w.pending = nil
+	return w.writeAll(pending)
+}
+
+// ExitCode returns the exit status of the command, if it was received.
+func (w *exitCodeWriter) ExitCode() (int, bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.exitCode == nil {
+		return 0, false
+	}
+	return *w.exitCode, true
+}
@@ -0,0 +1,310 @@
+/*
+Copyright (c) Microsoft Corporation.
+Licensed under the Apache 2.0 license.
+*/
+package provider
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	azaciv2 "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerinstance/armcontainerinstance/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/gorilla/websocket"
+	testsutil "github.com/virtual-kubelet/azure-aci/pkg/tests"
+	"github.com/virtual-kubelet/virtual-kubelet/node/api"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	utilexec "k8s.io/utils/exec"
+)
+
+func TestQuoteExecCommand(t *testing.T) {
+	cases := []struct {
+		description     string
+		cmd             []string
+		operatingSystem string
+		expected        string
+	}{
+		{
+			description: "plain arguments are not quoted",
+			cmd:         []string{"ls", "-la", "/var/log"},
+			expected:    "ls -la /var/log",
+		},
+		{
+			description: "arguments with spaces and quotes are quoted",
+			cmd:         []string{"sh", "-c", "echo 'hello world' && exit 3"},
+			expected:    `sh -c 'echo '\''hello world'\'' && exit 3'`,
+		},
+		{
+			description: "empty arguments are kept",
+			cmd:         []string{"printf", ""},
+			expected:    "printf ''",
+		},
+		{
+			description:     "windows arguments follow the command line rules",
+			cmd:             []string{"cmd", "/c", `echo "a b"`, `C:\dir with space\`},
+			operatingSystem: string(azaciv2.OperatingSystemTypesWindows),
+			expected:        `cmd /c "echo \"a b\"" "C:\dir with space\\"`,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.description, func(t *testing.T) {
+			assert.Check(t, is.Equal(quoteExecCommand(tc.cmd, tc.operatingSystem), tc.expected))
+		})
+	}
+}
+
+// TestWrapExecCommandInShell runs the command line sent to the ACI exec endpoint with a POSIX
+// shell, the wrapper hands the quoted command to /bin/sh, which splits it back into its arguments.
+func TestWrapExecCommandInShell(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires a POSIX shell")
+	}
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("requires a POSIX shell")
+	}
+
+	args := []string{"hello world", "it's", `"quoted"`, "$HOME", "`id`", `back\slash`, "", "line\nbreak", "a;b && c"}
+	cmd := append([]string{"/bin/sh", "-c", `printf '[%s]' "$@"; exit 3`, "sh"}, args...)
+	wrapped := wrapExecCommand(cmd, "", true)
+
+	out, err := exec.Command(sh, "-c", quoteExecCommand(wrapped, "")).Output()
+	var exitErr *exec.ExitError
+	assert.Assert(t, errors.As(err, &exitErr), "expected the exit status of the command, got %v", err)
+	assert.Check(t, is.Equal(exitErr.ExitCode(), 3))
+
+	var expected strings.Builder
+	for _, arg := range args {
+		expected.WriteString("[" + arg + "]")
+	}
+	assert.Check(t, is.Equal(string(out), expected.String()+execExitCodeMarker+"3\n"))
+}
+
+func TestExecOptionsCanBeDisabled(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	t.Setenv("ACI_EXEC_EXIT_CODE_DETECTION", "false")
+	t.Setenv("ACI_EXEC_TERMINAL_RESIZE", "false")
+	provider, err := createTestProvider(createNewACIMock(), NewMockConfigMapLister(mockCtrl),
+		NewMockSecretLister(mockCtrl), NewMockPodLister(mockCtrl), nil)
+	if err != nil {
+		t.Fatal("failed to create the test provider", err)
+	}
+	assert.Check(t, !provider.execExitCodeDetection)
+	assert.Check(t, !provider.execTerminalResize)
+}
+
+func TestExitCodeWriter(t *testing.T) {
+	cases := []struct {
+		description      string
+		chunks           []string
+		expectedOutput   string
+		expectedExitCode int
+		hasExitCode      bool
+	}{
+		{
+			description:      "exit status is stripped from the output",
+			chunks:           []string{"hello\n", execExitCodeMarker + "3\n"},
+			expectedOutput:   "hello\n",
+			expectedExitCode: 3,
+			hasExitCode:      true,
+		},
+		{
+			description:      "exit status split across messages",
+			chunks:           []string{"hello" + execExitCodeMarker[:5], execExitCodeMarker[5:] + "4", "2\r\n"},
+			expectedOutput:   "hello",
+			expectedExitCode: 42,
+			hasExitCode:      true,
+		},
+		{
+			description:    "output looking like the beginning of the marker is kept",
+			chunks:         []string{"__VK", "_other\n"},
+			expectedOutput: "__VK_other\n",
+		},
+		{
+			description:    "output kept back is flushed when there is no exit status",
+			chunks:         []string{"partial __VK"},
+			expectedOutput: "partial __VK",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.description, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			w := &exitCodeWriter{out: out}
+			for _, chunk := range tc.chunks {
+				n, err := w.Write([]byte(chunk))
+				assert.NilError(t, err)
+				assert.Check(t, is.Equal(n, len(chunk)))
+			}
+			assert.NilError(t, w.Flush())
+
+			assert.Check(t, is.Equal(out.String(), tc.expectedOutput))
+			code, ok := w.ExitCode()
+			assert.Check(t, is.Equal(ok, tc.hasExitCode))
+			assert.Check(t, is.Equal(code, tc.expectedExitCode))
+		})
+	}
+}
+
+func TestRunInContainerReportsExitCode(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	password := "fake-password"
+	var command string
+
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+
+		_, msg, err := c.ReadMessage()
+		assert.Check(t, err)
+		assert.Check(t, is.Equal(string(msg), password))
+
+		_ = c.WriteMessage(websocket.BinaryMessage, []byte("some output\n"))
+		_ = c.WriteMessage(websocket.BinaryMessage, []byte(execExitCodeMarker+"3\n"))
+		_ = c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	}))
+	defer server.Close()
+
+	aciMocks := createNewACIMock()
+	aciMocks.MockGetContainerGroupInfo = func(ctx context.Context, resourceGroup, namespace, name, nodeName string) (*azaciv2.ContainerGroup, error) {
+		return testsutil.CreateContainerGroupObj(podName, podNamespace, "Succeeded",
+			testsutil.CreateACIContainersListObj(runningState, "Initializing", testsutil.CgCreationTime.Add(time.Second*2), testsutil.CgCreationTime.Add(time.Second*3), true, true, true), "Succeeded"), nil
+	}
+	aciMocks.MockExecuteContainerCommand = func(ctx context.Context, resourceGroup, cgName, containerName string, containerReq azaciv2.ContainerExecRequest) (*azaciv2.ContainerExecResponse, error) {
+		command = *containerReq.Command
+		wsURI := "ws" + strings.TrimPrefix(server.URL, "http")
+		return &azaciv2.ContainerExecResponse{
+			WebSocketURI: &wsURI,
+			Password:     &password,
+		}, nil
+	}
+
+	provider, err := createTestProvider(aciMocks, NewMockConfigMapLister(mockCtrl),
+		NewMockSecretLister(mockCtrl), NewMockPodLister(mockCtrl), nil)
+	if err != nil {
+		t.Fatal("failed to create the test provider", err)
+	}
+	// The exit code detection is enabled by default.
+	assert.Check(t, provider.execExitCodeDetection)
+
+	out := &nopCloserBuffer{}
+	attachIO := NewMockAttachIO(mockCtrl)
+	attachIO.EXPECT().TTY().Return(false)
+	attachIO.EXPECT().Stdout().Return(out)
+	attachIO.EXPECT().Stdin().Return(nil)
+
+	err = provider.RunInContainer(context.Background(), podNamespace, podName, "container", []string{"sh", "-c", "exit 3"}, attachIO)
+
+	var exitErr utilexec.CodeExitError
+	assert.Assert(t, errors.As(err, &exitErr), "expected an exit error, got %v", err)
+	assert.Check(t, is.Equal(exitErr.ExitStatus(), 3))
+	assert.Check(t, is.Equal(out.String(), "some output\n"))
+	assert.Check(t, strings.HasPrefix(command, "/bin/sh -c 'sh -c '\\''exit 3'\\''; status=$?; printf"), command)
+}
+
+func TestRunInContainerAppliesTerminalResizes(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	password := "fake-password"
+	var lock sync.Mutex
+	var commands []string
+	resized := make(chan struct{})
+
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		_, _, _ = c.ReadMessage()
+
+		// The session lasts until the terminal is resized, the resize sessions end at once.
+		if r.URL.Path == "/session" {
+			select {
+			case <-resized:
+			case <-time.After(10 * time.Second):
+			}
+		}
+		_ = c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	}))
+	defer server.Close()
+
+	aciMocks := createNewACIMock()
+	aciMocks.MockGetContainerGroupInfo = func(ctx context.Context, resourceGroup, namespace, name, nodeName string) (*azaciv2.ContainerGroup, error) {
+		return testsutil.CreateContainerGroupObj(podName, podNamespace, "Succeeded",
+			testsutil.CreateACIContainersListObj(runningState, "Initializing", testsutil.CgCreationTime.Add(time.Second*2), testsutil.CgCreationTime.Add(time.Second*3), true, true, true), "Succeeded"), nil
+	}
+	aciMocks.MockExecuteContainerCommand = func(ctx context.Context, resourceGroup, cgName, containerName string, containerReq azaciv2.ContainerExecRequest) (*azaciv2.ContainerExecResponse, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		commands = append(commands, *containerReq.Command)
+		path := "/session"
+		if len(commands) > 1 {
+			path = "/resize"
+			assert.Check(t, is.Equal(*containerReq.TerminalSize.Cols, int32(100)))
+			assert.Check(t, is.Equal(*containerReq.TerminalSize.Rows, int32(40)))
+			close(resized)
+		}
+		wsURI := "ws" + strings.TrimPrefix(server.URL, "http") + path
+		return &azaciv2.ContainerExecResponse{
+			WebSocketURI: &wsURI,
+			Password:     &password,
+		}, nil
+	}
+
+	provider, err := createTestProvider(aciMocks, NewMockConfigMapLister(mockCtrl),
+		NewMockSecretLister(mockCtrl), NewMockPodLister(mockCtrl), nil)
+	if err != nil {
+		t.Fatal("failed to create the test provider", err)
+	}
+	assert.Check(t, provider.execTerminalResize, "the terminal resize should be enabled by default")
+	provider.execExitCodeDetection = false
+
+	termSize := make(chan api.TermSize, 3)
+	termSize <- api.TermSize{Width: 80, Height: 24}
+	attachIO := NewMockAttachIO(mockCtrl)
+	attachIO.EXPECT().TTY().Return(true)
+	attachIO.EXPECT().Resize().Return(termSize)
+	attachIO.EXPECT().Stdout().Return(&nopCloserBuffer{})
+	attachIO.EXPECT().Stdin().Return(nil)
+
+	go func() {
+		// The resizes received together are applied at once.
+		time.Sleep(100 * time.Millisecond)
+		termSize <- api.TermSize{Width: 90, Height: 30}
+		termSize <- api.TermSize{Width: 100, Height: 40}
+	}()
+	err = provider.RunInContainer(context.Background(), podNamespace, podName, "container", []string{"bash"}, attachIO)
+	assert.NilError(t, err)
+
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Assert(t, is.Len(commands, 2))
+	assert.Check(t, strings.HasPrefix(commands[0], "/bin/sh -c 'tty > "+execTTYFilePrefix), commands[0])
+	assert.Check(t, !strings.Contains(commands[0], execExitCodeMarker), "the exit code detection is disabled")
+	ttyFile := strings.TrimPrefix(commands[0], "/bin/sh -c 'tty > ")
+	ttyFile = ttyFile[:strings.Index(ttyFile, ";")]
+	assert.Check(t, is.Equal(commands[1], quoteExecCommand([]string{"/bin/sh", "-c",
+		`stty -F "$(cat ` + ttyFile + `)" cols 100 rows 40`}, "")))
+}
@@ -0,0 +1,331 @@
+/*
+Copyright (c) Microsoft Corporation.
+Licensed under the Apache 2.0 license.
+*/
+package provider
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"time"
+
+	azaciv2 "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerinstance/armcontainerinstance/v2"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	"github.com/virtual-kubelet/virtual-kubelet/node/api"
+	"github.com/virtual-kubelet/virtual-kubelet/trace"
+	v1 "k8s.io/api/core/v1"
+	k8serr "k8s.io/apimachinery/pkg/api/errors"
+)
+
+var (
+	// logsFollowInterval is how often ACI is polled for new log lines when following the logs. The
+	// interval doubles while there are no new lines, up to logsFollowMaxInterval.
+	logsFollowInterval    = 2 * time.Second
+	logsFollowMaxInterval = 30 * time.Second
+)
+
+// logLine is a line of container logs as returned by ACI with timestamps enabled.
+type logLine struct {
+	timestamp time.Time
+	// raw is the line as returned by ACI, content is the line without its timestamp.
+	raw     string
+	content string
+}
+
+// GetContainerLogs returns the logs of a pod by name that is running inside ACI.
+func (p *ACIProvider) GetContainerLogs(ctx context.Context, namespace, podName, containerName string, opts api.ContainerLogOpts) (io.ReadCloser, error) {
+	ctx, span := trace.StartSpan(ctx, "aci.GetContainerLogs")
+	defer span.End()
+	ctx = addAzureAttributes(ctx, span, p)
+
+	cg, err := p.getContainerGroupInfo(ctx, namespace, podName, p.nodeName)
+	if err != nil && !(errdefs.IsNotFound(err) && p.logArchiver != nil) {
+		return nil, err
+	}
+
+	// The logs of the previous instances and of the deleted container groups are served from
+	// the log archive.
+	if opts.Previous || cg == nil {
+		lines, err := p.getArchivedContainerLogs(ctx, namespace, podName, containerName, opts, cg)
+		if err != nil {
+			return nil, err
+		}
+		return newLogsReader(selectLogLines(lines, getLogsSince(opts), opts.Tail), opts), nil
+	}
+
+	lines, err := p.listLogLines(ctx, *cg.Name, containerName, opts)
+	if err != nil {
+		return nil, err
+	}
+	if lines == nil && !opts.Follow {
+		return nil, nil
+	}
+
+	since := getLogsSince(opts)
+	lines = selectLogLines(lines, since, opts.Tail)
+	if !opts.Follow {
+		return newLogsReader(lines, opts), nil
+	}
+
+	reader, pipeWriter := io.Pipe()
+	go func() {
+		writer := &logsWriter{out: pipeWriter, opts: opts}
+		err := p.followContainerLogs(ctx, namespace, podName, *cg.Name, containerName, lines, since, writer)
+		pipeWriter.CloseWithError(err)
+	}()
+	return reader, nil
+}
+
+// listLogLines returns the logs of the container. The timestamps are always requested from ACI,
+// they are needed to filter and follow the logs, and only written out when requested.
+func (p *ACIProvider) listLogLines(ctx context.Context, cgName, containerName string, opts api.ContainerLogOpts) ([]logLine, error) {
+	listOpts := api.ContainerLogOpts{Timestamps: true}
+	if getLogsSince(opts).IsZero() {
+		listOpts.Tail = opts.Tail
+	}
+
+	logContent, err := p.azClientsAPIs.ListLogs(ctx, p.resourceGroup, cgName, containerName, listOpts)
+	if err != nil {
+		return nil, err
+	}
+	if logContent == nil {
+		return nil, nil
+	}
+	return parseLogLines(*logContent), nil
+}
+
+// followContainerLogs writes the log lines already read, then polls ACI for the new lines until
+// the container terminates, the limit of bytes is reached or ctx is cancelled.
+func (p *ACIProvider) followContainerLogs(ctx context.Context, namespace, podName, cgName, containerName string, lines []logLine, since time.Time, writer *logsWriter) error {
+	// The span of the request ends once the logs are returned, the logs are followed after that.
+	ctx, span := trace.StartSpan(ctx, "aci.followContainerLogs")
+	defer span.End()
+
+	if err := writer.writeLines(lines); err != nil {
+		return ignoreLimitReached(err)
+	}
+	watermark := newLogsWatermark(lines)
+
+	interval := logsFollowInterval
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-timer.C:
+		}
+
+		// Check the state before reading the logs, so the last lines are read when it terminated.
+		terminated := p.isContainerTerminated(namespace, podName, containerName)
+
+		lines, err := p.listLogLines(ctx, cgName, containerName, api.ContainerLogOpts{})
+		if err != nil {
+			if ctx.Err() != nil || errdefs.IsNotFound(err) {
+				return nil
+			}
+			log.G(ctx).WithError(err).Warnf("failed to get the logs of container %s in pod %s", containerName, podName)
+			interval = nextLogsFollowInterval(interval, false)
+			timer.Reset(interval)
+			continue
+		}
+
+		newLines := watermark.newLines(filterLogLinesSince(lines, since))
+		if err := writer.writeLines(newLines); err != nil {
+			return ignoreLimitReached(err)
+		}
+
+		if terminated {
+			return nil
+		}
+		interval = nextLogsFollowInterval(interval, len(newLines) > 0)
+		timer.Reset(interval)
+	}
+}
+
+// nextLogsFollowInterval returns the interval until the next read of the logs, it is reset when
+// new lines were read, and backs off otherwise, as each read lists all the logs of the container.
+func nextLogsFollowInterval(interval time.Duration, newLines bool) time.Duration {
+	if newLines {
+		return logsFollowInterval
+	}
+	return min(interval*2, logsFollowMaxInterval)
+}
+
+// isContainerTerminated tells whether the container terminated from the status of the pod the
+// tracker reported, so following the logs doesn't get the container group from ARM.
+func (p *ACIProvider) isContainerTerminated(namespace, podName, containerName string) bool {
+	pod, err := p.podsL.Pods(namespace).Get(podName)
+	if k8serr.IsNotFound(err) || (err == nil && pod == nil) {
+		// The pod is gone, there are no more logs to follow.
+		return true
+	}
+	if err != nil {
+		return false
+	}
+	if pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+		return true
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.Name == containerName {
+			return status.State.Terminated != nil
+		}
+	}
+	return false
+}
+
+func getContainerRestartCount(cg *azaciv2.ContainerGroup, containerName string) *int32 {
+	if cg.Properties == nil {
+		return nil
+	}
+	for _, container := range cg.Properties.Containers {
+		if container.Name != nil && *container.Name == containerName &&
+			container.Properties != nil && container.Properties.InstanceView != nil {
+			return container.Properties.InstanceView.RestartCount
+		}
+	}
+	return nil
+}
+
+func getLogsSince(opts api.ContainerLogOpts) time.Time {
+	if opts.SinceSeconds > 0 {
+		return time.Now().Add(-time.Duration(opts.SinceSeconds) * time.Second)
+	}
+	return opts.SinceTime
+}
+
+func parseLogLines(content string) []logLine {
+	lines := make([]logLine, 0, strings.Count(content, "\n")+1)
+	var lastTimestamp time.Time
+	for _, raw := range strings.SplitAfter(content, "\n") {
+		if raw == "" {
+			continue
+		}
+
+		line := logLine{raw: raw, content: raw, timestamp: lastTimestamp}
+		if i := strings.IndexByte(raw, ' '); i > 0 {
+			if ts, err := time.Parse(time.RFC3339Nano, raw[:i]); err == nil {
+				line.timestamp = ts
+				line.content = raw[i+1:]
+				lastTimestamp = ts
+			}
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// selectLogLines returns the lines written since the given time, limited to the last tail lines.
+func selectLogLines(lines []logLine, since time.Time, tail int) []logLine {
+	lines = filterLogLinesSince(lines, since)
+	if tail > 0 && len(lines) > tail {
+		lines = lines[len(lines)-tail:]
+	}
+	return lines
+}
+
+func newLogsReader(lines []logLine, opts api.ContainerLogOpts) io.ReadCloser {
+	var b strings.Builder
+	writer := &logsWriter{out: &b, opts: opts}
+	_ = writer.writeLines(lines)
+	return io.NopCloser(strings.NewReader(b.String()))
+}
+
+func filterLogLinesSince(lines []logLine, since time.Time) []logLine {
+	if since.IsZero() {
+		return lines
+	}
+	for i := range lines {
+		if !lines[i].timestamp.Before(since) {
+			return lines[i:]
+		}
+	}
+	return nil
+}
+
+// logsWatermark remembers the last line written, to only write the lines that are new in the next
+// read of the logs. Lines sharing the same timestamp are told apart by their count.
+type logsWatermark struct {
+	timestamp time.Time
+	count     int
+}
+
+func newLogsWatermark(lines []logLine) *logsWatermark {
+	w := &logsWatermark{}
+	w.advance(lines)
+	return w
+}
+
+func (w *logsWatermark) newLines(lines []logLine) []logLine {
+	seen := 0
+	for i := range lines {
+		if lines[i].timestamp.Before(w.timestamp) {
+			continue
+		}
+		if lines[i].timestamp.Equal(w.timestamp) && seen < w.count {
+			seen++
+			continue
+		}
+		newLines := lines[i:]
+		w.advance(newLines)
+		return newLines
+	}
+	return nil
+}
+
+func (w *logsWatermark) advance(lines []logLine) {
+	for i := range lines {
+		if lines[i].timestamp.Equal(w.timestamp) {
+			w.count++
+			continue
+		}
+		w.timestamp = lines[i].timestamp
+		w.count = 1
+	}
+}
+
+// errLogsLimitReached ends the logs once opts.LimitBytes have been written.
+var errLogsLimitReached = errors.New("limit of bytes reached")
+
+func ignoreLimitReached(err error) error {
+	if err == errLogsLimitReached {
+		return nil
+	}
+	return err
+}
+
+// logsWriter writes the log lines as requested by the log options.
+type logsWriter struct {
+	out     io.Writer
+	opts    api.ContainerLogOpts
+	written int
+}
+
+func (w *logsWriter) writeLines(lines []logLine) error {
+	for i := range lines {
+		data := lines[i].content
+		if w.opts.Timestamps {
+			data = lines[i].raw
+		}
+
+		if w.opts.LimitBytes > 0 && w.written+len(data) >= w.opts.LimitBytes {
+			data = data[:w.opts.LimitBytes-w.written]
+			if _, err := io.WriteString(w.out, data); err != nil {
+				return err
+			}
+			w.written += len(data)
+			return errLogsLimitReached
+		}
+
+		n, err := io.WriteString(w.out, data)
+		w.written += n
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,349 @@
+/*
+Copyright (c) Microsoft Corporation.
+Licensed under the Apache 2.0 license.
+*/
+package provider
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	azaciv2 "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerinstance/armcontainerinstance/v2"
+	"github.com/virtual-kubelet/azure-aci/pkg/auth"
+	"github.com/virtual-kubelet/azure-aci/pkg/logarchive"
+	"github.com/virtual-kubelet/azure-aci/pkg/util"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	"github.com/virtual-kubelet/virtual-kubelet/node/api"
+	"github.com/virtual-kubelet/virtual-kubelet/trace"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	logArchiveSinkLocal = "local"
+	logArchiveSinkBlob  = "blob"
+
+	defaultLogArchiveDir = "/var/lib/virtual-kubelet/logs"
+	logArchiveExtension  = ".log"
+
+	// defaultLogArchiveRetention is how long the archives are kept by default.
+	defaultLogArchiveRetention = 7 * 24 * time.Hour
+	// logArchivePruneInterval is how often the archives older than the retention are deleted.
+	logArchivePruneInterval = time.Hour
+)
+
+// newLogArchiveSink returns the sink configured by ACI_LOG_ARCHIVE_SINK, or nil when the log
+// archive is disabled.
+func newLogArchiveSink(ctx context.Context, azConfig auth.Config) (logarchive.Sink, error) {
+	switch sink := os.Getenv("ACI_LOG_ARCHIVE_SINK"); sink {
+	case "":
+		return nil, nil
+	case logArchiveSinkLocal:
+		dir := os.Getenv("ACI_LOG_ARCHIVE_DIR")
+		if dir == "" {
+			dir = defaultLogArchiveDir
+		}
+		return logarchive.NewFileSink(dir)
+	case logArchiveSinkBlob:
+		containerURL := os.Getenv("ACI_LOG_ARCHIVE_BLOB_CONTAINER_URL")
+		if containerURL == "" {
+			return nil, fmt.Errorf("ACI_LOG_ARCHIVE_BLOB_CONTAINER_URL must be set to archive the logs to Azure Blob storage")
+		}
+		credential, err := azConfig.GetCredential(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return logarchive.NewBlobSink(containerURL, credential, azcore.ClientOptions{Cloud: azConfig.Cloud})
+	default:
+		return nil, fmt.Errorf("invalid ACI_LOG_ARCHIVE_SINK %q, expected %q or %q", sink, logArchiveSinkLocal, logArchiveSinkBlob)
+	}
+}
+
+// getLogArchiveRetention returns how long the archives are kept, from ACI_LOG_ARCHIVE_RETENTION.
+// The archives are kept forever when it is 0.
+func getLogArchiveRetention() (time.Duration, error) {
+	v := os.Getenv("ACI_LOG_ARCHIVE_RETENTION")
+	if v == "" {
+		return defaultLogArchiveRetention, nil
+	}
+	retention, err := time.ParseDuration(v)
+	if err != nil || retention < 0 {
+		return 0, fmt.Errorf("invalid ACI_LOG_ARCHIVE_RETENTION %q, expected a positive duration such as 72h, or 0", v)
+	}
+	return retention, nil
+}
+
+// containerLogsArchiver snapshots the logs of the terminated containers before ACI discards them,
+// which is when a container restarts and when its container group is deleted. The archives are
+// keyed by namespace, pod, pod UID, container and restart count of the container instance, so
+// the archives of a previous pod with the same name are never served.
+//
+// ACI only returns the logs of the current instance of a container, the logs of an instance are
+// archived when it is observed terminated, or when the container group is deleted. The instances
+// ACI restarts between two observations of the container group are not archived.
+type containerLogsArchiver struct {
+	sink logarchive.Sink
+	// retention is how long the archives are kept, they are kept forever when it is zero.
+	retention time.Duration
+
+	lock sync.Mutex
+	// archived is the restart count of the last instance archived of the containers, by archive
+	// prefix.
+	archived map[string]int32
+}
+
+func newContainerLogsArchiver(sink logarchive.Sink, retention time.Duration) *containerLogsArchiver {
+	return &containerLogsArchiver{
+		sink:      sink,
+		retention: retention,
+		archived:  make(map[string]int32),
+	}
+}
+
+func logArchivePrefix(namespace, podName string, podUID types.UID, containerName string) string {
+	return path.Join(namespace, podName, string(podUID), containerName) + "/"
+}
+
+func logArchiveKey(namespace, podName string, podUID types.UID, containerName string, restartCount int32) string {
+	return logArchivePrefix(namespace, podName, podUID, containerName) + strconv.Itoa(int(restartCount)) + logArchiveExtension
+}
+
+// observe records the state of a container, and returns whether its instance terminated and is
+// not archived yet.
+func (a *containerLogsArchiver) observe(prefix string, restartCount int32, terminated bool) bool {
+	if !terminated {
+		return false
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if last, ok := a.archived[prefix]; ok && last == restartCount {
+		return false
+	}
+	a.archived[prefix] = restartCount
+	return true
+}
+
+// unobserve forgets the terminated instance of the container, so it is archived again when it is
+// observed next.
+func (a *containerLogsArchiver) unobserve(prefix string, restartCount int32) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if last, ok := a.archived[prefix]; ok && last == restartCount {
+		delete(a.archived, prefix)
+	}
+}
+
+func (a *containerLogsArchiver) forget(namespace, podName string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	prefix := path.Join(namespace, podName) + "/"
+	for key := range a.archived {
+		if strings.HasPrefix(key, prefix) {
+			delete(a.archived, key)
+		}
+	}
+}
+
+// getLogArchivePodUID returns the UID of the pod the logs of the container group are archived
+// for, which is the pod the container group was created for, or the pod of the node when the
+// container group is gone.
+func (p *ACIProvider) getLogArchivePodUID(namespace, podName string, cg *azaciv2.ContainerGroup) types.UID {
+	if uid := util.GetContainerGroupPodUID(cg); uid != "" {
+		return types.UID(uid)
+	}
+	if pod, err := p.podsL.Pods(namespace).Get(podName); err == nil && pod != nil {
+		return pod.UID
+	}
+	return ""
+}
+
+// observeContainerGroupLogs archives the logs of the containers that terminated since the
+// container group was last observed.
+func (p *ACIProvider) observeContainerGroupLogs(ctx context.Context, namespace, podName string, cg *azaciv2.ContainerGroup) {
+	if p.logArchiver == nil || cg.Properties == nil {
+		return
+	}
+	podUID := p.getLogArchivePodUID(namespace, podName, cg)
+	if podUID == "" {
+		return
+	}
+
+	for _, container := range cg.Properties.Containers {
+		if container.Name == nil || container.Properties == nil || container.Properties.InstanceView == nil ||
+			container.Properties.InstanceView.RestartCount == nil {
+			continue
+		}
+		instanceView := container.Properties.InstanceView
+		terminated := instanceView.CurrentState != nil && instanceView.CurrentState.State != nil &&
+			*instanceView.CurrentState.State == "Terminated"
+
+		instance := *instanceView.RestartCount
+		if !p.logArchiver.observe(logArchivePrefix(namespace, podName, podUID, *container.Name), instance, terminated) {
+			continue
+		}
+
+		cgName, containerName := *cg.Name, *container.Name
+		prefix := logArchivePrefix(namespace, podName, podUID, containerName)
+		err := p.backgroundOperations.trySubmit(ctx, func(ctx context.Context) {
+			p.archiveContainerLogs(ctx, cgName, namespace, podName, podUID, containerName, instance)
+		})
+		if err != nil {
+			// The logs are archived on the next status update.
+			log.G(ctx).WithError(err).Debugf("postponing the archiving of the logs of container %s in pod %s", containerName, podName)
+			p.logArchiver.unobserve(prefix, instance)
+		}
+	}
+}
+
+// archiveContainerGroupLogs archives the logs of all the containers of the container group, it is
+// called before the container group is deleted.
+func (p *ACIProvider) archiveContainerGroupLogs(ctx context.Context, namespace, podName string, cg *azaciv2.ContainerGroup) {
+	if p.logArchiver == nil || cg.Properties == nil {
+		return
+	}
+	podUID := p.getLogArchivePodUID(namespace, podName, cg)
+	if podUID == "" {
+		return
+	}
+
+	for _, container := range cg.Properties.Containers {
+		if container.Name == nil {
+			continue
+		}
+		var restartCount int32
+		if container.Properties != nil && container.Properties.InstanceView != nil && container.Properties.InstanceView.RestartCount != nil {
+			restartCount = *container.Properties.InstanceView.RestartCount
+		}
+		p.archiveContainerLogs(ctx, *cg.Name, namespace, podName, podUID, *container.Name, restartCount)
+	}
+}
+
+// archiveContainerLogs stores the logs of a container instance, with their timestamps so they can
+// be filtered when served.
+func (p *ACIProvider) archiveContainerLogs(ctx context.Context, cgName, namespace, podName string, podUID types.UID, containerName string, restartCount int32) {
+	logger := log.G(ctx).WithField("container", containerName).WithField("pod", podName)
+
+	lines, err := p.listLogLines(ctx, cgName, containerName, api.ContainerLogOpts{})
+	if err != nil {
+		logger.WithError(err).Warn("failed to read the logs to archive")
+		return
+	}
+
+	var content strings.Builder
+	for _, line := range lines {
+		content.WriteString(line.raw)
+	}
+	if content.Len() == 0 {
+		return
+	}
+
+	key := logArchiveKey(namespace, podName, podUID, containerName, restartCount)
+	if err := p.logArchiver.sink.Put(ctx, key, []byte(content.String())); err != nil {
+		logger.WithError(err).Warnf("failed to archive the logs to %s", key)
+		return
+	}
+	logger.Debugf("archived the logs to %s", key)
+}
+
+// getArchivedContainerLogs returns the archived logs of a container. The previous instance is the
+// latest archived instance older than the running one, or than the latest archived instance when
+// the container group is gone.
+func (p *ACIProvider) getArchivedContainerLogs(ctx context.Context, namespace, podName, containerName string, opts api.ContainerLogOpts, cg *azaciv2.ContainerGroup) ([]logLine, error) {
+	notFound := errdefs.NotFoundf("container %q in pod %q not found", containerName, podName)
+	if opts.Previous {
+		notFound = errdefs.NotFoundf("previous terminated container %q in pod %q not found", containerName, podName)
+	}
+	if p.logArchiver == nil {
+		return nil, notFound
+	}
+	podUID := p.getLogArchivePodUID(namespace, podName, cg)
+	if podUID == "" {
+		return nil, notFound
+	}
+
+	prefix := logArchivePrefix(namespace, podName, podUID, containerName)
+	keys, err := p.logArchiver.sink.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	instances := make([]int, 0, len(keys))
+	for _, key := range keys {
+		name := strings.TrimSuffix(strings.TrimPrefix(key, prefix), logArchiveExtension)
+		if instance, err := strconv.Atoi(name); err == nil {
+			instances = append(instances, instance)
+		}
+	}
+
+	latest, previous := -1, -1
+	for _, instance := range instances {
+		if instance > latest {
+			latest = instance
+		}
+	}
+	limit := latest
+	if cg != nil {
+		if restartCount := getContainerRestartCount(cg, containerName); restartCount != nil {
+			limit = int(*restartCount)
+		}
+	}
+	for _, instance := range instances {
+		if instance < limit && instance > previous {
+			previous = instance
+		}
+	}
+
+	instance := latest
+	if opts.Previous {
+		instance = previous
+	}
+	if instance < 0 {
+		return nil, notFound
+	}
+
+	content, err := p.logArchiver.sink.Get(ctx, logArchiveKey(namespace, podName, podUID, containerName, int32(instance)))
+	if err != nil {
+		return nil, err
+	}
+	return parseLogLines(string(content)), nil
+}
+
+// runLogArchivePrune deletes the archives older than the retention periodically.
+func (p *ACIProvider) runLogArchivePrune(ctx context.Context) {
+	ticker := time.NewTicker(logArchivePruneInterval)
+	defer ticker.Stop()
+
+	for {
+		p.pruneLogArchive(ctx, time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *ACIProvider) pruneLogArchive(ctx context.Context, now time.Time) {
+	ctx, span := trace.StartSpan(ctx, "aci.pruneLogArchive")
+	defer span.End()
+
+	pruned, err := p.logArchiver.sink.Prune(ctx, now.Add(-p.logArchiver.retention))
+	if err != nil {
+		span.SetStatus(err)
+		log.G(ctx).WithError(err).Warn("failed to delete the log archives older than the retention")
+	}
+	if len(pruned) > 0 {
+		log.G(ctx).Infof("deleted %d log archives older than %s", len(pruned), p.logArchiver.retention)
+	}
+}
@@ -0,0 +1,219 @@
+/*
+Copyright (c) Microsoft Corporation.
+Licensed under the Apache 2.0 license.
+*/
+package provider
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	azaciv2 "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerinstance/armcontainerinstance/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/virtual-kubelet/azure-aci/pkg/logarchive"
+	testsutil "github.com/virtual-kubelet/azure-aci/pkg/tests"
+	"github.com/virtual-kubelet/azure-aci/pkg/util"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"github.com/virtual-kubelet/virtual-kubelet/node/api"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func newLogArchiveTestContainerGroup(state string, restartCount int32, startTime time.Time) *azaciv2.ContainerGroup {
+	cg := testsutil.CreateTestContainerGroupObj(podName, podNamespace, "Succeeded", state, startTime)
+	cg.Properties.Containers[0].Properties.InstanceView.RestartCount = &restartCount
+	return cg
+}
+
+func readContainerLogs(t *testing.T, logs io.ReadCloser, err error) string {
+	t.Helper()
+	assert.NilError(t, err)
+	content, err := io.ReadAll(logs)
+	assert.NilError(t, err)
+	return string(content)
+}
+
+func TestGetContainerLogsPreviousFromArchive(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	sink, err := logarchive.NewFileSink(t.TempDir())
+	assert.NilError(t, err)
+
+	restartTime, err := time.Parse(time.RFC3339, "2023-01-02T10:00:10Z")
+	assert.NilError(t, err)
+
+	var lock sync.Mutex
+	cg := newLogArchiveTestContainerGroup("Terminated", 0, restartTime.Add(-time.Minute))
+	podUID := types.UID(util.GetContainerGroupPodUID(cg))
+	logContent := "2023-01-02T10:00:00Z first instance\n"
+
+	aciMocks := createNewACIMock()
+	aciMocks.MockGetContainerGroupInfo = func(ctx context.Context, resourceGroup, namespace, name, nodeName string) (*azaciv2.ContainerGroup, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		return cg, nil
+	}
+	aciMocks.MockListLogs = func(ctx context.Context, resourceGroup, cgName, containerName string, opts api.ContainerLogOpts) (*string, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		content := logContent
+		return &content, nil
+	}
+
+	provider, err := createTestProvider(aciMocks, NewMockConfigMapLister(mockCtrl),
+		NewMockSecretLister(mockCtrl), NewMockPodLister(mockCtrl), nil)
+	if err != nil {
+		t.Fatal("failed to create the test provider", err)
+	}
+	provider.logArchiver = newContainerLogsArchiver(sink, defaultLogArchiveRetention)
+
+	containerName := testsutil.TestContainerName
+	_, err = provider.GetContainerLogs(context.Background(), podNamespace, podName, containerName, api.ContainerLogOpts{Previous: true})
+	assert.Check(t, errdefs.IsNotFound(err), "expected a NotFound error before any restart, got %v", err)
+
+	// The terminated instance is archived when it is observed.
+	_, err = provider.GetPodStatus(context.Background(), podNamespace, podName)
+	assert.NilError(t, err)
+	key := logArchiveKey(podNamespace, podName, podUID, containerName, 0)
+	assert.NilError(t, waitForLogArchive(sink, key))
+
+	// ACI restarts the container, and only returns the logs of the new instance.
+	lock.Lock()
+	cg = newLogArchiveTestContainerGroup(runningState, 1, restartTime)
+	logContent = "2023-01-02T10:00:11Z second instance\n"
+	lock.Unlock()
+
+	_, err = provider.GetPodStatus(context.Background(), podNamespace, podName)
+	assert.NilError(t, err)
+
+	previous, err := provider.GetContainerLogs(context.Background(), podNamespace, podName, containerName, api.ContainerLogOpts{Previous: true})
+	assert.Check(t, is.Equal(readContainerLogs(t, previous, err), "first instance\n"))
+
+	current, err := provider.GetContainerLogs(context.Background(), podNamespace, podName, containerName, api.ContainerLogOpts{Tail: 1})
+	assert.Check(t, is.Equal(readContainerLogs(t, current, err), "second instance\n"))
+}
+
+func TestGetContainerLogsOfDeletedContainerGroup(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	sink, err := logarchive.NewFileSink(t.TempDir())
+	assert.NilError(t, err)
+
+	deleted := false
+	cg := newLogArchiveTestContainerGroup("Terminated", 2, testsutil.CgCreationTime)
+	aciMocks := createNewACIMock()
+	aciMocks.MockGetContainerGroupInfo = func(ctx context.Context, resourceGroup, namespace, name, nodeName string) (*azaciv2.ContainerGroup, error) {
+		if deleted {
+			return nil, errdefs.NotFound("container group not found")
+		}
+		return cg, nil
+	}
+	aciMocks.MockListLogs = func(ctx context.Context, resourceGroup, cgName, containerName string, opts api.ContainerLogOpts) (*string, error) {
+		content := "2023-01-02T10:00:00Z job failed\n"
+		return &content, nil
+	}
+	aciMocks.MockDeleteContainerGroup = func(ctx context.Context, resourceGroup, cgName string) error {
+		deleted = true
+		return nil
+	}
+
+	// Once the container group is gone, the logs are looked up by the UID of the pod.
+	pod := testsutil.CreatePodObj(podName, podNamespace)
+	pod.UID = types.UID(util.GetContainerGroupPodUID(cg))
+	podLister := NewMockPodLister(mockCtrl)
+	podNamespaceLister := NewMockPodNamespaceLister(mockCtrl)
+	podLister.EXPECT().Pods(podNamespace).Return(podNamespaceLister).AnyTimes()
+	podNamespaceLister.EXPECT().Get(podName).DoAndReturn(func(string) (*v1.Pod, error) {
+		return pod, nil
+	}).AnyTimes()
+
+	provider, err := createTestProvider(aciMocks, NewMockConfigMapLister(mockCtrl),
+		NewMockSecretLister(mockCtrl), podLister, nil)
+	if err != nil {
+		t.Fatal("failed to create the test provider", err)
+	}
+	provider.logArchiver = newContainerLogsArchiver(sink, defaultLogArchiveRetention)
+
+	err = provider.deleteContainerGroup(context.Background(), podNamespace, podName, "")
+	assert.NilError(t, err)
+
+	logs, err := provider.GetContainerLogs(context.Background(), podNamespace, podName, testsutil.TestContainerName, api.ContainerLogOpts{Timestamps: true})
+	assert.Check(t, is.Equal(readContainerLogs(t, logs, err), "2023-01-02T10:00:00Z job failed\n"))
+
+	keys, err := sink.List(context.Background(), logArchivePrefix(podNamespace, podName, pod.UID, testsutil.TestContainerName))
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual(keys, []string{logArchiveKey(podNamespace, podName, pod.UID, testsutil.TestContainerName, 2)}))
+
+	// A new pod with the same name has none of the logs of the previous one.
+	pod = pod.DeepCopy()
+	pod.UID = "recreated-pod"
+	_, err = provider.GetContainerLogs(context.Background(), podNamespace, podName, testsutil.TestContainerName, api.ContainerLogOpts{})
+	assert.Check(t, errdefs.IsNotFound(err), "expected a NotFound error, got %v", err)
+}
+
+func TestGetContainerLogsPreviousWithoutArchive(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	aciMocks := createNewACIMock()
+	aciMocks.MockGetContainerGroupInfo = func(ctx context.Context, resourceGroup, namespace, name, nodeName string) (*azaciv2.ContainerGroup, error) {
+		return newLogArchiveTestContainerGroup(runningState, 1, testsutil.CgCreationTime), nil
+	}
+
+	provider, err := createTestProvider(aciMocks, NewMockConfigMapLister(mockCtrl),
+		NewMockSecretLister(mockCtrl), NewMockPodLister(mockCtrl), nil)
+	if err != nil {
+		t.Fatal("failed to create the test provider", err)
+	}
+
+	_, err = provider.GetContainerLogs(context.Background(), podNamespace, podName, testsutil.TestContainerName, api.ContainerLogOpts{Previous: true})
+	assert.Check(t, errdefs.IsNotFound(err), "expected a NotFound error, got %v", err)
+}
+
+func TestContainerLogsArchiverObserve(t *testing.T) {
+	archiver := newContainerLogsArchiver(nil, 0)
+	prefix := logArchivePrefix(podNamespace, podName, "uid", "container")
+
+	assert.Check(t, !archiver.observe(prefix, 0, false), "a running container should not be archived")
+	assert.Check(t, archiver.observe(prefix, 0, true), "a terminated container should be archived")
+	assert.Check(t, !archiver.observe(prefix, 0, true), "a terminated container should only be archived once")
+	assert.Check(t, !archiver.observe(prefix, 1, false), "a restarted container should not be archived while running")
+	assert.Check(t, archiver.observe(prefix, 1, true), "a terminated instance should be archived after a restart")
+
+	archiver.forget(podNamespace, podName)
+	assert.Check(t, archiver.observe(prefix, 1, true), "a forgotten container should be observed from scratch")
+}
+
+func TestGetLogArchiveRetention(t *testing.T) {
+	t.Setenv("ACI_LOG_ARCHIVE_RETENTION", "")
+	retention, err := getLogArchiveRetention()
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(retention, defaultLogArchiveRetention))
+
+	t.Setenv("ACI_LOG_ARCHIVE_RETENTION", "72h")
+	retention, err = getLogArchiveRetention()
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(retention, 72*time.Hour))
+
+	t.Setenv("ACI_LOG_ARCHIVE_RETENTION", "a week")
+	_, err = getLogArchiveRetention()
+	assert.Check(t, err != nil)
+}
+
+func waitForLogArchive(sink logarchive.Sink, key string) error {
+	var err error
+	for i := 0; i < 100; i++ {
+		if _, err = sink.Get(context.Background(), key); err == nil {
+			return nil
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return err
+}
@@ -0,0 +1,262 @@
+/*
+Copyright (c) Microsoft Corporation.
+Licensed under the Apache 2.0 license.
+*/
+package provider
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	azaciv2 "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerinstance/armcontainerinstance/v2"
+	"github.com/golang/mock/gomock"
+	testsutil "github.com/virtual-kubelet/azure-aci/pkg/tests"
+	"github.com/virtual-kubelet/virtual-kubelet/node/api"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	v1 "k8s.io/api/core/v1"
+)
+
+const testLogContent = "2023-01-02T10:00:00.000000001Z first line\n" +
+	"2023-01-02T10:00:01.000000001Z second line\n" +
+	"continuation of the second line\n" +
+	"2023-01-02T10:00:02.000000001Z third line\n"
+
+func TestGetContainerLogsOptions(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	sinceTime, err := time.Parse(time.RFC3339, "2023-01-02T10:00:01Z")
+	assert.NilError(t, err)
+
+	cases := []struct {
+		description     string
+		opts            api.ContainerLogOpts
+		expectedTail    int
+		expectedContent string
+	}{
+		{
+			description:     "timestamps are stripped by default",
+			opts:            api.ContainerLogOpts{},
+			expectedContent: "first line\nsecond line\ncontinuation of the second line\nthird line\n",
+		},
+		{
+			description:     "timestamps are kept when requested",
+			opts:            api.ContainerLogOpts{Timestamps: true},
+			expectedContent: testLogContent,
+		},
+		{
+			description:     "tail is passed to ACI",
+			opts:            api.ContainerLogOpts{Tail: 2},
+			expectedTail:    2,
+			expectedContent: "continuation of the second line\nthird line\n",
+		},
+		{
+			description:     "lines before sinceTime are filtered out",
+			opts:            api.ContainerLogOpts{SinceTime: sinceTime},
+			expectedContent: "second line\ncontinuation of the second line\nthird line\n",
+		},
+		{
+			description:     "tail is applied after the since filter",
+			opts:            api.ContainerLogOpts{SinceTime: sinceTime, Tail: 1},
+			expectedContent: "third line\n",
+		},
+		{
+			description:     "sinceSeconds filters out old lines",
+			opts:            api.ContainerLogOpts{SinceSeconds: 60},
+			expectedContent: "",
+		},
+		{
+			description:     "output is truncated to limitBytes",
+			opts:            api.ContainerLogOpts{LimitBytes: 15},
+			expectedContent: "first line\nseco",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.description, func(t *testing.T) {
+			aciMocks := createNewACIMock()
+			aciMocks.MockGetContainerGroupInfo = func(ctx context.Context, resourceGroup, namespace, name, nodeName string) (*azaciv2.ContainerGroup, error) {
+				return testsutil.CreateContainerGroupObj(name, namespace, "Succeeded",
+					testsutil.CreateACIContainersListObj(runningState, "Initializing",
+						testsutil.CgCreationTime.Add(time.Second*2), testsutil.CgCreationTime.Add(time.Second*3),
+						false, false, false), "Succeeded"), nil
+			}
+			aciMocks.MockListLogs = func(ctx context.Context, resourceGroup, cgName, containerName string, opts api.ContainerLogOpts) (*string, error) {
+				assert.Check(t, opts.Timestamps, "timestamps should always be requested from ACI")
+				assert.Check(t, is.Equal(opts.Tail, tc.expectedTail))
+
+				content := testLogContent
+				if opts.Tail > 0 {
+					lines := strings.SplitAfter(strings.TrimSuffix(content, "\n"), "\n")
+					content = strings.Join(lines[len(lines)-opts.Tail:], "") + "\n"
+				}
+				return &content, nil
+			}
+
+			provider, err := createTestProvider(aciMocks, NewMockConfigMapLister(mockCtrl),
+				NewMockSecretLister(mockCtrl), NewMockPodLister(mockCtrl), nil)
+			if err != nil {
+				t.Fatal("failed to create the test provider", err)
+			}
+
+			logs, err := provider.GetContainerLogs(context.Background(), podNamespace, podName, testsutil.TestContainerName, tc.opts)
+			assert.NilError(t, err)
+			content, err := io.ReadAll(logs)
+			assert.NilError(t, err)
+			assert.Check(t, is.Equal(string(content), tc.expectedContent))
+		})
+	}
+}
+
+func TestGetContainerLogsFollow(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	defaultInterval := logsFollowInterval
+	logsFollowInterval = 10 * time.Millisecond
+	defer func() { logsFollowInterval = defaultInterval }()
+
+	contents := []string{
+		"2023-01-02T10:00:00Z first line\n2023-01-02T10:00:01Z same time\n",
+		"2023-01-02T10:00:00Z first line\n2023-01-02T10:00:01Z same time\n2023-01-02T10:00:01Z same time\n",
+		"2023-01-02T10:00:00Z first line\n2023-01-02T10:00:01Z same time\n2023-01-02T10:00:01Z same time\n2023-01-02T10:00:02Z last line\n",
+	}
+
+	var lock sync.Mutex
+	reads := 0
+	gets := 0
+	aciMocks := createNewACIMock()
+	aciMocks.MockGetContainerGroupInfo = func(ctx context.Context, resourceGroup, namespace, name, nodeName string) (*azaciv2.ContainerGroup, error) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		gets++
+		return testsutil.CreateContainerGroupObj(name, namespace, "Succeeded",
+			testsutil.CreateACIContainersListObj(runningState, "Initializing",
+				testsutil.CgCreationTime.Add(time.Second*2), testsutil.CgCreationTime.Add(time.Second*3),
+				false, false, false), "Succeeded"), nil
+	}
+	aciMocks.MockListLogs = func(ctx context.Context, resourceGroup, cgName, containerName string, opts api.ContainerLogOpts) (*string, error) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		content := contents[reads]
+		if reads < len(contents)-1 {
+			reads++
+		}
+		return &content, nil
+	}
+
+	// The state of the container is the one the tracker reported on the pod.
+	podLister := NewMockPodLister(mockCtrl)
+	podNamespaceLister := NewMockPodNamespaceLister(mockCtrl)
+	podLister.EXPECT().Pods(podNamespace).Return(podNamespaceLister).AnyTimes()
+	podNamespaceLister.EXPECT().Get(podName).DoAndReturn(func(string) (*v1.Pod, error) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		pod := testsutil.CreatePodObj(podName, podNamespace)
+		status := v1.ContainerStatus{Name: testsutil.TestContainerName}
+		if reads >= len(contents)-1 {
+			status.State.Terminated = &v1.ContainerStateTerminated{ExitCode: 0}
+		} else {
+			status.State.Running = &v1.ContainerStateRunning{}
+		}
+		pod.Status.ContainerStatuses = []v1.ContainerStatus{status}
+		return pod, nil
+	}).AnyTimes()
+
+	provider, err := createTestProvider(aciMocks, NewMockConfigMapLister(mockCtrl),
+		NewMockSecretLister(mockCtrl), podLister, nil)
+	if err != nil {
+		t.Fatal("failed to create the test provider", err)
+	}
+
+	logs, err := provider.GetContainerLogs(context.Background(), podNamespace, podName, testsutil.TestContainerName, api.ContainerLogOpts{Follow: true})
+	assert.NilError(t, err)
+	defer logs.Close()
+
+	done := make(chan []byte)
+	go func() {
+		content, _ := io.ReadAll(logs)
+		done <- content
+	}()
+
+	select {
+	case content := <-done:
+		assert.Check(t, is.Equal(string(content), "first line\nsame time\nsame time\nlast line\n"))
+	case <-time.After(10 * time.Second):
+		t.Fatal("the logs were not closed once the container terminated")
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Check(t, is.Equal(gets, 1), "the container group should only be read once")
+}
+
+func TestNextLogsFollowInterval(t *testing.T) {
+	interval := logsFollowInterval
+	for i := 0; i < 10; i++ {
+		interval = nextLogsFollowInterval(interval, false)
+	}
+	assert.Check(t, is.Equal(interval, logsFollowMaxInterval))
+	assert.Check(t, is.Equal(nextLogsFollowInterval(interval, true), logsFollowInterval))
+	assert.Check(t, is.Equal(nextLogsFollowInterval(logsFollowInterval, false), 2*logsFollowInterval))
+}
+
+func TestGetContainerLogsFollowStopsOnCancel(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	defaultInterval := logsFollowInterval
+	logsFollowInterval = 10 * time.Millisecond
+	defer func() { logsFollowInterval = defaultInterval }()
+
+	aciMocks := createNewACIMock()
+	aciMocks.MockGetContainerGroupInfo = func(ctx context.Context, resourceGroup, namespace, name, nodeName string) (*azaciv2.ContainerGroup, error) {
+		return testsutil.CreateContainerGroupObj(name, namespace, "Succeeded",
+			testsutil.CreateACIContainersListObj(runningState, "Initializing",
+				testsutil.CgCreationTime.Add(time.Second*2), testsutil.CgCreationTime.Add(time.Second*3),
+				false, false, false), "Succeeded"), nil
+	}
+	aciMocks.MockListLogs = func(ctx context.Context, resourceGroup, cgName, containerName string, opts api.ContainerLogOpts) (*string, error) {
+		content := "2023-01-02T10:00:00Z running\n"
+		return &content, nil
+	}
+
+	podLister := NewMockPodLister(mockCtrl)
+	podNamespaceLister := NewMockPodNamespaceLister(mockCtrl)
+	podLister.EXPECT().Pods(podNamespace).Return(podNamespaceLister).AnyTimes()
+	podNamespaceLister.EXPECT().Get(podName).Return(testsutil.CreatePodObj(podName, podNamespace), nil).AnyTimes()
+
+	provider, err := createTestProvider(aciMocks, NewMockConfigMapLister(mockCtrl),
+		NewMockSecretLister(mockCtrl), podLister, nil)
+	if err != nil {
+		t.Fatal("failed to create the test provider", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	logs, err := provider.GetContainerLogs(ctx, podNamespace, podName, testsutil.TestContainerName, api.ContainerLogOpts{Follow: true})
+	assert.NilError(t, err)
+	defer logs.Close()
+
+	done := make(chan []byte)
+	go func() {
+		content, _ := io.ReadAll(logs)
+		done <- content
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case content := <-done:
+		assert.Check(t, is.Equal(string(content), "running\n"))
+	case <-time.After(10 * time.Second):
+		t.Fatal("the logs were not closed once the request was cancelled")
+	}
+}
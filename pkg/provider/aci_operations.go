@@ -0,0 +1,292 @@
+/*
+Copyright (c) Microsoft Corporation.
+Licensed under the Apache 2.0 license.
+*/
+package provider
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/virtual-kubelet/azure-aci/pkg/client"
+	"github.com/virtual-kubelet/azure-aci/pkg/util"
+	"github.com/virtual-kubelet/azure-aci/pkg/validation"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	"github.com/virtual-kubelet/virtual-kubelet/trace"
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// createOperationWorkers bounds the number of container group creations tracked concurrently.
+	createOperationWorkers = 10
+	// deleteOperationWorkers bounds the number of pods terminated concurrently, a termination
+	// lasts up to the grace period of the pod.
+	deleteOperationWorkers = 10
+	// backgroundOperationWorkers bounds the number of redeployments, restarts and log archivings
+	// run concurrently.
+	backgroundOperationWorkers = 5
+	// containerGroupOperationQueueSize is the number of operations waiting for a worker of a pool
+	// before submitting a new one blocks, or is refused by trySubmit.
+	containerGroupOperationQueueSize = 100
+)
+
+// errContainerGroupOperationsBusy is returned when an operation is not queued because the queue
+// of its workers is full.
+var errContainerGroupOperationsBusy = errors.New("too many container group operations in progress")
+
+// containerGroupOperation is the pending part of a container group operation, run by a worker.
+type containerGroupOperation func(ctx context.Context)
+
+// containerGroupOperations is a bounded pool of workers driving the container group long-running
+// operations, so the virtual-kubelet pod workers are not blocked until ARM completes them. Each
+// kind of operation has its own pool, so the slow terminations don't hold up the creations.
+type containerGroupOperations struct {
+	queue chan containerGroupOperation
+}
+
+func newContainerGroupOperations(ctx context.Context, workers int) *containerGroupOperations {
+	ops := &containerGroupOperations{
+		queue: make(chan containerGroupOperation, containerGroupOperationQueueSize),
+	}
+	for i := 0; i < workers; i++ {
+		go ops.run(ctx)
+	}
+	return ops
+}
+
+func (o *containerGroupOperations) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case op := <-o.queue:
+			op(ctx)
+		}
+	}
+}
+
+// submit queues the operation, and waits for room in the queue. The operation runs with the
+// workers context, which outlives the request that submitted it, and keeps the logger of the
+// request.
+func (o *containerGroupOperations) submit(ctx context.Context, op containerGroupOperation) error {
+	select {
+	case o.queue <- withRequestLogger(ctx, op):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// trySubmit queues the operation without waiting, it is used from the pod status updates which
+// retry the operation on their next cycle when the queue is full.
+func (o *containerGroupOperations) trySubmit(ctx context.Context, op containerGroupOperation) error {
+	select {
+	case o.queue <- withRequestLogger(ctx, op):
+		return nil
+	default:
+		return errContainerGroupOperationsBusy
+	}
+}
+
+func withRequestLogger(ctx context.Context, op containerGroupOperation) containerGroupOperation {
+	logger := log.G(ctx)
+	return func(workerCtx context.Context) {
+		op(log.WithLogger(workerCtx, logger))
+	}
+}
+
+// redeployContainerGroup redeploys the container group of a running pod with the container group
+// operation workers, so the pod status updates are not blocked until ARM completes it. Unlike
+// CreatePod, a failure doesn't report the pod as Pending, its container group is still running:
+// done is called with the outcome of the redeployment.
+func (p *ACIProvider) redeployContainerGroup(ctx context.Context, pod *v1.Pod, done func(ctx context.Context, pod *v1.Pod, err error)) error {
+	podCopy := pod.DeepCopy()
+	return p.backgroundOperations.trySubmit(ctx, func(ctx context.Context) {
+		done(ctx, podCopy, p.recreateContainerGroup(ctx, podCopy))
+	})
+}
+
+func (p *ACIProvider) recreateContainerGroup(ctx context.Context, pod *v1.Pod) error {
+	ctx, span := trace.StartSpan(ctx, "aci.recreateContainerGroup")
+	defer span.End()
+	ctx = addAzureAttributes(ctx, span, p)
+
+	cg, err := p.getContainerGroup(ctx, pod)
+	if err != nil {
+		return err
+	}
+	if err := p.migrateLegacyContainerGroup(ctx, pod); err != nil {
+		span.SetStatus(err)
+		return err
+	}
+	poller, err := p.azClientsAPIs.CreateContainerGroup(ctx, p.resourceGroup, pod.Namespace, pod.Name, cg)
+	if err != nil {
+		span.SetStatus(err)
+		return err
+	}
+	if _, err := poller.PollUntilDone(ctx); err != nil {
+		span.SetStatus(err)
+		return err
+	}
+	return nil
+}
+
+// migrateLegacyContainerGroup deletes the container group of the pod created before the names
+// were hashed, so the redeployment under the hashed name doesn't leave it running next to the new
+// one.
+func (p *ACIProvider) migrateLegacyContainerGroup(ctx context.Context, pod *v1.Pod) error {
+	current, err := p.getContainerGroupInfo(ctx, pod.Namespace, pod.Name, "")
+	if errdefs.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if *current.Name == util.ContainerGroupName(pod.Namespace, pod.Name) {
+		return nil
+	}
+
+	log.G(ctx).Infof("deleting legacy container group %s of pod %s before its redeployment", *current.Name, pod.Name)
+	poller, err := p.azClientsAPIs.DeleteContainerGroup(ctx, p.resourceGroup, *current.Name)
+	if err != nil {
+		return err
+	}
+	_, err = poller.PollUntilDone(ctx)
+	return err
+}
+
+// recordPodEvent records an event on the pod, when the provider has an event recorder.
+func (p *ACIProvider) recordPodEvent(pod *v1.Pod, eventType, reason, messageFmt string, args ...interface{}) {
+	if p.eventRecorder != nil {
+		p.eventRecorder.Eventf(pod, eventType, reason, messageFmt, args...)
+	}
+}
+
+// trackCreateContainerGroup waits for the container group creation to complete, and reports the
+// outcome on the pod status.
+func (p *ACIProvider) trackCreateContainerGroup(ctx context.Context, pod *v1.Pod, poller client.ContainerGroupPoller) {
+	ctx, span := trace.StartSpan(ctx, "aci.trackCreateContainerGroup")
+	defer span.End()
+	ctx = addAzureAttributes(ctx, span, p)
+
+	cg, err := poller.PollUntilDone(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			// The provider is stopping, the outcome of the creation is unknown. The pod status
+			// is refreshed from the container group on the next start.
+			log.G(ctx).WithError(err).Infof("stopped tracking the container group creation of pod %s", pod.Name)
+			return
+		}
+		log.G(ctx).WithError(err).Errorf("failed to provision container group for pod %s", pod.Name)
+		span.SetStatus(err)
+		// The pods the tracker skips while their creation failed are retried from the pending
+		// queue, until they are created or waited too long.
+		if _, _, retryable := getCreateFailureReason(err); retryable {
+			p.keepPodPending(ctx, pod, err)
+			return
+		}
+		p.pendingPods.remove(pod.UID)
+		p.updatePodStatusWithCreateFailure(ctx, pod, err)
+		return
+	}
+
+	log.G(ctx).Infof("container group for pod %s has been provisioned", pod.Name)
+	p.resumePendingPod(ctx, pod)
+	// The container group shows capacity is available, the pending pods are retried now.
+	p.pendingPods.wake(time.Now())
+	if p.tracker == nil || cg == nil {
+		return
+	}
+
+	// The tracker refreshes the status periodically, this only saves waiting for the next update.
+	if err := validation.ValidateContainerGroup(ctx, cg); err != nil {
+		log.G(ctx).WithError(err).Debugf("container group of pod %s is not complete yet, skipping status update", pod.Name)
+		return
+	}
+	podStatus, err := p.getPodStatusFromContainerGroup(ctx, cg)
+	if err != nil {
+		log.G(ctx).WithError(err).Warnf("failed to get status of pod %s from its container group", pod.Name)
+		return
+	}
+	err = p.tracker.UpdatePodStatus(ctx, pod.Namespace, pod.Name, func(status *v1.PodStatus) {
+		podStatus.DeepCopyInto(status)
+	}, false)
+	if err != nil {
+		log.G(ctx).WithError(err).Warnf("failed to update status of pod %s", pod.Name)
+	}
+}
+
+// Pod status reasons of the container group creation failures classified from the ARM error.
+const (
+	podStatusReasonQuotaExceeded        = "QuotaExceeded"
+	podStatusReasonInsufficientCapacity = "InsufficientCapacity"
+	podStatusReasonInvalidSpec          = "InvalidSpec"
+	podStatusReasonThrottled            = "Throttled"
+	podStatusReasonUnauthorized         = "Unauthorized"
+)
+
+var createFailureReasons = map[client.ARMErrorKind]string{
+	client.ARMErrorQuotaExceeded: podStatusReasonQuotaExceeded,
+	client.ARMErrorCapacity:      podStatusReasonInsufficientCapacity,
+	client.ARMErrorInvalidSpec:   podStatusReasonInvalidSpec,
+	client.ARMErrorThrottled:     podStatusReasonThrottled,
+	client.ARMErrorUnauthorized:  podStatusReasonUnauthorized,
+}
+
+// getCreateFailureReason returns the pod status reason and message of a container group creation
+// failure, and whether creating the container group again can succeed.
+func getCreateFailureReason(createErr error) (reason, message string, retryable bool) {
+	armErr := client.ClassifyARMError(createErr)
+	if armErr == nil {
+		return podStatusReasonProviderFailed, createErr.Error(), true
+	}
+
+	reason, ok := createFailureReasons[armErr.Kind]
+	if !ok {
+		reason = podStatusReasonProviderFailed
+	}
+	return reason, armErr.Summary(), armErr.Retryable()
+}
+
+// isCreateFailureReason is true when the pod status reports a container group creation failure.
+func isCreateFailureReason(reason string) bool {
+	if reason == podStatusReasonProviderFailed {
+		return true
+	}
+	for _, failureReason := range createFailureReasons {
+		if reason == failureReason {
+			return true
+		}
+	}
+	return false
+}
+
+// updatePodStatusWithCreateFailure surfaces a terminal creation failure on the pod, the same way
+// virtual-kubelet reports errors returned by CreatePod. The pods are marked as Failed, creating
+// them again would fail the same way.
+func (p *ACIProvider) updatePodStatusWithCreateFailure(ctx context.Context, pod *v1.Pod, createErr error) {
+	reason, message, _ := getCreateFailureReason(createErr)
+	p.reportCreateFailure(ctx, pod, v1.PodFailed, reason, message)
+}
+
+// reportCreateFailure reports the creation failure with an event and on the pod status.
+func (p *ACIProvider) reportCreateFailure(ctx context.Context, pod *v1.Pod, phase v1.PodPhase, reason, message string) {
+	if p.eventRecorder != nil {
+		p.eventRecorder.Eventf(pod, v1.EventTypeWarning, reason, "Failed to provision container group: %s", message)
+	}
+
+	if p.tracker == nil {
+		return
+	}
+
+	err := p.tracker.UpdatePodStatus(ctx, pod.Namespace, pod.Name, func(status *v1.PodStatus) {
+		status.Phase = phase
+		status.Reason = reason
+		status.Message = message
+	}, true)
+	if err != nil {
+		log.G(ctx).WithError(err).Errorf("failed to update status of pod %s with the provisioning failure", pod.Name)
+	}
+}
@@ -0,0 +1,325 @@
+/*
+Copyright (c) Microsoft Corporation.
+Licensed under the Apache 2.0 license.
+*/
+package provider
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	azaciv2 "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerinstance/armcontainerinstance/v2"
+	"github.com/golang/mock/gomock"
+	testsutil "github.com/virtual-kubelet/azure-aci/pkg/tests"
+	"github.com/virtual-kubelet/azure-aci/pkg/util"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestCreatePodReportsProvisioningOutcome(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	cases := []struct {
+		description     string
+		restartPolicy   v1.RestartPolicy
+		pollErr         error
+		expectedPhase   v1.PodPhase
+		expectedReason  string
+		expectedMessage string
+		expectedEvent   bool
+	}{
+		{
+			description:     "invalid spec marks the pod as Failed even when it can be restarted",
+			restartPolicy:   v1.RestartPolicyAlways,
+			pollErr:         testsutil.NewARMResponseError(http.StatusBadRequest, `{"error":{"code":"InaccessibleImage","message":"The image 'fake' is not accessible."}}`),
+			expectedPhase:   v1.PodFailed,
+			expectedReason:  podStatusReasonInvalidSpec,
+			expectedMessage: "InaccessibleImage: The image 'fake' is not accessible.",
+			expectedEvent:   true,
+		},
+		{
+			description:     "region capacity failure keeps the pod Pending even when it is never restarted",
+			restartPolicy:   v1.RestartPolicyNever,
+			pollErr:         testsutil.NewARMResponseError(http.StatusConflict, `{"error":{"code":"ServiceUnavailable","message":"The requested resource is not available."}}`),
+			expectedPhase:   v1.PodPending,
+			expectedReason:  podStatusReasonInsufficientCapacity,
+			expectedMessage: "ACI capacity unavailable in " + fakeRegion + ": ServiceUnavailable: The requested resource is not available.",
+			expectedEvent:   true,
+		},
+		{
+			description:     "quota failure keeps the pod Pending",
+			restartPolicy:   v1.RestartPolicyAlways,
+			pollErr:         testsutil.NewARMResponseError(http.StatusConflict, `{"error":{"code":"ContainerGroupQuotaReached","message":"Resource type 'Microsoft.ContainerInstance/containerGroups' container group quota exceeded."}}`),
+			expectedPhase:   v1.PodPending,
+			expectedReason:  podStatusReasonQuotaExceeded,
+			expectedMessage: "ACI quota reached in " + fakeRegion + ": ContainerGroupQuotaReached: Resource type 'Microsoft.ContainerInstance/containerGroups' container group quota exceeded.",
+			expectedEvent:   true,
+		},
+		{
+			description:     "throttled creation keeps the pod Pending until it is retried",
+			restartPolicy:   v1.RestartPolicyAlways,
+			pollErr:         testsutil.NewARMResponseError(http.StatusTooManyRequests, `{"error":{"code":"TooManyRequests","message":"The request is throttled."}}`),
+			expectedPhase:   v1.PodPending,
+			expectedReason:  podStatusReasonThrottled,
+			expectedMessage: "ACI failed to provision the container group: TooManyRequests: The request is throttled.",
+			expectedEvent:   true,
+		},
+		{
+			description:     "transient failure keeps the pod Pending until it is retried",
+			restartPolicy:   v1.RestartPolicyNever,
+			pollErr:         testsutil.NewARMResponseError(http.StatusInternalServerError, `{"error":{"code":"InternalServerError","message":"Retry the request."}}`),
+			expectedPhase:   v1.PodPending,
+			expectedReason:  podStatusReasonProviderFailed,
+			expectedMessage: "ACI failed to provision the container group: InternalServerError: Retry the request.",
+			expectedEvent:   true,
+		},
+		{
+			description:     "unclassified failure marks the pod as Failed with the provider failed reason",
+			restartPolicy:   v1.RestartPolicyAlways,
+			pollErr:         testsutil.NewARMResponseError(http.StatusConflict, `{"error":{"code":"Conflict","message":"The operation conflicts."}}`),
+			expectedPhase:   v1.PodFailed,
+			expectedReason:  podStatusReasonProviderFailed,
+			expectedMessage: "Conflict: The operation conflicts.",
+			expectedEvent:   true,
+		},
+		{
+			description:   "successful provisioning updates the pod status from the container group",
+			restartPolicy: v1.RestartPolicyAlways,
+			expectedPhase: v1.PodRunning,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.description, func(t *testing.T) {
+			pod := testsutil.CreatePodObj(podName, podNamespace)
+			pod.Spec.RestartPolicy = tc.restartPolicy
+
+			aciMocks := createNewACIMock()
+			aciMocks.MockPollCreateContainerGroup = func(ctx context.Context, cg *azaciv2.ContainerGroup) (*azaciv2.ContainerGroup, error) {
+				if tc.pollErr != nil {
+					return nil, tc.pollErr
+				}
+				return testsutil.CreateContainerGroupObj(podName, podNamespace, runningState,
+					testsutil.CreateACIContainersListObj(runningState, "Initializing",
+						testsutil.CgCreationTime.Add(time.Second*2), testsutil.CgCreationTime.Add(time.Second*3),
+						true, true, true), "Succeeded"), nil
+			}
+
+			podLister := NewMockPodLister(mockCtrl)
+			podLister.EXPECT().List(gomock.Any()).Return([]*v1.Pod{pod}, nil).AnyTimes()
+
+			provider, err := createTestProvider(aciMocks, NewMockConfigMapLister(mockCtrl),
+				NewMockSecretLister(mockCtrl), podLister, nil)
+			if err != nil {
+				t.Fatal("failed to create the test provider", err)
+			}
+			recorder := record.NewFakeRecorder(5)
+			provider.eventRecorder = recorder
+
+			updates := make(chan *v1.Pod, 1)
+			provider.tracker = &PodsTracker{
+				pods: podLister,
+				updateCb: func(updatedPod *v1.Pod) {
+					updates <- updatedPod
+				},
+				handler: provider,
+			}
+
+			err = provider.CreatePod(context.Background(), pod)
+			assert.NilError(t, err)
+
+			select {
+			case updatedPod := <-updates:
+				assert.Check(t, is.Equal(updatedPod.Status.Phase, tc.expectedPhase))
+				assert.Check(t, is.Equal(updatedPod.Status.Reason, tc.expectedReason))
+				assert.Check(t, is.Equal(updatedPod.Status.Message, tc.expectedMessage))
+			case <-time.After(10 * time.Second):
+				t.Fatal("pod status was not updated after the container group operation completed")
+			}
+
+			if tc.expectedEvent {
+				assert.Assert(t, is.Len(recorder.Events, 1))
+				event := <-recorder.Events
+				assert.Check(t, strings.Contains(event, tc.expectedReason), event)
+			}
+		})
+	}
+}
+
+func TestCreatePodReturnsSubmissionErrors(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	pod := testsutil.CreatePodObj(podName, podNamespace)
+
+	polled := false
+	aciMocks := createNewACIMock()
+	aciMocks.MockCreateContainerGroup = func(ctx context.Context, resourceGroup, podNS, podName string, cg *azaciv2.ContainerGroup) error {
+		return testsutil.NewARMResponseError(http.StatusBadRequest, `{"error":{"code":"InvalidContainerGroup","message":"invalid"}}`)
+	}
+	aciMocks.MockPollCreateContainerGroup = func(ctx context.Context, cg *azaciv2.ContainerGroup) (*azaciv2.ContainerGroup, error) {
+		polled = true
+		return cg, nil
+	}
+
+	provider, err := createTestProvider(aciMocks, NewMockConfigMapLister(mockCtrl),
+		NewMockSecretLister(mockCtrl), NewMockPodLister(mockCtrl), nil)
+	if err != nil {
+		t.Fatal("failed to create the test provider", err)
+	}
+
+	err = provider.CreatePod(context.Background(), pod)
+	assert.Check(t, err != nil)
+	assert.Check(t, !polled)
+}
+
+func TestCreatePodReportsRejectedContainerGroups(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	pod := testsutil.CreatePodObj(podName, podNamespace)
+	pod.Spec.RestartPolicy = v1.RestartPolicyAlways
+
+	aciMocks := createNewACIMock()
+	aciMocks.MockCreateContainerGroup = func(ctx context.Context, resourceGroup, podNS, podName string, cg *azaciv2.ContainerGroup) error {
+		return testsutil.NewARMResponseError(http.StatusBadRequest, `{"error":{"code":"InvalidImage","message":"The image 'fake' is invalid."}}`)
+	}
+
+	podLister := NewMockPodLister(mockCtrl)
+	podLister.EXPECT().List(gomock.Any()).Return([]*v1.Pod{pod}, nil).AnyTimes()
+
+	provider, err := createTestProvider(aciMocks, NewMockConfigMapLister(mockCtrl),
+		NewMockSecretLister(mockCtrl), podLister, nil)
+	if err != nil {
+		t.Fatal("failed to create the test provider", err)
+	}
+
+	var updatedPod *v1.Pod
+	provider.tracker = &PodsTracker{
+		pods: podLister,
+		updateCb: func(p *v1.Pod) {
+			updatedPod = p
+		},
+		handler: provider,
+	}
+
+	err = provider.CreatePod(context.Background(), pod)
+	assert.NilError(t, err, "the pods ACI rejected should not be retried")
+	assert.Assert(t, updatedPod != nil)
+	assert.Check(t, is.Equal(updatedPod.Status.Phase, v1.PodFailed))
+	assert.Check(t, is.Equal(updatedPod.Status.Reason, podStatusReasonInvalidSpec))
+	assert.Check(t, is.Equal(updatedPod.Status.Message, "InvalidImage: The image 'fake' is invalid."))
+
+	aciMocks.MockCreateContainerGroup = func(ctx context.Context, resourceGroup, podNS, podName string, cg *azaciv2.ContainerGroup) error {
+		return testsutil.NewARMResponseError(http.StatusTooManyRequests, `{"error":{"code":"TooManyRequests","message":"throttled"}}`)
+	}
+	err = provider.CreatePod(context.Background(), pod)
+	assert.Check(t, err != nil, "the throttled pods should be retried")
+}
+
+func TestTrackCreateContainerGroupStopsWithTheProvider(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	pod := testsutil.CreatePodObj(podName, podNamespace)
+
+	podLister := NewMockPodLister(mockCtrl)
+	podLister.EXPECT().List(gomock.Any()).Return([]*v1.Pod{pod}, nil).AnyTimes()
+
+	provider, err := createTestProvider(createNewACIMock(), NewMockConfigMapLister(mockCtrl),
+		NewMockSecretLister(mockCtrl), podLister, nil)
+	if err != nil {
+		t.Fatal("failed to create the test provider", err)
+	}
+	updated := false
+	provider.tracker = &PodsTracker{
+		pods: podLister,
+		updateCb: func(*v1.Pod) {
+			updated = true
+		},
+		handler: provider,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	poller := &mockContainerGroupPoller{poll: func(ctx context.Context, cg *azaciv2.ContainerGroup) (*azaciv2.ContainerGroup, error) {
+		return nil, ctx.Err()
+	}}
+	provider.trackCreateContainerGroup(ctx, pod, poller)
+	assert.Check(t, !updated, "the pod status should not be updated when the provider stops")
+	assert.Check(t, !provider.pendingPods.isPending(pod.UID))
+}
+
+func TestContainerGroupOperationsTrySubmit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Without workers, the queue is only drained by the test.
+	ops := newContainerGroupOperations(ctx, 0)
+	for i := 0; i < containerGroupOperationQueueSize; i++ {
+		assert.NilError(t, ops.trySubmit(ctx, func(context.Context) {}))
+	}
+	assert.Check(t, errors.Is(ops.trySubmit(ctx, func(context.Context) {}), errContainerGroupOperationsBusy),
+		"the operations submitted from the status updates should not wait for a full queue")
+
+	submitCtx, submitCancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer submitCancel()
+	assert.Check(t, errors.Is(ops.submit(submitCtx, func(context.Context) {}), context.DeadlineExceeded))
+
+	<-ops.queue
+	assert.NilError(t, ops.trySubmit(ctx, func(context.Context) {}))
+}
+
+func TestRecreateContainerGroupMigratesLegacyContainerGroup(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	pod := testsutil.CreatePodObj(podName, podNamespace)
+	legacyName := util.LegacyContainerGroupName(podNamespace, podName)
+
+	var calls []string
+	var current *azaciv2.ContainerGroup
+	aciMocks := createNewACIMock()
+	aciMocks.MockGetContainerGroupInfo = func(ctx context.Context, resourceGroup, namespace, name, nodeName string) (*azaciv2.ContainerGroup, error) {
+		if current == nil {
+			return nil, errdefs.NotFound("cg is not found")
+		}
+		return current, nil
+	}
+	aciMocks.MockDeleteContainerGroup = func(ctx context.Context, resourceGroup, cgName string) error {
+		calls = append(calls, "delete "+cgName)
+		return nil
+	}
+	aciMocks.MockCreateContainerGroup = func(ctx context.Context, resourceGroup, podNS, podName string, cg *azaciv2.ContainerGroup) error {
+		calls = append(calls, "create "+util.ContainerGroupName(podNS, podName))
+		return nil
+	}
+
+	provider, err := createTestProvider(aciMocks, NewMockConfigMapLister(mockCtrl),
+		NewMockSecretLister(mockCtrl), NewMockPodLister(mockCtrl), nil)
+	if err != nil {
+		t.Fatal("Unable to create test provider", err)
+	}
+
+	for _, name := range []string{legacyName, util.ContainerGroupName(podNamespace, podName)} {
+		current, err = provider.getContainerGroup(context.Background(), pod)
+		assert.NilError(t, err)
+		current.Name = &name
+		calls = nil
+		assert.NilError(t, provider.recreateContainerGroup(context.Background(), pod))
+		if name == legacyName {
+			assert.Check(t, is.DeepEqual(calls, []string{"delete " + legacyName, "create " + util.ContainerGroupName(podNamespace, podName)}),
+				"the legacy container group should be deleted before the redeployment")
+		} else {
+			assert.Check(t, is.DeepEqual(calls, []string{"create " + name}))
+		}
+	}
+}
@@ -0,0 +1,267 @@
+/*
+Copyright (c) Microsoft Corporation.
+Licensed under the Apache 2.0 license.
+*/
+package provider
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/virtual-kubelet/azure-aci/pkg/client"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	"github.com/virtual-kubelet/virtual-kubelet/trace"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	pendingPodsMaxWaitEnv = "ACI_PENDING_POD_MAX_WAIT"
+
+	defaultPendingPodsMaxWait = 30 * time.Minute
+	pendingPodsRetryInterval  = 5 * time.Second
+	pendingPodsBaseBackoff    = 30 * time.Second
+	pendingPodsMaxBackoff     = 5 * time.Minute
+
+	podEventReasonProvisioningResumed = "ProvisioningResumed"
+)
+
+// pendingPods are the pods whose container group could not be created because the ACI quota or
+// the regional capacity is exhausted, or whose provisioning failed with a retryable error. Their
+// creation is retried with an exponential backoff, and as soon as a container group is deleted or
+// created, which frees quota or shows capacity is back.
+type pendingPods struct {
+	lock sync.Mutex
+	pods map[types.UID]*pendingPod
+}
+
+type pendingPod struct {
+	pod         *v1.Pod
+	attempts    int
+	firstFailed time.Time
+	nextAttempt time.Time
+	// retrying is set while a creation attempt is in progress.
+	retrying bool
+}
+
+func newPendingPods() *pendingPods {
+	return &pendingPods{pods: make(map[types.UID]*pendingPod)}
+}
+
+// add records a failed creation attempt of the pod, and returns its state.
+func (q *pendingPods) add(pod *v1.Pod, now time.Time) pendingPod {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	pending, ok := q.pods[pod.UID]
+	if !ok {
+		pending = &pendingPod{firstFailed: now}
+		q.pods[pod.UID] = pending
+	}
+	pending.pod = pod.DeepCopy()
+	pending.retrying = false
+	pending.attempts++
+	pending.nextAttempt = now.Add(getPendingPodBackoff(pending.attempts))
+	return *pending
+}
+
+func (q *pendingPods) remove(uid types.UID) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	delete(q.pods, uid)
+}
+
+func (q *pendingPods) isPending(uid types.UID) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	_, ok := q.pods[uid]
+	return ok
+}
+
+// due returns the pods to retry, they are not due again until their creation attempt fails.
+func (q *pendingPods) due(now time.Time) []pendingPod {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	var due []pendingPod
+	for _, pending := range q.pods {
+		if !pending.retrying && !pending.nextAttempt.After(now) {
+			pending.retrying = true
+			due = append(due, *pending)
+		}
+	}
+	return due
+}
+
+// wake schedules the retry of all the pending pods.
+func (q *pendingPods) wake(now time.Time) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for _, pending := range q.pods {
+		if pending.nextAttempt.After(now) {
+			pending.nextAttempt = now
+		}
+	}
+}
+
+func getPendingPodBackoff(attempts int) time.Duration {
+	backoff := pendingPodsBaseBackoff << (attempts - 1)
+	if backoff <= 0 || backoff > pendingPodsMaxBackoff {
+		return pendingPodsMaxBackoff
+	}
+	return backoff
+}
+
+func getPendingPodsMaxWait() (time.Duration, error) {
+	v := os.Getenv(pendingPodsMaxWaitEnv)
+	if v == "" {
+		return defaultPendingPodsMaxWait, nil
+	}
+	maxWait, err := time.ParseDuration(v)
+	if err != nil || maxWait <= 0 {
+		return 0, fmt.Errorf("%s %q is invalid, expected a positive duration such as 30m", pendingPodsMaxWaitEnv, v)
+	}
+	return maxWait, nil
+}
+
+// isPendingCreateFailure is true when the container group creation failed because the ACI quota or
+// the regional capacity is exhausted, the creation is retried once they are available again.
+func isPendingCreateFailure(err error) bool {
+	armErr := client.ClassifyARMError(err)
+	return armErr != nil && (armErr.Kind == client.ARMErrorQuotaExceeded || armErr.Kind == client.ARMErrorCapacity)
+}
+
+// keepPodPending queues the pod for a new creation attempt, and reports it as unschedulable until
+// then. The pod is failed once it has waited longer than the maximum wait.
+func (p *ACIProvider) keepPodPending(ctx context.Context, pod *v1.Pod, createErr error) {
+	now := time.Now()
+	pending := p.pendingPods.add(pod, now)
+	reason, summary, _ := getCreateFailureReason(createErr)
+
+	if now.Sub(pending.firstFailed) >= p.pendingPodsMaxWait {
+		p.pendingPods.remove(pod.UID)
+		log.G(ctx).Warnf("pod %s waited more than %s to be provisioned, failing it", pod.Name, p.pendingPodsMaxWait)
+		p.reportCreateFailure(ctx, pod, v1.PodFailed, reason,
+			fmt.Sprintf("gave up after waiting %s: %s", p.pendingPodsMaxWait, summary))
+		return
+	}
+
+	var message string
+	switch reason {
+	case podStatusReasonQuotaExceeded:
+		message = fmt.Sprintf("ACI quota reached in %s: %s", p.region, summary)
+	case podStatusReasonInsufficientCapacity:
+		message = fmt.Sprintf("ACI capacity unavailable in %s: %s", p.region, summary)
+	default:
+		message = fmt.Sprintf("ACI failed to provision the container group: %s", summary)
+	}
+	retryIn := pending.nextAttempt.Sub(now).Round(time.Second)
+	log.G(ctx).Infof("keeping pod %s pending, %s, retrying in %s", pod.Name, message, retryIn)
+
+	if p.eventRecorder != nil {
+		p.eventRecorder.Eventf(pod, v1.EventTypeWarning, reason, "%s, retrying in %s (attempt %d)", message, retryIn, pending.attempts)
+	}
+
+	if p.tracker == nil {
+		return
+	}
+	err := p.tracker.UpdatePodStatus(ctx, pod.Namespace, pod.Name, func(status *v1.PodStatus) {
+		status.Phase = v1.PodPending
+		status.Reason = reason
+		status.Message = message
+		setPodCondition(status, v1.PodCondition{
+			Type:               v1.PodScheduled,
+			Status:             v1.ConditionFalse,
+			Reason:             v1.PodReasonUnschedulable,
+			Message:            message,
+			LastTransitionTime: metav1.NewTime(now),
+		})
+	}, true)
+	if err != nil {
+		log.G(ctx).WithError(err).Errorf("failed to update status of pending pod %s", pod.Name)
+	}
+}
+
+// setPodCondition adds the condition to the status, or replaces the condition of the same type.
+func setPodCondition(status *v1.PodStatus, condition v1.PodCondition) {
+	for i := range status.Conditions {
+		if status.Conditions[i].Type == condition.Type {
+			if status.Conditions[i].Status == condition.Status {
+				condition.LastTransitionTime = status.Conditions[i].LastTransitionTime
+			}
+			status.Conditions[i] = condition
+			return
+		}
+	}
+	status.Conditions = append(status.Conditions, condition)
+}
+
+// runPendingPodsRetry periodically retries the creation of the pending pods that are due.
+func (p *ACIProvider) runPendingPodsRetry(ctx context.Context) {
+	ticker := time.NewTicker(pendingPodsRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.retryPendingPods(ctx, time.Now())
+		}
+	}
+}
+
+func (p *ACIProvider) retryPendingPods(ctx context.Context, now time.Time) {
+	ctx, span := trace.StartSpan(ctx, "aci.retryPendingPods")
+	defer span.End()
+
+	for _, pending := range p.pendingPods.due(now) {
+		pod, err := p.podsL.Pods(pending.pod.Namespace).Get(pending.pod.Name)
+		if err != nil || pod == nil || pod.UID != pending.pod.UID || pod.DeletionTimestamp != nil {
+			p.pendingPods.remove(pending.pod.UID)
+			continue
+		}
+
+		log.G(ctx).Infof("retrying the creation of pending pod %s (attempt %d)", pod.Name, pending.attempts+1)
+		if err := p.CreatePod(ctx, pod); err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to retry the creation of pending pod %s", pod.Name)
+			// The pod stays in the queue, and is retried after its backoff.
+			p.pendingPods.add(pod, now)
+		}
+	}
+}
+
+// resumePendingPod reports that the container group of a pending pod was created, the pod is not
+// unschedulable anymore.
+func (p *ACIProvider) resumePendingPod(ctx context.Context, pod *v1.Pod) {
+	if !p.pendingPods.isPending(pod.UID) {
+		return
+	}
+	p.pendingPods.remove(pod.UID)
+
+	if p.eventRecorder != nil {
+		p.eventRecorder.Event(pod, v1.EventTypeNormal, podEventReasonProvisioningResumed, "ACI quota and capacity are available, the container group is created")
+	}
+	if p.tracker == nil {
+		return
+	}
+	err := p.tracker.UpdatePodStatus(ctx, pod.Namespace, pod.Name, func(status *v1.PodStatus) {
+		status.Reason = ""
+		status.Message = ""
+		setPodCondition(status, v1.PodCondition{
+			Type:               v1.PodScheduled,
+			Status:             v1.ConditionTrue,
+			LastTransitionTime: metav1.Now(),
+		})
+	}, true)
+	if err != nil {
+		log.G(ctx).WithError(err).Errorf("failed to update status of resumed pod %s", pod.Name)
+	}
+}
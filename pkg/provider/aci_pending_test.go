@@ -0,0 +1,153 @@
+/*
+Copyright (c) Microsoft Corporation.
+Licensed under the Apache 2.0 license.
+*/
+package provider
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	azaciv2 "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerinstance/armcontainerinstance/v2"
+	"github.com/golang/mock/gomock"
+	testsutil "github.com/virtual-kubelet/azure-aci/pkg/tests"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestCreatePodKeepsPodPendingUntilQuotaIsAvailable(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	pod := testsutil.CreatePodObj(podName, podNamespace)
+
+	quotaReached := true
+	aciMocks := createNewACIMock()
+	aciMocks.MockCreateContainerGroup = func(ctx context.Context, resourceGroup, podNS, podName string, cg *azaciv2.ContainerGroup) error {
+		if quotaReached {
+			return testsutil.NewARMResponseError(http.StatusConflict, `{"error":{"code":"ContainerGroupQuotaReached","message":"container group quota exceeded."}}`)
+		}
+		return nil
+	}
+
+	podLister := NewMockPodLister(mockCtrl)
+	podNamespaceLister := NewMockPodNamespaceLister(mockCtrl)
+	podLister.EXPECT().List(gomock.Any()).Return([]*v1.Pod{pod}, nil).AnyTimes()
+	podLister.EXPECT().Pods(podNamespace).Return(podNamespaceLister).AnyTimes()
+	podNamespaceLister.EXPECT().Get(podName).Return(pod, nil).AnyTimes()
+
+	provider, err := createTestProvider(aciMocks, NewMockConfigMapLister(mockCtrl),
+		NewMockSecretLister(mockCtrl), podLister, nil)
+	if err != nil {
+		t.Fatal("failed to create the test provider", err)
+	}
+	recorder := record.NewFakeRecorder(5)
+	provider.eventRecorder = recorder
+
+	var updatedPod *v1.Pod
+	provider.tracker = &PodsTracker{
+		pods: podLister,
+		updateCb: func(p *v1.Pod) {
+			updatedPod = p
+		},
+		handler: provider,
+	}
+
+	err = provider.CreatePod(context.Background(), pod)
+	assert.NilError(t, err, "the pods waiting for quota should not be retried by virtual-kubelet")
+	assert.Check(t, provider.pendingPods.isPending(pod.UID))
+	assert.Assert(t, updatedPod != nil)
+	assert.Check(t, is.Equal(updatedPod.Status.Phase, v1.PodPending))
+	assert.Check(t, is.Equal(updatedPod.Status.Reason, podStatusReasonQuotaExceeded))
+	assert.Check(t, is.Equal(updatedPod.Status.Message, "ACI quota reached in "+fakeRegion+": ContainerGroupQuotaReached: container group quota exceeded."))
+	assert.Assert(t, is.Len(updatedPod.Status.Conditions, 1))
+	assert.Check(t, is.Equal(updatedPod.Status.Conditions[0].Type, v1.PodScheduled))
+	assert.Check(t, is.Equal(updatedPod.Status.Conditions[0].Status, v1.ConditionFalse))
+	assert.Check(t, is.Equal(updatedPod.Status.Conditions[0].Reason, v1.PodReasonUnschedulable))
+
+	assert.Assert(t, is.Len(recorder.Events, 1))
+	event := <-recorder.Events
+	assert.Check(t, strings.Contains(event, "retrying in 30s (attempt 1)"), event)
+
+	// The pod is not retried before its backoff.
+	provider.retryPendingPods(context.Background(), time.Now())
+	assert.Check(t, is.Len(recorder.Events, 0))
+
+	quotaReached = false
+	provider.pendingPods.wake(time.Now())
+	provider.retryPendingPods(context.Background(), time.Now())
+
+	select {
+	case event := <-recorder.Events:
+		assert.Check(t, strings.Contains(event, podEventReasonProvisioningResumed), event)
+	case <-time.After(10 * time.Second):
+		t.Fatal("the pending pod was not resumed after its container group was created")
+	}
+	assert.Check(t, !provider.pendingPods.isPending(pod.UID))
+}
+
+func TestKeepPodPendingFailsPodAfterMaxWait(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	pod := testsutil.CreatePodObj(podName, podNamespace)
+	podLister := NewMockPodLister(mockCtrl)
+	podLister.EXPECT().List(gomock.Any()).Return([]*v1.Pod{pod}, nil).AnyTimes()
+
+	provider, err := createTestProvider(createNewACIMock(), NewMockConfigMapLister(mockCtrl),
+		NewMockSecretLister(mockCtrl), podLister, nil)
+	if err != nil {
+		t.Fatal("failed to create the test provider", err)
+	}
+
+	var updatedPod *v1.Pod
+	provider.tracker = &PodsTracker{
+		pods: podLister,
+		updateCb: func(p *v1.Pod) {
+			updatedPod = p
+		},
+		handler: provider,
+	}
+
+	createErr := testsutil.NewARMResponseError(http.StatusConflict, `{"error":{"code":"ServiceUnavailable","message":"The requested resource is not available."}}`)
+	provider.keepPodPending(context.Background(), pod, createErr)
+	assert.Assert(t, updatedPod != nil)
+	assert.Check(t, is.Equal(updatedPod.Status.Phase, v1.PodPending))
+	assert.Check(t, is.Equal(updatedPod.Status.Reason, podStatusReasonInsufficientCapacity))
+
+	provider.pendingPods.pods[pod.UID].firstFailed = time.Now().Add(-provider.pendingPodsMaxWait)
+	provider.keepPodPending(context.Background(), pod, createErr)
+	assert.Check(t, is.Equal(updatedPod.Status.Phase, v1.PodFailed))
+	assert.Check(t, is.Equal(updatedPod.Status.Reason, podStatusReasonInsufficientCapacity))
+	assert.Check(t, strings.HasPrefix(updatedPod.Status.Message, "gave up after waiting 30m0s"), updatedPod.Status.Message)
+	assert.Check(t, !provider.pendingPods.isPending(pod.UID))
+}
+
+func TestGetPendingPodBackoff(t *testing.T) {
+	assert.Check(t, is.Equal(getPendingPodBackoff(1), 30*time.Second))
+	assert.Check(t, is.Equal(getPendingPodBackoff(2), time.Minute))
+	assert.Check(t, is.Equal(getPendingPodBackoff(4), 4*time.Minute))
+	assert.Check(t, is.Equal(getPendingPodBackoff(5), pendingPodsMaxBackoff))
+	assert.Check(t, is.Equal(getPendingPodBackoff(100), pendingPodsMaxBackoff))
+}
+
+func TestGetPendingPodsMaxWait(t *testing.T) {
+	t.Setenv(pendingPodsMaxWaitEnv, "")
+	maxWait, err := getPendingPodsMaxWait()
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(maxWait, defaultPendingPodsMaxWait))
+
+	t.Setenv(pendingPodsMaxWaitEnv, "1h")
+	maxWait, err = getPendingPodsMaxWait()
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(maxWait, time.Hour))
+
+	t.Setenv(pendingPodsMaxWaitEnv, "soon")
+	_, err = getPendingPodsMaxWait()
+	assert.Check(t, err != nil)
+}
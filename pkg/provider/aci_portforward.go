@@ -0,0 +1,118 @@
+/*
+Copyright (c) Microsoft Corporation.
+Licensed under the Apache 2.0 license.
+*/
+package provider
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	azaciv2 "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerinstance/armcontainerinstance/v2"
+	"github.com/pkg/errors"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	"github.com/virtual-kubelet/virtual-kubelet/trace"
+)
+
+const portForwardDialTimeout = 10 * time.Second
+
+// PortForward forwards the stream to a port of the pod, by connecting from virtual-kubelet to the
+// IP of the container group. It is only possible when the container group is in the virtual
+// network, or when the port is exposed on the public IP of the container group.
+func (p *ACIProvider) PortForward(ctx context.Context, namespace, pod string, port int32, stream io.ReadWriteCloser) error {
+	ctx, span := trace.StartSpan(ctx, "aci.PortForward")
+	defer span.End()
+	ctx = addAzureAttributes(ctx, span, p)
+
+	defer stream.Close()
+
+	cg, err := p.getContainerGroupInfo(ctx, namespace, pod, p.nodeName)
+	if err != nil {
+		return err
+	}
+
+	address, err := getPortForwardAddress(cg, port)
+	if err != nil {
+		return err
+	}
+
+	dialer := net.Dialer{Timeout: portForwardDialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return errors.Wrapf(err, "failed to connect to port %d of pod %s", port, pod)
+	}
+	defer conn.Close()
+
+	log.G(ctx).Debugf("forwarding port %d of pod %s to %s", port, pod, address)
+	return pipeStreams(ctx, conn, stream)
+}
+
+// getPortForwardAddress returns the address virtual-kubelet connects to, to reach the port of the
+// container group.
+func getPortForwardAddress(cg *azaciv2.ContainerGroup, port int32) (string, error) {
+	if cg.Properties == nil || cg.Properties.IPAddress == nil || cg.Properties.IPAddress.IP == nil || *cg.Properties.IPAddress.IP == "" {
+		return "", errdefs.InvalidInput("port forwarding requires the container group to have an IP address")
+	}
+	ipAddress := cg.Properties.IPAddress
+
+	if ipAddress.Type == nil || *ipAddress.Type != azaciv2.ContainerGroupIPAddressTypePublic {
+		// The container groups in the virtual network are reachable on any port of their private IP.
+		return net.JoinHostPort(*ipAddress.IP, strconv.Itoa(int(port))), nil
+	}
+
+	for _, exposed := range ipAddress.Ports {
+		if exposed == nil || exposed.Port == nil || *exposed.Port != port {
+			continue
+		}
+		if exposed.Protocol != nil && !strings.EqualFold(string(*exposed.Protocol), string(azaciv2.ContainerGroupNetworkProtocolTCP)) {
+			continue
+		}
+		return net.JoinHostPort(*ipAddress.IP, strconv.Itoa(int(port))), nil
+	}
+	return "", errdefs.InvalidInputf("port forwarding requires the port %d to be exposed on the public IP of the container group, or the container group to be in the virtual network", port)
+}
+
+// pipeStreams copies data both ways until the pod closes the connection or ctx is cancelled. When
+// the client is done sending, the response of the pod is still copied back.
+func pipeStreams(ctx context.Context, conn net.Conn, stream io.ReadWriteCloser) error {
+	toPod := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(conn, stream)
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			_ = tcpConn.CloseWrite()
+		}
+		toPod <- err
+	}()
+
+	fromPod := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(stream, conn)
+		fromPod <- err
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-toPod:
+			if err != nil && !isClosedStreamError(err) {
+				return err
+			}
+			toPod = nil
+		case err := <-fromPod:
+			if err != nil && !isClosedStreamError(err) {
+				return err
+			}
+			return nil
+		}
+	}
+}
+
+func isClosedStreamError(err error) bool {
+	return errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrClosedPipe)
+}
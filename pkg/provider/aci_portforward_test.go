@@ -0,0 +1,121 @@
+/*
+Copyright (c) Microsoft Corporation.
+Licensed under the Apache 2.0 license.
+*/
+package provider
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	azaciv2 "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerinstance/armcontainerinstance/v2"
+	"github.com/golang/mock/gomock"
+	testsutil "github.com/virtual-kubelet/azure-aci/pkg/tests"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func newPortForwardTestContainerGroup(ip string, ipType azaciv2.ContainerGroupIPAddressType, ports ...int32) *azaciv2.ContainerGroup {
+	cg := testsutil.CreateTestContainerGroupObj(podName, podNamespace, "Succeeded", runningState,
+		testsutil.CgCreationTime.Add(time.Second*2))
+	cg.Properties.IPAddress = &azaciv2.IPAddress{IP: &ip, Type: &ipType}
+	for i := range ports {
+		protocol := azaciv2.ContainerGroupNetworkProtocolTCP
+		cg.Properties.IPAddress.Ports = append(cg.Properties.IPAddress.Ports, &azaciv2.Port{Port: &ports[i], Protocol: &protocol})
+	}
+	return cg
+}
+
+func TestGetPortForwardAddress(t *testing.T) {
+	cases := []struct {
+		description     string
+		cg              *azaciv2.ContainerGroup
+		expectedAddress string
+	}{
+		{
+			description:     "private IP of the container groups in the virtual network",
+			cg:              newPortForwardTestContainerGroup("10.241.0.4", azaciv2.ContainerGroupIPAddressTypePrivate),
+			expectedAddress: "10.241.0.4:8080",
+		},
+		{
+			description:     "public IP when the port is exposed",
+			cg:              newPortForwardTestContainerGroup("20.1.2.3", azaciv2.ContainerGroupIPAddressTypePublic, 80, 8080),
+			expectedAddress: "20.1.2.3:8080",
+		},
+		{
+			description: "public IP when the port is not exposed",
+			cg:          newPortForwardTestContainerGroup("20.1.2.3", azaciv2.ContainerGroupIPAddressTypePublic, 80),
+		},
+		{
+			description: "no IP address",
+			cg:          newPortForwardTestContainerGroup("", azaciv2.ContainerGroupIPAddressTypePublic),
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.description, func(t *testing.T) {
+			address, err := getPortForwardAddress(tc.cg, 8080)
+			if tc.expectedAddress == "" {
+				assert.Check(t, errdefs.IsInvalidInput(err), "expected an InvalidInput error, got %v", err)
+				return
+			}
+			assert.NilError(t, err)
+			assert.Check(t, is.Equal(address, tc.expectedAddress))
+		})
+	}
+}
+
+func TestPortForward(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		_, _ = conn.Write([]byte("pong " + line))
+	}()
+
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	aciMocks := createNewACIMock()
+	aciMocks.MockGetContainerGroupInfo = func(ctx context.Context, resourceGroup, namespace, name, nodeName string) (*azaciv2.ContainerGroup, error) {
+		return newPortForwardTestContainerGroup("127.0.0.1", azaciv2.ContainerGroupIPAddressTypePrivate), nil
+	}
+
+	provider, err := createTestProvider(aciMocks, NewMockConfigMapLister(mockCtrl),
+		NewMockSecretLister(mockCtrl), NewMockPodLister(mockCtrl), nil)
+	if err != nil {
+		t.Fatal("failed to create the test provider", err)
+	}
+
+	client, stream := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- provider.PortForward(context.Background(), podNamespace, podName, int32(port), stream)
+	}()
+
+	_, err = client.Write([]byte("ping\n"))
+	assert.NilError(t, err)
+	response, err := bufio.NewReader(client).ReadString('\n')
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(response, "pong ping\n"))
+
+	select {
+	case err := <-done:
+		assert.NilError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("port forwarding did not end once the pod closed the connection")
+	}
+}
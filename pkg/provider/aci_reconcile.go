@@ -0,0 +1,248 @@
+/*
+Copyright (c) Microsoft Corporation.
+Licensed under the Apache 2.0 license.
+*/
+package provider
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	azaciv2 "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerinstance/armcontainerinstance/v2"
+	"github.com/virtual-kubelet/azure-aci/pkg/util"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	"github.com/virtual-kubelet/virtual-kubelet/trace"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/utils/ptr"
+)
+
+const (
+	previousNodeNamesEnv = "ACI_PREVIOUS_NODE_NAMES"
+	reconcileDryRunEnv   = "ACI_RECONCILE_DRY_RUN"
+)
+
+// reconcileRetryBackoff is the backoff used to retry a failed reconciliation. Once it is exhausted
+// the container groups not adopted are ignored.
+var reconcileRetryBackoff = wait.Backoff{
+	Duration: 10 * time.Second,
+	Factor:   2,
+	Jitter:   0.1,
+	Steps:    8,
+	Cap:      5 * time.Minute,
+}
+
+// reconcileSummary is the outcome of the reconciliation of the container groups with the pods of
+// the node, each entry describes a container group.
+type reconcileSummary struct {
+	// matched is the number of container groups already tagged for their pod.
+	matched int
+	// adopted are the container groups of a pod of the node that were tagged with a previous node
+	// name, or without the cluster identity, they are re-tagged for the node.
+	adopted []string
+	// orphaned are the container groups of the node, or of a previous node name, without pod.
+	orphaned []string
+	// conflicting are the container groups that can't be adopted, they belong to another node,
+	// or to a previous pod with the same name.
+	conflicting []string
+}
+
+func (s *reconcileSummary) String() string {
+	return fmt.Sprintf("%d matched, %d adopted, %d orphaned, %d conflicting",
+		s.matched, len(s.adopted), len(s.orphaned), len(s.conflicting))
+}
+
+// setReconcileConfig reads the previous node names and the dry-run mode of the reconciliation from
+// the environment, which overrides the config file.
+func (p *ACIProvider) setReconcileConfig() error {
+	if names := os.Getenv(previousNodeNamesEnv); names != "" {
+		p.previousNodeNames = nil
+		for _, name := range strings.Split(names, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				p.previousNodeNames = append(p.previousNodeNames, name)
+			}
+		}
+	}
+	if v := os.Getenv(reconcileDryRunEnv); v != "" {
+		dryRun, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("%s %q is invalid, expected true or false", reconcileDryRunEnv, v)
+		}
+		p.reconcileDryRun = dryRun
+	}
+	return nil
+}
+
+// runReconcile reconciles the container groups in the background, retrying with backoff when the
+// reconciliation fails. The untagged container groups of the pods of the node are managed until
+// then, the reconciliation is the only place they are tagged.
+func (p *ACIProvider) runReconcile(ctx context.Context) {
+	backoff := reconcileRetryBackoff
+	for {
+		_, err := p.reconcileContainerGroups(ctx, p.reconcileDryRun)
+		if err == nil {
+			return
+		}
+		if backoff.Steps <= 1 {
+			log.G(ctx).WithError(err).Warn("giving up reconciling the container groups, the container groups not adopted are ignored")
+			return
+		}
+		log.G(ctx).WithError(err).Warn("failed to reconcile the container groups, retrying")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff.Step()):
+		}
+	}
+}
+
+// listPodsOfNodes lists the pods bound to the node and to its previous node names from the API
+// server. The pod lister only has the pods bound to the node, and may not be synced yet when the
+// reconciliation starts.
+func (p *ACIProvider) listPodsOfNodes(ctx context.Context) ([]*v1.Pod, error) {
+	var pods []*v1.Pod
+	for _, nodeName := range append([]string{p.nodeName}, p.previousNodeNames...) {
+		list, err := p.kubeClient.CoreV1().Pods(v1.NamespaceAll).List(ctx, metav1.ListOptions{
+			FieldSelector: fields.OneTermEqualSelector("spec.nodeName", nodeName).String(),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list the pods of node %s: %w", nodeName, err)
+		}
+		for i := range list.Items {
+			pods = append(pods, &list.Items[i])
+		}
+	}
+	return pods, nil
+}
+
+// reconcileContainerGroups matches the container groups of the resource group to the pods of the
+// node, and of its previous node names, by their UID tag. The container groups of these pods
+// tagged with a previous node name, or created before the cluster identity tag, are re-tagged so
+// they are not ignored. Nothing is deleted, the container groups without pod are only reported,
+// and nothing is changed in dry-run mode.
+func (p *ACIProvider) reconcileContainerGroups(ctx context.Context, dryRun bool) (*reconcileSummary, error) {
+	ctx, span := trace.StartSpan(ctx, "aci.reconcileContainerGroups")
+	defer span.End()
+	ctx = addAzureAttributes(ctx, span, p)
+
+	cgs, err := p.azClientsAPIs.GetContainerGroupListResult(ctx, p.resourceGroup)
+	if err != nil {
+		return nil, err
+	}
+	pods, err := p.listPodsOfNodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	podsByUID := make(map[string]*v1.Pod, len(pods))
+	for _, pod := range pods {
+		podsByUID[string(pod.UID)] = pod
+	}
+
+	summary := &reconcileSummary{}
+	var errs []error
+	for _, cg := range cgs {
+		if cg == nil || cg.Name == nil || cg.Tags == nil || cg.Tags["Namespace"] == nil || cg.Tags["PodName"] == nil {
+			continue
+		}
+		// The container groups of the other clusters are never reconciled.
+		if cg.Tags[clusterIDTag] != nil && !p.isContainerGroupOfCluster(cg) {
+			continue
+		}
+		cgNode := ptr.Deref(cg.Tags["NodeName"], "")
+		podNS, podName := *cg.Tags["Namespace"], *cg.Tags["PodName"]
+		description := fmt.Sprintf("container group %s of pod %s/%s", *cg.Name, podNS, podName)
+
+		pod := podsByUID[util.GetContainerGroupPodUID(cg)]
+		if pod == nil || !util.IsContainerGroupOfPod(cg, pod.Namespace, pod.Name) {
+			if cgNode != p.nodeName && !p.isPreviousNodeName(cgNode) {
+				continue
+			}
+			if getPodFromList(pods, podNS, podName) != nil {
+				summary.conflicting = append(summary.conflicting, description+" belongs to a previous pod with the same name")
+				continue
+			}
+			summary.orphaned = append(summary.orphaned, fmt.Sprintf("%s of node %s has no pod", description, cgNode))
+			continue
+		}
+
+		switch {
+		case cgNode == p.nodeName && p.isContainerGroupOfCluster(cg):
+			summary.matched++
+		case cgNode == p.nodeName || p.isPreviousNodeName(cgNode):
+			if !dryRun {
+				if err := p.adoptContainerGroup(ctx, cg); err != nil {
+					errs = append(errs, fmt.Errorf("failed to adopt %s: %w", description, err))
+					continue
+				}
+				if pod.Spec.NodeName != p.nodeName {
+					p.migratedPods.Store(pod.UID, struct{}{})
+				}
+			}
+			summary.adopted = append(summary.adopted, fmt.Sprintf("%s from node %s", description, cgNode))
+		default:
+			summary.conflicting = append(summary.conflicting, fmt.Sprintf("%s is tagged with node %s", description, cgNode))
+		}
+	}
+
+	logger := log.G(ctx).WithField("dryRun", dryRun)
+	for _, adopted := range summary.adopted {
+		logger.Infof("adopted %s", adopted)
+	}
+	for _, orphaned := range summary.orphaned {
+		logger.Warnf("orphaned %s", orphaned)
+	}
+	for _, conflicting := range summary.conflicting {
+		logger.Warnf("conflicting %s", conflicting)
+	}
+	logger.Infof("reconciled the container groups of node %s: %s", p.nodeName, summary)
+	return summary, utilerrors.NewAggregate(errs)
+}
+
+// adoptContainerGroup tags the container group with the node name and the cluster identity, the
+// other tags are kept.
+func (p *ACIProvider) adoptContainerGroup(ctx context.Context, cg *azaciv2.ContainerGroup) error {
+	tags := make(map[string]*string, len(cg.Tags)+1)
+	for key, value := range cg.Tags {
+		tags[key] = value
+	}
+	nodeName, clusterID := p.nodeName, p.clusterID
+	tags["NodeName"] = &nodeName
+	tags[clusterIDTag] = &clusterID
+	return p.azClientsAPIs.UpdateContainerGroupTags(ctx, p.resourceGroup, *cg.Name, tags)
+}
+
+// isMigratedPodAlive returns whether the pod is a live pod bound to a previous node name whose
+// container group was adopted. The pod lister doesn't have these pods, their container group is
+// not dangling until the pod is deleted.
+func (p *ACIProvider) isMigratedPodAlive(ctx context.Context, ns, name string, uid types.UID) (bool, error) {
+	if _, ok := p.migratedPods.Load(uid); !ok {
+		return false, nil
+	}
+	pod, err := p.kubeClient.CoreV1().Pods(ns).Get(ctx, name, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return false, err
+	}
+	if err == nil && pod.UID == uid && pod.DeletionTimestamp == nil {
+		return true, nil
+	}
+	p.migratedPods.Delete(uid)
+	return false, nil
+}
+
+func (p *ACIProvider) isPreviousNodeName(nodeName string) bool {
+	for _, name := range p.previousNodeNames {
+		if name == nodeName {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,141 @@
+/*
+Copyright (c) Microsoft Corporation.
+Licensed under the Apache 2.0 license.
+*/
+package provider
+
+import (
+	"context"
+	"sort"
+	"testing"
+
+	azaciv2 "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerinstance/armcontainerinstance/v2"
+	"github.com/golang/mock/gomock"
+	testsutil "github.com/virtual-kubelet/azure-aci/pkg/tests"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+func TestReconcileContainerGroups(t *testing.T) {
+	pods := testsutil.CreatePodsList([]string{"matched", "legacy", "renamed", "recreated", "claimed"}, podNamespace)
+	for _, pod := range pods {
+		pod.Spec.NodeName = fakeNodeName
+	}
+	// The pods are bound for good, the pod of the renamed node is still bound to its previous name.
+	pods[2].Spec.NodeName = "vk-old"
+	newContainerGroup := func(podName, uid, nodeName, clusterID string) *azaciv2.ContainerGroup {
+		cg := newClusterTestContainerGroup(podName, clusterID)
+		cg.Tags["UID"] = &uid
+		cg.Tags["NodeName"] = &nodeName
+		return cg
+	}
+	cgs := []*azaciv2.ContainerGroup{
+		newContainerGroup("matched", string(pods[0].UID), fakeNodeName, testsutil.FakeClusterID),
+		newContainerGroup("legacy", string(pods[1].UID), fakeNodeName, ""),
+		newContainerGroup("renamed", string(pods[2].UID), "vk-old", testsutil.FakeClusterID),
+		newContainerGroup("recreated", "previous-pod", fakeNodeName, testsutil.FakeClusterID),
+		newContainerGroup("claimed", string(pods[4].UID), "other-node", testsutil.FakeClusterID),
+		newContainerGroup("deleted", "deleted-pod", "vk-old", ""),
+		newContainerGroup("other-node", "other-pod", "other-node", testsutil.FakeClusterID),
+		newContainerGroup("other-cluster", string(pods[0].UID), fakeNodeName, "other-cluster"),
+	}
+
+	for _, dryRun := range []bool{true, false} {
+		mockCtrl := gomock.NewController(t)
+
+		aciMocks := createNewACIMock()
+		aciMocks.MockGetContainerGroupList = func(ctx context.Context, resourceGroup string) ([]*azaciv2.ContainerGroup, error) {
+			return cgs, nil
+		}
+		updated := map[string]map[string]*string{}
+		aciMocks.MockUpdateContainerGroupTags = func(ctx context.Context, resourceGroup, cgName string, tags map[string]*string) error {
+			updated[cgName] = tags
+			return nil
+		}
+
+		deleted := 0
+		aciMocks.MockDeleteContainerGroup = func(ctx context.Context, resourceGroup, cgName string) error {
+			deleted++
+			return nil
+		}
+
+		objects := make([]runtime.Object, 0, len(pods))
+		for _, pod := range pods {
+			objects = append(objects, pod)
+		}
+		kubeClient := fake.NewSimpleClientset(objects...)
+		// The fake client ignores the field selectors.
+		kubeClient.PrependReactor("list", "pods", func(action clienttesting.Action) (bool, runtime.Object, error) {
+			selector := action.(clienttesting.ListAction).GetListRestrictions().Fields
+			list := &v1.PodList{}
+			for _, pod := range pods {
+				if selector.Matches(fields.Set{"spec.nodeName": pod.Spec.NodeName}) {
+					list.Items = append(list.Items, *pod)
+				}
+			}
+			return true, list, nil
+		})
+
+		// The pods are not read from the pod lister, it only has the pods bound to the node.
+		provider, err := createTestProvider(aciMocks, NewMockConfigMapLister(mockCtrl),
+			NewMockSecretLister(mockCtrl), NewMockPodLister(mockCtrl), kubeClient)
+		if err != nil {
+			t.Fatal("failed to create the test provider", err)
+		}
+		provider.previousNodeNames = []string{"vk-old"}
+
+		summary, err := provider.reconcileContainerGroups(context.Background(), dryRun)
+		assert.NilError(t, err)
+		assert.Check(t, is.Equal(summary.matched, 1))
+		assert.Check(t, is.DeepEqual(summary.adopted, []string{
+			"container group legacy of pod " + podNamespace + "/legacy from node vk",
+			"container group renamed of pod " + podNamespace + "/renamed from node vk-old",
+		}))
+		assert.Check(t, is.DeepEqual(summary.orphaned, []string{
+			"container group deleted of pod " + podNamespace + "/deleted of node vk-old has no pod",
+		}))
+		assert.Check(t, is.DeepEqual(summary.conflicting, []string{
+			"container group recreated of pod " + podNamespace + "/recreated belongs to a previous pod with the same name",
+			"container group claimed of pod " + podNamespace + "/claimed is tagged with node other-node",
+		}))
+		assert.Check(t, is.Equal(summary.String(), "1 matched, 2 adopted, 1 orphaned, 2 conflicting"))
+
+		if dryRun {
+			assert.Check(t, is.Len(updated, 0), "nothing should be changed in dry-run mode")
+			mockCtrl.Finish()
+			continue
+		}
+		names := make([]string, 0, len(updated))
+		for name, tags := range updated {
+			names = append(names, name)
+			assert.Check(t, is.Equal(*tags["NodeName"], fakeNodeName))
+			assert.Check(t, is.Equal(*tags[clusterIDTag], testsutil.FakeClusterID))
+			assert.Check(t, is.Equal(*tags["PodName"], name), "the other tags should be kept")
+		}
+		sort.Strings(names)
+		assert.Check(t, is.DeepEqual(names, []string{"legacy", "renamed"}))
+
+		// The container group of the pod bound to the previous node name is not dangling.
+		assert.NilError(t, provider.CleanupPod(context.Background(), podNamespace, "renamed", pods[2].UID))
+		assert.Check(t, is.Equal(deleted, 0))
+		mockCtrl.Finish()
+	}
+}
+
+func TestSetReconcileConfig(t *testing.T) {
+	t.Setenv(previousNodeNamesEnv, "vk-old, vk-older,")
+	t.Setenv(reconcileDryRunEnv, "true")
+
+	p := ACIProvider{previousNodeNames: []string{"from-config"}}
+	assert.NilError(t, p.setReconcileConfig())
+	assert.Check(t, is.DeepEqual(p.previousNodeNames, []string{"vk-old", "vk-older"}))
+	assert.Check(t, p.reconcileDryRun)
+
+	t.Setenv(reconcileDryRunEnv, "maybe")
+	assert.ErrorContains(t, p.setReconcileConfig(), reconcileDryRunEnv)
+}
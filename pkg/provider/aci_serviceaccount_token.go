@@ -0,0 +1,352 @@
+/*
+Copyright (c) Microsoft Corporation.
+Licensed under the Apache 2.0 license.
+*/
+package provider
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	"github.com/virtual-kubelet/virtual-kubelet/trace"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	v1 "k8s.io/api/core/v1"
+	k8serr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ServiceAccountTokenRefreshPolicy defines what the provider does when a bound service account
+// token rendered into a container group is about to expire. ACI cannot update the content of a
+// secret volume on a running container group, so a refreshed token only reaches the containers
+// when the container group is deployed again.
+type ServiceAccountTokenRefreshPolicy string
+
+const (
+	// ServiceAccountTokenRefreshPolicyNone only reports tokens about to expire with a warning event.
+	ServiceAccountTokenRefreshPolicyNone ServiceAccountTokenRefreshPolicy = "None"
+	// ServiceAccountTokenRefreshPolicyRecreate re-issues the token and redeploys the container group,
+	// which restarts its containers.
+	ServiceAccountTokenRefreshPolicyRecreate ServiceAccountTokenRefreshPolicy = "Recreate"
+)
+
+const (
+	serviceAccountTokenRefreshPolicyEnv = "ACI_SERVICE_ACCOUNT_TOKEN_REFRESH_POLICY"
+
+	// kubelet requests this expiration for the default projected token, which lets the API server
+	// extend it when --service-account-extend-token-expiration is enabled.
+	defaultServiceAccountTokenExpirationSeconds = int64(3607)
+	serviceAccountTokenKey                      = "token"
+	serviceAccountRootCAConfigMap               = "kube-root-ca.crt"
+	serviceAccountRootCAKey                     = "ca.crt"
+	serviceAccountNamespaceKey                  = "namespace"
+
+	serviceAccountTokenRefreshInterval = time.Minute
+	serviceAccountTokenMaxRetryDelay   = 10 * time.Minute
+
+	reasonServiceAccountTokenExpiring  = "ServiceAccountTokenExpiring"
+	reasonServiceAccountTokenRefreshed = "ServiceAccountTokenRefreshed"
+	reasonServiceAccountTokenFailed    = "ServiceAccountTokenRefreshFailed"
+)
+
+var validServiceAccountTokenRefreshPolicies = map[ServiceAccountTokenRefreshPolicy]bool{
+	ServiceAccountTokenRefreshPolicyNone:     true,
+	ServiceAccountTokenRefreshPolicyRecreate: true,
+}
+
+// serviceAccountTokenSource issues the bound tokens of the service accounts.
+type serviceAccountTokenSource interface {
+	CreateToken(ctx context.Context, namespace, serviceAccountName string, tokenRequest *authenticationv1.TokenRequest) (*authenticationv1.TokenRequest, error)
+}
+
+// kubeServiceAccountTokenSource requests the tokens with the TokenRequest API of the API server.
+type kubeServiceAccountTokenSource struct {
+	kubeClient kubernetes.Interface
+}
+
+func (s *kubeServiceAccountTokenSource) CreateToken(ctx context.Context, namespace, serviceAccountName string, tokenRequest *authenticationv1.TokenRequest) (*authenticationv1.TokenRequest, error) {
+	return s.kubeClient.CoreV1().ServiceAccounts(namespace).CreateToken(ctx, serviceAccountName, tokenRequest, metav1.CreateOptions{})
+}
+
+type serviceAccountTokenExpiry struct {
+	namespace string
+	name      string
+	refreshAt time.Time
+	expiresAt time.Time
+	warned    bool
+	// refreshing is set while the container group is redeployed, so the token issued for the new
+	// deployment replaces this entry.
+	refreshing bool
+	attempts   int
+}
+
+// serviceAccountTokens keeps track of the bound tokens rendered into container groups, by pod UID.
+type serviceAccountTokens struct {
+	lock   sync.Mutex
+	tokens map[types.UID]*serviceAccountTokenExpiry
+}
+
+func (s *serviceAccountTokens) track(pod *v1.Pod, issuedAt, expiresAt time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.tokens == nil {
+		s.tokens = make(map[types.UID]*serviceAccountTokenExpiry)
+	}
+
+	// Same as kubelet, refresh once 80% of the token lifetime has elapsed.
+	refreshAt := issuedAt.Add(expiresAt.Sub(issuedAt) * 8 / 10)
+	if existing, ok := s.tokens[pod.UID]; ok && !existing.refreshing && existing.refreshAt.Before(refreshAt) {
+		// A pod may project more than one token, the first one to expire drives the refresh.
+		return
+	}
+	s.tokens[pod.UID] = &serviceAccountTokenExpiry{
+		namespace: pod.Namespace,
+		name:      pod.Name,
+		refreshAt: refreshAt,
+		expiresAt: expiresAt,
+	}
+}
+
+func (s *serviceAccountTokens) forget(uid types.UID) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.tokens, uid)
+}
+
+// startRefresh marks the token of the pod as being refreshed until refreshed or retryLater is called.
+func (s *serviceAccountTokens) startRefresh(uid types.UID) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if token, ok := s.tokens[uid]; ok {
+		token.refreshing = true
+	}
+}
+
+// refreshed forgets the token of the pod unless the redeployment issued a new one.
+func (s *serviceAccountTokens) refreshed(uid types.UID) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if token, ok := s.tokens[uid]; ok && token.refreshing {
+		delete(s.tokens, uid)
+	}
+}
+
+// retryLater keeps tracking a token that could not be refreshed and postpones the next attempt
+// with an exponential backoff.
+func (s *serviceAccountTokens) retryLater(uid types.UID, now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	token, ok := s.tokens[uid]
+	if !ok {
+		return
+	}
+	delay := serviceAccountTokenMaxRetryDelay
+	if token.attempts < 4 {
+		delay = min(serviceAccountTokenRefreshInterval<<token.attempts, serviceAccountTokenMaxRetryDelay)
+	}
+	token.attempts++
+	token.refreshing = false
+	token.refreshAt = now.Add(delay)
+}
+
+// due returns the pods whose tokens should be refreshed at the given time.
+func (s *serviceAccountTokens) due(now time.Time) map[types.UID]serviceAccountTokenExpiry {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	result := make(map[types.UID]serviceAccountTokenExpiry)
+	for uid, token := range s.tokens {
+		if !now.Before(token.refreshAt) {
+			result[uid] = *token
+		}
+	}
+	return result
+}
+
+func (s *serviceAccountTokens) markWarned(uid types.UID) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if token, ok := s.tokens[uid]; ok {
+		token.warned = true
+	}
+}
+
+func getServiceAccountTokenRefreshPolicy() (ServiceAccountTokenRefreshPolicy, error) {
+	policy := ServiceAccountTokenRefreshPolicyNone
+	if v := os.Getenv(serviceAccountTokenRefreshPolicyEnv); v != "" {
+		policy = ServiceAccountTokenRefreshPolicy(v)
+	}
+	if !validServiceAccountTokenRefreshPolicies[policy] {
+		return "", fmt.Errorf("%s %q is invalid, supported values are %s and %s", serviceAccountTokenRefreshPolicyEnv, policy,
+			ServiceAccountTokenRefreshPolicyNone, ServiceAccountTokenRefreshPolicyRecreate)
+	}
+	return policy, nil
+}
+
+// getServiceAccountToken mints a token for the pod's service account using the token source.
+// The token is bound to the pod, so it is invalidated as soon as the pod is deleted.
+func (p *ACIProvider) getServiceAccountToken(ctx context.Context, pod *v1.Pod, source *v1.ServiceAccountTokenProjection) (string, error) {
+	if p.tokenSource == nil {
+		return "", fmt.Errorf("cannot request a service account token for pod %s without a kubernetes client", pod.Name)
+	}
+
+	serviceAccountName := pod.Spec.ServiceAccountName
+	if serviceAccountName == "" {
+		serviceAccountName = "default"
+	}
+
+	expirationSeconds := defaultServiceAccountTokenExpirationSeconds
+	if source.ExpirationSeconds != nil {
+		expirationSeconds = *source.ExpirationSeconds
+	}
+
+	var audiences []string
+	if source.Audience != "" {
+		audiences = []string{source.Audience}
+	}
+
+	tokenRequest := &authenticationv1.TokenRequest{
+		Spec: authenticationv1.TokenRequestSpec{
+			Audiences:         audiences,
+			ExpirationSeconds: &expirationSeconds,
+			BoundObjectRef: &authenticationv1.BoundObjectReference{
+				APIVersion: "v1",
+				Kind:       "Pod",
+				Name:       pod.Name,
+				UID:        pod.UID,
+			},
+		},
+	}
+
+	issuedAt := time.Now()
+	tr, err := p.tokenSource.CreateToken(ctx, pod.Namespace, serviceAccountName, tokenRequest)
+	if err != nil {
+		return "", fmt.Errorf("failed to request a token for service account %s of pod %s: %w", serviceAccountName, pod.Name, err)
+	}
+
+	expiresAt := tr.Status.ExpirationTimestamp.Time
+	if expiresAt.IsZero() {
+		expiresAt = issuedAt.Add(time.Duration(expirationSeconds) * time.Second)
+	}
+	p.serviceAccountTokens.track(pod, issuedAt, expiresAt)
+
+	log.G(ctx).Debugf("issued service account token for pod %s expiring at %s", pod.Name, expiresAt)
+	return tr.Status.Token, nil
+}
+
+// getServiceAccountRootCA returns the cluster CA bundle published in every namespace, falling back
+// to the one mounted in the virtual-kubelet pod.
+func (p *ACIProvider) getServiceAccountRootCA(ctx context.Context, namespace string) ([]byte, error) {
+	configMap, err := p.configL.ConfigMaps(namespace).Get(serviceAccountRootCAConfigMap)
+	if err != nil && !k8serr.IsNotFound(err) {
+		return nil, err
+	}
+	if configMap != nil {
+		if ca, ok := configMap.Data[serviceAccountRootCAKey]; ok {
+			return []byte(ca), nil
+		}
+	}
+
+	log.G(ctx).Debugf("configMap %s not found in namespace %s, using the virtual-kubelet CA bundle", serviceAccountRootCAConfigMap, namespace)
+	return os.ReadFile(path.Join(serviceAccountSecretMountPath, serviceAccountRootCAKey))
+}
+
+// addServiceAccountTokenFile renders the token of the projection in the projected volume.
+func (p *ACIProvider) addServiceAccountTokenFile(ctx context.Context, pod *v1.Pod, source *v1.ServiceAccountTokenProjection, paths map[string]*string) error {
+	token, err := p.getServiceAccountToken(ctx, pod, source)
+	if err != nil {
+		return err
+	}
+
+	tokenPath := source.Path
+	if tokenPath == "" {
+		tokenPath = serviceAccountTokenKey
+	}
+	strV := base64.StdEncoding.EncodeToString([]byte(token))
+	paths[tokenPath] = &strV
+	return nil
+}
+
+// addServiceAccountRootCAFile renders the ca.crt file of the kube-root-ca.crt config map projected
+// next to the token, when the config map is not published in the namespace yet.
+func (p *ACIProvider) addServiceAccountRootCAFile(ctx context.Context, pod *v1.Pod, source *v1.ConfigMapProjection, paths map[string]*string) {
+	for _, keyToPath := range source.Items {
+		if keyToPath.Key != serviceAccountRootCAKey {
+			continue
+		}
+		ca, err := p.getServiceAccountRootCA(ctx, pod.Namespace)
+		if err != nil {
+			log.G(ctx).WithError(err).Warnf("cannot find the cluster CA bundle for the service account token of pod %s", pod.Name)
+			return
+		}
+		caStr := base64.StdEncoding.EncodeToString(ca)
+		paths[keyToPath.Path] = &caStr
+	}
+}
+
+// runServiceAccountTokenRefresh periodically handles bound service account tokens about to expire
+// according to the configured refresh policy.
+func (p *ACIProvider) runServiceAccountTokenRefresh(ctx context.Context) {
+	ticker := time.NewTicker(serviceAccountTokenRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.refreshServiceAccountTokens(ctx, time.Now())
+		}
+	}
+}
+
+func (p *ACIProvider) refreshServiceAccountTokens(ctx context.Context, now time.Time) {
+	ctx, span := trace.StartSpan(ctx, "aci.refreshServiceAccountTokens")
+	defer span.End()
+
+	for uid, token := range p.serviceAccountTokens.due(now) {
+		pod, err := p.podsL.Pods(token.namespace).Get(token.name)
+		if err != nil || pod == nil || pod.UID != uid || pod.DeletionTimestamp != nil {
+			p.serviceAccountTokens.forget(uid)
+			continue
+		}
+
+		switch p.serviceAccountTokenRefreshPolicy {
+		case ServiceAccountTokenRefreshPolicyRecreate:
+			log.G(ctx).Infof("service account token of pod %s expires at %s, redeploying container group", pod.Name, token.expiresAt)
+			// The redeployment issues new tokens, which replace the tracked expiration.
+			p.serviceAccountTokens.startRefresh(uid)
+			if err := p.recreateContainerGroup(ctx, pod); err != nil {
+				log.G(ctx).WithError(err).Errorf("failed to redeploy pod %s to refresh its service account token", pod.Name)
+				p.serviceAccountTokens.retryLater(uid, now)
+				p.recordPodEvent(pod, v1.EventTypeWarning, reasonServiceAccountTokenFailed,
+					"Failed to redeploy the container group to refresh the service account token: %v", err)
+				continue
+			}
+			p.serviceAccountTokens.refreshed(uid)
+			p.recordPodEvent(pod, v1.EventTypeNormal, reasonServiceAccountTokenRefreshed,
+				"Container group redeployed with a refreshed service account token")
+		default:
+			if token.warned {
+				continue
+			}
+			p.serviceAccountTokens.markWarned(uid)
+			p.recordPodEvent(pod, v1.EventTypeWarning, reasonServiceAccountTokenExpiring,
+				"Service account token expires at %s and cannot be refreshed in place on ACI, set %s to %s to redeploy the container group",
+				token.expiresAt.Format(time.RFC3339), serviceAccountTokenRefreshPolicyEnv, ServiceAccountTokenRefreshPolicyRecreate)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+/*
+Copyright (c) Microsoft Corporation.
+Licensed under the Apache 2.0 license.
+*/
+package provider
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	azaciv2 "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerinstance/armcontainerinstance/v2"
+	"github.com/golang/mock/gomock"
+	testsutil "github.com/virtual-kubelet/azure-aci/pkg/tests"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestRefreshServiceAccountTokens(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	cases := []struct {
+		description       string
+		policy            ServiceAccountTokenRefreshPolicy
+		podDeleted        bool
+		createErr         error
+		expectedEvents    []string
+		expectedRecreates int
+		expectedTracked   int
+	}{
+		{
+			description:     "None policy warns once about the expiring token",
+			policy:          ServiceAccountTokenRefreshPolicyNone,
+			expectedEvents:  []string{reasonServiceAccountTokenExpiring},
+			expectedTracked: 1,
+		},
+		{
+			description:       "Recreate policy redeploys the container group",
+			policy:            ServiceAccountTokenRefreshPolicyRecreate,
+			expectedEvents:    []string{reasonServiceAccountTokenRefreshed},
+			expectedRecreates: 1,
+		},
+		{
+			description:       "failed redeployments keep the token and retry later",
+			policy:            ServiceAccountTokenRefreshPolicyRecreate,
+			createErr:         errors.New("capacity"),
+			expectedEvents:    []string{reasonServiceAccountTokenFailed},
+			expectedRecreates: 1,
+			expectedTracked:   1,
+		},
+		{
+			description: "tokens of deleted pods are forgotten",
+			policy:      ServiceAccountTokenRefreshPolicyRecreate,
+			podDeleted:  true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.description, func(t *testing.T) {
+			pod := testsutil.CreatePodObj(podName, podNamespace)
+
+			podLister := NewMockPodLister(mockCtrl)
+			podNamespaceLister := NewMockPodNamespaceLister(mockCtrl)
+			podLister.EXPECT().Pods(podNamespace).Return(podNamespaceLister).AnyTimes()
+			if tc.podDeleted {
+				podNamespaceLister.EXPECT().Get(podName).Return(nil, nil).AnyTimes()
+			} else {
+				podNamespaceLister.EXPECT().Get(podName).Return(pod, nil).AnyTimes()
+			}
+
+			recreates := 0
+			aciMocks := createNewACIMock()
+			aciMocks.MockCreateContainerGroup = func(ctx context.Context, resourceGroup, podNS, podName string, cg *azaciv2.ContainerGroup) error {
+				recreates++
+				return tc.createErr
+			}
+
+			provider, err := createTestProvider(aciMocks, NewMockConfigMapLister(mockCtrl),
+				NewMockSecretLister(mockCtrl), podLister, nil)
+			if err != nil {
+				t.Fatal("Unable to create test provider", err)
+			}
+			recorder := record.NewFakeRecorder(5)
+			provider.eventRecorder = recorder
+			provider.serviceAccountTokenRefreshPolicy = tc.policy
+
+			now := time.Now()
+			provider.serviceAccountTokens.track(pod, now.Add(-time.Hour), now.Add(10*time.Minute))
+
+			// Nothing is due before 80% of the token lifetime.
+			provider.refreshServiceAccountTokens(context.Background(), now.Add(-20*time.Minute))
+			assert.Check(t, is.Len(recorder.Events, 0))
+
+			provider.refreshServiceAccountTokens(context.Background(), now)
+			provider.refreshServiceAccountTokens(context.Background(), now)
+
+			assert.Check(t, is.Equal(recreates, tc.expectedRecreates))
+			assert.Check(t, is.Len(provider.serviceAccountTokens.tokens, tc.expectedTracked))
+			assert.Assert(t, is.Len(recorder.Events, len(tc.expectedEvents)))
+			for _, reason := range tc.expectedEvents {
+				event := <-recorder.Events
+				assert.Check(t, strings.Contains(event, reason), event)
+			}
+
+			if tc.createErr != nil {
+				// The next attempt is postponed, not dropped.
+				provider.refreshServiceAccountTokens(context.Background(), now.Add(serviceAccountTokenRefreshInterval))
+				assert.Check(t, is.Equal(recreates, tc.expectedRecreates+1))
+				token := provider.serviceAccountTokens.tokens[pod.UID]
+				assert.Assert(t, token != nil)
+				assert.Check(t, is.Equal(token.attempts, 2))
+				assert.Check(t, token.refreshAt.Equal(now.Add(3*serviceAccountTokenRefreshInterval)))
+			}
+		})
+	}
+}
+
+func TestGetServiceAccountTokenRefreshPolicy(t *testing.T) {
+	t.Setenv(serviceAccountTokenRefreshPolicyEnv, "")
+	policy, err := getServiceAccountTokenRefreshPolicy()
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(policy, ServiceAccountTokenRefreshPolicyNone))
+
+	t.Setenv(serviceAccountTokenRefreshPolicyEnv, string(ServiceAccountTokenRefreshPolicyRecreate))
+	policy, err = getServiceAccountTokenRefreshPolicy()
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(policy, ServiceAccountTokenRefreshPolicyRecreate))
+
+	t.Setenv(serviceAccountTokenRefreshPolicyEnv, "Restart")
+	_, err = getServiceAccountTokenRefreshPolicy()
+	assert.Check(t, err != nil)
+}
@@ -0,0 +1,173 @@
+/*
+Copyright (c) Microsoft Corporation.
+Licensed under the Apache 2.0 license.
+*/
+package provider
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	"github.com/virtual-kubelet/virtual-kubelet/node/api"
+	"github.com/virtual-kubelet/virtual-kubelet/trace"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	reasonFailedPreStopHook           = "FailedPreStopHook"
+	reasonContainerGroupDeleteFailed  = "ContainerGroupDeleteFailed"
+	defaultTerminationGracePeriodSecs = int64(v1.DefaultTerminationGracePeriodSeconds)
+)
+
+// deleteRetryBackoff is the backoff used to retry a failed container group deletion. Once it is
+// exhausted the container group is left to the dangling pods cleanup.
+var deleteRetryBackoff = wait.Backoff{
+	Duration: 5 * time.Second,
+	Factor:   2,
+	Jitter:   0.1,
+	Steps:    6,
+	Cap:      2 * time.Minute,
+}
+
+// terminatePod runs the preStop hooks of the pod containers within the termination grace period,
+// then deletes its container group, retrying with backoff when the deletion fails.
+func (p *ACIProvider) terminatePod(ctx context.Context, pod *v1.Pod) {
+	ctx, span := trace.StartSpan(ctx, "aci.terminatePod")
+	defer span.End()
+	ctx = addAzureAttributes(ctx, span, p)
+
+	p.runPreStopHooks(ctx, pod, getTerminationGracePeriod(pod))
+
+	backoff := deleteRetryBackoff
+	for {
+		cgName, err := p.deletePodContainerGroup(ctx, pod.Namespace, pod.Name, pod.UID)
+		if err == nil || errdefs.IsNotFound(err) {
+			return
+		}
+
+		span.SetStatus(err)
+		target := "the container group of the pod"
+		if cgName != "" {
+			target = "container group " + cgName
+		}
+		p.recordPodEvent(pod, v1.EventTypeWarning, reasonContainerGroupDeleteFailed,
+			"Failed to delete %s: %v", target, err)
+
+		if backoff.Steps <= 1 {
+			log.G(ctx).WithError(err).Errorf("giving up deleting the container group of pod %s", pod.Name)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff.Step()):
+		}
+	}
+}
+
+// getTerminationGracePeriod returns the grace period requested for the deletion of the pod.
+func getTerminationGracePeriod(pod *v1.Pod) time.Duration {
+	seconds := defaultTerminationGracePeriodSecs
+	if pod.DeletionGracePeriodSeconds != nil {
+		seconds = *pod.DeletionGracePeriodSeconds
+	} else if pod.Spec.TerminationGracePeriodSeconds != nil {
+		seconds = *pod.Spec.TerminationGracePeriodSeconds
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// runPreStopHooks runs the preStop hooks of all the containers in parallel, as kubelet does, and
+// waits at most for the grace period. ACI has no way to signal the containers before the container
+// group is deleted, so the hooks are the only chance given to the workload to shut down gracefully.
+func (p *ACIProvider) runPreStopHooks(ctx context.Context, pod *v1.Pod, gracePeriod time.Duration) {
+	if gracePeriod <= 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, gracePeriod)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for i := range pod.Spec.Containers {
+		container := &pod.Spec.Containers[i]
+		if container.Lifecycle == nil || container.Lifecycle.PreStop == nil {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := p.runPreStopHook(ctx, pod, container); err != nil {
+				log.G(ctx).WithError(err).Warnf("preStop hook of container %s in pod %s failed", container.Name, pod.Name)
+				p.recordPodEvent(pod, v1.EventTypeWarning, reasonFailedPreStopHook,
+					"PreStopHook failed for container %s: %v", container.Name, err)
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.G(ctx).Warnf("preStop hooks of pod %s did not complete within the grace period of %s", pod.Name, gracePeriod)
+	}
+}
+
+func (p *ACIProvider) runPreStopHook(ctx context.Context, pod *v1.Pod, container *v1.Container) error {
+	hook := container.Lifecycle.PreStop
+	switch {
+	case hook.Exec != nil:
+		log.G(ctx).Debugf("running preStop exec hook of container %s in pod %s", container.Name, pod.Name)
+		return p.RunInContainer(ctx, pod.Namespace, pod.Name, container.Name, hook.Exec.Command, &preStopAttachIO{})
+	case hook.Sleep != nil:
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Duration(hook.Sleep.Seconds) * time.Second):
+		}
+		return nil
+	default:
+		log.G(ctx).Warnf("preStop hook of container %s in pod %s is not supported, only exec and sleep hooks are", container.Name, pod.Name)
+		return nil
+	}
+}
+
+// preStopAttachIO discards the output of the preStop hooks.
+type preStopAttachIO struct{}
+
+func (a *preStopAttachIO) Stdin() io.Reader {
+	return nil
+}
+
+func (a *preStopAttachIO) Stdout() io.WriteCloser {
+	return nopWriteCloser{io.Discard}
+}
+
+func (a *preStopAttachIO) Stderr() io.WriteCloser {
+	return nil
+}
+
+func (a *preStopAttachIO) TTY() bool {
+	return false
+}
+
+func (a *preStopAttachIO) Resize() <-chan api.TermSize {
+	return nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,227 @@
+/*
+Copyright (c) Microsoft Corporation.
+Licensed under the Apache 2.0 license.
+*/
+package provider
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	azaciv2 "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerinstance/armcontainerinstance/v2"
+	"github.com/golang/mock/gomock"
+	testsutil "github.com/virtual-kubelet/azure-aci/pkg/tests"
+	"github.com/virtual-kubelet/azure-aci/pkg/util"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/record"
+)
+
+func newTerminationTestContainerGroup(ctx context.Context, resourceGroup, namespace, name, nodeName string) (*azaciv2.ContainerGroup, error) {
+	cg := testsutil.CreateTestContainerGroupObj(name, namespace, runningState, runningState,
+		testsutil.CgCreationTime.Add(time.Second*2))
+	cgName := util.ContainerGroupName(namespace, name)
+	cg.Name = &cgName
+	return cg, nil
+}
+
+func TestDeletePodRunsPreStopHookAndWaitsForDeletion(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	pod := testsutil.CreatePodObj(podName, podNamespace)
+	preStopCommand := []string{"/bin/sh", "-c", "nginx -s quit"}
+	pod.Spec.Containers[0].Lifecycle = &v1.Lifecycle{
+		PreStop: &v1.LifecycleHandler{
+			Exec: &v1.ExecAction{Command: preStopCommand},
+		},
+	}
+
+	var lock sync.Mutex
+	var calls []string
+	trackCall := func(call string) {
+		lock.Lock()
+		defer lock.Unlock()
+		calls = append(calls, call)
+	}
+
+	deleteCompleted := make(chan struct{})
+	aciMocks := createNewACIMock()
+	aciMocks.MockGetContainerGroupInfo = newTerminationTestContainerGroup
+	aciMocks.MockExecuteContainerCommand = func(ctx context.Context, resourceGroup, cgName, containerName string, containerReq azaciv2.ContainerExecRequest) (*azaciv2.ContainerExecResponse, error) {
+		trackCall("exec " + *containerReq.Command)
+		return nil, errors.New("exec is not available")
+	}
+	aciMocks.MockDeleteContainerGroup = func(ctx context.Context, resourceGroup, cgName string) error {
+		trackCall("delete " + cgName)
+		return nil
+	}
+	aciMocks.MockPollDeleteContainerGroup = func(ctx context.Context, cg *azaciv2.ContainerGroup) (*azaciv2.ContainerGroup, error) {
+		<-deleteCompleted
+		return nil, nil
+	}
+
+	podLister := NewMockPodLister(mockCtrl)
+	podLister.EXPECT().List(gomock.Any()).Return([]*v1.Pod{pod}, nil).AnyTimes()
+
+	provider, err := createTestProvider(aciMocks, NewMockConfigMapLister(mockCtrl),
+		NewMockSecretLister(mockCtrl), podLister, nil)
+	if err != nil {
+		t.Fatal("failed to create the test provider", err)
+	}
+	provider.eventRecorder = record.NewFakeRecorder(10)
+
+	updates := make(chan *v1.Pod, 1)
+	provider.tracker = &PodsTracker{
+		pods: podLister,
+		updateCb: func(updatedPod *v1.Pod) {
+			updates <- updatedPod
+		},
+	}
+
+	err = provider.DeletePod(context.Background(), pod)
+	assert.NilError(t, err)
+
+	select {
+	case <-updates:
+		t.Fatal("pod status should not be updated before the container group is deleted")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(deleteCompleted)
+	select {
+	case updatedPod := <-updates:
+		for _, status := range updatedPod.Status.ContainerStatuses {
+			assert.Check(t, status.State.Terminated != nil)
+			assert.Check(t, is.Nil(status.State.Running))
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("pod status was not updated after the container group was deleted")
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Check(t, is.DeepEqual(calls, []string{
+		"exec " + quoteExecCommand(wrapExecCommand(preStopCommand, "", true), ""),
+		"delete " + util.ContainerGroupName(podNamespace, podName),
+	}))
+}
+
+func TestDeletePodRetriesFailedDeletion(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	defaultBackoff := deleteRetryBackoff
+	deleteRetryBackoff = wait.Backoff{Duration: time.Millisecond, Factor: 1, Steps: 3}
+	defer func() { deleteRetryBackoff = defaultBackoff }()
+
+	pod := testsutil.CreatePodObj(podName, podNamespace)
+
+	// The container groups created before the names were hashed are reported with their name.
+	legacyName := util.LegacyContainerGroupName(podNamespace, podName)
+	attempts := 0
+	deleted := make(chan struct{})
+	aciMocks := createNewACIMock()
+	aciMocks.MockGetContainerGroupInfo = func(ctx context.Context, resourceGroup, namespace, name, nodeName string) (*azaciv2.ContainerGroup, error) {
+		cg, err := newTerminationTestContainerGroup(ctx, resourceGroup, namespace, name, nodeName)
+		cg.Name = &legacyName
+		return cg, err
+	}
+	aciMocks.MockDeleteContainerGroup = func(ctx context.Context, resourceGroup, cgName string) error {
+		assert.Check(t, is.Equal(cgName, legacyName))
+		attempts++
+		if attempts == 1 {
+			return errors.New("the container group is busy")
+		}
+		return nil
+	}
+	aciMocks.MockPollDeleteContainerGroup = func(ctx context.Context, cg *azaciv2.ContainerGroup) (*azaciv2.ContainerGroup, error) {
+		if attempts == 2 {
+			return nil, errors.New("the delete operation failed")
+		}
+		close(deleted)
+		return nil, nil
+	}
+
+	provider, err := createTestProvider(aciMocks, NewMockConfigMapLister(mockCtrl),
+		NewMockSecretLister(mockCtrl), NewMockPodLister(mockCtrl), nil)
+	if err != nil {
+		t.Fatal("failed to create the test provider", err)
+	}
+	recorder := record.NewFakeRecorder(5)
+	provider.eventRecorder = recorder
+
+	err = provider.DeletePod(context.Background(), pod)
+	assert.NilError(t, err)
+
+	select {
+	case <-deleted:
+	case <-time.After(10 * time.Second):
+		t.Fatal("container group was not deleted")
+	}
+
+	assert.Check(t, is.Equal(attempts, 3))
+	assert.Assert(t, is.Len(recorder.Events, 2))
+	for i := 0; i < 2; i++ {
+		event := <-recorder.Events
+		assert.Check(t, strings.Contains(event, reasonContainerGroupDeleteFailed), event)
+		assert.Check(t, strings.Contains(event, legacyName), event)
+	}
+}
+
+func TestTerminatePodWithoutEventRecorder(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	defaultBackoff := deleteRetryBackoff
+	deleteRetryBackoff = wait.Backoff{Duration: time.Millisecond, Factor: 1, Steps: 2}
+	defer func() { deleteRetryBackoff = defaultBackoff }()
+
+	pod := testsutil.CreatePodObj(podName, podNamespace)
+	pod.Spec.Containers[0].Lifecycle = &v1.Lifecycle{
+		PreStop: &v1.LifecycleHandler{
+			Exec: &v1.ExecAction{Command: []string{"nginx", "-s", "quit"}},
+		},
+	}
+
+	attempts := 0
+	aciMocks := createNewACIMock()
+	aciMocks.MockGetContainerGroupInfo = newTerminationTestContainerGroup
+	aciMocks.MockExecuteContainerCommand = func(ctx context.Context, resourceGroup, cgName, containerName string, containerReq azaciv2.ContainerExecRequest) (*azaciv2.ContainerExecResponse, error) {
+		return nil, errors.New("the container is not running")
+	}
+	aciMocks.MockDeleteContainerGroup = func(ctx context.Context, resourceGroup, cgName string) error {
+		attempts++
+		return errors.New("the container group is busy")
+	}
+
+	provider, err := createTestProvider(aciMocks, NewMockConfigMapLister(mockCtrl),
+		NewMockSecretLister(mockCtrl), NewMockPodLister(mockCtrl), nil)
+	if err != nil {
+		t.Fatal("failed to create the test provider", err)
+	}
+	provider.eventRecorder = nil
+
+	// The failures are only logged.
+	provider.terminatePod(context.Background(), pod)
+	assert.Check(t, is.Equal(attempts, 2))
+}
+
+func TestGetTerminationGracePeriod(t *testing.T) {
+	pod := testsutil.CreatePodObj(podName, podNamespace)
+	assert.Check(t, is.Equal(getTerminationGracePeriod(pod), 30*time.Second))
+
+	specGracePeriod := int64(10)
+	pod.Spec.TerminationGracePeriodSeconds = &specGracePeriod
+	assert.Check(t, is.Equal(getTerminationGracePeriod(pod), 10*time.Second))
+
+	deletionGracePeriod := int64(0)
+	pod.DeletionGracePeriodSeconds = &deletionGracePeriod
+	assert.Check(t, is.Equal(getTerminationGracePeriod(pod), time.Duration(0)))
+}
@@ -6,11 +6,14 @@ package provider
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"strings"
 	"testing"
@@ -20,9 +23,11 @@ import (
 	"github.com/cpuguy83/dockercfg"
 	"github.com/golang/mock/gomock"
 	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
 	"github.com/virtual-kubelet/azure-aci/pkg/auth"
 	testsutil "github.com/virtual-kubelet/azure-aci/pkg/tests"
 	"github.com/virtual-kubelet/azure-aci/pkg/util"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
 	"github.com/virtual-kubelet/virtual-kubelet/node/nodeutil"
 	"gotest.tools/assert"
 
@@ -32,6 +37,7 @@ import (
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/fake"
 	"k8s.io/client-go/tools/record"
@@ -741,6 +747,10 @@ func createTestProvider(aciMocks *MockACIProvider, configMapMocker *MockConfigMa
 	if err != nil {
 		return nil, err
 	}
+	err = os.Setenv("ACI_CLUSTER_ID", testsutil.FakeClusterID)
+	if err != nil {
+		return nil, err
+	}
 
 	cfg := nodeutil.ProviderConfig{
 		ConfigMaps: configMapMocker,
@@ -1310,6 +1320,7 @@ func TestDeleteContainerGroup(t *testing.T) {
 		podName               string
 		cgDeleteExpectedError error
 		hasValidPodsTracker   bool
+		cgPodUID              string
 	}{
 		{
 			description:           "successfully deletes container group and updates pod status",
@@ -1329,6 +1340,13 @@ func TestDeleteContainerGroup(t *testing.T) {
 			cgDeleteExpectedError: errors.New("failed to delete container group"),
 			hasValidPodsTracker:   false,
 		},
+		{
+			description:           "keeps the container group of a pod recreated with the same name",
+			podName:               podName2,
+			cgDeleteExpectedError: nil,
+			hasValidPodsTracker:   false,
+			cgPodUID:              "previous-pod",
+		},
 	}
 
 	for _, tc := range cases {
@@ -1339,7 +1357,27 @@ func TestDeleteContainerGroup(t *testing.T) {
 			aciMocks := createNewACIMock()
 			podLister := NewMockPodLister(mockCtrl)
 
+			var podUID types.UID
+			for _, pod := range fakePods {
+				if pod.Name == tc.podName {
+					podUID = pod.UID
+				}
+			}
+			aciMocks.MockGetContainerGroupInfo = func(ctx context.Context, resourceGroup, namespace, name, nodeName string) (*azaciv2.ContainerGroup, error) {
+				cg := testsutil.CreateContainerGroupObj(name, namespace, "Succeeded",
+					testsutil.CreateACIContainersListObj(runningState, "Initializing",
+						testsutil.CgCreationTime.Add(time.Second*2), testsutil.CgCreationTime.Add(time.Second*3),
+						false, false, false), "Succeeded")
+				cgPodUID := string(podUID)
+				if tc.cgPodUID != "" {
+					cgPodUID = tc.cgPodUID
+				}
+				cg.Tags["UID"] = &cgPodUID
+				return cg, nil
+			}
+			deleted := false
 			aciMocks.MockDeleteContainerGroup = func(ctx context.Context, resourceGroup, cgName string) error {
+				deleted = true
 				return tc.cgDeleteExpectedError
 			}
 
@@ -1366,8 +1404,13 @@ func TestDeleteContainerGroup(t *testing.T) {
 				provider.tracker = podsTracker
 			}
 
-			err = provider.deleteContainerGroup(context.Background(), podNamespace, tc.podName)
+			err = provider.deleteContainerGroup(context.Background(), podNamespace, tc.podName, podUID)
 
+			if tc.cgPodUID != "" {
+				assert.Check(t, errdefs.IsNotFound(err), "the container group of another pod should not be found")
+				assert.Check(t, !deleted, "the container group of another pod should not be deleted")
+				return
+			}
 			if tc.cgDeleteExpectedError == nil {
 				assert.NilError(t, tc.cgDeleteExpectedError, err)
 			} else {
@@ -1902,7 +1945,7 @@ func TestFetchStandardPodsEvents(t *testing.T) {
 		Spec: corev1.PodSpec{},
 	}
 
-	cg := testsutil.CreateContainerGroupObj(containerGroupName(podNamespace, podNamespace), "", "Succeeded",
+	cg := testsutil.CreateContainerGroupObj(util.ContainerGroupName(podNamespace, podNamespace), "", "Succeeded",
 		testsutil.CreateACIContainersListObj(runningState, "Initializing",
 			testsutil.CgCreationTime.Add(time.Second*2),
 			testsutil.CgCreationTime.Add(time.Second*3),
@@ -1920,7 +1963,7 @@ func TestFetchStandardPodsEvents(t *testing.T) {
 		return cg, nil
 	}
 	aciMocks.MockGetContainerGroupInfo = func(ctx context.Context, resourceGroup, namespace, name, nodeName string) (*azaciv2.ContainerGroup, error) {
-		return aciMocks.MockGetContainerGroup(ctx, resourceGroup, containerGroupName(name, namespace))
+		return aciMocks.MockGetContainerGroup(ctx, resourceGroup, util.ContainerGroupName(name, namespace))
 	}
 	podLister := NewMockPodLister(mockCtrl)
 	podLister.EXPECT().List(labels.Everything()).Times(2).Return([]*corev1.Pod{pod}, nil)
@@ -1932,10 +1975,9 @@ func TestFetchStandardPodsEvents(t *testing.T) {
 	}
 
 	podsTracker := &PodsTracker{
-		pods:           podLister,
-		updateCb:       func(pod *corev1.Pod) {},
-		handler:        provider,
-		lastEventCheck: time.UnixMicro(0),
+		pods:     podLister,
+		updateCb: func(pod *corev1.Pod) {},
+		handler:  provider,
 	}
 
 	fakeRecorder := record.NewFakeRecorder(2)
@@ -1994,7 +2036,45 @@ func TestCreatePodWithLifecycleHooks(t *testing.T) {
 	}
 
 	err = provider.CreatePod(context.Background(), pod)
-	assert.Error(t, err, "ACI does not support lifecycle hooks")
+	assert.Error(t, err, "ACI does not support postStart lifecycle hooks")
+
+	pod.Spec.Containers[0].Lifecycle = &corev1.Lifecycle{
+		PreStop: &corev1.LifecycleHandler{
+			HTTPGet: &corev1.HTTPGetAction{Path: "/shutdown"},
+		},
+	}
+	err = provider.CreatePod(context.Background(), pod)
+	assert.Error(t, err, "ACI only supports exec and sleep preStop lifecycle hooks")
+}
+
+func TestCreatePodWithPreStopExecHook(t *testing.T) {
+	podName := "pod-" + uuid.New().String()
+	podNamespace := "ns-" + uuid.New().String()
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	created := false
+	aciMocks := createNewACIMock()
+	aciMocks.MockCreateContainerGroup = func(ctx context.Context, resourceGroup, podNS, podName string, cg *azaciv2.ContainerGroup) error {
+		created = true
+		return nil
+	}
+
+	pod := testsutil.CreatePodObj(podName, podNamespace)
+	pod.Spec.Containers[0].Lifecycle = &corev1.Lifecycle{
+		PreStop: &corev1.LifecycleHandler{
+			Exec: &corev1.ExecAction{Command: []string{"nginx", "-s", "quit"}},
+		},
+	}
+
+	provider, err := createTestProvider(aciMocks, NewMockConfigMapLister(mockCtrl),
+		NewMockSecretLister(mockCtrl), NewMockPodLister(mockCtrl), nil)
+	if err != nil {
+		t.Fatal("failed to create the test provider", err)
+	}
+
+	assert.NilError(t, provider.CreatePod(context.Background(), pod))
+	assert.Check(t, created, "the container group should be created")
 }
 
 func TestRunInContainer(t *testing.T) {
@@ -2039,6 +2119,103 @@ func TestRunInContainer(t *testing.T) {
 	attachIO.EXPECT().TTY().Return(true)
 	attachIO.EXPECT().Resize().Return(termSize)
 	attachIO.EXPECT().Stdout().Return(nil)
+	attachIO.EXPECT().Stderr().Return(nil)
 
 	provider.RunInContainer(context.Background(), podNamespace, podName, "", nil, attachIO)
 }
+
+type nopCloserBuffer struct {
+	bytes.Buffer
+}
+
+func (b *nopCloserBuffer) Close() error {
+	return nil
+}
+
+func TestAttachToContainer(t *testing.T) {
+	podName := "pod-" + uuid.New().String()
+	podNamespace := "ns-" + uuid.New().String()
+	password := "fake-password"
+
+	cases := []struct {
+		description   string
+		stdinEnabled  bool
+		expectedInput string
+	}{
+		{
+			description:   "streams the container output and input when stdin is enabled",
+			stdinEnabled:  true,
+			expectedInput: "hello",
+		},
+		{
+			description:  "ignores the input when the container was not started with stdin",
+			stdinEnabled: false,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.description, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+
+			received := make(chan string, 1)
+			upgrader := websocket.Upgrader{}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Check(t, is.Equal(r.Header.Get("Authorization"), password))
+				c, err := upgrader.Upgrade(w, r, nil)
+				if err != nil {
+					return
+				}
+				defer c.Close()
+
+				if tc.stdinEnabled {
+					_, msg, err := c.ReadMessage()
+					assert.Check(t, err)
+					received <- string(msg)
+				}
+				_ = c.WriteMessage(websocket.BinaryMessage, []byte("container output"))
+				_ = c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			}))
+			defer server.Close()
+
+			aciMocks := createNewACIMock()
+			aciMocks.MockGetContainerGroupInfo = func(ctx context.Context, resourceGroup, namespace, name, nodeName string) (*azaciv2.ContainerGroup, error) {
+				return testsutil.CreateContainerGroupObj(podName, podNamespace, "Succeeded",
+					testsutil.CreateACIContainersListObj(runningState, "Initializing", testsutil.CgCreationTime.Add(time.Second*2), testsutil.CgCreationTime.Add(time.Second*3), true, true, true), "Succeeded"), nil
+			}
+			aciMocks.MockAttach = func(ctx context.Context, resourceGroup, cgName, containerName string) (*azaciv2.ContainerAttachResponse, error) {
+				wsURI := "ws" + strings.TrimPrefix(server.URL, "http")
+				return &azaciv2.ContainerAttachResponse{
+					WebSocketURI: &wsURI,
+					Password:     &password,
+				}, nil
+			}
+
+			pod := testsutil.CreatePodObj(podName, podNamespace)
+			pod.Spec.Containers[0].Stdin = tc.stdinEnabled
+
+			podLister := NewMockPodLister(mockCtrl)
+			podNamespaceLister := NewMockPodNamespaceLister(mockCtrl)
+			podLister.EXPECT().Pods(podNamespace).Return(podNamespaceLister)
+			podNamespaceLister.EXPECT().Get(podName).Return(pod, nil)
+
+			provider, err := createTestProvider(aciMocks, NewMockConfigMapLister(mockCtrl),
+				NewMockSecretLister(mockCtrl), podLister, nil)
+			if err != nil {
+				t.Fatal("failed to create the test provider", err)
+			}
+
+			out := &nopCloserBuffer{}
+			attachIO := NewMockAttachIO(mockCtrl)
+			attachIO.EXPECT().Stdout().Return(out)
+			attachIO.EXPECT().Stdin().Return(strings.NewReader("hello"))
+
+			err = provider.AttachToContainer(context.Background(), podNamespace, podName, pod.Spec.Containers[0].Name, attachIO)
+			assert.NilError(t, err)
+			assert.Check(t, is.Equal(out.String(), "container output"))
+			if tc.stdinEnabled {
+				assert.Check(t, is.Equal(<-received, tc.expectedInput))
+			}
+		})
+	}
+}
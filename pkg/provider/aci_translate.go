@@ -0,0 +1,248 @@
+/*
+Copyright (c) Microsoft Corporation.
+Licensed under the Apache 2.0 license.
+*/
+package provider
+
+import (
+	"context"
+	"fmt"
+
+	azaciv2 "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerinstance/armcontainerinstance/v2"
+	"github.com/virtual-kubelet/azure-aci/pkg/featureflag"
+	"github.com/virtual-kubelet/azure-aci/pkg/network"
+	"github.com/virtual-kubelet/azure-aci/pkg/util"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	// redactedValue replaces the secret values of the translated container groups.
+	redactedValue = "REDACTED"
+
+	containerGroupTemplateSchema     = "https://schema.management.azure.com/schemas/2019-04-01/deploymentTemplate.json#"
+	containerGroupResourceType       = "Microsoft.ContainerInstance/containerGroups"
+	containerGroupResourceAPIVersion = "2022-10-01-preview"
+)
+
+// TranslateOptions configures the offline translation of a pod to a container group.
+type TranslateOptions struct {
+	Region          string
+	OperatingSystem string
+	NodeName        string
+	ClusterDomain   string
+	// ClusterID is the identity of the cluster the container group is tagged with, the tag is
+	// omitted when it is empty.
+	ClusterID string
+	// Network is the virtual network the container group is deployed to, the container group gets
+	// a public IP when its subnet is not set.
+	Network network.ProviderNetwork
+	// Secrets and ConfigMaps are the objects the pod references, they are read instead of the
+	// ones of the cluster.
+	Secrets    []*v1.Secret
+	ConfigMaps []*v1.ConfigMap
+}
+
+// ARMTemplate is an ARM deployment template of a container group.
+type ARMTemplate struct {
+	Schema         string                `json:"$schema"`
+	ContentVersion string                `json:"contentVersion"`
+	Resources      []ARMTemplateResource `json:"resources"`
+}
+
+// ARMTemplateResource is a resource of an ARM deployment template.
+type ARMTemplateResource struct {
+	Type       string                                      `json:"type"`
+	APIVersion string                                      `json:"apiVersion"`
+	Name       string                                      `json:"name"`
+	Location   *string                                     `json:"location,omitempty"`
+	Tags       map[string]*string                          `json:"tags,omitempty"`
+	Zones      []*string                                   `json:"zones,omitempty"`
+	Identity   *azaciv2.ContainerGroupIdentity             `json:"identity,omitempty"`
+	Properties *azaciv2.ContainerGroupPropertiesProperties `json:"properties"`
+}
+
+// TranslatePod converts the pod to the container group CreatePod deploys, without calling Azure
+// nor the API server. The secret values of the container group are redacted, and the conversion
+// errors are returned as an aggregate of all of them.
+func TranslatePod(ctx context.Context, pod *v1.Pod, opts TranslateOptions) (*azaciv2.ContainerGroup, error) {
+	pod = withDefaultNamespace(pod).(*v1.Pod)
+	if pod.Spec.NodeName == "" {
+		pod.Spec.NodeName = opts.NodeName
+	}
+	// the manifests are not defaulted by the API server
+	if pod.Spec.RestartPolicy == "" {
+		pod.Spec.RestartPolicy = v1.RestartPolicyAlways
+	}
+	if pod.Spec.DNSPolicy == "" {
+		pod.Spec.DNSPolicy = v1.DNSClusterFirst
+	}
+
+	p, err := newTranslateProvider(ctx, opts, pod.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	cg, err := p.getContainerGroup(ctx, pod)
+	if err != nil {
+		return nil, err
+	}
+	name := util.ContainerGroupName(pod.Namespace, pod.Name)
+	cg.Name = &name
+
+	redactContainerGroup(cg)
+	return cg, nil
+}
+
+// NewContainerGroupTemplate returns an ARM template deploying the container group.
+func NewContainerGroupTemplate(cg *azaciv2.ContainerGroup) *ARMTemplate {
+	resource := ARMTemplateResource{
+		Type:       containerGroupResourceType,
+		APIVersion: containerGroupResourceAPIVersion,
+		Location:   cg.Location,
+		Tags:       cg.Tags,
+		Zones:      cg.Zones,
+		Identity:   cg.Identity,
+		Properties: cg.Properties,
+	}
+	if cg.Name != nil {
+		resource.Name = *cg.Name
+	}
+
+	return &ARMTemplate{
+		Schema:         containerGroupTemplateSchema,
+		ContentVersion: "1.0.0.0",
+		Resources:      []ARMTemplateResource{resource},
+	}
+}
+
+// newTranslateProvider returns a provider reading the secrets and config maps of the options. The
+// service account tokens it requests, and the cluster CA bundle of the namespace when its config
+// map is not given, are placeholders.
+func newTranslateProvider(ctx context.Context, opts TranslateOptions, namespace string) (*ACIProvider, error) {
+	if opts.Region == "" {
+		return nil, fmt.Errorf("region can not be empty")
+	}
+	if !isValidACIRegion(opts.Region) {
+		return nil, fmt.Errorf("region %s is invalid", opts.Region)
+	}
+
+	indexers := cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}
+	secrets := cache.NewIndexer(cache.MetaNamespaceKeyFunc, indexers)
+	for _, secret := range opts.Secrets {
+		secret = withDefaultNamespace(secret).(*v1.Secret)
+		// the API server merges the string data of the manifests into the data
+		for key, value := range secret.StringData {
+			if secret.Data == nil {
+				secret.Data = make(map[string][]byte)
+			}
+			secret.Data[key] = []byte(value)
+		}
+		if err := secrets.Add(secret); err != nil {
+			return nil, err
+		}
+	}
+	configMaps := cache.NewIndexer(cache.MetaNamespaceKeyFunc, indexers)
+	rootCA := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: serviceAccountRootCAConfigMap, Namespace: namespace},
+		Data:       map[string]string{serviceAccountRootCAKey: redactedValue},
+	}
+	for _, configMap := range append([]*v1.ConfigMap{rootCA}, opts.ConfigMaps...) {
+		// the config maps given replace the placeholder
+		if err := configMaps.Update(withDefaultNamespace(configMap).(*v1.ConfigMap)); err != nil {
+			return nil, err
+		}
+	}
+
+	p := &ACIProvider{
+		secretL:         corev1listers.NewSecretLister(secrets),
+		configL:         corev1listers.NewConfigMapLister(configMaps),
+		enabledFeatures: featureflag.InitFeatureFlag(ctx),
+		providerNetwork: opts.Network,
+		eventRecorder:   &record.FakeRecorder{},
+		tokenSource:     redactedServiceAccountTokenSource{},
+		region:          opts.Region,
+		nodeName:        opts.NodeName,
+		clusterID:       opts.ClusterID,
+		operatingSystem: opts.OperatingSystem,
+		clusterDomain:   opts.ClusterDomain,
+		// The capabilities of the region are not known offline, the GPU SKU of the pod is trusted.
+		gpuSKUs: azaciv2.PossibleGpuSKUValues(),
+	}
+	return p, nil
+}
+
+// redactedServiceAccountTokenSource issues placeholder tokens, without calling the API server.
+type redactedServiceAccountTokenSource struct{}
+
+func (redactedServiceAccountTokenSource) CreateToken(_ context.Context, _, _ string, _ *authenticationv1.TokenRequest) (*authenticationv1.TokenRequest, error) {
+	return &authenticationv1.TokenRequest{
+		Status: authenticationv1.TokenRequestStatus{Token: redactedValue},
+	}, nil
+}
+
+func withDefaultNamespace(obj runtime.Object) runtime.Object {
+	obj = obj.DeepCopyObject()
+	if accessor, err := meta.Accessor(obj); err == nil && accessor.GetNamespace() == "" {
+		accessor.SetNamespace(metav1.NamespaceDefault)
+	}
+	return obj
+}
+
+// redactContainerGroup replaces the secret values of the container group by redactedValue.
+func redactContainerGroup(cg *azaciv2.ContainerGroup) {
+	if cg.Properties == nil {
+		return
+	}
+	redacted := func() *string {
+		v := redactedValue
+		return &v
+	}
+
+	for _, container := range cg.Properties.Containers {
+		if container.Properties != nil {
+			redactEnvironmentVariables(container.Properties.EnvironmentVariables, redacted)
+		}
+	}
+	for _, container := range cg.Properties.InitContainers {
+		if container.Properties != nil {
+			redactEnvironmentVariables(container.Properties.EnvironmentVariables, redacted)
+		}
+	}
+	for _, credential := range cg.Properties.ImageRegistryCredentials {
+		if credential.Password != nil {
+			credential.Password = redacted()
+		}
+	}
+	for _, volume := range cg.Properties.Volumes {
+		for key := range volume.Secret {
+			volume.Secret[key] = redacted()
+		}
+		if volume.AzureFile != nil && volume.AzureFile.StorageAccountKey != nil {
+			volume.AzureFile.StorageAccountKey = redacted()
+		}
+	}
+	if cg.Properties.Diagnostics != nil && cg.Properties.Diagnostics.LogAnalytics != nil &&
+		cg.Properties.Diagnostics.LogAnalytics.WorkspaceKey != nil {
+		cg.Properties.Diagnostics.LogAnalytics.WorkspaceKey = redacted()
+	}
+	for _, extension := range cg.Properties.Extensions {
+		if extension.Properties != nil && extension.Properties.ProtectedSettings != nil {
+			extension.Properties.ProtectedSettings = redactedValue
+		}
+	}
+}
+
+func redactEnvironmentVariables(envs []*azaciv2.EnvironmentVariable, redacted func() *string) {
+	for _, env := range envs {
+		if env.SecureValue != nil {
+			env.SecureValue = redacted()
+		}
+	}
+}
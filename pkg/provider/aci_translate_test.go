@@ -0,0 +1,124 @@
+/*
+Copyright (c) Microsoft Corporation.
+Licensed under the Apache 2.0 license.
+*/
+package provider
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/virtual-kubelet/azure-aci/pkg/util"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/utils/ptr"
+)
+
+func newTranslatePod() *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "web"},
+		Spec: v1.PodSpec{
+			ImagePullSecrets: []v1.LocalObjectReference{{Name: "registry"}},
+			Containers: []v1.Container{{
+				Name:  "web",
+				Image: "myregistry.azurecr.io/web",
+				Ports: []v1.ContainerPort{{ContainerPort: 80}},
+				Env: []v1.EnvVar{
+					{Name: "PASSWORD", ValueFrom: &v1.EnvVarSource{SecretKeyRef: &v1.SecretKeySelector{
+						LocalObjectReference: v1.LocalObjectReference{Name: "creds"}, Key: "password"}}},
+					{Name: "MODE", ValueFrom: &v1.EnvVarSource{ConfigMapKeyRef: &v1.ConfigMapKeySelector{
+						LocalObjectReference: v1.LocalObjectReference{Name: "settings"}, Key: "mode"}}},
+				},
+				VolumeMounts: []v1.VolumeMount{{Name: "creds", MountPath: "/creds"}},
+			}},
+			Volumes: []v1.Volume{{
+				Name:         "creds",
+				VolumeSource: v1.VolumeSource{Secret: &v1.SecretVolumeSource{SecretName: "creds", Optional: ptr.To(false)}},
+			}},
+		},
+	}
+}
+
+func TestTranslatePod(t *testing.T) {
+	opts := TranslateOptions{
+		Region:          "westus2",
+		OperatingSystem: "Linux",
+		NodeName:        "virtual-kubelet",
+		ClusterDomain:   "cluster.local",
+		Secrets: []*v1.Secret{
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "creds"},
+				StringData: map[string]string{"password": "hunter2"},
+			},
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "registry"},
+				Type:       v1.SecretTypeDockerConfigJson,
+				Data: map[string][]byte{v1.DockerConfigJsonKey: []byte(
+					`{"auths":{"myregistry.azurecr.io":{"username":"user","password":"hunter2"}}}`)},
+			},
+		},
+		ConfigMaps: []*v1.ConfigMap{{
+			ObjectMeta: metav1.ObjectMeta{Name: "settings"},
+			Data:       map[string]string{"mode": "prod"},
+		}},
+	}
+
+	cg, err := TranslatePod(context.Background(), newTranslatePod(), opts)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(*cg.Name, util.ContainerGroupName("default", "web")))
+	assert.Check(t, is.Equal(*cg.Location, "westus2"))
+	assert.Check(t, is.Equal(*cg.Tags["NodeName"], "virtual-kubelet"))
+	assert.Check(t, is.Equal(string(*cg.Properties.RestartPolicy), string(v1.RestartPolicyAlways)))
+	assert.Check(t, cg.Properties.IPAddress != nil, "the container group should get a public IP without subnet")
+
+	envs := cg.Properties.Containers[0].Properties.EnvironmentVariables
+	assert.Assert(t, is.Len(envs, 2))
+	assert.Check(t, is.Equal(*envs[0].SecureValue, redactedValue))
+	assert.Check(t, is.Equal(*envs[1].Value, "prod"), "the config map values should not be redacted")
+	assert.Assert(t, is.Len(cg.Properties.ImageRegistryCredentials, 1))
+	assert.Check(t, is.Equal(*cg.Properties.ImageRegistryCredentials[0].Username, "user"))
+	assert.Check(t, is.Equal(*cg.Properties.ImageRegistryCredentials[0].Password, redactedValue))
+	assert.Assert(t, is.Len(cg.Properties.Volumes, 1))
+	assert.Check(t, is.Equal(*cg.Properties.Volumes[0].Secret["password"], redactedValue))
+
+	template := NewContainerGroupTemplate(cg)
+	assert.Assert(t, is.Len(template.Resources, 1))
+	assert.Check(t, is.Equal(template.Resources[0].Type, containerGroupResourceType))
+	assert.Check(t, is.Equal(template.Resources[0].Name, util.ContainerGroupName("default", "web")))
+	assert.Check(t, template.Resources[0].Properties == cg.Properties)
+
+	opts.Network.VnetSubscriptionID = "subscription"
+	opts.Network.VnetResourceGroup = "vnet-rg"
+	opts.Network.VnetName = "vnet"
+	opts.Network.SubnetName = "aci"
+	opts.Network.KubeDNSIP = "10.0.0.10"
+	cg, err = TranslatePod(context.Background(), newTranslatePod(), opts)
+	assert.NilError(t, err)
+	assert.Check(t, cg.Properties.IPAddress == nil, "the container group should not get a public IP in a subnet")
+	assert.Assert(t, is.Len(cg.Properties.SubnetIDs, 1))
+	assert.Check(t, is.Equal(*cg.Properties.SubnetIDs[0].ID,
+		"/subscriptions/subscription/resourceGroups/vnet-rg/providers/Microsoft.Network/virtualNetworks/vnet/subnets/aci"))
+	assert.Assert(t, cg.Properties.DNSConfig != nil)
+	assert.Check(t, is.DeepEqual(cg.Properties.DNSConfig.NameServers, []*string{ptr.To("10.0.0.10")}))
+}
+
+func TestTranslatePodReportsAllErrors(t *testing.T) {
+	opts := TranslateOptions{
+		Region:          "westus2",
+		OperatingSystem: "Linux",
+	}
+
+	_, err := TranslatePod(context.Background(), newTranslatePod(), opts)
+	assert.Assert(t, err != nil)
+	var agg utilerrors.Aggregate
+	assert.Assert(t, errors.As(err, &agg), "the errors of every part of the pod should be reported: %v", err)
+	assert.Check(t, is.Len(agg.Errors(), 3), "containers, image pull secrets and volumes should all fail: %v", err)
+
+	opts.Region = "mars"
+	_, err = TranslatePod(context.Background(), newTranslatePod(), opts)
+	assert.Check(t, is.ErrorContains(err, "region mars is invalid"))
+}
@@ -0,0 +1,390 @@
+/*
+Copyright (c) Microsoft Corporation.
+Licensed under the Apache 2.0 license.
+*/
+package provider
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	azaciv2 "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerinstance/armcontainerinstance/v2"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	"github.com/virtual-kubelet/virtual-kubelet/trace"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+)
+
+// PodUpdatePolicy defines what the provider does when a running pod is updated. ACI cannot change
+// a container group in place, the updates only reach the containers when the container group is
+// deployed again or restarted.
+type PodUpdatePolicy string
+
+const (
+	// PodUpdatePolicyNone ignores the updates of the pods, it is the default.
+	PodUpdatePolicyNone PodUpdatePolicy = "None"
+	// PodUpdatePolicyRecreate redeploys the container group when the image of a container, or a
+	// secret or config map referenced by the pod, changes, and restarts its containers in place
+	// when only the kubectl.kubernetes.io/restartedAt annotation changes.
+	PodUpdatePolicyRecreate PodUpdatePolicy = "Recreate"
+)
+
+const (
+	podUpdatePolicyEnv = "ACI_POD_UPDATE_POLICY"
+	// podUpdatePolicyAnnotation is the pod annotation overriding the PodUpdatePolicy of the node.
+	podUpdatePolicyAnnotation = "virtual-kubelet.io/update-policy"
+	// restartedAtAnnotation is set by `kubectl rollout restart`, the pods of a bare pod can be
+	// restarted by setting it too.
+	restartedAtAnnotation = "kubectl.kubernetes.io/restartedAt"
+
+	// restartedAtTag is the tag of the container groups with the restartedAt annotation of the pod
+	// they were last deployed or restarted for.
+	restartedAtTag = "RestartedAt"
+	// configHashTag is the tag of the container groups with the hash of the versions of the secrets
+	// and config maps of the pod they were deployed with.
+	configHashTag = "ConfigHash"
+
+	reasonContainerGroupRecreating = "ContainerGroupRecreating"
+	reasonContainerGroupRestarting = "ContainerGroupRestarting"
+	reasonContainerGroupRestarted  = "ContainerGroupRestarted"
+	reasonPodUpdateFailed          = "PodUpdateFailed"
+)
+
+var validPodUpdatePolicies = map[PodUpdatePolicy]bool{
+	PodUpdatePolicyNone:     true,
+	PodUpdatePolicyRecreate: true,
+}
+
+func getPodUpdatePolicy() (PodUpdatePolicy, error) {
+	policy := PodUpdatePolicyNone
+	if v := os.Getenv(podUpdatePolicyEnv); v != "" {
+		policy = PodUpdatePolicy(v)
+	}
+	if !validPodUpdatePolicies[policy] {
+		return "", fmt.Errorf("%s %q is invalid, supported values are %s and %s", podUpdatePolicyEnv, policy,
+			PodUpdatePolicyNone, PodUpdatePolicyRecreate)
+	}
+	return policy, nil
+}
+
+// getPodUpdatePolicyOfPod returns the PodUpdatePolicy of the pod, the one of the node unless the
+// pod annotation overrides it. An invalid annotation is ignored.
+func (p *ACIProvider) getPodUpdatePolicyOfPod(ctx context.Context, pod *v1.Pod) PodUpdatePolicy {
+	v, ok := pod.Annotations[podUpdatePolicyAnnotation]
+	if !ok {
+		return p.podUpdatePolicy
+	}
+	if policy := PodUpdatePolicy(v); validPodUpdatePolicies[policy] {
+		return policy
+	}
+	log.G(ctx).Warnf("%s %q of pod %s is invalid, supported values are %s and %s", podUpdatePolicyAnnotation, v,
+		pod.Name, PodUpdatePolicyNone, PodUpdatePolicyRecreate)
+	return p.podUpdatePolicy
+}
+
+// setPodUpdateTags tags the container group with the state of the pod the updates are compared
+// to, only for the pods whose updates are applied.
+func (p *ACIProvider) setPodUpdateTags(ctx context.Context, pod *v1.Pod, cg *azaciv2.ContainerGroup) {
+	if p.getPodUpdatePolicyOfPod(ctx, pod) != PodUpdatePolicyRecreate {
+		return
+	}
+	if restartedAt := pod.Annotations[restartedAtAnnotation]; restartedAt != "" {
+		cg.Tags[restartedAtTag] = &restartedAt
+	}
+	configHash := p.getPodConfigHash(pod)
+	cg.Tags[configHashTag] = &configHash
+}
+
+// getPodConfigHash returns the hash of the resource versions of the secrets and config maps the
+// pod references. The content of the secrets is not hashed, a missing object has no version.
+func (p *ACIProvider) getPodConfigHash(pod *v1.Pod) string {
+	secrets, configMaps := getPodConfigReferences(pod)
+
+	versions := make([]string, 0, len(secrets)+len(configMaps))
+	for name := range secrets {
+		var version string
+		if secret, err := p.secretL.Secrets(pod.Namespace).Get(name); err == nil && secret != nil {
+			version = secret.ResourceVersion
+		}
+		versions = append(versions, "secret/"+name+"="+version)
+	}
+	for name := range configMaps {
+		var version string
+		if configMap, err := p.configL.ConfigMaps(pod.Namespace).Get(name); err == nil && configMap != nil {
+			version = configMap.ResourceVersion
+		}
+		versions = append(versions, "configmap/"+name+"="+version)
+	}
+	sort.Strings(versions)
+
+	sum := sha256.Sum256([]byte(strings.Join(versions, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// getPodConfigReferences returns the names of the secrets and config maps referenced by the
+// volumes, the image pull secrets and the environment of the containers of the pod.
+func getPodConfigReferences(pod *v1.Pod) (map[string]struct{}, map[string]struct{}) {
+	secrets := make(map[string]struct{})
+	configMaps := make(map[string]struct{})
+
+	for _, ref := range pod.Spec.ImagePullSecrets {
+		secrets[ref.Name] = struct{}{}
+	}
+	for _, volume := range pod.Spec.Volumes {
+		switch {
+		case volume.Secret != nil:
+			secrets[volume.Secret.SecretName] = struct{}{}
+		case volume.ConfigMap != nil:
+			configMaps[volume.ConfigMap.Name] = struct{}{}
+		case volume.AzureFile != nil:
+			secrets[volume.AzureFile.SecretName] = struct{}{}
+		case volume.Projected != nil:
+			for _, source := range volume.Projected.Sources {
+				if source.Secret != nil {
+					secrets[source.Secret.Name] = struct{}{}
+				}
+				if source.ConfigMap != nil {
+					configMaps[source.ConfigMap.Name] = struct{}{}
+				}
+			}
+		}
+	}
+
+	containers := append(append([]v1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...)
+	for _, container := range containers {
+		for _, envFrom := range container.EnvFrom {
+			if envFrom.SecretRef != nil {
+				secrets[envFrom.SecretRef.Name] = struct{}{}
+			}
+			if envFrom.ConfigMapRef != nil {
+				configMaps[envFrom.ConfigMapRef.Name] = struct{}{}
+			}
+		}
+		for _, env := range container.Env {
+			if env.ValueFrom == nil {
+				continue
+			}
+			if env.ValueFrom.SecretKeyRef != nil {
+				secrets[env.ValueFrom.SecretKeyRef.Name] = struct{}{}
+			}
+			if env.ValueFrom.ConfigMapKeyRef != nil {
+				configMaps[env.ValueFrom.ConfigMapKeyRef.Name] = struct{}{}
+			}
+		}
+	}
+	return secrets, configMaps
+}
+
+// podUpdate is the update of a pod its container group doesn't have yet.
+type podUpdate struct {
+	changes []string
+	// recreate is true when the container group must be redeployed, otherwise the containers are
+	// only restarted.
+	recreate bool
+}
+
+// getPodUpdate compares the pod with the container group deployed for it, it is nil when they
+// match. The container groups deployed before the update policy of the pod was set are only
+// compared on their images. The changes of the secrets and config maps are compared by
+// getConfigUpdate.
+func (p *ACIProvider) getPodUpdate(pod *v1.Pod, cg *azaciv2.ContainerGroup) *podUpdate {
+	update := &podUpdate{}
+	if cg.Properties != nil {
+		images := make(map[string]string)
+		for _, container := range cg.Properties.InitContainers {
+			if container != nil && container.Name != nil && container.Properties != nil {
+				images[*container.Name] = ptr.Deref(container.Properties.Image, "")
+			}
+		}
+		for _, container := range cg.Properties.Containers {
+			if container != nil && container.Name != nil && container.Properties != nil {
+				images[*container.Name] = ptr.Deref(container.Properties.Image, "")
+			}
+		}
+		containers := append(append([]v1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...)
+		for _, container := range containers {
+			if image, ok := images[container.Name]; ok && image != container.Image {
+				update.changes = append(update.changes, fmt.Sprintf("image of container %s changed to %s", container.Name, container.Image))
+				update.recreate = true
+			}
+		}
+	}
+
+	// The pods of a workload restarted with kubectl have the restartedAt annotation from their
+	// creation, it is only compared for the container groups deployed with the update tags.
+	if cg.Tags[configHashTag] != nil {
+		if restartedAt := pod.Annotations[restartedAtAnnotation]; restartedAt != "" &&
+			restartedAt != ptr.Deref(cg.Tags[restartedAtTag], "") {
+			update.changes = append(update.changes, "restart requested at "+restartedAt)
+		}
+	}
+
+	if len(update.changes) == 0 {
+		return nil
+	}
+	return update
+}
+
+// getConfigUpdate compares the secrets and config maps referenced by the pod with the versions
+// the container group was deployed with, it is nil when they match.
+func (p *ACIProvider) getConfigUpdate(pod *v1.Pod, cg *azaciv2.ContainerGroup) *podUpdate {
+	configHash := cg.Tags[configHashTag]
+	if configHash == nil || *configHash == p.getPodConfigHash(pod) {
+		return nil
+	}
+	return &podUpdate{changes: []string{"secrets or config maps changed"}, recreate: true}
+}
+
+// UpdatePod applies the updates of the pod to its container group, according to the
+// PodUpdatePolicy of the pod. The container groups not created yet are deployed with the pod as
+// it is when they are.
+func (p *ACIProvider) UpdatePod(ctx context.Context, pod *v1.Pod) error {
+	ctx, span := trace.StartSpan(ctx, "aci.UpdatePod")
+	defer span.End()
+	ctx = addAzureAttributes(ctx, span, p)
+
+	if pod.DeletionTimestamp != nil || p.getPodUpdatePolicyOfPod(ctx, pod) != PodUpdatePolicyRecreate {
+		return nil
+	}
+
+	cg, err := p.getContainerGroupInfo(ctx, pod.Namespace, pod.Name, p.nodeName)
+	if err == nil {
+		err = checkContainerGroupOwner(cg, pod.UID)
+	}
+	if errdefs.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return p.applyPodUpdate(ctx, pod, cg, p.getPodUpdate(pod, cg), &p.podUpdates)
+}
+
+// checkConfigUpdate redeploys the container group of the pod when the secrets or config maps it
+// references changed. Their changes don't update the pod, the tracker checks them periodically.
+func (p *ACIProvider) checkConfigUpdate(ctx context.Context, pod *v1.Pod, cg *azaciv2.ContainerGroup) {
+	if p.getPodUpdatePolicyOfPod(ctx, pod) != PodUpdatePolicyRecreate {
+		return
+	}
+	if err := p.applyPodUpdate(ctx, pod, cg, p.getConfigUpdate(pod, cg), &p.configUpdates); err != nil {
+		log.G(ctx).WithError(err).Warnf("failed to apply the secrets and config maps changes of pod %s", pod.Name)
+	}
+}
+
+// applyPodUpdate redeploys or restarts the container group of the pod to apply the update. An
+// update is only applied once, until it changes again, the updates applied are recorded in
+// applied by pod UID.
+func (p *ACIProvider) applyPodUpdate(ctx context.Context, pod *v1.Pod, cg *azaciv2.ContainerGroup, update *podUpdate, applied *sync.Map) error {
+	if update == nil {
+		applied.Delete(pod.UID)
+		return nil
+	}
+	key := strings.Join(update.changes, ", ")
+	if handled, ok := applied.Load(pod.UID); ok && handled == key {
+		return nil
+	}
+	applied.Store(pod.UID, key)
+
+	if update.recreate {
+		log.G(ctx).Infof("redeploying container group %s of pod %s: %s", *cg.Name, pod.Name, key)
+		p.recordPodEvent(pod, v1.EventTypeNormal, reasonContainerGroupRecreating,
+			"Redeploying the container group to apply the pod update: %s", key)
+		p.updatePodStatusWithUpdate(ctx, pod, reasonContainerGroupRecreating, key)
+		cgName := *cg.Name
+		err := p.redeployContainerGroup(ctx, pod, func(ctx context.Context, pod *v1.Pod, err error) {
+			if err != nil {
+				log.G(ctx).WithError(err).Errorf("failed to redeploy container group %s of pod %s", cgName, pod.Name)
+				applied.Delete(pod.UID)
+				p.recordPodEvent(pod, v1.EventTypeWarning, reasonPodUpdateFailed,
+					"Failed to redeploy the container group to apply the pod update: %v", err)
+			}
+		})
+		if err != nil {
+			applied.Delete(pod.UID)
+			return err
+		}
+		return nil
+	}
+
+	log.G(ctx).Infof("restarting container group %s of pod %s: %s", *cg.Name, pod.Name, key)
+	poller, err := p.azClientsAPIs.RestartContainerGroup(ctx, p.resourceGroup, *cg.Name)
+	if err != nil {
+		applied.Delete(pod.UID)
+		p.recordPodEvent(pod, v1.EventTypeWarning, reasonPodUpdateFailed,
+			"Failed to restart the container group to apply the pod update: %v", err)
+		return err
+	}
+	p.recordPodEvent(pod, v1.EventTypeNormal, reasonContainerGroupRestarting,
+		"Restarting the containers to apply the pod update: %s", key)
+	p.updatePodStatusWithUpdate(ctx, pod, reasonContainerGroupRestarting, key)
+
+	podCopy := pod.DeepCopy()
+	cgName := *cg.Name
+	tags := make(map[string]*string, len(cg.Tags)+1)
+	for k, v := range cg.Tags {
+		tags[k] = v
+	}
+	restartedAt := pod.Annotations[restartedAtAnnotation]
+	tags[restartedAtTag] = &restartedAt
+	err = p.backgroundOperations.trySubmit(ctx, func(ctx context.Context) {
+		if _, err := poller.PollUntilDone(ctx); err != nil {
+			log.G(ctx).WithError(err).Errorf("failed to restart container group %s of pod %s", cgName, podCopy.Name)
+			applied.Delete(podCopy.UID)
+			p.recordPodEvent(podCopy, v1.EventTypeWarning, reasonPodUpdateFailed,
+				"Failed to restart the container group to apply the pod update: %v", err)
+			return
+		}
+		p.recordPodEvent(podCopy, v1.EventTypeNormal, reasonContainerGroupRestarted,
+			"Containers restarted to apply the pod update")
+		// The tag records the restart, so the containers aren't restarted again for it.
+		if err := p.azClientsAPIs.UpdateContainerGroupTags(ctx, p.resourceGroup, cgName, tags); err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to tag container group %s with its restart", cgName)
+		}
+	})
+	if err != nil {
+		// The restart is not tracked, it is recorded right away so it isn't requested again.
+		log.G(ctx).WithError(err).Warnf("not waiting for the restart of container group %s of pod %s", cgName, pod.Name)
+		if err := p.azClientsAPIs.UpdateContainerGroupTags(ctx, p.resourceGroup, cgName, tags); err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to tag container group %s with its restart", cgName)
+		}
+	}
+	return nil
+}
+
+// updatePodStatusWithUpdate reports on the pod status that its containers are not ready while
+// the update is applied, the tracker reports their new state once it is.
+func (p *ACIProvider) updatePodStatusWithUpdate(ctx context.Context, pod *v1.Pod, reason, message string) {
+	if p.tracker == nil {
+		return
+	}
+
+	err := p.tracker.UpdatePodStatus(ctx, pod.Namespace, pod.Name, func(status *v1.PodStatus) {
+		now := metav1.Now()
+		for i := range status.Conditions {
+			if status.Conditions[i].Type == v1.PodReady || status.Conditions[i].Type == v1.ContainersReady {
+				status.Conditions[i].Status = v1.ConditionFalse
+				status.Conditions[i].Reason = reason
+				status.Conditions[i].Message = message
+				status.Conditions[i].LastTransitionTime = now
+			}
+		}
+		for i := range status.ContainerStatuses {
+			status.ContainerStatuses[i].Ready = false
+			status.ContainerStatuses[i].State = v1.ContainerState{
+				Waiting: &v1.ContainerStateWaiting{Reason: reason, Message: message},
+			}
+		}
+	}, false)
+	if err != nil {
+		log.G(ctx).WithError(err).Warnf("failed to update status of pod %s with its update", pod.Name)
+	}
+}
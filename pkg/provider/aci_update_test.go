@@ -0,0 +1,273 @@
+/*
+Copyright (c) Microsoft Corporation.
+Licensed under the Apache 2.0 license.
+*/
+package provider
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	azaciv2 "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerinstance/armcontainerinstance/v2"
+	"github.com/golang/mock/gomock"
+	testsutil "github.com/virtual-kubelet/azure-aci/pkg/tests"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestUpdatePod(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	const secretName = "db"
+
+	cases := []struct {
+		description       string
+		policy            PodUpdatePolicy
+		update            func(pod *v1.Pod, secret *v1.Secret)
+		periodicCheck     bool
+		expectedEvents    []string
+		expectedRecreates int
+		expectedRestarts  int
+	}{
+		{
+			description: "updates are ignored by default",
+			update: func(pod *v1.Pod, secret *v1.Secret) {
+				pod.Spec.Containers[0].Image = "nginx:updated"
+			},
+		},
+		{
+			description: "unchanged pod is not redeployed",
+			policy:      PodUpdatePolicyRecreate,
+			update:      func(pod *v1.Pod, secret *v1.Secret) {},
+		},
+		{
+			description: "image update redeploys the container group",
+			policy:      PodUpdatePolicyRecreate,
+			update: func(pod *v1.Pod, secret *v1.Secret) {
+				pod.Spec.Containers[0].Image = "nginx:updated"
+			},
+			expectedEvents:    []string{reasonContainerGroupRecreating},
+			expectedRecreates: 1,
+		},
+		{
+			description: "secret update is not applied by pod updates",
+			policy:      PodUpdatePolicyRecreate,
+			update: func(pod *v1.Pod, secret *v1.Secret) {
+				secret.ResourceVersion = "2"
+			},
+		},
+		{
+			description: "secret update redeploys the container group on the periodic check",
+			policy:      PodUpdatePolicyRecreate,
+			update: func(pod *v1.Pod, secret *v1.Secret) {
+				secret.ResourceVersion = "2"
+			},
+			periodicCheck:     true,
+			expectedEvents:    []string{reasonContainerGroupRecreating},
+			expectedRecreates: 1,
+		},
+		{
+			description: "image update is not applied by the periodic check",
+			policy:      PodUpdatePolicyRecreate,
+			update: func(pod *v1.Pod, secret *v1.Secret) {
+				pod.Spec.Containers[0].Image = "nginx:updated"
+			},
+			periodicCheck: true,
+		},
+		{
+			description: "restartedAt annotation restarts the containers",
+			policy:      PodUpdatePolicyRecreate,
+			update: func(pod *v1.Pod, secret *v1.Secret) {
+				pod.Annotations[restartedAtAnnotation] = "2024-01-02T00:00:00Z"
+			},
+			expectedEvents:   []string{reasonContainerGroupRestarting, reasonContainerGroupRestarted},
+			expectedRestarts: 1,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.description, func(t *testing.T) {
+			secret := &v1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: secretName, Namespace: podNamespace, ResourceVersion: "1"},
+				Data:       map[string][]byte{"password": []byte("s3cr3t")},
+			}
+			secretLister := NewMockSecretLister(mockCtrl)
+			secretNamespaceLister := NewMockSecretNamespaceLister(mockCtrl)
+			secretLister.EXPECT().Secrets(podNamespace).Return(secretNamespaceLister).AnyTimes()
+			secretNamespaceLister.EXPECT().Get(secretName).DoAndReturn(func(string) (*v1.Secret, error) {
+				return secret.DeepCopy(), nil
+			}).AnyTimes()
+
+			pod := testsutil.CreatePodObj(podName, podNamespace)
+			pod.Spec.NodeName = fakeNodeName
+			pod.Annotations = map[string]string{restartedAtAnnotation: "2024-01-01T00:00:00Z"}
+			if tc.policy != "" {
+				pod.Annotations[podUpdatePolicyAnnotation] = string(tc.policy)
+			}
+			pod.Spec.Containers[0].Env = []v1.EnvVar{{
+				Name: "PASSWORD",
+				ValueFrom: &v1.EnvVarSource{SecretKeyRef: &v1.SecretKeySelector{
+					LocalObjectReference: v1.LocalObjectReference{Name: secretName},
+					Key:                  "password",
+				}},
+			}}
+
+			var deployed *azaciv2.ContainerGroup
+			restarts := 0
+			recreated := make(chan struct{}, 2)
+			restarted := make(chan map[string]*string, 1)
+			aciMocks := createNewACIMock()
+			aciMocks.MockGetContainerGroupInfo = func(ctx context.Context, resourceGroup, namespace, name, nodeName string) (*azaciv2.ContainerGroup, error) {
+				return deployed, nil
+			}
+			aciMocks.MockGetContainerGroupList = func(ctx context.Context, resourceGroup string) ([]*azaciv2.ContainerGroup, error) {
+				return []*azaciv2.ContainerGroup{deployed}, nil
+			}
+			aciMocks.MockCreateContainerGroup = func(ctx context.Context, resourceGroup, podNS, podName string, cg *azaciv2.ContainerGroup) error {
+				recreated <- struct{}{}
+				return nil
+			}
+			aciMocks.MockRestartContainerGroup = func(ctx context.Context, resourceGroup, cgName string) error {
+				restarts++
+				return nil
+			}
+			aciMocks.MockUpdateContainerGroupTags = func(ctx context.Context, resourceGroup, cgName string, tags map[string]*string) error {
+				restarted <- tags
+				return nil
+			}
+
+			provider, err := createTestProvider(aciMocks, NewMockConfigMapLister(mockCtrl),
+				secretLister, NewMockPodLister(mockCtrl), nil)
+			if err != nil {
+				t.Fatal("Unable to create test provider", err)
+			}
+			recorder := record.NewFakeRecorder(5)
+			provider.eventRecorder = recorder
+
+			cg, err := provider.getContainerGroup(context.Background(), pod)
+			assert.NilError(t, err)
+			deployed = newDeployedContainerGroup(t, cg)
+
+			tc.update(pod, secret)
+			apply := func() {
+				if tc.periodicCheck {
+					provider.CheckPodSpecs(context.Background(), []*v1.Pod{pod})
+					return
+				}
+				assert.NilError(t, provider.UpdatePod(context.Background(), pod))
+			}
+			apply()
+			// The update is applied once.
+			apply()
+
+			if tc.expectedRestarts > 0 {
+				select {
+				case tags := <-restarted:
+					assert.Check(t, is.Equal(*tags[restartedAtTag], pod.Annotations[restartedAtAnnotation]))
+				case <-time.After(10 * time.Second):
+					t.Fatal("container group was not tagged with its restart")
+				}
+			}
+			for i := 0; i < tc.expectedRecreates; i++ {
+				select {
+				case <-recreated:
+				case <-time.After(10 * time.Second):
+					t.Fatal("container group was not redeployed")
+				}
+			}
+			assert.Check(t, is.Len(recreated, 0))
+			assert.Check(t, is.Equal(restarts, tc.expectedRestarts))
+			assert.Assert(t, is.Len(recorder.Events, len(tc.expectedEvents)))
+			for _, reason := range tc.expectedEvents {
+				event := <-recorder.Events
+				assert.Check(t, strings.Contains(event, reason), event)
+			}
+		})
+	}
+}
+
+func TestUpdatePodRedeploymentFailure(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	pod := testsutil.CreatePodObj(podName, podNamespace)
+	pod.Annotations = map[string]string{podUpdatePolicyAnnotation: string(PodUpdatePolicyRecreate)}
+
+	var deployed *azaciv2.ContainerGroup
+	aciMocks := createNewACIMock()
+	aciMocks.MockGetContainerGroupInfo = func(ctx context.Context, resourceGroup, namespace, name, nodeName string) (*azaciv2.ContainerGroup, error) {
+		return deployed, nil
+	}
+	aciMocks.MockCreateContainerGroup = func(ctx context.Context, resourceGroup, podNS, podName string, cg *azaciv2.ContainerGroup) error {
+		return testsutil.NewARMResponseError(http.StatusConflict, `{"error":{"code":"ContainerGroupQuotaReached","message":"container group quota exceeded."}}`)
+	}
+
+	provider, err := createTestProvider(aciMocks, NewMockConfigMapLister(mockCtrl),
+		NewMockSecretLister(mockCtrl), NewMockPodLister(mockCtrl), nil)
+	if err != nil {
+		t.Fatal("Unable to create test provider", err)
+	}
+	recorder := record.NewFakeRecorder(5)
+	provider.eventRecorder = recorder
+
+	cg, err := provider.getContainerGroup(context.Background(), pod)
+	assert.NilError(t, err)
+	deployed = newDeployedContainerGroup(t, cg)
+
+	pod.Spec.Containers[0].Image = "nginx:updated"
+	assert.NilError(t, provider.UpdatePod(context.Background(), pod))
+
+	events := waitForEvents(t, recorder, 2)
+	assert.Check(t, strings.Contains(events[0], reasonContainerGroupRecreating), events[0])
+	assert.Check(t, strings.Contains(events[1], reasonPodUpdateFailed), events[1])
+	// The container group of the running pod is still deployed, the pod is not kept pending.
+	assert.Check(t, !provider.pendingPods.isPending(pod.UID))
+}
+
+func TestGetPodUpdateIgnoresRestartedAtOfUntaggedContainerGroups(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	provider, err := createTestProvider(createNewACIMock(), NewMockConfigMapLister(mockCtrl),
+		NewMockSecretLister(mockCtrl), NewMockPodLister(mockCtrl), nil)
+	if err != nil {
+		t.Fatal("Unable to create test provider", err)
+	}
+
+	pod := testsutil.CreatePodObj(podName, podNamespace)
+	pod.Annotations = map[string]string{restartedAtAnnotation: "2024-01-01T00:00:00Z"}
+	cg, err := provider.getContainerGroup(context.Background(), pod)
+	assert.NilError(t, err)
+	assert.Check(t, is.Nil(cg.Tags[configHashTag]), "the update tags should only be set with the Recreate policy")
+	deployed := newDeployedContainerGroup(t, cg)
+
+	assert.Check(t, is.Nil(provider.getPodUpdate(pod, deployed)))
+	pod.Spec.Containers[0].Image = "nginx:updated"
+	update := provider.getPodUpdate(pod, deployed)
+	assert.Assert(t, update != nil)
+	assert.Check(t, update.recreate)
+	assert.Check(t, is.DeepEqual(update.changes, []string{"image of container nginx changed to nginx:updated"}))
+}
+
+func TestGetPodUpdatePolicy(t *testing.T) {
+	t.Setenv(podUpdatePolicyEnv, "")
+	policy, err := getPodUpdatePolicy()
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(policy, PodUpdatePolicyNone))
+
+	t.Setenv(podUpdatePolicyEnv, string(PodUpdatePolicyRecreate))
+	policy, err = getPodUpdatePolicy()
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(policy, PodUpdatePolicyRecreate))
+
+	t.Setenv(podUpdatePolicyEnv, "Restart")
+	_, err = getPodUpdatePolicy()
+	assert.Check(t, err != nil)
+}
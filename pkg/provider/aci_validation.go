@@ -0,0 +1,117 @@
+/*
+Copyright (c) Microsoft Corporation.
+Licensed under the Apache 2.0 license.
+*/
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	v1 "k8s.io/api/core/v1"
+)
+
+// getContainerProblems returns the features of the container ACI doesn't support.
+func getContainerProblems(container v1.Container) []error {
+	var problems []error
+	if len(container.Command) == 0 && len(container.Args) > 0 {
+		problems = append(problems, errdefs.InvalidInput("ACI does not support providing args without specifying the command. Please supply both command and args to the pod spec."))
+	}
+	if lifecycle := container.Lifecycle; lifecycle != nil {
+		if hasLifecycleHandler(lifecycle.PostStart) {
+			problems = append(problems, errdefs.InvalidInput("ACI does not support postStart lifecycle hooks"))
+		}
+		// The preStop exec and sleep hooks are run by the provider before the container group is
+		// deleted.
+		if preStop := lifecycle.PreStop; preStop != nil && (preStop.HTTPGet != nil || preStop.TCPSocket != nil) {
+			problems = append(problems, errdefs.InvalidInput("ACI only supports exec and sleep preStop lifecycle hooks"))
+		}
+	}
+	if container.StartupProbe != nil {
+		problems = append(problems, errdefs.InvalidInput("ACI does not support startupProbe"))
+	}
+	return problems
+}
+
+// getInitContainerProblems returns the features of the init container ACI doesn't support.
+func getInitContainerProblems(initContainer v1.Container) []error {
+	var problems []error
+	if len(initContainer.Command) == 0 && len(initContainer.Args) > 0 {
+		problems = append(problems, errdefs.InvalidInput("ACI does not support providing args without specifying the command. Please supply both command and args to the pod spec."))
+	}
+	if initContainer.Ports != nil {
+		problems = append(problems, errdefs.InvalidInput("azure container instances initContainers do not support ports"))
+	}
+	if initContainer.Resources.Requests != nil {
+		problems = append(problems, errdefs.InvalidInput("azure container instances initContainers do not support resources requests"))
+	}
+	if initContainer.Resources.Limits != nil {
+		problems = append(problems, errdefs.InvalidInput("azure container instances initContainers do not support resources limits"))
+	}
+	if initContainer.LivenessProbe != nil {
+		problems = append(problems, errdefs.InvalidInput("azure container instances initContainers do not support livenessProbe"))
+	}
+	if initContainer.ReadinessProbe != nil {
+		problems = append(problems, errdefs.InvalidInput("azure container instances initContainers do not support readinessProbe"))
+	}
+	if hasLifecycleHook(initContainer) {
+		problems = append(problems, errdefs.InvalidInput("azure container instances initContainers do not support lifecycle hooks"))
+	}
+	if initContainer.StartupProbe != nil {
+		problems = append(problems, errdefs.InvalidInput("azure container instances initContainers do not support startupProbe"))
+	}
+	return problems
+}
+
+// validatePod returns all the problems preventing ACI from running the pod, as CreatePod would
+// report them one at a time. The secrets and config maps the pod references are not checked, they
+// may be created after the pod.
+func (p *ACIProvider) validatePod(ctx context.Context, pod *v1.Pod) []error {
+	var problems []error
+	addProblems := func(kind, name string, errs ...error) {
+		for _, err := range errs {
+			problems = append(problems, fmt.Errorf("%s %s: %w", kind, name, err))
+		}
+	}
+
+	gpuRequested := false
+	for _, container := range pod.Spec.Containers {
+		addProblems("container", container.Name, getContainerProblems(container)...)
+
+		if gpu, ok := container.Resources.Limits[gpuResourceName]; ok {
+			gpuRequested = true
+			if gpu.Value() == 0 {
+				addProblems("container", container.Name, errors.New("GPU must be a integer number"))
+			}
+		}
+		if container.LivenessProbe != nil {
+			if _, err := getProbe(container.LivenessProbe, container.Ports); err != nil {
+				addProblems("container", container.Name, fmt.Errorf("livenessProbe: %w", err))
+			}
+		}
+		if container.ReadinessProbe != nil {
+			if _, err := getProbe(container.ReadinessProbe, container.Ports); err != nil {
+				addProblems("container", container.Name, fmt.Errorf("readinessProbe: %w", err))
+			}
+		}
+	}
+	if gpuRequested {
+		if _, err := p.getGPUSKU(pod); err != nil {
+			problems = append(problems, err)
+		}
+	}
+
+	for _, initContainer := range pod.Spec.InitContainers {
+		addProblems("init container", initContainer.Name, getInitContainerProblems(initContainer)...)
+	}
+
+	for _, volume := range pod.Spec.Volumes {
+		if _, err := p.getVolumeBuilder(pod, &volume); err != nil {
+			problems = append(problems, err)
+		}
+	}
+
+	return problems
+}
@@ -13,7 +13,6 @@ import (
 	"github.com/virtual-kubelet/virtual-kubelet/log"
 	v1 "k8s.io/api/core/v1"
 	k8serr "k8s.io/apimachinery/pkg/api/errors"
-	"k8s.io/apimachinery/pkg/labels"
 )
 
 func (p *ACIProvider) getAzureFileCSI(volume v1.Volume, namespace string) (*azaciv2.Volume, error) {
@@ -57,232 +56,255 @@ func (p *ACIProvider) getAzureFileCSI(volume v1.Volume, namespace string) (*azac
 		}}, nil
 }
 
+// volumeBuilder returns the ACI volume of a pod volume, a nil volume is left out of the container
+// group.
+type volumeBuilder func(ctx context.Context, pod *v1.Pod, volume *v1.Volume) (*azaciv2.Volume, error)
+
+// getVolumeBuilder returns the builder of the type of the volume, or an error when ACI doesn't
+// support it.
+func (p *ACIProvider) getVolumeBuilder(pod *v1.Pod, volume *v1.Volume) (volumeBuilder, error) {
+	switch {
+	case volume.CSI != nil:
+		// Disk is not supported by ACI
+		if volume.CSI.Driver != AzureFileDriverName {
+			return nil, fmt.Errorf("pod %s requires volume %s which is of an unsupported type %s", pod.Name, volume.Name, volume.CSI.Driver)
+		}
+		return p.getAzureFileCSIVolume, nil
+	case volume.AzureFile != nil:
+		return p.getAzureFileVolume, nil
+	case volume.EmptyDir != nil:
+		return getEmptyDirVolume, nil
+	case volume.GitRepo != nil:
+		return getGitRepoVolume, nil
+	case volume.Secret != nil:
+		return p.getSecretVolume, nil
+	case volume.ConfigMap != nil:
+		return p.getConfigMapVolume, nil
+	case volume.Projected != nil:
+		return p.getProjectedVolume, nil
+	default:
+		return nil, fmt.Errorf("pod %s requires volume %s which is of an unsupported type", pod.Name, volume.Name)
+	}
+}
+
 func (p *ACIProvider) getVolumes(ctx context.Context, pod *v1.Pod) ([]*azaciv2.Volume, error) {
 	volumes := make([]*azaciv2.Volume, 0, len(pod.Spec.Volumes))
 	podVolumes := pod.Spec.Volumes
 	for i := range podVolumes {
-		// Handle the case for Azure File CSI driver
-		if podVolumes[i].CSI != nil {
-			// Check if the CSI driver is file (Disk is not supported by ACI)
-			if podVolumes[i].CSI.Driver == AzureFileDriverName {
-				csiVolume, err := p.getAzureFileCSI(podVolumes[i], pod.Namespace)
-				if err != nil {
-					return nil, err
-				}
-				volumes = append(volumes, csiVolume)
-				continue
-			} else {
-				return nil, fmt.Errorf("pod %s requires volume %s which is of an unsupported type %s", pod.Name, podVolumes[i].Name, podVolumes[i].CSI.Driver)
-			}
+		build, err := p.getVolumeBuilder(pod, &podVolumes[i])
+		if err != nil {
+			return nil, err
 		}
+		volume, err := build(ctx, pod, &podVolumes[i])
+		if err != nil {
+			return nil, err
+		}
+		if volume != nil {
+			volumes = append(volumes, volume)
+		}
+	}
 
-		// Handle the case for the AzureFile volume.
-		if podVolumes[i].AzureFile != nil {
-			secret, err := p.secretL.Secrets(pod.Namespace).Get(podVolumes[i].AzureFile.SecretName)
-			if err != nil {
-				return volumes, err
-			}
+	return volumes, nil
+}
 
-			if secret == nil {
-				return nil, fmt.Errorf("getting secret for AzureFile volume returned an empty secret")
-			}
-			storageAccountNameStr := string(secret.Data[azureFileStorageAccountName])
-			storageAccountKeyStr := string(secret.Data[azureFileStorageAccountKey])
-
-			volumes = append(volumes, &azaciv2.Volume{
-				Name: &podVolumes[i].Name,
-				AzureFile: &azaciv2.AzureFileVolume{
-					ShareName:          &podVolumes[i].AzureFile.ShareName,
-					ReadOnly:           &podVolumes[i].AzureFile.ReadOnly,
-					StorageAccountName: &storageAccountNameStr,
-					StorageAccountKey:  &storageAccountKeyStr,
-				},
-			})
-			continue
-		}
+// Handle the case for Azure File CSI driver
+func (p *ACIProvider) getAzureFileCSIVolume(ctx context.Context, pod *v1.Pod, volume *v1.Volume) (*azaciv2.Volume, error) {
+	return p.getAzureFileCSI(*volume, pod.Namespace)
+}
 
-		// Handle the case for the EmptyDir.
-		if podVolumes[i].EmptyDir != nil {
-			log.G(ctx).Debugf("empty volume name ", podVolumes[i].Name)
-			volumes = append(volumes, &azaciv2.Volume{
-				Name:     &podVolumes[i].Name,
-				EmptyDir: map[string]interface{}{},
-			})
-			continue
-		}
+// Handle the case for the AzureFile volume.
+func (p *ACIProvider) getAzureFileVolume(ctx context.Context, pod *v1.Pod, volume *v1.Volume) (*azaciv2.Volume, error) {
+	secret, err := p.secretL.Secrets(pod.Namespace).Get(volume.AzureFile.SecretName)
+	if err != nil {
+		return nil, err
+	}
 
-		// Handle the case for GitRepo volume.
-		if podVolumes[i].GitRepo != nil {
-			volumes = append(volumes, &azaciv2.Volume{
-				Name: &podVolumes[i].Name,
-				GitRepo: &azaciv2.GitRepoVolume{
-					Directory:  &podVolumes[i].GitRepo.Directory,
-					Repository: &podVolumes[i].GitRepo.Repository,
-					Revision:   &podVolumes[i].GitRepo.Revision,
-				},
-			})
-			continue
-		}
+	if secret == nil {
+		return nil, fmt.Errorf("getting secret for AzureFile volume returned an empty secret")
+	}
+	storageAccountNameStr := string(secret.Data[azureFileStorageAccountName])
+	storageAccountKeyStr := string(secret.Data[azureFileStorageAccountKey])
 
-		// Handle the case for Secret volume.
-		if podVolumes[i].Secret != nil {
-			paths := make(map[string]*string)
-			secret, err := p.secretL.Secrets(pod.Namespace).Get(podVolumes[i].Secret.SecretName)
-			if podVolumes[i].Secret.Optional != nil && !*podVolumes[i].Secret.Optional && k8serr.IsNotFound(err) {
-				return nil, fmt.Errorf("secret %s is required by Pod %s and does not exist", podVolumes[i].Secret.SecretName, pod.Name)
-			}
-			if secret == nil {
-				continue
-			}
+	return &azaciv2.Volume{
+		Name: &volume.Name,
+		AzureFile: &azaciv2.AzureFileVolume{
+			ShareName:          &volume.AzureFile.ShareName,
+			ReadOnly:           &volume.AzureFile.ReadOnly,
+			StorageAccountName: &storageAccountNameStr,
+			StorageAccountKey:  &storageAccountKeyStr,
+		},
+	}, nil
+}
 
-			for k, v := range secret.Data {
-				strV := base64.StdEncoding.EncodeToString(v)
-				paths[k] = &strV
-			}
+// Handle the case for the EmptyDir.
+func getEmptyDirVolume(ctx context.Context, pod *v1.Pod, volume *v1.Volume) (*azaciv2.Volume, error) {
+	log.G(ctx).Debugf("empty volume name ", volume.Name)
+	return &azaciv2.Volume{
+		Name:     &volume.Name,
+		EmptyDir: map[string]interface{}{},
+	}, nil
+}
 
-			if len(paths) != 0 {
-				volumes = append(volumes, &azaciv2.Volume{
-					Name:   &podVolumes[i].Name,
-					Secret: paths,
-				})
-			}
-			continue
-		}
+// Handle the case for GitRepo volume.
+func getGitRepoVolume(ctx context.Context, pod *v1.Pod, volume *v1.Volume) (*azaciv2.Volume, error) {
+	return &azaciv2.Volume{
+		Name: &volume.Name,
+		GitRepo: &azaciv2.GitRepoVolume{
+			Directory:  &volume.GitRepo.Directory,
+			Repository: &volume.GitRepo.Repository,
+			Revision:   &volume.GitRepo.Revision,
+		},
+	}, nil
+}
 
-		// Handle the case for ConfigMap volume.
-		if podVolumes[i].ConfigMap != nil {
-			paths := make(map[string]*string)
-			configMap, err := p.configL.ConfigMaps(pod.Namespace).Get(podVolumes[i].ConfigMap.Name)
-			if podVolumes[i].ConfigMap.Optional != nil && !*podVolumes[i].ConfigMap.Optional && k8serr.IsNotFound(err) {
-				return nil, fmt.Errorf("ConfigMap %s is required by Pod %s and does not exist", podVolumes[i].ConfigMap.Name, pod.Name)
-			}
-			if configMap == nil {
-				continue
-			}
+// Handle the case for Secret volume.
+func (p *ACIProvider) getSecretVolume(ctx context.Context, pod *v1.Pod, volume *v1.Volume) (*azaciv2.Volume, error) {
+	paths := make(map[string]*string)
+	secret, err := p.secretL.Secrets(pod.Namespace).Get(volume.Secret.SecretName)
+	if volume.Secret.Optional != nil && !*volume.Secret.Optional && k8serr.IsNotFound(err) {
+		return nil, fmt.Errorf("secret %s is required by Pod %s and does not exist", volume.Secret.SecretName, pod.Name)
+	}
+	if secret == nil {
+		return nil, nil
+	}
 
-			for k, v := range configMap.Data {
-				strV := base64.StdEncoding.EncodeToString([]byte(v))
-				paths[k] = &strV
-			}
-			for k, v := range configMap.BinaryData {
-				strV := base64.StdEncoding.EncodeToString(v)
-				paths[k] = &strV
+	for k, v := range secret.Data {
+		strV := base64.StdEncoding.EncodeToString(v)
+		paths[k] = &strV
+	}
+
+	return getSecretPathsVolume(volume, paths), nil
+}
+
+// Handle the case for ConfigMap volume.
+func (p *ACIProvider) getConfigMapVolume(ctx context.Context, pod *v1.Pod, volume *v1.Volume) (*azaciv2.Volume, error) {
+	paths := make(map[string]*string)
+	configMap, err := p.configL.ConfigMaps(pod.Namespace).Get(volume.ConfigMap.Name)
+	if volume.ConfigMap.Optional != nil && !*volume.ConfigMap.Optional && k8serr.IsNotFound(err) {
+		return nil, fmt.Errorf("ConfigMap %s is required by Pod %s and does not exist", volume.ConfigMap.Name, pod.Name)
+	}
+	if configMap == nil {
+		return nil, nil
+	}
+
+	for k, v := range configMap.Data {
+		strV := base64.StdEncoding.EncodeToString([]byte(v))
+		paths[k] = &strV
+	}
+	for k, v := range configMap.BinaryData {
+		strV := base64.StdEncoding.EncodeToString(v)
+		paths[k] = &strV
+	}
+
+	return getSecretPathsVolume(volume, paths), nil
+}
+
+// Handle the case for Projected volume.
+func (p *ACIProvider) getProjectedVolume(ctx context.Context, pod *v1.Pod, volume *v1.Volume) (*azaciv2.Volume, error) {
+	log.G(ctx).Debug("Found projected volume")
+	paths := make(map[string]*string)
+
+	for _, source := range volume.Projected.Sources {
+		switch {
+		case source.ServiceAccountToken != nil:
+			if err := p.addServiceAccountTokenFile(ctx, pod, source.ServiceAccountToken, paths); err != nil {
+				return nil, err
 			}
 
-			if len(paths) != 0 {
-				volumes = append(volumes, &azaciv2.Volume{
-					Name:   &podVolumes[i].Name,
-					Secret: paths,
-				})
+		case source.DownwardAPI != nil:
+			p.addDownwardAPIFiles(ctx, pod, source.DownwardAPI, paths)
+
+		case source.Secret != nil:
+			secret, err := p.secretL.Secrets(pod.Namespace).Get(source.Secret.Name)
+			if source.Secret.Optional != nil && !*source.Secret.Optional && k8serr.IsNotFound(err) {
+				return nil, fmt.Errorf("projected secret %s is required by pod %s and does not exist", source.Secret.Name, pod.Name)
+			}
+			if secret == nil {
+				continue
 			}
-			continue
-		}
 
-		if podVolumes[i].Projected != nil {
-			log.G(ctx).Debug("Found projected volume")
-			paths := make(map[string]*string)
-
-			for _, source := range podVolumes[i].Projected.Sources {
-				switch {
-				case source.ServiceAccountToken != nil:
-					// This is still stored in a secret, hence the dance to figure out what secret.
-					secrets, err := p.secretL.Secrets(pod.Namespace).List(labels.Everything())
-					if err != nil {
-						return nil, err
-					}
-				Secrets:
-					for _, secret := range secrets {
-						if secret.Type != v1.SecretTypeServiceAccountToken {
-							continue
-						}
-						// annotation now needs to match the pod.ServiceAccountName
-						for k, a := range secret.ObjectMeta.Annotations {
-							if k == "kubernetes.io/service-account.name" && a == pod.Spec.ServiceAccountName {
-								for k, v := range secret.StringData {
-									data, err := base64.StdEncoding.DecodeString(v)
-									if err != nil {
-										return nil, err
-									}
-									dataStr := string(data)
-									paths[k] = &dataStr
-								}
-
-								for k, v := range secret.Data {
-									strV := base64.StdEncoding.EncodeToString(v)
-									paths[k] = &strV
-								}
-
-								break Secrets
-							}
+			for _, keyToPath := range source.Secret.Items {
+				for k, v := range secret.StringData {
+					if keyToPath.Key == k {
+						data, err := base64.StdEncoding.DecodeString(v)
+						if err != nil {
+							return nil, err
 						}
+						dataStr := string(data)
+						paths[k] = &dataStr
 					}
+				}
 
-				case source.Secret != nil:
-					secret, err := p.secretL.Secrets(pod.Namespace).Get(source.Secret.Name)
-					if source.Secret.Optional != nil && !*source.Secret.Optional && k8serr.IsNotFound(err) {
-						return nil, fmt.Errorf("projected secret %s is required by pod %s and does not exist", source.Secret.Name, pod.Name)
-					}
-					if secret == nil {
-						continue
+				for k, v := range secret.Data {
+					if keyToPath.Key == k {
+						strV := base64.StdEncoding.EncodeToString(v)
+						paths[k] = &strV
 					}
+				}
+			}
 
-					for _, keyToPath := range source.Secret.Items {
-						for k, v := range secret.StringData {
-							if keyToPath.Key == k {
-								data, err := base64.StdEncoding.DecodeString(v)
-								if err != nil {
-									return nil, err
-								}
-								dataStr := string(data)
-								paths[k] = &dataStr
-							}
-						}
-
-						for k, v := range secret.Data {
-							if keyToPath.Key == k {
-								strV := base64.StdEncoding.EncodeToString(v)
-								paths[k] = &strV
-							}
-						}
-					}
+		case source.ConfigMap != nil:
+			configMap, err := p.configL.ConfigMaps(pod.Namespace).Get(source.ConfigMap.Name)
+			if source.ConfigMap.Optional != nil && !*source.ConfigMap.Optional && k8serr.IsNotFound(err) {
+				return nil, fmt.Errorf("projected configMap %s is required by pod %s and does not exist", source.ConfigMap.Name, pod.Name)
+			}
+			if configMap == nil && source.ConfigMap.Name == serviceAccountRootCAConfigMap {
+				p.addServiceAccountRootCAFile(ctx, pod, source.ConfigMap, paths)
+				continue
+			}
+			if configMap == nil {
+				continue
+			}
 
-				case source.ConfigMap != nil:
-					configMap, err := p.configL.ConfigMaps(pod.Namespace).Get(source.ConfigMap.Name)
-					if source.ConfigMap.Optional != nil && !*source.ConfigMap.Optional && k8serr.IsNotFound(err) {
-						return nil, fmt.Errorf("projected configMap %s is required by pod %s and does not exist", source.ConfigMap.Name, pod.Name)
-					}
-					if configMap == nil {
-						continue
+			for _, keyToPath := range source.ConfigMap.Items {
+				for k, v := range configMap.Data {
+					if keyToPath.Key == k {
+						strV := base64.StdEncoding.EncodeToString([]byte(v))
+						paths[k] = &strV
 					}
-
-					for _, keyToPath := range source.ConfigMap.Items {
-						for k, v := range configMap.Data {
-							if keyToPath.Key == k {
-								strV := base64.StdEncoding.EncodeToString([]byte(v))
-								paths[k] = &strV
-							}
-						}
-						for k, v := range configMap.BinaryData {
-							if keyToPath.Key == k {
-								strV := base64.StdEncoding.EncodeToString(v)
-								paths[k] = &strV
-							}
-						}
+				}
+				for k, v := range configMap.BinaryData {
+					if keyToPath.Key == k {
+						strV := base64.StdEncoding.EncodeToString(v)
+						paths[k] = &strV
 					}
 				}
 			}
-			if len(paths) != 0 {
-				volumes = append(volumes, &azaciv2.Volume{
-					Name:   &podVolumes[i].Name,
-					Secret: paths,
-				})
-			}
-			continue
 		}
+	}
 
-		// If we've made it this far we have found a volume type that isn't supported
-		return nil, fmt.Errorf("pod %s requires volume %s which is of an unsupported type", pod.Name, podVolumes[i].Name)
+	return getSecretPathsVolume(volume, paths), nil
+}
+
+// getSecretPathsVolume returns a secret volume with the files of the paths, or nil when there are
+// no files.
+func getSecretPathsVolume(volume *v1.Volume, paths map[string]*string) *azaciv2.Volume {
+	if len(paths) == 0 {
+		return nil
+	}
+	return &azaciv2.Volume{
+		Name:   &volume.Name,
+		Secret: paths,
 	}
+}
 
-	return volumes, nil
+// addDownwardAPIFiles renders the pod fields projected in the volume, e.g. the namespace file of
+// the service account volumes. The files of the container resources are not supported.
+func (p *ACIProvider) addDownwardAPIFiles(ctx context.Context, pod *v1.Pod, source *v1.DownwardAPIProjection, paths map[string]*string) {
+	for _, item := range source.Items {
+		if item.FieldRef == nil {
+			log.G(ctx).Warnf("skipping file %s of the projected volume of pod %s, only the pod fields are supported", item.Path, pod.Name)
+			continue
+		}
+		value, ok, err := p.getFieldRefValue(ctx, pod, item.Path, item.FieldRef)
+		if err != nil {
+			log.G(ctx).WithError(err).Warnf("skipping file %s of the projected volume of pod %s", item.Path, pod.Name)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		strV := base64.StdEncoding.EncodeToString([]byte(value))
+		paths[item.Path] = &strV
+	}
 }
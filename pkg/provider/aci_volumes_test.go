@@ -9,6 +9,7 @@ import (
 	"encoding/base64"
 	"fmt"
 	"testing"
+	"time"
 
 	azaciv2 "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerinstance/armcontainerinstance/v2"
 	"github.com/golang/mock/gomock"
@@ -17,10 +18,14 @@ import (
 	testsutil "github.com/virtual-kubelet/azure-aci/pkg/tests"
 	"gotest.tools/assert"
 	is "gotest.tools/assert/cmp"
+	authenticationv1 "k8s.io/api/authentication/v1"
 	v1 "k8s.io/api/core/v1"
 	errors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	ktesting "k8s.io/client-go/testing"
 )
 
 var (
@@ -972,38 +977,10 @@ func TestGetVolumesProjectedVolConfMapSource(t *testing.T) {
 
 func TestGetVolumesProjectedVolSvcAcctTokenSource(t *testing.T) {
 	projectedVolumeName := "ProjectedVolume"
-	secretName := "ServiceAccountToken"
 	serviceAccountName := "fake-service-account"
-	fakeVolumeSecret := "fake-volume-secret"
-
-	fakeSecret2 := v1.Secret{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      secretName,
-			Namespace: podNamespace,
-			Annotations: map[string]string{
-				"kubernetes.io/service-account.name": serviceAccountName,
-			},
-		},
-		Type: v1.SecretTypeServiceAccountToken,
-		Data: map[string][]byte{
-			secretName: []byte("fake-svc-acct-token-data"),
-		},
-	}
-
-	fakeSecret1 := v1.Secret{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      fakeVolumeSecret,
-			Namespace: podNamespace,
-		},
-		Data: map[string][]byte{
-			azureFileStorageAccountName: []byte("azureFileStorageAccountName"),
-			azureFileStorageAccountKey:  []byte("azureFileStorageAccountKey")},
-	}
-
-	fakeSecrets := []*v1.Secret{&fakeSecret1, &fakeSecret2}
-
-	setOptional := new(bool)
-	*setOptional = false
+	audience := "fake-audience"
+	expirationSeconds := int64(600)
+	expirationTimestamp := metav1.NewTime(time.Now().Add(10 * time.Minute))
 
 	fakePodVolumes := []v1.Volume{
 		{
@@ -1019,7 +996,39 @@ func TestGetVolumesProjectedVolSvcAcctTokenSource(t *testing.T) {
 					Sources: []v1.VolumeProjection{
 						{
 							ServiceAccountToken: &v1.ServiceAccountTokenProjection{
-								Path: serviceAccountSecretMountPath,
+								Audience:          audience,
+								ExpirationSeconds: &expirationSeconds,
+								Path:              "token",
+							},
+						},
+						{
+							ConfigMap: &v1.ConfigMapProjection{
+								LocalObjectReference: v1.LocalObjectReference{Name: serviceAccountRootCAConfigMap},
+								Items:                []v1.KeyToPath{{Key: serviceAccountRootCAKey, Path: serviceAccountRootCAKey}},
+							},
+						},
+						{
+							DownwardAPI: &v1.DownwardAPIProjection{
+								Items: []v1.DownwardAPIVolumeFile{{
+									Path:     serviceAccountNamespaceKey,
+									FieldRef: &v1.ObjectFieldSelector{FieldPath: "metadata.namespace"},
+								}},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			Name: "token-only",
+			VolumeSource: v1.VolumeSource{
+				Projected: &v1.ProjectedVolumeSource{
+					Sources: []v1.VolumeProjection{
+						{
+							ServiceAccountToken: &v1.ServiceAccountTokenProjection{
+								Audience:          audience,
+								ExpirationSeconds: &expirationSeconds,
+								Path:              "token",
 							},
 						},
 					},
@@ -1034,52 +1043,79 @@ func TestGetVolumesProjectedVolSvcAcctTokenSource(t *testing.T) {
 	aciMocks := createNewACIMock()
 
 	cases := []struct {
-		description     string
-		callSecretMocks func(secretMock *MockSecretLister)
-		expectedError   error
+		description   string
+		tokenErr      error
+		expectedError bool
 	}{
 		{
-			description: "GetVolumes successfully retrives ServiceAccountToken from Projected ServiceAccountToken Volume Source",
-			callSecretMocks: func(secretMock *MockSecretLister) {
-				for _, volume := range fakePodVolumes {
-					if volume.Name == projectedVolumeName {
-						mockSecretNamespaceLister := NewMockSecretNamespaceLister(mockCtrl)
-						secretMock.EXPECT().Secrets(podNamespace).Return(mockSecretNamespaceLister)
-						mockSecretNamespaceLister.EXPECT().List(labels.Everything()).Return(fakeSecrets, nil)
-					}
-				}
-			},
-			expectedError: nil,
+			description: "GetVolumes successfully requests a bound token for the Projected ServiceAccountToken Volume Source",
+		},
+		{
+			description:   "GetVolumes fails when the token cannot be requested",
+			tokenErr:      errors.NewForbidden(schema.GroupResource{Resource: "serviceaccounts"}, serviceAccountName, fmt.Errorf("denied")),
+			expectedError: true,
 		},
 	}
 
 	for _, tc := range cases {
 		t.Run(tc.description, func(t *testing.T) {
-			mockSecretLister := NewMockSecretLister(mockCtrl)
-
 			pod := testsutil.CreatePodObj(podName, podNamespace)
-			tc.callSecretMocks(mockSecretLister)
-
 			pod.Spec.Volumes = fakePodVolumes
-
 			pod.Spec.ServiceAccountName = serviceAccountName
 
-			provider, err := createTestProvider(aciMocks, NewMockConfigMapLister(mockCtrl),
-				mockSecretLister, NewMockPodLister(mockCtrl), nil)
+			var tokenRequest *authenticationv1.TokenRequest
+			kubeClient := fake.NewSimpleClientset()
+			kubeClient.PrependReactor("create", "serviceaccounts", func(action ktesting.Action) (bool, runtime.Object, error) {
+				createAction := action.(ktesting.CreateAction)
+				assert.Equal(t, createAction.GetSubresource(), "token")
+				assert.Equal(t, createAction.GetNamespace(), podNamespace)
+				if tc.tokenErr != nil {
+					return true, nil, tc.tokenErr
+				}
+				tokenRequest = createAction.GetObject().(*authenticationv1.TokenRequest)
+				tokenRequest.Status = authenticationv1.TokenRequestStatus{
+					Token:               "fake-svc-acct-token-data",
+					ExpirationTimestamp: expirationTimestamp,
+				}
+				return true, tokenRequest, nil
+			})
+
+			mockConfigMapLister := NewMockConfigMapLister(mockCtrl)
+			mockConfigMapNamespaceLister := NewMockConfigMapNamespaceLister(mockCtrl)
+			mockConfigMapLister.EXPECT().ConfigMaps(podNamespace).Return(mockConfigMapNamespaceLister).AnyTimes()
+			mockConfigMapNamespaceLister.EXPECT().Get(serviceAccountRootCAConfigMap).Return(&v1.ConfigMap{
+				Data: map[string]string{serviceAccountRootCAKey: "fake-ca-data"},
+			}, nil).AnyTimes()
+
+			provider, err := createTestProvider(aciMocks, mockConfigMapLister,
+				NewMockSecretLister(mockCtrl), NewMockPodLister(mockCtrl), kubeClient)
 			if err != nil {
 				t.Fatal("Unable to create test provider", err)
 			}
 
 			volumes, err := provider.getVolumes(context.Background(), pod)
-
-			if tc.expectedError == nil {
-				fakeServiceAccountData := base64.StdEncoding.EncodeToString([]byte("fake-svc-acct-token-data"))
-				assert.NilError(t, err)
-				assert.DeepEqual(t, *volumes[1].Secret[secretName], fakeServiceAccountData)
-			} else {
-				assert.Equal(t, tc.expectedError.Error(), err.Error())
+			if tc.expectedError {
+				assert.Check(t, err != nil)
+				return
 			}
+			assert.NilError(t, err)
+
+			assert.Assert(t, tokenRequest != nil)
+			assert.Check(t, is.DeepEqual(tokenRequest.Spec.Audiences, []string{audience}))
+			assert.Check(t, is.Equal(*tokenRequest.Spec.ExpirationSeconds, expirationSeconds))
+			assert.Check(t, is.Equal(tokenRequest.Spec.BoundObjectRef.Kind, "Pod"))
+			assert.Check(t, is.Equal(tokenRequest.Spec.BoundObjectRef.UID, pod.UID))
+
+			assert.Check(t, is.Equal(*volumes[1].Secret["token"], base64.StdEncoding.EncodeToString([]byte("fake-svc-acct-token-data"))))
+			assert.Check(t, is.Equal(*volumes[1].Secret[serviceAccountRootCAKey], base64.StdEncoding.EncodeToString([]byte("fake-ca-data"))))
+			assert.Check(t, is.Equal(*volumes[1].Secret[serviceAccountNamespaceKey], base64.StdEncoding.EncodeToString([]byte(podNamespace))))
+			// Only the sources of the projection are rendered.
+			assert.Check(t, is.Len(volumes[2].Secret, 1))
+			assert.Check(t, volumes[2].Secret["token"] != nil)
+
+			due := provider.serviceAccountTokens.due(expirationTimestamp.Time)
+			assert.Check(t, is.Len(due, 1))
+			assert.Check(t, is.Equal(due[pod.UID].expiresAt, expirationTimestamp.Time))
 		})
 	}
-
 }
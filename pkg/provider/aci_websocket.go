@@ -0,0 +1,107 @@
+/*
+Copyright (c) Microsoft Corporation.
+Licensed under the Apache 2.0 license.
+*/
+package provider
+
+import (
+	"context"
+	"io"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	"github.com/virtual-kubelet/virtual-kubelet/node/api"
+)
+
+// containerStreamAuth is how the password returned by ACI authenticates a container websocket.
+type containerStreamAuth int
+
+const (
+	// passwordAsFirstMessage is used by exec, the terminal is only active once the password is sent.
+	passwordAsFirstMessage containerStreamAuth = iota
+	// passwordAsAuthorizationHeader is used by attach.
+	passwordAsAuthorizationHeader
+)
+
+// dialContainerStream connects to the websocket of a container exec or attach session.
+func dialContainerStream(ctx context.Context, wsURI, password string, auth containerStreamAuth) (*websocket.Conn, error) {
+	header := http.Header{}
+	if auth == passwordAsAuthorizationHeader {
+		header.Set("Authorization", password)
+	}
+
+	c, _, err := websocket.DefaultDialer.DialContext(ctx, wsURI, header)
+	if err != nil {
+		return nil, err
+	}
+
+	if auth == passwordAsFirstMessage {
+		if err := c.WriteMessage(websocket.TextMessage, []byte(password)); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// streamContainer pumps stdin to the container websocket, and its output to stdout, until the
+// session ends or ctx is cancelled. The connection is closed on return.
+func streamContainer(ctx context.Context, c *websocket.Conn, stdin io.Reader, stdout io.Writer) error {
+	logger := log.G(ctx)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Unblock the reads and writes on the connection when the session is cancelled.
+	go func() {
+		<-ctx.Done()
+		c.Close()
+	}()
+
+	if stdin != nil {
+		go func() {
+			var msg = make([]byte, 512)
+			for {
+				n, err := stdin.Read(msg)
+				if n > 0 { // Only call WriteMessage if there is data to send
+					if err := c.WriteMessage(websocket.BinaryMessage, msg[:n]); err != nil {
+						logger.WithError(err).Debug("an error has occurred while trying to write message")
+						return
+					}
+				}
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	for {
+		_, cr, err := c.NextReader()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) || ctx.Err() != nil {
+				return ctx.Err()
+			}
+			// ACI closes the connection without a close frame when the session ends.
+			logger.WithError(err).Debug("container stream closed")
+			return nil
+		}
+		if stdout == nil {
+			continue
+		}
+		if _, err := io.Copy(stdout, cr); err != nil {
+			logger.WithError(err).Errorf("an error has occurred while trying to copy message")
+			return err
+		}
+	}
+}
+
+// containerOutput returns where the output of a container stream goes. ACI multiplexes stdout and
+// stderr on the websocket, so stderr is only used when stdout was not requested.
+func containerOutput(attach api.AttachIO) io.WriteCloser {
+	if out := attach.Stdout(); out != nil {
+		return out
+	}
+	return attach.Stderr()
+}
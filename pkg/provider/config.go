@@ -21,6 +21,11 @@ type providerConfig struct {
 	Pods            string
 	SubnetName      string
 	SubnetCIDR      string
+	// PreviousNodeNames are the names the node had before, the container groups tagged with them
+	// are adopted on startup when their pod is on the node.
+	PreviousNodeNames []string
+	// ReconcileDryRun only reports the container groups the startup reconciliation would adopt.
+	ReconcileDryRun bool
 }
 
 var validOS = map[string]bool{
@@ -76,6 +81,9 @@ func (p *ACIProvider) loadConfig(r io.Reader) error {
 		}
 	}
 
+	p.previousNodeNames = config.PreviousNodeNames
+	p.reconcileDryRun = config.ReconcileDryRun
+
 	p.operatingSystem = config.OperatingSystem
 	return nil
 }
@@ -16,17 +16,20 @@ import (
 	errdef "github.com/virtual-kubelet/virtual-kubelet/errdefs"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 )
 
 func (p *ACIProvider) containerGroupToPod(ctx context.Context, cg *azaciv2.ContainerGroup) (*v1.Pod, error) {
 	//cg is validated
-	pod, err := p.podsL.Pods(*cg.Tags["Namespace"]).Get(*cg.Name)
-	// in case pod got deleted, we want to continue the workflow to kick off clean dangling pods
-	if errdef.IsNotFound(err) || pod == nil {
+	pod, err := p.podsL.Pods(*cg.Tags["Namespace"]).Get(*cg.Tags["PodName"])
+	// in case pod got deleted, or was recreated with the same name, we want to continue the
+	// workflow to kick off clean dangling pods
+	if errdef.IsNotFound(err) || pod == nil || (err == nil && checkContainerGroupOwner(cg, pod.UID) != nil) {
 		return &v1.Pod{
 			ObjectMeta: metav1.ObjectMeta{
 				Name:      *cg.Tags["PodName"],
 				Namespace: *cg.Tags["Namespace"],
+				UID:       types.UID(util.GetContainerGroupPodUID(cg)),
 			},
 		}, nil
 	}
@@ -8,29 +8,47 @@ import (
 	"context"
 
 	azaciv2 "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerinstance/armcontainerinstance/v2"
+	"github.com/virtual-kubelet/azure-aci/pkg/client"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
 	"github.com/virtual-kubelet/virtual-kubelet/node/api"
 )
 
 type CreateContainerGroupFunc func(ctx context.Context, resourceGroup, podNS, podName string, cg *azaciv2.ContainerGroup) error
+type PollContainerGroupFunc func(ctx context.Context, cg *azaciv2.ContainerGroup) (*azaciv2.ContainerGroup, error)
 type GetContainerGroupInfoFunc func(ctx context.Context, resourceGroup, namespace, name, nodeName string) (*azaciv2.ContainerGroup, error)
 type GetContainerGroupListFunc func(ctx context.Context, resourceGroup string) ([]*azaciv2.ContainerGroup, error)
 type ListCapabilitiesFunc func(ctx context.Context, region string) ([]*azaciv2.Capabilities, error)
+type ListUsageFunc func(ctx context.Context, region string) ([]*azaciv2.Usage, error)
 type DeleteContainerGroupFunc func(ctx context.Context, resourceGroup, cgName string) error
 type ListLogsFunc func(ctx context.Context, resourceGroup, cgName, containerName string, opts api.ContainerLogOpts) (*string, error)
 type ExecuteContainerCommandFunc func(ctx context.Context, resourceGroup, cgName, containerName string, containerReq azaciv2.ContainerExecRequest) (*azaciv2.ContainerExecResponse, error)
 
+type AttachFunc func(ctx context.Context, resourceGroup, cgName, containerName string) (*azaciv2.ContainerAttachResponse, error)
+
 type GetContainerGroupFunc func(ctx context.Context, resourceGroup, containerGroupName string) (*azaciv2.ContainerGroup, error)
 
+type UpdateContainerGroupTagsFunc func(ctx context.Context, resourceGroup, cgName string, tags map[string]*string) error
+
+type RestartContainerGroupFunc func(ctx context.Context, resourceGroup, cgName string) error
+
 type MockACIProvider struct {
-	MockCreateContainerGroup    CreateContainerGroupFunc
-	MockGetContainerGroupInfo   GetContainerGroupInfoFunc
-	MockGetContainerGroupList   GetContainerGroupListFunc
-	MockListCapabilities        ListCapabilitiesFunc
-	MockDeleteContainerGroup    DeleteContainerGroupFunc
-	MockListLogs                ListLogsFunc
-	MockExecuteContainerCommand ExecuteContainerCommandFunc
+	MockCreateContainerGroup     CreateContainerGroupFunc
+	MockPollCreateContainerGroup PollContainerGroupFunc
+	MockPollDeleteContainerGroup PollContainerGroupFunc
+	MockGetContainerGroupInfo    GetContainerGroupInfoFunc
+	MockGetContainerGroupList    GetContainerGroupListFunc
+	MockListCapabilities         ListCapabilitiesFunc
+	MockListUsage                ListUsageFunc
+	MockDeleteContainerGroup     DeleteContainerGroupFunc
+	MockListLogs                 ListLogsFunc
+	MockExecuteContainerCommand  ExecuteContainerCommandFunc
+	MockAttach                   AttachFunc
 
-	MockGetContainerGroup GetContainerGroupFunc
+	MockGetContainerGroup         GetContainerGroupFunc
+	MockUpdateContainerGroupTags  UpdateContainerGroupTagsFunc
+	MockRestartContainerGroup     RestartContainerGroupFunc
+	MockPollRestartContainerGroup PollContainerGroupFunc
+	MockThrottlingState           func() client.ThrottlingState
 }
 
 func NewMockACIProvider(capList ListCapabilitiesFunc) *MockACIProvider {
@@ -46,6 +64,13 @@ func (m *MockACIProvider) ListCapabilities(ctx context.Context, region string) (
 	return nil, nil
 }
 
+func (m *MockACIProvider) ListUsage(ctx context.Context, region string) ([]*azaciv2.Usage, error) {
+	if m.MockListUsage != nil {
+		return m.MockListUsage(ctx, region)
+	}
+	return nil, nil
+}
+
 func (m *MockACIProvider) GetContainerGroupListResult(ctx context.Context, resourcegroup string) ([]*azaciv2.ContainerGroup, error) {
 	if m.MockGetContainerGroupList != nil {
 		return m.MockGetContainerGroupList(ctx, resourcegroup)
@@ -57,22 +82,54 @@ func (m *MockACIProvider) GetContainerGroupInfo(ctx context.Context, resourceGro
 	if m.MockGetContainerGroupInfo != nil {
 		return m.MockGetContainerGroupInfo(ctx, resourceGroup, namespace, name, nodeName)
 	}
-	return nil, nil
+	return nil, errdefs.NotFound("cg is not found")
 }
 
-func (m *MockACIProvider) CreateContainerGroup(ctx context.Context, resourceGroup, podNS, podName string, cg *azaciv2.ContainerGroup) error {
+func (m *MockACIProvider) CreateContainerGroup(ctx context.Context, resourceGroup, podNS, podName string, cg *azaciv2.ContainerGroup) (client.ContainerGroupPoller, error) {
 	if m.MockCreateContainerGroup != nil {
-		return m.MockCreateContainerGroup(ctx, resourceGroup, podNS, podName, cg)
+		if err := m.MockCreateContainerGroup(ctx, resourceGroup, podNS, podName, cg); err != nil {
+			return nil, err
+		}
 	}
-	return nil
+	return &mockContainerGroupPoller{cg: cg, poll: m.MockPollCreateContainerGroup}, nil
+}
+
+type mockContainerGroupPoller struct {
+	cg   *azaciv2.ContainerGroup
+	poll PollContainerGroupFunc
+}
+
+func (m *mockContainerGroupPoller) PollUntilDone(ctx context.Context) (*azaciv2.ContainerGroup, error) {
+	if m.poll != nil {
+		return m.poll(ctx, m.cg)
+	}
+	return m.cg, nil
 }
-func (m *MockACIProvider) DeleteContainerGroup(ctx context.Context, resourceGroup, cgName string) error {
+func (m *MockACIProvider) DeleteContainerGroup(ctx context.Context, resourceGroup, cgName string) (client.ContainerGroupPoller, error) {
 	if m.MockDeleteContainerGroup != nil {
-		return m.MockDeleteContainerGroup(ctx, resourceGroup, cgName)
+		if err := m.MockDeleteContainerGroup(ctx, resourceGroup, cgName); err != nil {
+			return nil, err
+		}
+	}
+	return &mockContainerGroupPoller{poll: m.MockPollDeleteContainerGroup}, nil
+}
+
+func (m *MockACIProvider) UpdateContainerGroupTags(ctx context.Context, resourceGroup, cgName string, tags map[string]*string) error {
+	if m.MockUpdateContainerGroupTags != nil {
+		return m.MockUpdateContainerGroupTags(ctx, resourceGroup, cgName, tags)
 	}
 	return nil
 }
 
+func (m *MockACIProvider) RestartContainerGroup(ctx context.Context, resourceGroup, cgName string) (client.ContainerGroupPoller, error) {
+	if m.MockRestartContainerGroup != nil {
+		if err := m.MockRestartContainerGroup(ctx, resourceGroup, cgName); err != nil {
+			return nil, err
+		}
+	}
+	return &mockContainerGroupPoller{poll: m.MockPollRestartContainerGroup}, nil
+}
+
 func (m *MockACIProvider) ListLogs(ctx context.Context, resourceGroup, cgName, containerName string, opts api.ContainerLogOpts) (*string, error) {
 	if m.MockListLogs != nil {
 		return m.MockListLogs(ctx, resourceGroup, cgName, containerName, opts)
@@ -88,9 +145,23 @@ func (m *MockACIProvider) ExecuteContainerCommand(ctx context.Context, resourceG
 	return nil, nil
 }
 
+func (m *MockACIProvider) Attach(ctx context.Context, resourceGroup, cgName, containerName string) (*azaciv2.ContainerAttachResponse, error) {
+	if m.MockAttach != nil {
+		return m.MockAttach(ctx, resourceGroup, cgName, containerName)
+	}
+	return nil, nil
+}
+
 func (m *MockACIProvider) GetContainerGroup(ctx context.Context, resourceGroup, containerGroupName string) (*azaciv2.ContainerGroup, error) {
 	if m.MockGetContainerGroup != nil {
 		return m.MockGetContainerGroup(ctx, resourceGroup, containerGroupName)
 	}
 	return nil, nil
 }
+
+func (m *MockACIProvider) ThrottlingState() client.ThrottlingState {
+	if m.MockThrottlingState != nil {
+		return m.MockThrottlingState()
+	}
+	return client.ThrottlingState{}
+}
@@ -6,8 +6,10 @@ package provider
 
 import (
 	"context"
+	"sync"
 	"time"
 
+	"github.com/virtual-kubelet/azure-aci/pkg/metrics/collectors"
 	errdef "github.com/virtual-kubelet/virtual-kubelet/errdefs"
 	"github.com/virtual-kubelet/virtual-kubelet/log"
 	"github.com/virtual-kubelet/virtual-kubelet/trace"
@@ -15,6 +17,7 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	corev1listers "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/tools/record/util"
@@ -26,20 +29,55 @@ const (
 	statusMessageNotFound               = "The pod may have been deleted from the provider"
 	containerExitCodeNotFound     int32 = -137
 
-	statusUpdatesInterval = 5 * time.Second
-	cleanupInterval       = 5 * time.Minute
+	// The statuses are polled at statusUpdatesInterval while pods are changing, and at
+	// steadyStatusUpdatesInterval otherwise. The status of the pods whose container group is
+	// unchanged in the list is still refreshed every statusRefreshInterval, as the list does not
+	// have the instance view of the container groups.
+	statusUpdatesInterval       = 5 * time.Second
+	steadyStatusUpdatesInterval = 30 * time.Second
+	statusRefreshInterval       = time.Minute
+	cleanupInterval             = 5 * time.Minute
+	// The container groups are compared with the spec of their pods every specCheckInterval.
+	specCheckInterval = time.Minute
 )
 
 type PodIdentifier struct {
 	namespace string
 	name      string
+	// uid is the UID of the pod the container group was created for, when it is known.
+	uid types.UID
+}
+
+// PodEvent is an event of a pod, or of one of its containers, reported by the provider.
+type PodEvent struct {
+	Object runtime.Object
+	// Container is empty for the events of the pod itself.
+	Container string
+
+	Type    string
+	Reason  string
+	Message string
+	// Count is the number of occurrences of the event reported by the provider.
+	Count          int32
+	FirstTimestamp *time.Time
+	LastTimestamp  *time.Time
 }
 
 type PodsTrackerHandler interface {
 	ListActivePods(ctx context.Context) ([]PodIdentifier, error)
-	FetchPodStatus(ctx context.Context, ns, name string) (*v1.PodStatus, error)
-	FetchPodEvents(ctx context.Context, pod *v1.Pod, evtSink func(timestamp *time.Time, object runtime.Object, eventtype, reason, messageFmt string, args ...interface{})) error
-	CleanupPod(ctx context.Context, ns, name string) error
+	// ListPodFingerprints returns a fingerprint of the provider state of each pod, which changes
+	// with the state of the pod, using a single call to the provider.
+	ListPodFingerprints(ctx context.Context) (map[PodIdentifier]string, error)
+	// FetchPodStatus returns the status of the pod, and reports its events to evtSink.
+	FetchPodStatus(ctx context.Context, pod *v1.Pod, evtSink func(evt *PodEvent)) (*v1.PodStatus, error)
+	// CheckPodSpecs compares the provider state of the pods with their spec, and handles the
+	// differences, using a single call to the provider.
+	CheckPodSpecs(ctx context.Context, pods []*v1.Pod)
+	// IsThrottled is true while the provider asks to slow down the status updates.
+	IsThrottled(ctx context.Context) bool
+	// CleanupPod deletes the resources of the pod with the given UID, the resources of a pod
+	// recreated with the same namespace and name are kept.
+	CleanupPod(ctx context.Context, ns, name string, uid types.UID) error
 }
 
 type PodsTracker struct {
@@ -47,8 +85,27 @@ type PodsTracker struct {
 	updateCb func(*v1.Pod)
 	handler  PodsTrackerHandler
 
-	lastEventCheck time.Time
-	eventRecorder  record.EventRecorder
+	// eventWatermarks tracks the events already recorded, by pod UID and container.
+	eventWatermarks map[types.UID]map[string]*eventsWatermark
+	eventRecorder   record.EventRecorder
+
+	// polledPods tracks the provider state of the pods when their status was last fetched.
+	polledPods map[types.UID]*polledPod
+
+	pollingStatsLock sync.Mutex
+	pollingStats     collectors.StatusPollingStats
+}
+
+type polledPod struct {
+	fingerprint string
+	lastFetch   time.Time
+}
+
+// eventsWatermark is the timestamp of the last event recorded for a pod or a container, and the
+// occurrences recorded of the events currently reported by the provider.
+type eventsWatermark struct {
+	lastTimestamp time.Time
+	counts        map[string]int32
 }
 
 // StartTracking starts the background tracking for created pods.
@@ -58,8 +115,10 @@ func (pt *PodsTracker) StartTracking(ctx context.Context) {
 
 	statusUpdatesTimer := time.NewTimer(statusUpdatesInterval)
 	cleanupTimer := time.NewTimer(cleanupInterval)
+	specCheckTimer := time.NewTimer(specCheckInterval)
 	defer statusUpdatesTimer.Stop()
 	defer cleanupTimer.Stop()
+	defer specCheckTimer.Stop()
 
 	for {
 		log.G(ctx).Debug("Pod status updates & cleanup loop start")
@@ -69,11 +128,13 @@ func (pt *PodsTracker) StartTracking(ctx context.Context) {
 			log.G(ctx).WithError(ctx.Err()).Debug("Pod status update loop exiting")
 			return
 		case <-statusUpdatesTimer.C:
-			pt.updatePodsLoop(ctx)
-			statusUpdatesTimer.Reset(statusUpdatesInterval)
+			statusUpdatesTimer.Reset(pt.updatePodsLoop(ctx))
 		case <-cleanupTimer.C:
 			pt.cleanupDanglingPods(ctx)
 			cleanupTimer.Reset(cleanupInterval)
+		case <-specCheckTimer.C:
+			pt.checkPodSpecs(ctx)
+			specCheckTimer.Reset(specCheckInterval)
 		}
 	}
 }
@@ -103,7 +164,9 @@ func (pt *PodsTracker) UpdatePodStatus(ctx context.Context, ns, name string, upd
 	return nil
 }
 
-func (pt *PodsTracker) updatePodsLoop(ctx context.Context) {
+// updatePodsLoop updates the status of the pods whose container group changed since their status
+// was last fetched, and returns the interval until the next update.
+func (pt *PodsTracker) updatePodsLoop(ctx context.Context) time.Duration {
 	ctx, span := trace.StartSpan(ctx, "PodsTracker.updatePods")
 	defer span.End()
 
@@ -111,13 +174,131 @@ func (pt *PodsTracker) updatePodsLoop(ctx context.Context) {
 	if err != nil {
 		log.L.WithError(err).Errorf("failed to retrieve pods list")
 	}
+
+	throttled := pt.handler.IsThrottled(ctx)
+	fingerprints, listErr := pt.handler.ListPodFingerprints(ctx)
+	if listErr != nil {
+		if throttled {
+			log.G(ctx).WithError(listErr).Warn("failed to list the container groups while throttled, skipping the status updates")
+			// The cycle is skipped, it spends no polling call.
+			pt.setPollingStats(0, 0, steadyStatusUpdatesInterval)
+			return steadyStatusUpdatesInterval
+		}
+		log.G(ctx).WithError(listErr).Warn("failed to list the container groups, fetching the status of each pod")
+	}
+	if pt.polledPods == nil {
+		pt.polledPods = make(map[types.UID]*polledPod)
+	}
+
+	now := time.Now()
+	getCalls := 0
+	interval := steadyStatusUpdatesInterval
 	for _, pod := range k8sPods {
+		fingerprint, listed := fingerprints[PodIdentifier{namespace: pod.Namespace, name: pod.Name}]
+		polled := pt.polledPods[pod.UID]
+		changed := listed && (polled == nil || polled.fingerprint != fingerprint)
+
+		if pt.shouldSkipPodStatusUpdate(pod) {
+			// The status is final, the container group is only fetched for its new events.
+			if changed {
+				getCalls++
+				if err := pt.recordPodEvents(ctx, pod); err != nil {
+					log.G(ctx).WithError(err).Warnf("cannot fetch aci events for pod %s in namespace %s", pod.Name, pod.Namespace)
+				}
+				pt.polledPods[pod.UID] = &polledPod{fingerprint: fingerprint, lastFetch: now}
+			}
+			continue
+		}
+
+		pending := pod.Status.Phase == v1.PodPending
+		if listErr != nil || !listed || changed || pending {
+			interval = statusUpdatesInterval
+		} else if now.Sub(polled.lastFetch) < statusRefreshInterval {
+			continue
+		}
+
+		getCalls++
 		updatedPod := pod.DeepCopy()
 		ok := pt.processPodUpdates(ctx, updatedPod)
 		if ok {
 			pt.updateCb(updatedPod)
+			pt.polledPods[pod.UID] = &polledPod{fingerprint: fingerprint, lastFetch: now}
 		}
 	}
+	pt.pruneEventWatermarks(k8sPods)
+
+	// The pods changing are polled at the steady pace while ARM throttles the requests.
+	if throttled {
+		interval = steadyStatusUpdatesInterval
+	}
+	pt.setPollingStats(1, getCalls, interval)
+	return interval
+}
+
+func (pt *PodsTracker) setPollingStats(listCalls, getCalls int, interval time.Duration) {
+	pt.pollingStatsLock.Lock()
+	defer pt.pollingStatsLock.Unlock()
+
+	pt.pollingStats.ListCalls = listCalls
+	pt.pollingStats.GetCalls = getCalls
+	pt.pollingStats.TotalCalls += int64(listCalls + getCalls)
+	pt.pollingStats.Interval = interval
+}
+
+// PollingStats returns the ARM calls spent polling the status of the pods.
+func (pt *PodsTracker) PollingStats() collectors.StatusPollingStats {
+	pt.pollingStatsLock.Lock()
+	defer pt.pollingStatsLock.Unlock()
+
+	return pt.pollingStats
+}
+
+// pruneEventWatermarks forgets the events, and the polling state, of the pods that are gone.
+func (pt *PodsTracker) pruneEventWatermarks(k8sPods []*v1.Pod) {
+	if len(pt.eventWatermarks) == 0 && len(pt.polledPods) == 0 {
+		return
+	}
+	uids := make(map[types.UID]struct{}, len(k8sPods))
+	for _, pod := range k8sPods {
+		uids[pod.UID] = struct{}{}
+	}
+	for uid := range pt.eventWatermarks {
+		if _, ok := uids[uid]; !ok {
+			delete(pt.eventWatermarks, uid)
+		}
+	}
+	for uid := range pt.polledPods {
+		if _, ok := uids[uid]; !ok {
+			delete(pt.polledPods, uid)
+		}
+	}
+}
+
+// checkPodSpecs compares the provider state of the running pods with their spec. The check is
+// skipped while the provider is throttled.
+func (pt *PodsTracker) checkPodSpecs(ctx context.Context) {
+	ctx, span := trace.StartSpan(ctx, "PodsTracker.checkPodSpecs")
+	defer span.End()
+
+	if pt.handler.IsThrottled(ctx) {
+		log.G(ctx).Debug("skipping the pod spec checks while throttled")
+		return
+	}
+	k8sPods, err := pt.pods.List(labels.Everything())
+	if err != nil {
+		log.G(ctx).WithError(err).Errorf("failed to retrieve pods list")
+		return
+	}
+
+	pods := make([]*v1.Pod, 0, len(k8sPods))
+	for _, pod := range k8sPods {
+		if !pt.shouldSkipPodStatusUpdate(pod) {
+			pods = append(pods, pod)
+		}
+	}
+	if len(pods) > 0 {
+		pt.handler.CheckPodSpecs(ctx, pods)
+	}
 }
 
 func (pt *PodsTracker) cleanupDanglingPods(ctx context.Context) {
@@ -136,6 +317,8 @@ func (pt *PodsTracker) cleanupDanglingPods(ctx context.Context) {
 
 	if len(activePods) > 0 {
 		for i := range activePods {
+			// A pod recreated with the same name is not dangling, even though the container group
+			// still belongs to the previous pod, its creation replaces the container group.
 			pod := getPodFromList(k8sPods, activePods[i].namespace, activePods[i].name)
 			if pod != nil {
 				continue
@@ -143,7 +326,7 @@ func (pt *PodsTracker) cleanupDanglingPods(ctx context.Context) {
 
 			log.G(ctx).Errorf("cleaning up dangling pod %v", activePods[i].name)
 
-			err := pt.handler.CleanupPod(ctx, activePods[i].namespace, activePods[i].name)
+			err := pt.handler.CleanupPod(ctx, activePods[i].namespace, activePods[i].name, activePods[i].uid)
 			if err != nil && !errdef.IsNotFound(err) {
 				log.G(ctx).WithError(err).Errorf("failed to cleanup pod %v", activePods[i].name)
 			}
@@ -155,29 +338,12 @@ func (pt *PodsTracker) processPodUpdates(ctx context.Context, pod *v1.Pod) bool
 	ctx, span := trace.StartSpan(ctx, "PodsTracker.processPodUpdates")
 	defer span.End()
 
-	lastEventCheck := pt.lastEventCheck
-	err := pt.handler.FetchPodEvents(ctx, pod, func(timestamp *time.Time, object runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
-		if timestamp == nil || timestamp.After(pt.lastEventCheck) {
-			if !util.ValidateEventType(eventtype) {
-				eventtype = v1.EventTypeWarning
-			}
-			if timestamp != nil && timestamp.After(lastEventCheck) {
-				lastEventCheck = *timestamp
-			}
-			pt.eventRecorder.Eventf(object, eventtype, reason, messageFmt, args...)
-		}
-	})
-	pt.lastEventCheck = lastEventCheck
-	if err != nil {
-		log.G(ctx).WithError(err).Warnf("cannot fetch aci events for pod %s in namespace %s", pod.Name, pod.Namespace)
-	}
-
 	if pt.shouldSkipPodStatusUpdate(pod) {
 		log.G(ctx).Infof("pod %s will skip pod status update", pod.Name)
 		return false
 	}
 
-	podStatusFromProvider, err := pt.handler.FetchPodStatus(ctx, pod.Namespace, pod.Name)
+	podStatusFromProvider, err := pt.fetchPodStatus(ctx, pod)
 	if err == nil && podStatusFromProvider != nil {
 		podStatusFromProvider.DeepCopyInto(&pod.Status)
 		return true
@@ -217,10 +383,87 @@ func (pt *PodsTracker) processPodUpdates(ctx context.Context, pod *v1.Pod) bool
 	return false
 }
 
+// recordPodEvents records the new events of the pod, its status is discarded.
+func (pt *PodsTracker) recordPodEvents(ctx context.Context, pod *v1.Pod) error {
+	_, err := pt.fetchPodStatus(ctx, pod)
+	return err
+}
+
+// fetchPodStatus returns the status of the pod from the provider, and records the events of the
+// pod that are new, or that occurred again, since the last time the events of the pod were
+// fetched. The occurrences of an event are recorded with the same reason and message, so the
+// event recorder aggregates them in a single event with a count.
+func (pt *PodsTracker) fetchPodStatus(ctx context.Context, pod *v1.Pod) (*v1.PodStatus, error) {
+	if pt.eventWatermarks == nil {
+		pt.eventWatermarks = make(map[types.UID]map[string]*eventsWatermark)
+	}
+	watermarks := pt.eventWatermarks[pod.UID]
+	if watermarks == nil {
+		watermarks = make(map[string]*eventsWatermark)
+	}
+
+	fetchedEvents := false
+	updated := make(map[string]*eventsWatermark, len(watermarks))
+	status, err := pt.handler.FetchPodStatus(ctx, pod, func(evt *PodEvent) {
+		fetchedEvents = true
+		watermark := watermarks[evt.Container]
+		if watermark == nil {
+			watermark = &eventsWatermark{}
+		}
+		next := updated[evt.Container]
+		if next == nil {
+			next = &eventsWatermark{lastTimestamp: watermark.lastTimestamp, counts: make(map[string]int32)}
+			updated[evt.Container] = next
+		}
+
+		key := podEventKey(evt)
+		recordedCount, known := watermark.counts[key]
+		next.counts[key] = evt.Count
+		if evt.LastTimestamp != nil && evt.LastTimestamp.After(next.lastTimestamp) {
+			next.lastTimestamp = *evt.LastTimestamp
+		}
+
+		if known {
+			if evt.Count <= recordedCount {
+				return
+			}
+		} else if evt.LastTimestamp != nil && !evt.LastTimestamp.After(watermark.lastTimestamp) {
+			return
+		}
+
+		eventType := evt.Type
+		if !util.ValidateEventType(eventType) {
+			eventType = v1.EventTypeWarning
+		}
+		pt.eventRecorder.Event(evt.Object, eventType, evt.Reason, evt.Message)
+	})
+	// The events recorded are kept even when the status is invalid.
+	if err != nil && !fetchedEvents {
+		return nil, err
+	}
+
+	// The containers without events keep their watermark.
+	for container, watermark := range watermarks {
+		if _, ok := updated[container]; !ok {
+			updated[container] = &eventsWatermark{lastTimestamp: watermark.lastTimestamp}
+		}
+	}
+	pt.eventWatermarks[pod.UID] = updated
+	return status, err
+}
+
+func podEventKey(evt *PodEvent) string {
+	var firstTimestamp string
+	if evt.FirstTimestamp != nil {
+		firstTimestamp = evt.FirstTimestamp.UTC().Format(time.RFC3339Nano)
+	}
+	return evt.Reason + "/" + evt.Message + "/" + firstTimestamp
+}
+
 func (pt *PodsTracker) shouldSkipPodStatusUpdate(pod *v1.Pod) bool {
 	return pod.Status.Phase == v1.PodSucceeded || // Pod completed its execution
 		pod.Status.Phase == v1.PodFailed ||
-		pod.Status.Reason == podStatusReasonProviderFailed || // Pending phase because of failure
+		isCreateFailureReason(pod.Status.Reason) || // Pending phase because of failure
 		pod.DeletionTimestamp != nil // Terminating
 }
 
@@ -6,7 +6,8 @@ package provider
 
 import (
 	"context"
-	"fmt"
+	"errors"
+	"sort"
 	"strings"
 	"testing"
 	"time"
@@ -20,6 +21,8 @@ import (
 	is "gotest.tools/assert/cmp"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/tools/record"
 )
 
@@ -226,12 +229,16 @@ func TestCleanupDanglingPods(t *testing.T) {
 		}
 	}
 
+	aciMocks.MockGetContainerGroupInfo = func(ctx context.Context, resourceGroup, namespace, name, nodeName string) (*azaciv2.ContainerGroup, error) {
+		return aciMocks.MockGetContainerGroup(ctx, resourceGroup, name)
+	}
+
 	aciMocks.MockDeleteContainerGroup = func(ctx context.Context, resourceGroup, cgName string) error {
 		updatedActivePods := make([]*v1.Pod, 0)
 
+		// The container groups of the test are named after their pod.
 		for i := range activePods {
-			podCgName := fmt.Sprintf("%s-%s", activePods[i].Namespace, activePods[i].Name)
-			if podCgName != cgName {
+			if activePods[i].Name != cgName {
 				updatedActivePods = append(updatedActivePods, activePods[i])
 			}
 		}
@@ -376,6 +383,192 @@ func TestUpdatePodsLoop(t *testing.T) {
 	}
 }
 
+// podPollingHandler reports the fingerprints of the pods and records the pods fetched.
+type podPollingHandler struct {
+	PodsTrackerHandler
+	fingerprints map[PodIdentifier]string
+	fetched      []string
+	checked      []string
+	throttled    bool
+	listErr      error
+}
+
+func (h *podPollingHandler) CheckPodSpecs(ctx context.Context, pods []*v1.Pod) {
+	for _, pod := range pods {
+		h.checked = append(h.checked, pod.Name)
+	}
+}
+
+func (h *podPollingHandler) IsThrottled(ctx context.Context) bool {
+	return h.throttled
+}
+
+func (h *podPollingHandler) ListPodFingerprints(ctx context.Context) (map[PodIdentifier]string, error) {
+	if h.listErr != nil {
+		return nil, h.listErr
+	}
+	return h.fingerprints, nil
+}
+
+func (h *podPollingHandler) FetchPodStatus(ctx context.Context, pod *v1.Pod, evtSink func(evt *PodEvent)) (*v1.PodStatus, error) {
+	h.fetched = append(h.fetched, pod.Name)
+	return pod.Status.DeepCopy(), nil
+}
+
+func TestUpdatePodsLoopPollsChangedPods(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	var k8sPods []*v1.Pod
+	handler := &podPollingHandler{fingerprints: make(map[PodIdentifier]string)}
+	for name, phase := range map[string]v1.PodPhase{"running": v1.PodRunning, "pending": v1.PodPending, "failed": v1.PodFailed} {
+		pod := testsutil.CreatePodObj(name, podNamespace)
+		pod.UID = types.UID(uuid.New().String())
+		pod.Status.Phase = phase
+		k8sPods = append(k8sPods, pod)
+		handler.fingerprints[PodIdentifier{namespace: podNamespace, name: name}] = "v1"
+	}
+
+	k8sPodsLister := NewMockPodLister(mockCtrl)
+	k8sPodsLister.EXPECT().List(gomock.Any()).DoAndReturn(func(labels.Selector) ([]*v1.Pod, error) {
+		return k8sPods, nil
+	}).AnyTimes()
+
+	podsTracker := &PodsTracker{
+		pods:          k8sPodsLister,
+		updateCb:      func(p *v1.Pod) {},
+		handler:       handler,
+		eventRecorder: record.NewFakeRecorder(10),
+	}
+
+	cycle := func() ([]string, time.Duration) {
+		handler.fetched = nil
+		interval := podsTracker.updatePodsLoop(context.Background())
+		sort.Strings(handler.fetched)
+		return handler.fetched, interval
+	}
+
+	fetched, interval := cycle()
+	assert.Check(t, is.DeepEqual(fetched, []string{"failed", "pending", "running"}), "the pods seen for the first time should be fetched")
+	assert.Check(t, is.Equal(interval, statusUpdatesInterval))
+
+	fetched, interval = cycle()
+	assert.Check(t, is.DeepEqual(fetched, []string{"pending"}), "only the pending pod should be fetched")
+	assert.Check(t, is.Equal(interval, statusUpdatesInterval))
+
+	for i, pod := range k8sPods {
+		if pod.Name == "pending" {
+			k8sPods = append(k8sPods[:i], k8sPods[i+1:]...)
+			break
+		}
+	}
+	fetched, interval = cycle()
+	assert.Check(t, is.Len(fetched, 0), "the unchanged pods should not be fetched")
+	assert.Check(t, is.Equal(interval, steadyStatusUpdatesInterval))
+	assert.Check(t, is.Len(podsTracker.polledPods, 2), "the deleted pod should be forgotten")
+
+	handler.fingerprints[PodIdentifier{namespace: podNamespace, name: "running"}] = "v2"
+	fetched, interval = cycle()
+	assert.Check(t, is.DeepEqual(fetched, []string{"running"}), "the changed pod should be fetched")
+	assert.Check(t, is.Equal(interval, statusUpdatesInterval))
+
+	// The status of an unchanged pod is still refreshed, the list does not have its instance view.
+	for _, polled := range podsTracker.polledPods {
+		polled.lastFetch = polled.lastFetch.Add(-statusRefreshInterval)
+	}
+	fetched, _ = cycle()
+	assert.Check(t, is.DeepEqual(fetched, []string{"running"}), "the status should be refreshed")
+
+	handler.throttled = true
+	handler.fingerprints[PodIdentifier{namespace: podNamespace, name: "running"}] = "v3"
+	fetched, interval = cycle()
+	assert.Check(t, is.DeepEqual(fetched, []string{"running"}), "the changed pod should be fetched")
+	assert.Check(t, is.Equal(interval, steadyStatusUpdatesInterval), "the polling should slow down while throttled")
+
+	stats := podsTracker.PollingStats()
+	assert.Check(t, is.Equal(stats.ListCalls, 1))
+	assert.Check(t, is.Equal(stats.GetCalls, 1))
+	assert.Check(t, is.Equal(stats.TotalCalls, int64(4+2+1+2+2+2)))
+	assert.Check(t, is.Equal(stats.Interval, steadyStatusUpdatesInterval))
+
+	handler.listErr = errors.New("throttled")
+	fetched, interval = cycle()
+	assert.Check(t, is.Len(fetched, 0), "the status updates should be skipped while throttled")
+	assert.Check(t, is.Equal(interval, steadyStatusUpdatesInterval))
+	stats = podsTracker.PollingStats()
+	assert.Check(t, is.Equal(stats.ListCalls, 0), "the skipped cycle should not count a list call")
+	assert.Check(t, is.Equal(stats.GetCalls, 0))
+	assert.Check(t, is.Equal(stats.TotalCalls, int64(4+2+1+2+2+2)))
+}
+
+func TestCheckPodSpecsSkipsFinalPods(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	var k8sPods []*v1.Pod
+	for name, phase := range map[string]v1.PodPhase{"running": v1.PodRunning, "pending": v1.PodPending, "failed": v1.PodFailed} {
+		pod := testsutil.CreatePodObj(name, podNamespace)
+		pod.Status.Phase = phase
+		k8sPods = append(k8sPods, pod)
+	}
+	k8sPodsLister := NewMockPodLister(mockCtrl)
+	k8sPodsLister.EXPECT().List(gomock.Any()).Return(k8sPods, nil).AnyTimes()
+
+	handler := &podPollingHandler{}
+	podsTracker := &PodsTracker{
+		pods:     k8sPodsLister,
+		updateCb: func(p *v1.Pod) {},
+		handler:  handler,
+	}
+
+	podsTracker.checkPodSpecs(context.Background())
+	sort.Strings(handler.checked)
+	assert.Check(t, is.DeepEqual(handler.checked, []string{"pending", "running"}))
+	assert.Check(t, is.Len(handler.fetched, 0), "the spec checks should not fetch the status of the pods")
+
+	handler.checked = nil
+	handler.throttled = true
+	podsTracker.checkPodSpecs(context.Background())
+	assert.Check(t, is.Len(handler.checked, 0), "the spec checks should be skipped while throttled")
+}
+
+func TestListPodFingerprints(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	containersList := testsutil.CreateACIContainersListObj(runningState, "Initializing",
+		testsutil.CgCreationTime.Add(time.Second*2), testsutil.CgCreationTime.Add(time.Second*3),
+		true, true, true)
+	cg := testsutil.CreateContainerGroupObj(podName, podNamespace, "Succeeded", containersList, "Succeeded")
+	otherNodeCG := testsutil.CreateContainerGroupObj("other-node-pod", podNamespace, "Succeeded", containersList, "Succeeded")
+	otherNode := "other-node"
+	otherNodeCG.Tags["NodeName"] = &otherNode
+
+	aciMocks := createNewACIMock()
+	aciMocks.MockGetContainerGroupList = func(ctx context.Context, resourceGroup string) ([]*azaciv2.ContainerGroup, error) {
+		return []*azaciv2.ContainerGroup{cg, otherNodeCG}, nil
+	}
+
+	provider, err := createTestProvider(aciMocks, NewMockConfigMapLister(mockCtrl),
+		NewMockSecretLister(mockCtrl), NewMockPodLister(mockCtrl), nil)
+	if err != nil {
+		t.Fatal("failed to create the test provider", err)
+	}
+
+	fingerprints, err := provider.ListPodFingerprints(context.Background())
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(fingerprints, 1), "only the container groups of the node should be listed")
+	fingerprint := fingerprints[PodIdentifier{namespace: podNamespace, name: podName}]
+	assert.Check(t, fingerprint != "")
+
+	state := "Failed"
+	cg.Properties.ProvisioningState = &state
+	fingerprints, err = provider.ListPodFingerprints(context.Background())
+	assert.NilError(t, err)
+	assert.Check(t, fingerprints[PodIdentifier{namespace: podNamespace, name: podName}] != fingerprint,
+		"the fingerprint should change with the container group")
+}
+
 func TestFetchPodEvents(t *testing.T) {
 	podName := "pod-" + uuid.New().String()
 	podNamespace := "ns-" + uuid.New().String()
@@ -468,7 +661,7 @@ func TestFetchPodEvents(t *testing.T) {
 
 			for _, evts := range tc.events {
 				container.Properties.InstanceView.Events = evts
-				podsTracker.processPodUpdates(context.Background(), pod)
+				assert.NilError(t, podsTracker.recordPodEvents(context.Background(), pod))
 			}
 
 			close(eventRecorder.Events)
@@ -481,3 +674,130 @@ func TestFetchPodEvents(t *testing.T) {
 		})
 	}
 }
+
+// podEventsHandler reports the events of the pods by name.
+type podEventsHandler struct {
+	PodsTrackerHandler
+	events map[string][]*PodEvent
+}
+
+func (h *podEventsHandler) FetchPodStatus(ctx context.Context, pod *v1.Pod, evtSink func(evt *PodEvent)) (*v1.PodStatus, error) {
+	for _, evt := range h.events[pod.Name] {
+		evtSink(evt)
+	}
+	return &v1.PodStatus{}, nil
+}
+
+func newPodEvent(pod *v1.Pod, container, reason string, count int32, firstTimestamp, lastTimestamp time.Time) *PodEvent {
+	return &PodEvent{
+		Object:         pod,
+		Container:      container,
+		Type:           v1.EventTypeNormal,
+		Reason:         reason,
+		Message:        reason + " message",
+		Count:          count,
+		FirstTimestamp: &firstTimestamp,
+		LastTimestamp:  &lastTimestamp,
+	}
+}
+
+func drainEvents(recorder *record.FakeRecorder) []string {
+	var events []string
+	for {
+		select {
+		case evt := <-recorder.Events:
+			events = append(events, evt)
+		default:
+			return events
+		}
+	}
+}
+
+func TestRecordPodEventsWatermarks(t *testing.T) {
+	podA := testsutil.CreatePodObj("pod-a", podNamespace)
+	podA.UID = types.UID(uuid.New().String())
+	podB := testsutil.CreatePodObj("pod-b", podNamespace)
+	podB.UID = types.UID(uuid.New().String())
+
+	handler := &podEventsHandler{events: map[string][]*PodEvent{
+		podA.Name: {newPodEvent(podA, "", "Scheduled", 1, time.Unix(10, 0), time.Unix(10, 0))},
+		// Older than the events of pod A, but never recorded.
+		podB.Name: {newPodEvent(podB, "", "Scheduled", 1, time.Unix(5, 0), time.Unix(5, 0))},
+	}}
+	recorder := record.NewFakeRecorder(10)
+	podsTracker := &PodsTracker{handler: handler, eventRecorder: recorder}
+
+	assert.NilError(t, podsTracker.recordPodEvents(context.Background(), podA))
+	assert.NilError(t, podsTracker.recordPodEvents(context.Background(), podB))
+	assert.Check(t, is.DeepEqual(drainEvents(recorder), []string{
+		"Normal Scheduled Scheduled message",
+		"Normal Scheduled Scheduled message",
+	}))
+
+	// Containers have their own watermark, and the events already recorded are skipped.
+	handler.events[podA.Name] = append(handler.events[podA.Name],
+		newPodEvent(podA, "container", "Pulling", 1, time.Unix(8, 0), time.Unix(8, 0)),
+		newPodEvent(podA, "", "Past", 1, time.Unix(9, 0), time.Unix(9, 0)))
+	assert.NilError(t, podsTracker.recordPodEvents(context.Background(), podA))
+	assert.Check(t, is.DeepEqual(drainEvents(recorder), []string{"Normal Pulling Pulling message"}))
+}
+
+func TestRecordPodEventsAggregatesOccurrences(t *testing.T) {
+	pod := testsutil.CreatePodObj(podName, podNamespace)
+	first := time.Unix(10, 0)
+
+	handler := &podEventsHandler{events: map[string][]*PodEvent{
+		pod.Name: {newPodEvent(pod, "container", "BackOff", 1, first, first)},
+	}}
+	recorder := record.NewFakeRecorder(10)
+	podsTracker := &PodsTracker{handler: handler, eventRecorder: recorder}
+
+	assert.NilError(t, podsTracker.recordPodEvents(context.Background(), pod))
+	assert.Check(t, is.Len(drainEvents(recorder), 1))
+
+	assert.NilError(t, podsTracker.recordPodEvents(context.Background(), pod))
+	assert.Check(t, is.Len(drainEvents(recorder), 0), "an event seen again should not be recorded again")
+
+	// ACI reports the event occurred again by increasing its count.
+	handler.events[pod.Name] = []*PodEvent{newPodEvent(pod, "container", "BackOff", 3, first, first.Add(time.Minute))}
+	assert.NilError(t, podsTracker.recordPodEvents(context.Background(), pod))
+	assert.Check(t, is.DeepEqual(drainEvents(recorder), []string{"Normal BackOff BackOff message"}))
+}
+
+func TestPruneEventWatermarks(t *testing.T) {
+	pod := testsutil.CreatePodObj(podName, podNamespace)
+	pod.UID = types.UID(uuid.New().String())
+	deletedPod := testsutil.CreatePodObj("deleted-pod", podNamespace)
+	deletedPod.UID = types.UID(uuid.New().String())
+
+	podsTracker := &PodsTracker{
+		eventWatermarks: map[types.UID]map[string]*eventsWatermark{
+			pod.UID:        {"": {lastTimestamp: time.Unix(10, 0)}},
+			deletedPod.UID: {"": {lastTimestamp: time.Unix(10, 0)}},
+		},
+	}
+	podsTracker.pruneEventWatermarks([]*v1.Pod{pod})
+
+	assert.Check(t, is.Len(podsTracker.eventWatermarks, 1))
+	assert.Check(t, podsTracker.eventWatermarks[pod.UID] != nil)
+}
+
+func TestToKubeletEvent(t *testing.T) {
+	cases := []struct {
+		name, eventType                   string
+		expectedReason, expectedEventType string
+	}{
+		{"pulling", "Normal", "Pulling", v1.EventTypeNormal},
+		{"Pulled", "Normal", "Pulled", v1.EventTypeNormal},
+		{"Started", "Normal", "Started", v1.EventTypeNormal},
+		{"Killing", "Normal", "Killing", v1.EventTypeNormal},
+		{"BackOff", "Normal", "BackOff", v1.EventTypeWarning},
+		{"SuccessfulMountAzureFileVolume", "Normal", "SuccessfulMountAzureFileVolume", v1.EventTypeNormal},
+	}
+
+	for _, tc := range cases {
+		reason, eventType := toKubeletEvent(tc.name, tc.eventType)
+		assert.Check(t, is.Equal(reason, tc.expectedReason))
+		assert.Check(t, is.Equal(eventType, tc.expectedEventType))
+	}
+}
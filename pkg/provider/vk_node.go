@@ -9,17 +9,15 @@ import (
 	"os"
 	"strings"
 
+	"github.com/virtual-kubelet/virtual-kubelet/log"
 	"github.com/virtual-kubelet/virtual-kubelet/trace"
 	v1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/api/resource"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 // ConfigureNode enables a provider to configure the node object that
 // will be used for Kubernetes.
 func (p *ACIProvider) ConfigureNode(ctx context.Context, node *v1.Node) {
-	node.Status.Capacity = p.capacity()
-	node.Status.Allocatable = p.capacity()
+	node.Status.Phase = v1.NodeRunning
 	node.Status.Conditions = p.nodeConditions()
 	node.Status.Addresses = p.nodeAddresses()
 	node.Status.DaemonEndpoints = p.nodeDaemonEndpoints()
@@ -34,69 +32,13 @@ func (p *ACIProvider) ConfigureNode(ctx context.Context, node *v1.Node) {
 
 	// Virtual node would be skipped for cloud provider operations (e.g. CP should not add route).
 	node.ObjectMeta.Labels["kubernetes.azure.com/managed"] = "false"
-}
-
-// capacity returns a resource list containing the capacity limits set for ACI.
-func (p *ACIProvider) capacity() v1.ResourceList {
-	resourceList := v1.ResourceList{
-		v1.ResourceCPU:    resource.MustParse(p.cpu),
-		v1.ResourceMemory: resource.MustParse(p.memory),
-		v1.ResourcePods:   resource.MustParse(p.pods),
-	}
 
-	if p.gpu != "" {
-		resourceList[gpuResourceName] = resource.MustParse(p.gpu)
-	}
-
-	return resourceList
-}
+	p.setNodeCapacity(node)
 
-// nodeConditions returns a list of conditions (Ready, OutOfDisk, etc), for updates to the node status
-// within Kubernetes.
-func (p *ACIProvider) nodeConditions() []v1.NodeCondition {
-	// TODO: Make these dynamic and augment with custom ACI specific conditions of interest
-	return []v1.NodeCondition{
-		{
-			Type:               "Ready",
-			Status:             v1.ConditionTrue,
-			LastHeartbeatTime:  metav1.Now(),
-			LastTransitionTime: metav1.Now(),
-			Reason:             "KubeletReady",
-			Message:            "kubelet is ready.",
-		},
-		{
-			Type:               "OutOfDisk",
-			Status:             v1.ConditionFalse,
-			LastHeartbeatTime:  metav1.Now(),
-			LastTransitionTime: metav1.Now(),
-			Reason:             "KubeletHasSufficientDisk",
-			Message:            "kubelet has sufficient disk space available",
-		},
-		{
-			Type:               "MemoryPressure",
-			Status:             v1.ConditionFalse,
-			LastHeartbeatTime:  metav1.Now(),
-			LastTransitionTime: metav1.Now(),
-			Reason:             "KubeletHasSufficientMemory",
-			Message:            "kubelet has sufficient memory available",
-		},
-		{
-			Type:               "DiskPressure",
-			Status:             v1.ConditionFalse,
-			LastHeartbeatTime:  metav1.Now(),
-			LastTransitionTime: metav1.Now(),
-			Reason:             "KubeletHasNoDiskPressure",
-			Message:            "kubelet has no disk pressure",
-		},
-		{
-			Type:               "NetworkUnavailable",
-			Status:             v1.ConditionFalse,
-			LastHeartbeatTime:  metav1.Now(),
-			LastTransitionTime: metav1.Now(),
-			Reason:             "RouteCreated",
-			Message:            "RouteController created a route",
-		},
-	}
+	// The node is kept to send its status when the capacity is refreshed.
+	p.capacityLock.Lock()
+	p.node = node.DeepCopy()
+	p.capacityLock.Unlock()
 }
 
 // nodeAddresses returns a list of addresses for the node status
@@ -121,10 +63,12 @@ func (p *ACIProvider) nodeDaemonEndpoints() v1.NodeDaemonEndpoints {
 	}
 }
 
+// setupNodeCapacity sets the static capacity of the node, and computes its capacity from the ACI
+// quota of the region when it is available.
 func (p *ACIProvider) setupNodeCapacity(ctx context.Context) error {
 	ctx, span := trace.StartSpan(ctx, "aci.setupNodeCapacity")
 	defer span.End()
-	_ = addAzureAttributes(ctx, span, p)
+	ctx = addAzureAttributes(ctx, span, p)
 
 	// Set sane defaults for Capacity in case config is not supplied
 	p.cpu = "10000"
@@ -143,21 +87,19 @@ func (p *ACIProvider) setupNodeCapacity(ctx context.Context) error {
 		p.pods = podsQuota
 	}
 
-	//TODO To be uncommented after Location API fix
-	//capabilities, err := p.azClientsAPIs.ListCapabilities(ctx, p.region)
-	//if err != nil {
-	//	return errors.Wrapf(err, "Unable to fetch the ACI capabilities for the location %s, skipping GPU availability check. GPU capacity will be disabled", p.region)
-	//}
-	//
-	//for _, capability := range *capabilities {
-	//	if strings.EqualFold(*capability.Location, p.region) && *capability.Gpu != "" {
-	//		p.gpu = "100"
-	//		if gpu := os.Getenv("ACI_QUOTA_GPU"); gpu != "" {
-	//			p.gpu = gpu
-	//		}
-	//		p.gpuSKUs = append(p.gpuSKUs, azaci.GpuSku(*capability.Gpu))
-	//	}
-	//}
+	var err error
+	p.capacityLimits, err = getCapacityLimits(os.Getenv)
+	if err != nil {
+		return err
+	}
+
+	// The pod lister is not synced yet, the pods of the node are listed from the API server so
+	// their resources are allocatable from the start.
+	_, err = p.refreshNodeCapacity(ctx, p.getNodeResourceUsageFromAPIServer(ctx))
+	p.nodeHealth.setARMError(err)
+	if err != nil {
+		log.G(ctx).WithError(err).Warnf("unable to fetch the ACI quota of the location %s, the node capacity is static until the next refresh", p.region)
+	}
 
 	return nil
 }
@@ -0,0 +1,513 @@
+/*
+Copyright (c) Microsoft Corporation.
+Licensed under the Apache 2.0 license.
+*/
+package provider
+
+import (
+	"context"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	azaciv2 "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerinstance/armcontainerinstance/v2"
+	"github.com/pkg/errors"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	"github.com/virtual-kubelet/virtual-kubelet/trace"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	// nodeStatusRefreshInterval is how often the node conditions are computed again.
+	nodeStatusRefreshInterval = 30 * time.Second
+	// nodeCapacityRefreshInterval is how often the node capacity is computed again from the ACI
+	// usage and capabilities of the region, and the ACI subnet is checked.
+	nodeCapacityRefreshInterval = 5 * time.Minute
+
+	usageNameCores           = "StandardCores"
+	usageNameContainerGroups = "ContainerGroups"
+
+	// gpuSKULabelPrefix prefixes the labels holding the number of GPUs allocatable per SKU, e.g.
+	// virtual-kubelet.io/gpu-v100=4.
+	gpuSKULabelPrefix = "virtual-kubelet.io/gpu-"
+
+	// defaultGPUsPerSKU is the number of GPUs of the SKUs without quota in the usage of the region.
+	defaultGPUsPerSKU = 100
+	// defaultCoresPerGPU is the number of cores of a GPU, the GPU quotas are in cores, when the
+	// capabilities of the SKU don't tell it.
+	defaultCoresPerGPU = 6
+)
+
+// nodeCapacity is the capacity of the virtual node computed from the remaining ACI quota.
+type nodeCapacity struct {
+	capacity    v1.ResourceList
+	allocatable v1.ResourceList
+	// gpuSKUs are the GPU SKUs available in the region, the first one is used when pods don't
+	// request a SKU.
+	gpuSKUs []azaciv2.GpuSKU
+	// gpus is the number of GPUs allocatable per SKU.
+	gpus map[azaciv2.GpuSKU]int64
+}
+
+// nodeResourceUsage is the resources used by the pods of the node, they are part of the quota
+// consumed in the subscription but remain allocatable to the node.
+type nodeResourceUsage struct {
+	cpu    resource.Quantity
+	memory resource.Quantity
+	pods   int64
+	// gpus is the number of GPUs used per SKU, the GPUs of the pods without SKU are counted
+	// under the empty SKU, they use the default SKU of the region.
+	gpus map[azaciv2.GpuSKU]int64
+}
+
+// getCapacityLimits returns the capacity set by ACI_QUOTA_CPU, ACI_QUOTA_MEMORY, ACI_QUOTA_POD and
+// ACI_QUOTA_GPU, the capacity computed from the quota does not go over them.
+func getCapacityLimits(getenv func(string) string) (v1.ResourceList, error) {
+	limits := v1.ResourceList{}
+	for env, name := range map[string]v1.ResourceName{
+		"ACI_QUOTA_CPU":    v1.ResourceCPU,
+		"ACI_QUOTA_MEMORY": v1.ResourceMemory,
+		"ACI_QUOTA_POD":    v1.ResourcePods,
+		"ACI_QUOTA_GPU":    gpuResourceName,
+	} {
+		value := getenv(env)
+		if value == "" {
+			continue
+		}
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid %s %q", env, value)
+		}
+		limits[name] = quantity
+	}
+	return limits, nil
+}
+
+// capacity returns a resource list containing the capacity limits set for ACI.
+func (p *ACIProvider) capacity() v1.ResourceList {
+	p.capacityLock.RLock()
+	defer p.capacityLock.RUnlock()
+
+	if p.nodeCapacity != nil {
+		return p.nodeCapacity.capacity.DeepCopy()
+	}
+	return p.staticCapacity()
+}
+
+// allocatable returns a resource list containing the resources the pods can still use in ACI.
+func (p *ACIProvider) allocatable() v1.ResourceList {
+	p.capacityLock.RLock()
+	defer p.capacityLock.RUnlock()
+
+	if p.nodeCapacity != nil {
+		return p.nodeCapacity.allocatable.DeepCopy()
+	}
+	return p.staticCapacity()
+}
+
+func (p *ACIProvider) staticCapacity() v1.ResourceList {
+	resourceList := v1.ResourceList{
+		v1.ResourceCPU:    resource.MustParse(p.cpu),
+		v1.ResourceMemory: resource.MustParse(p.memory),
+		v1.ResourcePods:   resource.MustParse(p.pods),
+	}
+
+	if p.gpu != "" {
+		resourceList[gpuResourceName] = resource.MustParse(p.gpu)
+	}
+
+	return resourceList
+}
+
+// getGPUSKUs returns the GPU SKUs available in the region.
+func (p *ACIProvider) getGPUSKUs() []azaciv2.GpuSKU {
+	p.capacityLock.RLock()
+	defer p.capacityLock.RUnlock()
+
+	return p.gpuSKUs
+}
+
+// setNodeCapacity sets the capacity, allocatable resources and GPU labels of the node.
+func (p *ACIProvider) setNodeCapacity(node *v1.Node) {
+	node.Status.Capacity = p.capacity()
+	node.Status.Allocatable = p.allocatable()
+
+	if node.ObjectMeta.Labels == nil {
+		node.ObjectMeta.Labels = map[string]string{}
+	}
+	for label := range node.ObjectMeta.Labels {
+		if strings.HasPrefix(label, gpuSKULabelPrefix) {
+			delete(node.ObjectMeta.Labels, label)
+		}
+	}
+
+	p.capacityLock.RLock()
+	defer p.capacityLock.RUnlock()
+	if p.nodeCapacity != nil {
+		for sku, gpus := range p.nodeCapacity.gpus {
+			node.ObjectMeta.Labels[gpuSKULabelPrefix+strings.ToLower(string(sku))] = strconv.FormatInt(gpus, 10)
+		}
+	}
+}
+
+// NotifyNodeStatus refreshes the node capacity and conditions periodically, and calls cb with the
+// node when they changed.
+func (p *ACIProvider) NotifyNodeStatus(ctx context.Context, cb func(*v1.Node)) {
+	go p.runNodeStatusRefresh(ctx, cb)
+}
+
+// Ping checks if the node is still active.
+func (p *ACIProvider) Ping(ctx context.Context) error {
+	return ctx.Err()
+}
+
+func (p *ACIProvider) runNodeStatusRefresh(ctx context.Context, cb func(*v1.Node)) {
+	ticker := time.NewTicker(nodeStatusRefreshInterval)
+	defer ticker.Stop()
+
+	var lastRefresh time.Time
+	var lastNode *v1.Node
+	for {
+		now := time.Now()
+		// The capacity is refreshed again on the next tick when ARM failed, so the node recovers
+		// as soon as ARM is available.
+		if now.Sub(lastRefresh) >= nodeCapacityRefreshInterval || p.nodeHealth.hasARMError() {
+			if p.refreshNodeHealth(ctx) {
+				lastRefresh = now
+			}
+		}
+		p.nodeHealth.observeThrottling(p.azClientsAPIs.ThrottlingState(), now)
+
+		if node := p.getNode(); node != nil && !equalNodeStatus(lastNode, node) {
+			cb(node)
+			lastNode = node
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refreshNodeHealth refreshes the node capacity and checks the ACI subnet, it returns whether ARM
+// answered.
+func (p *ACIProvider) refreshNodeHealth(ctx context.Context) bool {
+	_, err := p.refreshNodeCapacity(ctx, p.getNodeResourceUsage(ctx))
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("failed to refresh the node capacity from the ACI quota")
+	}
+	p.nodeHealth.setARMError(err)
+
+	if p.checkSubnet != nil {
+		subnetErr := p.checkSubnet(ctx)
+		if subnetErr != nil {
+			log.G(ctx).WithError(subnetErr).Warn("the ACI subnet is unavailable")
+		}
+		p.nodeHealth.setSubnetError(subnetErr)
+	}
+	return err == nil
+}
+
+// getNode returns the node as configured by ConfigureNode, with its current capacity.
+func (p *ACIProvider) getNode() *v1.Node {
+	p.capacityLock.RLock()
+	node := p.node.DeepCopy()
+	p.capacityLock.RUnlock()
+
+	if node == nil {
+		return nil
+	}
+	node.Status.Conditions = p.nodeConditions()
+	p.setNodeCapacity(node)
+	return node
+}
+
+// refreshNodeCapacity computes the node capacity from the ACI usage and capabilities of the region,
+// and returns whether it changed.
+func (p *ACIProvider) refreshNodeCapacity(ctx context.Context, usage nodeResourceUsage) (bool, error) {
+	ctx, span := trace.StartSpan(ctx, "aci.refreshNodeCapacity")
+	defer span.End()
+	ctx = addAzureAttributes(ctx, span, p)
+
+	capabilities, err := p.azClientsAPIs.ListCapabilities(ctx, p.region)
+	if err != nil {
+		return false, err
+	}
+	usages, err := p.azClientsAPIs.ListUsage(ctx, p.region)
+	if err != nil {
+		return false, err
+	}
+
+	p.capacityLock.Lock()
+	defer p.capacityLock.Unlock()
+
+	capacity := computeNodeCapacity(p.region, p.operatingSystem, usages, capabilities, usage, p.staticCapacity(), p.capacityLimits)
+	changed := p.nodeCapacity == nil || !equalNodeCapacity(*p.nodeCapacity, capacity)
+	if changed {
+		log.G(ctx).Infof("node capacity is %v, allocatable %v, GPU SKUs %v", capacity.capacity, capacity.allocatable, capacity.gpuSKUs)
+	}
+	p.nodeCapacity = &capacity
+	p.gpuSKUs = capacity.gpuSKUs
+	return changed, nil
+}
+
+// getNodeResourceUsage returns the resources requested by the pods of the node that are not
+// terminated.
+func (p *ACIProvider) getNodeResourceUsage(ctx context.Context) nodeResourceUsage {
+	if p.podsL == nil {
+		return getPodsResourceUsage(nil)
+	}
+	pods, err := p.podsL.List(labels.Everything())
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("failed to list the pods of the node")
+	}
+	return getPodsResourceUsage(pods)
+}
+
+// getNodeResourceUsageFromAPIServer returns the resources requested by the pods bound to the
+// node, listed from the API server.
+func (p *ACIProvider) getNodeResourceUsageFromAPIServer(ctx context.Context) nodeResourceUsage {
+	if p.kubeClient == nil {
+		return getPodsResourceUsage(nil)
+	}
+	list, err := p.kubeClient.CoreV1().Pods(v1.NamespaceAll).List(ctx, metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("spec.nodeName", p.nodeName).String(),
+	})
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("failed to list the pods of the node, they are accounted for on the next refresh")
+		return getPodsResourceUsage(nil)
+	}
+	pods := make([]*v1.Pod, 0, len(list.Items))
+	for i := range list.Items {
+		pods = append(pods, &list.Items[i])
+	}
+	return getPodsResourceUsage(pods)
+}
+
+// getPodsResourceUsage returns the resources requested by the pods that are not terminated.
+func getPodsResourceUsage(pods []*v1.Pod) nodeResourceUsage {
+	usage := nodeResourceUsage{gpus: map[azaciv2.GpuSKU]int64{}}
+	for _, pod := range pods {
+		if pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			continue
+		}
+		usage.pods++
+		for _, container := range pod.Spec.Containers {
+			cpu, ok := container.Resources.Requests[v1.ResourceCPU]
+			if !ok {
+				cpu = resource.MustParse(defaultContainerCPURequest)
+			}
+			usage.cpu.Add(cpu)
+
+			memory, ok := container.Resources.Requests[v1.ResourceMemory]
+			if !ok {
+				memory = resource.MustParse(defaultContainerMemoryRequest)
+			}
+			usage.memory.Add(memory)
+
+			if gpus, ok := container.Resources.Limits[gpuResourceName]; ok {
+				usage.gpus[azaciv2.GpuSKU(pod.Annotations[gpuTypeAnnotation])] += gpus.Value()
+			}
+		}
+	}
+	return usage
+}
+
+// computeNodeCapacity computes the capacity of the node from the quota limits, and the allocatable
+// resources from the quota remaining in the subscription. The memory has no quota in ACI, it is
+// computed from the cores with the memory per core of the region, and the GPU quotas are in
+// cores, they are converted to GPUs with the cores per GPU of the SKU. The resources without
+// usage keep their static capacity.
+func computeNodeCapacity(region, operatingSystem string, usages []*azaciv2.Usage, capabilities []*azaciv2.Capabilities,
+	nodeUsage nodeResourceUsage, staticCapacity, limits v1.ResourceList) nodeCapacity {
+	capacity := nodeCapacity{
+		capacity:    staticCapacity.DeepCopy(),
+		allocatable: staticCapacity.DeepCopy(),
+		gpus:        map[azaciv2.GpuSKU]int64{},
+	}
+	delete(capacity.capacity, gpuResourceName)
+	delete(capacity.allocatable, gpuResourceName)
+
+	var memoryPerCore float64
+	coresPerGPU := map[azaciv2.GpuSKU]int64{}
+	for _, capability := range capabilities {
+		if !isRegionCapability(capability, region, operatingSystem) {
+			continue
+		}
+		sku := getCapabilityGPUSKU(capability)
+		if sku == "" {
+			if memoryPerCore == 0 && capability.Capabilities != nil && capability.Capabilities.MaxCPU != nil &&
+				*capability.Capabilities.MaxCPU > 0 && capability.Capabilities.MaxMemoryInGB != nil {
+				memoryPerCore = float64(*capability.Capabilities.MaxMemoryInGB / *capability.Capabilities.MaxCPU)
+			}
+			continue
+		}
+		if _, ok := capacity.gpus[sku]; !ok {
+			capacity.gpuSKUs = append(capacity.gpuSKUs, sku)
+			capacity.gpus[sku] = 0
+		}
+		if coresPerGPU[sku] == 0 && capability.Capabilities != nil && capability.Capabilities.MaxCPU != nil &&
+			capability.Capabilities.MaxGpuCount != nil && *capability.Capabilities.MaxGpuCount > 0 {
+			coresPerGPU[sku] = int64(*capability.Capabilities.MaxCPU / *capability.Capabilities.MaxGpuCount)
+		}
+	}
+
+	if limit, remaining, ok := getUsageQuota(usages, usageNameCores); ok {
+		allocatable := remaining*1000 + nodeUsage.cpu.MilliValue()
+		capacity.capacity[v1.ResourceCPU] = *resource.NewMilliQuantity(limit*1000, resource.DecimalSI)
+		capacity.allocatable[v1.ResourceCPU] = *resource.NewMilliQuantity(min(allocatable, limit*1000), resource.DecimalSI)
+
+		if memoryPerCore > 0 {
+			capacity.capacity[v1.ResourceMemory] = getMemoryOfCores(capacity.capacity[v1.ResourceCPU], memoryPerCore)
+			capacity.allocatable[v1.ResourceMemory] = getMemoryOfCores(capacity.allocatable[v1.ResourceCPU], memoryPerCore)
+		}
+	}
+	if limit, remaining, ok := getUsageQuota(usages, usageNameContainerGroups); ok {
+		capacity.capacity[v1.ResourcePods] = *resource.NewQuantity(limit, resource.DecimalSI)
+		capacity.allocatable[v1.ResourcePods] = *resource.NewQuantity(min(remaining+nodeUsage.pods, limit), resource.DecimalSI)
+	}
+
+	if len(capacity.gpuSKUs) > 0 {
+		var gpuCapacity, gpuAllocatable int64
+		for i, sku := range capacity.gpuSKUs {
+			// The GPU quotas are named after the SKU, e.g. StandardV100Cores.
+			limit, remaining, ok := getUsageQuota(usages, string(sku))
+			if ok {
+				cores := coresPerGPU[sku]
+				if cores == 0 {
+					cores = defaultCoresPerGPU
+				}
+				limit, remaining = limit/cores, remaining/cores
+			} else {
+				limit, remaining = defaultGPUsPerSKU, defaultGPUsPerSKU
+			}
+			used := nodeUsage.gpus[sku]
+			if i == 0 {
+				used += nodeUsage.gpus[""]
+			}
+			allocatable := min(remaining+used, limit)
+			capacity.gpus[sku] = allocatable
+			gpuCapacity += limit
+			gpuAllocatable += allocatable
+		}
+		capacity.capacity[gpuResourceName] = *resource.NewQuantity(gpuCapacity, resource.DecimalSI)
+		capacity.allocatable[gpuResourceName] = *resource.NewQuantity(gpuAllocatable, resource.DecimalSI)
+	}
+
+	for name, limit := range limits {
+		if _, ok := capacity.capacity[name]; !ok {
+			continue
+		}
+		if quantity := capacity.capacity[name]; quantity.Cmp(limit) > 0 {
+			capacity.capacity[name] = limit.DeepCopy()
+		}
+		if quantity := capacity.allocatable[name]; quantity.Cmp(limit) > 0 {
+			capacity.allocatable[name] = limit.DeepCopy()
+		}
+	}
+	return capacity
+}
+
+func isRegionCapability(capability *azaciv2.Capabilities, region, operatingSystem string) bool {
+	if capability == nil || capability.Location == nil {
+		return false
+	}
+	location := strings.ReplaceAll(*capability.Location, " ", "")
+	if !strings.EqualFold(location, region) {
+		return false
+	}
+	return capability.OSType == nil || strings.EqualFold(*capability.OSType, operatingSystem)
+}
+
+func getCapabilityGPUSKU(capability *azaciv2.Capabilities) azaciv2.GpuSKU {
+	if capability.Gpu == nil || *capability.Gpu == "" || strings.EqualFold(*capability.Gpu, "None") {
+		return ""
+	}
+	return azaciv2.GpuSKU(*capability.Gpu)
+}
+
+// getUsageQuota returns the limit and remaining quota of the usage whose name contains name.
+func getUsageQuota(usages []*azaciv2.Usage, name string) (int64, int64, bool) {
+	for _, usage := range usages {
+		if usage == nil || usage.Name == nil || usage.Name.Value == nil || usage.Limit == nil {
+			continue
+		}
+		if !strings.Contains(strings.ToLower(*usage.Name.Value), strings.ToLower(name)) {
+			continue
+		}
+		// StandardCores should not match StandardSpotCores or the GPU cores.
+		if name == usageNameCores && !strings.EqualFold(*usage.Name.Value, usageNameCores) {
+			continue
+		}
+		limit := int64(*usage.Limit)
+		var current int64
+		if usage.CurrentValue != nil {
+			current = int64(*usage.CurrentValue)
+		}
+		return limit, max(limit-current, 0), true
+	}
+	return 0, 0, false
+}
+
+func getMemoryOfCores(cpu resource.Quantity, memoryPerCore float64) resource.Quantity {
+	gigabytes := float64(cpu.MilliValue()) / 1000 * memoryPerCore
+	return *resource.NewQuantity(int64(math.Floor(gigabytes*1e9)), resource.DecimalSI)
+}
+
+func equalNodeCapacity(a, b nodeCapacity) bool {
+	if !equalResourceLists(a.capacity, b.capacity) || !equalResourceLists(a.allocatable, b.allocatable) ||
+		len(a.gpus) != len(b.gpus) || len(a.gpuSKUs) != len(b.gpuSKUs) {
+		return false
+	}
+	for i := range a.gpuSKUs {
+		if a.gpuSKUs[i] != b.gpuSKUs[i] {
+			return false
+		}
+	}
+	for sku, gpus := range a.gpus {
+		if b.gpus[sku] != gpus {
+			return false
+		}
+	}
+	return true
+}
+
+// equalNodeStatus returns whether the capacity, labels and conditions of the nodes are the same,
+// ignoring the times of the conditions.
+func equalNodeStatus(a, b *v1.Node) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if !equalResourceLists(a.Status.Capacity, b.Status.Capacity) || !equalResourceLists(a.Status.Allocatable, b.Status.Allocatable) ||
+		!reflect.DeepEqual(a.Labels, b.Labels) || len(a.Status.Conditions) != len(b.Status.Conditions) {
+		return false
+	}
+	for i := range a.Status.Conditions {
+		ca, cb := a.Status.Conditions[i], b.Status.Conditions[i]
+		if ca.Type != cb.Type || ca.Status != cb.Status || ca.Reason != cb.Reason || ca.Message != cb.Message {
+			return false
+		}
+	}
+	return true
+}
+
+func equalResourceLists(a, b v1.ResourceList) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, quantity := range a {
+		other, ok := b[name]
+		if !ok || quantity.Cmp(other) != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,165 @@
+/*
+Copyright (c) Microsoft Corporation.
+Licensed under the Apache 2.0 license.
+*/
+package provider
+
+import (
+	"context"
+	"testing"
+
+	azaciv2 "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerinstance/armcontainerinstance/v2"
+	"github.com/golang/mock/gomock"
+	testsutil "github.com/virtual-kubelet/azure-aci/pkg/tests"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/utils/ptr"
+)
+
+func newUsage(name string, current, limit int32) *azaciv2.Usage {
+	return &azaciv2.Usage{
+		Name:         &azaciv2.UsageName{Value: ptr.To(name)},
+		CurrentValue: ptr.To(current),
+		Limit:        ptr.To(limit),
+	}
+}
+
+func newCapability(location, osType, gpu string, maxCPU, maxMemoryInGB float32) *azaciv2.Capabilities {
+	capability := &azaciv2.Capabilities{
+		Location: ptr.To(location),
+		Gpu:      ptr.To(gpu),
+		Capabilities: &azaciv2.CapabilitiesCapabilities{
+			MaxCPU:        ptr.To(maxCPU),
+			MaxMemoryInGB: ptr.To(maxMemoryInGB),
+		},
+	}
+	if osType != "" {
+		capability.OSType = ptr.To(osType)
+	}
+	return capability
+}
+
+func TestComputeNodeCapacity(t *testing.T) {
+	staticCapacity := v1.ResourceList{
+		v1.ResourceCPU:    resource.MustParse("10000"),
+		v1.ResourceMemory: resource.MustParse("4Ti"),
+		v1.ResourcePods:   resource.MustParse("5000"),
+	}
+	v100 := newCapability("West US 2", "Linux", "V100", 24, 448)
+	v100.Capabilities.MaxGpuCount = ptr.To[float32](4)
+	capabilities := []*azaciv2.Capabilities{
+		newCapability("West US 2", "Linux", "None", 4, 16),
+		v100,
+		newCapability("West US 2", "Windows", "K80", 4, 14),
+		newCapability("East US", "Linux", "P100", 24, 448),
+	}
+	usages := []*azaciv2.Usage{
+		newUsage("ContainerGroups", 90, 100),
+		newUsage("StandardCores", 20, 50),
+		newUsage("StandardSpotCores", 0, 10),
+		newUsage("StandardV100Cores", 24, 48),
+	}
+	nodeUsage := nodeResourceUsage{
+		cpu:  resource.MustParse("5"),
+		pods: 3,
+		// The GPUs without SKU use the default SKU of the region.
+		gpus: map[azaciv2.GpuSKU]int64{azaciv2.GpuSKUV100: 1, "": 1},
+	}
+
+	capacity := computeNodeCapacity("westus2", "Linux", usages, capabilities, nodeUsage, staticCapacity, nil)
+	assert.Check(t, is.DeepEqual(capacity.gpuSKUs, []azaciv2.GpuSKU{azaciv2.GpuSKUV100}))
+	// The V100 quota is 48 cores, or 8 GPUs of 6 cores, and 4 GPUs remain.
+	assert.Check(t, is.Equal(capacity.gpus[azaciv2.GpuSKUV100], int64(6)), "the remaining GPUs and the GPUs of the node should be allocatable")
+
+	expectedCapacity := map[v1.ResourceName]string{
+		v1.ResourceCPU:    "50",
+		v1.ResourceMemory: "200G",
+		v1.ResourcePods:   "100",
+		gpuResourceName:   "8",
+	}
+	expectedAllocatable := map[v1.ResourceName]string{
+		v1.ResourceCPU:    "35",
+		v1.ResourceMemory: "140G",
+		v1.ResourcePods:   "13",
+		gpuResourceName:   "6",
+	}
+	for name, expected := range expectedCapacity {
+		quantity := capacity.capacity[name]
+		assert.Check(t, quantity.Cmp(resource.MustParse(expected)) == 0, "capacity of %s is %s, expected %s", name, quantity.String(), expected)
+	}
+	for name, expected := range expectedAllocatable {
+		quantity := capacity.allocatable[name]
+		assert.Check(t, quantity.Cmp(resource.MustParse(expected)) == 0, "allocatable %s is %s, expected %s", name, quantity.String(), expected)
+	}
+
+	limits := v1.ResourceList{v1.ResourceCPU: resource.MustParse("10"), gpuResourceName: resource.MustParse("2")}
+	capacity = computeNodeCapacity("westus2", "Linux", usages, capabilities, nodeUsage, staticCapacity, limits)
+	cpu, gpus := capacity.allocatable[v1.ResourceCPU], capacity.allocatable[gpuResourceName]
+	assert.Check(t, cpu.Cmp(resource.MustParse("10")) == 0, "the allocatable CPU should be limited by ACI_QUOTA_CPU: %s", cpu.String())
+	assert.Check(t, gpus.Cmp(resource.MustParse("2")) == 0, "the allocatable GPUs should be limited by ACI_QUOTA_GPU: %s", gpus.String())
+
+	capacity = computeNodeCapacity("westus2", "Linux", nil, nil, nodeUsage, staticCapacity, nil)
+	assert.Check(t, equalResourceLists(capacity.capacity, staticCapacity), "the static capacity should be kept without usage")
+	assert.Check(t, is.Len(capacity.gpuSKUs, 0))
+}
+
+func TestNodeCapacityIsRefreshedFromQuota(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	usedCores := int32(10)
+	aciMocks := createNewACIMock()
+	aciMocks.MockListCapabilities = func(ctx context.Context, region string) ([]*azaciv2.Capabilities, error) {
+		return []*azaciv2.Capabilities{
+			newCapability(region, "", "None", 4, 16),
+			newCapability(region, "", "K80", 24, 224),
+		}, nil
+	}
+	aciMocks.MockListUsage = func(ctx context.Context, region string) ([]*azaciv2.Usage, error) {
+		return []*azaciv2.Usage{
+			newUsage("StandardCores", usedCores, 100),
+			newUsage("StandardK80Cores", 0, 24),
+		}, nil
+	}
+
+	// The pods of the node are allocatable from the start.
+	pod := testsutil.CreatePodObj(podName, podNamespace)
+	pod.Spec.NodeName = fakeNodeName
+	pod.Spec.Containers[0].Resources.Requests = v1.ResourceList{v1.ResourceCPU: resource.MustParse("2")}
+	provider, err := createTestProvider(aciMocks, NewMockConfigMapLister(mockCtrl),
+		NewMockSecretLister(mockCtrl), NewMockPodLister(mockCtrl), fake.NewSimpleClientset(pod))
+	if err != nil {
+		t.Fatal("failed to create the test provider", err)
+	}
+
+	sku, err := provider.getGPUSKU(&v1.Pod{})
+	assert.NilError(t, err, "the GPU SKUs of the region should be discovered")
+	assert.Check(t, is.Equal(sku, azaciv2.GpuSKUK80))
+
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "virtual-kubelet", Labels: map[string]string{}}}
+	provider.ConfigureNode(context.Background(), node)
+	cpu := node.Status.Allocatable[v1.ResourceCPU]
+	assert.Check(t, cpu.Cmp(resource.MustParse("92")) == 0, "allocatable CPU is %s", cpu.String())
+	// The K80 quota is 24 cores, the default 6 cores per GPU are 4 GPUs.
+	assert.Check(t, is.Equal(node.Labels[gpuSKULabelPrefix+"k80"], "4"))
+
+	usage := getPodsResourceUsage([]*v1.Pod{pod})
+	changed, err := provider.refreshNodeCapacity(context.Background(), usage)
+	assert.NilError(t, err)
+	assert.Check(t, !changed, "the capacity should not change when the usage is the same")
+
+	usedCores = 40
+	changed, err = provider.refreshNodeCapacity(context.Background(), usage)
+	assert.NilError(t, err)
+	assert.Check(t, changed)
+
+	node = provider.getNode()
+	assert.Assert(t, node != nil)
+	cpu = node.Status.Allocatable[v1.ResourceCPU]
+	assert.Check(t, cpu.Cmp(resource.MustParse("62")) == 0, "allocatable CPU is %s", cpu.String())
+	assert.Check(t, is.Equal(node.Labels[gpuSKULabelPrefix+"k80"], "4"))
+}
@@ -0,0 +1,235 @@
+/*
+Copyright (c) Microsoft Corporation.
+Licensed under the Apache 2.0 license.
+*/
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/virtual-kubelet/azure-aci/pkg/client"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// NodeConditionACIAPIUnavailable is true when ARM can't be reached, or rejects the credentials
+	// of the virtual kubelet.
+	NodeConditionACIAPIUnavailable v1.NodeConditionType = "ACIAPIUnavailable"
+	// NodeConditionACIQuotaPressure is true when little of the ACI quota of the region remains.
+	NodeConditionACIQuotaPressure v1.NodeConditionType = "ACIQuotaPressure"
+	// NodeConditionACIThrottled is true when ARM has been throttling the requests for a while.
+	NodeConditionACIThrottled v1.NodeConditionType = "ACIThrottled"
+
+	// sustainedThrottlingDuration is how long ARM throttles the requests before the node reports
+	// it, short bursts of throttling are absorbed by the client retries.
+	sustainedThrottlingDuration = 2 * time.Minute
+	// sustainedARMUnavailableDuration is how long ARM is unavailable before the node is not ready,
+	// a failed refresh of the node capacity is only reported by NodeConditionACIAPIUnavailable.
+	sustainedARMUnavailableDuration = 5 * time.Minute
+
+	// quotaPressureRatio is the share of the quota under which the remaining quota is low.
+	quotaPressureRatio = 0.1
+)
+
+// nodeHealth is the health of the dependencies the virtual node needs to start pods, the node
+// conditions are computed from it.
+type nodeHealth struct {
+	lock sync.Mutex
+	// armErr is the error of the last ARM requests made to refresh the node capacity.
+	armErr error
+	// armUnavailableSince is when ARM became unavailable, zero when it is available.
+	armUnavailableSince time.Time
+	// subnetErr is the error of the last check of the ACI subnet.
+	subnetErr error
+	// throttledSince is when ARM started throttling the requests, zero when it is not.
+	throttledSince time.Time
+	// transitions are the last transition times of the conditions, by type and status.
+	transitions map[v1.NodeConditionType]nodeConditionTransition
+}
+
+type nodeConditionTransition struct {
+	status v1.ConditionStatus
+	time   metav1.Time
+}
+
+func (h *nodeHealth) setARMError(err error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.armErr = err
+
+	switch _, unavailable := getARMUnavailableReason(err); {
+	case !unavailable:
+		h.armUnavailableSince = time.Time{}
+	case h.armUnavailableSince.IsZero():
+		h.armUnavailableSince = time.Now()
+	}
+}
+
+func (h *nodeHealth) hasARMError() bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.armErr != nil
+}
+
+func (h *nodeHealth) setSubnetError(err error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.subnetErr = err
+}
+
+func (h *nodeHealth) observeThrottling(state client.ThrottlingState, now time.Time) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	switch {
+	case !state.Reads.Throttled && !state.Writes.Throttled:
+		h.throttledSince = time.Time{}
+	case h.throttledSince.IsZero():
+		h.throttledSince = now
+	}
+}
+
+// nodeConditions returns a list of conditions (Ready, ACIAPIUnavailable, etc), for updates to the
+// node status within Kubernetes. The node is not ready when it can't start pods, which is when ARM
+// has been unavailable for sustainedARMUnavailableDuration or the ACI subnet is not usable anymore.
+// Throttling and quota pressure only slow down or limit the creation of pods, they are reported by
+// their own conditions.
+func (p *ACIProvider) nodeConditions() []v1.NodeCondition {
+	now := time.Now()
+
+	p.capacityLock.RLock()
+	quotaPressure, quotaMessage := getQuotaPressure(p.nodeCapacity)
+	p.capacityLock.RUnlock()
+
+	h := &p.nodeHealth
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	apiUnavailable := condition(NodeConditionACIAPIUnavailable, false, "ARMAvailable", "ARM accepts the requests of the virtual kubelet")
+	if reason, ok := getARMUnavailableReason(h.armErr); ok {
+		apiUnavailable = condition(NodeConditionACIAPIUnavailable, true, reason, h.armErr.Error())
+	}
+
+	networkUnavailable := condition(v1.NodeNetworkUnavailable, false, "RouteCreated", "RouteController created a route")
+	if h.subnetErr != nil {
+		networkUnavailable = condition(v1.NodeNetworkUnavailable, true, "ACISubnetUnavailable", h.subnetErr.Error())
+	}
+
+	ready := condition(v1.NodeReady, true, "KubeletReady", "kubelet is ready.")
+	switch {
+	case apiUnavailable.Status == v1.ConditionTrue && now.Sub(h.armUnavailableSince) >= sustainedARMUnavailableDuration:
+		ready = condition(v1.NodeReady, false, apiUnavailable.Reason, "ACI is unavailable: "+apiUnavailable.Message)
+	case h.subnetErr != nil:
+		ready = condition(v1.NodeReady, false, networkUnavailable.Reason, "the ACI subnet is unavailable: "+networkUnavailable.Message)
+	}
+
+	throttled := condition(NodeConditionACIThrottled, false, "ARMNotThrottled", "ARM is not throttling the requests")
+	if !h.throttledSince.IsZero() && now.Sub(h.throttledSince) >= sustainedThrottlingDuration {
+		throttled = condition(NodeConditionACIThrottled, true, "ARMThrottled",
+			fmt.Sprintf("ARM has been throttling the requests since %s", h.throttledSince.UTC().Format(time.RFC3339)))
+	}
+
+	quota := condition(NodeConditionACIQuotaPressure, false, "ACIHasSufficientQuota", "ACI has sufficient quota available")
+	if quotaPressure {
+		quota = condition(NodeConditionACIQuotaPressure, true, "ACIQuotaLow", quotaMessage)
+	}
+
+	conditions := []v1.NodeCondition{
+		ready,
+		apiUnavailable,
+		quota,
+		throttled,
+		condition(v1.NodeMemoryPressure, false, "KubeletHasSufficientMemory", "kubelet has sufficient memory available"),
+		condition(v1.NodeDiskPressure, false, "KubeletHasNoDiskPressure", "kubelet has no disk pressure"),
+		networkUnavailable,
+	}
+
+	if h.transitions == nil {
+		h.transitions = make(map[v1.NodeConditionType]nodeConditionTransition)
+	}
+	heartbeat := metav1.NewTime(now)
+	for i := range conditions {
+		transition, ok := h.transitions[conditions[i].Type]
+		if !ok || transition.status != conditions[i].Status {
+			transition = nodeConditionTransition{status: conditions[i].Status, time: heartbeat}
+			h.transitions[conditions[i].Type] = transition
+		}
+		conditions[i].LastHeartbeatTime = heartbeat
+		conditions[i].LastTransitionTime = transition.time
+	}
+	return conditions
+}
+
+func condition(conditionType v1.NodeConditionType, status bool, reason, message string) v1.NodeCondition {
+	c := v1.NodeCondition{
+		Type:    conditionType,
+		Status:  v1.ConditionFalse,
+		Reason:  reason,
+		Message: message,
+	}
+	if status {
+		c.Status = v1.ConditionTrue
+	}
+	return c
+}
+
+// getARMUnavailableReason returns the reason ARM is unavailable when err is set, which is when ARM
+// can't be reached, fails on its side, or rejects the credentials. ARM answered the other errors,
+// such as the throttled requests or the missing resources, they are not reported as ARM being
+// unavailable.
+func getARMUnavailableReason(err error) (string, bool) {
+	if err == nil {
+		return "", false
+	}
+
+	var authErr *azidentity.AuthenticationFailedError
+	if errors.As(err, &authErr) {
+		return "InvalidCredentials", true
+	}
+	armErr := client.ClassifyARMError(err)
+	if armErr == nil {
+		return "ARMUnreachable", true
+	}
+	switch armErr.Kind {
+	case client.ARMErrorUnauthorized:
+		return "InvalidCredentials", true
+	case client.ARMErrorTransient:
+		return "ARMUnreachable", true
+	default:
+		return "", false
+	}
+}
+
+// getQuotaPressure returns whether the allocatable resources computed from the quota are below
+// quotaPressureRatio of the capacity, with a message listing them.
+func getQuotaPressure(capacity *nodeCapacity) (bool, string) {
+	if capacity == nil {
+		return false, ""
+	}
+
+	var low []string
+	for name, quantity := range capacity.capacity {
+		if name == gpuResourceName {
+			continue
+		}
+		allocatable, ok := capacity.allocatable[name]
+		if !ok || quantity.IsZero() {
+			continue
+		}
+		if float64(allocatable.MilliValue()) < float64(quantity.MilliValue())*quotaPressureRatio {
+			low = append(low, fmt.Sprintf("%s %s of %s", name, allocatable.String(), quantity.String()))
+		}
+	}
+	if len(low) == 0 {
+		return false, ""
+	}
+	sort.Strings(low)
+	return true, "ACI quota remaining is low: " + strings.Join(low, ", ")
+}
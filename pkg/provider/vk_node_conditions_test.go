@@ -0,0 +1,161 @@
+/*
+Copyright (c) Microsoft Corporation.
+Licensed under the Apache 2.0 license.
+*/
+package provider
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	azaciv2 "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerinstance/armcontainerinstance/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/virtual-kubelet/azure-aci/pkg/client"
+	testsutil "github.com/virtual-kubelet/azure-aci/pkg/tests"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func getNodeCondition(conditions []v1.NodeCondition, conditionType v1.NodeConditionType) *v1.NodeCondition {
+	for i := range conditions {
+		if conditions[i].Type == conditionType {
+			return &conditions[i]
+		}
+	}
+	return nil
+}
+
+func checkNodeCondition(t *testing.T, conditions []v1.NodeCondition, conditionType v1.NodeConditionType, status v1.ConditionStatus, reason string) {
+	t.Helper()
+	c := getNodeCondition(conditions, conditionType)
+	assert.Assert(t, c != nil, "condition %s is missing", conditionType)
+	assert.Check(t, is.Equal(c.Status, status), "status of condition %s", conditionType)
+	assert.Check(t, is.Equal(c.Reason, reason), "reason of condition %s", conditionType)
+}
+
+func TestNodeConditions(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	provider, err := createTestProvider(createNewACIMock(), NewMockConfigMapLister(mockCtrl),
+		NewMockSecretLister(mockCtrl), NewMockPodLister(mockCtrl), nil)
+	if err != nil {
+		t.Fatal("failed to create the test provider", err)
+	}
+
+	conditions := provider.nodeConditions()
+	checkNodeCondition(t, conditions, v1.NodeReady, v1.ConditionTrue, "KubeletReady")
+	checkNodeCondition(t, conditions, NodeConditionACIAPIUnavailable, v1.ConditionFalse, "ARMAvailable")
+	checkNodeCondition(t, conditions, NodeConditionACIQuotaPressure, v1.ConditionFalse, "ACIHasSufficientQuota")
+	checkNodeCondition(t, conditions, NodeConditionACIThrottled, v1.ConditionFalse, "ARMNotThrottled")
+	checkNodeCondition(t, conditions, v1.NodeNetworkUnavailable, v1.ConditionFalse, "RouteCreated")
+	assert.Check(t, getNodeCondition(conditions, "OutOfDisk") == nil, "OutOfDisk should not be reported anymore")
+	readySince := getNodeCondition(conditions, v1.NodeReady).LastTransitionTime
+	time.Sleep(time.Millisecond)
+	conditions = provider.nodeConditions()
+	assert.Check(t, getNodeCondition(conditions, v1.NodeReady).LastTransitionTime.Equal(&readySince),
+		"the transition time should not change while the status is the same")
+
+	provider.nodeHealth.setARMError(client.AsARMError(testsutil.NewARMResponseError(http.StatusForbidden,
+		`{"error":{"code":"AuthorizationFailed","message":"The client does not have authorization."}}`)))
+	conditions = provider.nodeConditions()
+	checkNodeCondition(t, conditions, v1.NodeReady, v1.ConditionTrue, "KubeletReady")
+	checkNodeCondition(t, conditions, NodeConditionACIAPIUnavailable, v1.ConditionTrue, "InvalidCredentials")
+	provider.nodeHealth.armUnavailableSince = time.Now().Add(-sustainedARMUnavailableDuration)
+	conditions = provider.nodeConditions()
+	checkNodeCondition(t, conditions, v1.NodeReady, v1.ConditionFalse, "InvalidCredentials")
+
+	provider.nodeHealth.setARMError(errors.New("dial tcp: lookup management.azure.com: no such host"))
+	conditions = provider.nodeConditions()
+	checkNodeCondition(t, conditions, v1.NodeReady, v1.ConditionFalse, "ARMUnreachable")
+	assert.Check(t, time.Since(provider.nodeHealth.armUnavailableSince) >= sustainedARMUnavailableDuration,
+		"ARM is unavailable since the first error")
+
+	for _, armErr := range []string{
+		`{"error":{"code":"ResourceNotFound","message":"not found"}}`,
+		`{"error":{"code":"InvalidParameter","message":"invalid"}}`,
+	} {
+		provider.nodeHealth.setARMError(client.AsARMError(testsutil.NewARMResponseError(http.StatusBadRequest, armErr)))
+		conditions = provider.nodeConditions()
+		checkNodeCondition(t, conditions, v1.NodeReady, v1.ConditionTrue, "KubeletReady")
+		checkNodeCondition(t, conditions, NodeConditionACIAPIUnavailable, v1.ConditionFalse, "ARMAvailable")
+	}
+
+	provider.nodeHealth.setARMError(client.AsARMError(testsutil.NewARMResponseError(http.StatusTooManyRequests,
+		`{"error":{"code":"TooManyRequests","message":"throttled"}}`)))
+	conditions = provider.nodeConditions()
+	checkNodeCondition(t, conditions, v1.NodeReady, v1.ConditionTrue, "KubeletReady")
+	checkNodeCondition(t, conditions, NodeConditionACIAPIUnavailable, v1.ConditionFalse, "ARMAvailable")
+
+	provider.nodeHealth.setARMError(nil)
+	provider.nodeHealth.setSubnetError(errors.New("subnet 'fake' is not delegated to Azure Container Instance"))
+	conditions = provider.nodeConditions()
+	checkNodeCondition(t, conditions, v1.NodeReady, v1.ConditionFalse, "ACISubnetUnavailable")
+	checkNodeCondition(t, conditions, v1.NodeNetworkUnavailable, v1.ConditionTrue, "ACISubnetUnavailable")
+	provider.nodeHealth.setSubnetError(nil)
+
+	throttled := client.ThrottlingState{Writes: client.OperationThrottling{Throttled: true}}
+	provider.nodeHealth.observeThrottling(throttled, time.Now())
+	checkNodeCondition(t, provider.nodeConditions(), NodeConditionACIThrottled, v1.ConditionFalse, "ARMNotThrottled")
+	provider.nodeHealth.throttledSince = time.Now().Add(-sustainedThrottlingDuration)
+	provider.nodeHealth.observeThrottling(throttled, time.Now())
+	checkNodeCondition(t, provider.nodeConditions(), NodeConditionACIThrottled, v1.ConditionTrue, "ARMThrottled")
+	provider.nodeHealth.observeThrottling(client.ThrottlingState{}, time.Now())
+	checkNodeCondition(t, provider.nodeConditions(), NodeConditionACIThrottled, v1.ConditionFalse, "ARMNotThrottled")
+
+	provider.nodeCapacity = &nodeCapacity{
+		capacity:    v1.ResourceList{v1.ResourceCPU: resource.MustParse("100"), v1.ResourcePods: resource.MustParse("100")},
+		allocatable: v1.ResourceList{v1.ResourceCPU: resource.MustParse("50"), v1.ResourcePods: resource.MustParse("5")},
+	}
+	conditions = provider.nodeConditions()
+	checkNodeCondition(t, conditions, NodeConditionACIQuotaPressure, v1.ConditionTrue, "ACIQuotaLow")
+	assert.Check(t, is.Equal(getNodeCondition(conditions, NodeConditionACIQuotaPressure).Message, "ACI quota remaining is low: pods 5 of 100"))
+}
+
+func TestRefreshNodeHealth(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	var usageErr error
+	aciMocks := createNewACIMock()
+	aciMocks.MockListUsage = func(ctx context.Context, region string) ([]*azaciv2.Usage, error) {
+		return nil, usageErr
+	}
+
+	podLister := NewMockPodLister(mockCtrl)
+	podLister.EXPECT().List(gomock.Any()).Return(nil, nil).AnyTimes()
+
+	provider, err := createTestProvider(aciMocks, NewMockConfigMapLister(mockCtrl),
+		NewMockSecretLister(mockCtrl), podLister, nil)
+	if err != nil {
+		t.Fatal("failed to create the test provider", err)
+	}
+
+	var subnetErr error
+	provider.checkSubnet = func(ctx context.Context) error {
+		return subnetErr
+	}
+
+	usageErr = client.AsARMError(testsutil.NewARMResponseError(http.StatusServiceUnavailable, `{"error":{"code":"InternalServerError","message":"unavailable"}}`))
+	subnetErr = errors.New("subnet 'fake' is not delegated to Azure Container Instance")
+	assert.Check(t, !provider.refreshNodeHealth(context.Background()))
+	node := provider.getNode()
+	assert.Check(t, node == nil, "the node is only known once configured")
+
+	provider.node = &v1.Node{}
+	node = provider.getNode()
+	checkNodeCondition(t, node.Status.Conditions, NodeConditionACIAPIUnavailable, v1.ConditionTrue, "ARMUnreachable")
+	checkNodeCondition(t, node.Status.Conditions, v1.NodeNetworkUnavailable, v1.ConditionTrue, "ACISubnetUnavailable")
+
+	usageErr, subnetErr = nil, nil
+	assert.Check(t, provider.refreshNodeHealth(context.Background()))
+	recovered := provider.getNode()
+	checkNodeCondition(t, recovered.Status.Conditions, v1.NodeReady, v1.ConditionTrue, "KubeletReady")
+	assert.Check(t, !equalNodeStatus(node, recovered), "the recovered node status should be sent")
+	assert.Check(t, equalNodeStatus(recovered, provider.getNode()), "the same node status should not be sent again")
+}
@@ -5,8 +5,13 @@ Licensed under the Apache 2.0 license.
 package tests
 
 import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"time"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
 	azaciv2 "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerinstance/armcontainerinstance/v2"
 	"github.com/google/uuid"
 	"github.com/virtual-kubelet/azure-aci/pkg/util"
@@ -26,6 +31,7 @@ var (
 	RestartCount      = int32(0)
 	FakeIP            = "127.0.0.1"
 	TestContainerName = "testContainer"
+	FakeClusterID     = "test-cluster"
 	TestImageNginx    = "nginx"
 	testGPUCount      = int32(5)
 
@@ -45,6 +51,7 @@ func CreateContainerGroupObj(cgName, cgNamespace, cgState string, containers []*
 	}
 	timeAsString := v1.NewTime(cgCreationTime).String()
 	nodeName := "vk"
+	clusterID := FakeClusterID
 
 	return &azaciv2.ContainerGroup{
 		Tags: map[string]*string{
@@ -52,7 +59,7 @@ func CreateContainerGroupObj(cgName, cgNamespace, cgState string, containers []*
 			"PodName":           &cgName,
 			"Namespace":         &cgNamespace,
 			"NodeName":          &nodeName,
-			"ClusterName":       &nodeName,
+			"ClusterID":         &clusterID,
 			"UID":               &cgName,
 		},
 		Name: &cgName,
@@ -68,6 +75,14 @@ func CreateContainerGroupObj(cgName, cgNamespace, cgState string, containers []*
 	}
 }
 
+// CreateTestContainerGroupObj returns a provisioned container group with a single container in
+// containerState, started at startTime and finished a second later, without resources.
+func CreateTestContainerGroupObj(cgName, cgNamespace, cgState, containerState string, startTime time.Time) *azaciv2.ContainerGroup {
+	return CreateContainerGroupObj(cgName, cgNamespace, cgState,
+		CreateACIContainersListObj(containerState, "Initializing", startTime, startTime.Add(time.Second),
+			false, false, false), "Succeeded")
+}
+
 func CreateACIContainersListObj(currentState, PrevState string, startTime, finishTime time.Time, hasResources, hasLimits, hasGPU bool) []*azaciv2.Container {
 	containerList := append([]*azaciv2.Container{}, CreateACIContainerObj(currentState, PrevState, startTime, finishTime, hasResources, hasLimits, hasGPU))
 	return containerList
@@ -381,3 +396,14 @@ func CreateContainerGroupEvent(count int32, firstTimestamp time.Time, lastTimest
 		Type:           &eventType,
 	}
 }
+
+// NewARMResponseError returns the error the ARM clients return for a response with the status code
+// and the ARM error body.
+func NewARMResponseError(statusCode int, body string) error {
+	return runtime.NewResponseError(&http.Response{
+		StatusCode: statusCode,
+		Header:     http.Header{},
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    httptest.NewRequest(http.MethodPut, "https://management.azure.com/containerGroups/fake", nil),
+	})
+}
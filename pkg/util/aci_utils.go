@@ -8,6 +8,7 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"regexp"
 	"strings"
 
 	azaciv2 "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerinstance/armcontainerinstance/v2"
@@ -27,6 +28,58 @@ var (
 	ContainerGroupNetworkProtocolTCP = azaciv2.ContainerGroupNetworkProtocolTCP
 )
 
+const (
+	// maxContainerGroupNameLength is the length limit of the container group names in ACI.
+	maxContainerGroupNameLength  = 63
+	containerGroupNameHashLength = 8
+)
+
+// containerGroupNameSeparators matches the characters of the pod namespaces and names that ACI
+// does not allow, and the runs of dashes which ACI does not allow either.
+var containerGroupNameSeparators = regexp.MustCompile(`[^a-z0-9]+`)
+
+// ContainerGroupName returns the name of the container group of a pod. The name starts with the
+// namespace and name of the pod, truncated to fit in the ACI limit, and ends with a hash of them,
+// so the pods whose namespace and name join into the same string get distinct container groups.
+func ContainerGroupName(podNS, podName string) string {
+	sum := sha256.Sum256([]byte(podNS + "/" + podName))
+	hash := hex.EncodeToString(sum[:])[:containerGroupNameHashLength]
+
+	prefix := containerGroupNameSeparators.ReplaceAllString(strings.ToLower(podNS+"-"+podName), "-")
+	if maxLength := maxContainerGroupNameLength - containerGroupNameHashLength - 1; len(prefix) > maxLength {
+		prefix = prefix[:maxLength]
+	}
+	prefix = strings.Trim(prefix, "-")
+	if prefix == "" {
+		return hash
+	}
+	return prefix + "-" + hash
+}
+
+// LegacyContainerGroupName returns the name of the container groups created for a pod before the
+// names were hashed, it is only used to look them up.
+func LegacyContainerGroupName(podNS, podName string) string {
+	return fmt.Sprintf("%s-%s", podNS, podName)
+}
+
+// IsContainerGroupOfPod is true when the container group is tagged with the namespace and name of
+// the pod. The container groups are looked up by name, the tags tell which pod they belong to.
+func IsContainerGroupOfPod(cg *azaciv2.ContainerGroup, podNS, podName string) bool {
+	if cg == nil || cg.Tags == nil || cg.Tags["Namespace"] == nil || cg.Tags["PodName"] == nil {
+		return false
+	}
+	return *cg.Tags["Namespace"] == podNS && *cg.Tags["PodName"] == podName
+}
+
+// GetContainerGroupPodUID returns the UID of the pod the container group was created for, or an
+// empty string when the container group is not tagged with it.
+func GetContainerGroupPodUID(cg *azaciv2.ContainerGroup) string {
+	if cg == nil || cg.Tags == nil || cg.Tags["UID"] == nil {
+		return ""
+	}
+	return *cg.Tags["UID"]
+}
+
 func GetContainerID(cgID, containerName *string) string {
 	if cgID == nil {
 		return ""
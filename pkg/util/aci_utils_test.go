@@ -0,0 +1,40 @@
+/*
+Copyright (c) Microsoft Corporation.
+Licensed under the Apache 2.0 license.
+*/
+package util
+
+import (
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestContainerGroupName(t *testing.T) {
+	name := ContainerGroupName("default", "nginx")
+	assert.Check(t, strings.HasPrefix(name, "default-nginx-"), name)
+	assert.Check(t, is.Len(name, len("default-nginx-")+8))
+	assert.Check(t, is.Equal(name, ContainerGroupName("default", "nginx")), "the name should be stable")
+	assert.Check(t, ContainerGroupName("a-b", "c") != ContainerGroupName("a", "b-c"),
+		"the pods whose namespace and name join into the same string should get distinct container groups")
+	assert.Check(t, ContainerGroupName("default", "web.v1") != ContainerGroupName("default", "web-v1"))
+
+	long := ContainerGroupName("a-very-long-namespace-name", "web-statefulset-with-a-long-name-0123456789-0")
+	assert.Check(t, is.Len(long, 63))
+	assert.Check(t, strings.HasPrefix(long, "a-very-long-namespace-name-web-statefulset-with-a-long-"), long)
+	assert.Check(t, long != ContainerGroupName("a-very-long-namespace-name", "web-statefulset-with-a-long-name-0123456789-1"),
+		"the names truncated to the same prefix should differ by their hash")
+
+	for _, name := range []string{
+		ContainerGroupName("default", "web.v1"),
+		ContainerGroupName("default", "web--1"),
+		ContainerGroupName("kube-system", strings.Repeat("a", 253)),
+		ContainerGroupName("ns", strings.Repeat("a", 52)+"-b"),
+	} {
+		assert.Check(t, len(name) <= 63, name)
+		assert.Check(t, !strings.Contains(name, "--") && !strings.Contains(name, "."), name)
+		assert.Check(t, !strings.HasPrefix(name, "-") && !strings.HasSuffix(name, "-"), name)
+	}
+}